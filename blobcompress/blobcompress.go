@@ -0,0 +1,455 @@
+// Package blobcompress stores compressible blobs gzip compressed in chunks that
+// can be decompressed on their own, so range reads stay cheap:
+//
+//	header: magic "CSEZ" | version | algorithm | chunk size (uint32) | zero padding to 16 bytes
+//	chunks: one gzip member per ChunkSize bytes of content, the last one shorter
+//	index:  end offset of every chunk (uint64 each)
+//	footer: content size (uint64) | chunk count (uint64) | magic "CSEZ"
+//
+// Compressed blobs are named with Ext so they are never confused with blobs
+// stored as they are. Compression happens before encryption: the file on disk
+// is the blobcrypt envelope of the compressed stream.
+package blobcompress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud-storage/blobcrypt"
+)
+
+const (
+	// Ext is appended to the name of compressed blobs.
+	Ext = ".gzc"
+	// Gzip is the algorithm recorded for compressed files.
+	Gzip = "gzip"
+
+	ChunkSize  = 256 << 10
+	SampleSize = 64 << 10
+	headerSize = 16
+	footerSize = 20
+	version    = 1
+	algGzip    = 1
+
+	minSize  = 1 << 10
+	maxRatio = 0.9 // compressed size relative to the original to be worth it
+)
+
+var magic = []byte("CSEZ")
+
+var (
+	ErrCorrupt       = errors.New("blobcompress: blob is corrupt")
+	ErrNotWorthwhile = errors.New("blobcompress: content does not compress well")
+)
+
+// Types that are compressed already or compress badly, besides audio, video
+// and most images.
+var incompressible = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/zstd":             true,
+	"application/x-7z-compressed":  true,
+	"application/vnd.rar":          true,
+	"application/x-rar-compressed": true,
+	"application/pdf":              true,
+	"application/epub+zip":         true,
+	"application/jar":              true,
+	"application/java-archive":     true,
+}
+
+// Worthwhile reports whether content of mimeType should be compressed, judged
+// by its type and by how well sample, the start of the content, compresses.
+func Worthwhile(mimeType string, sample []byte) bool {
+	if len(sample) < minSize {
+		return false
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	switch {
+	case incompressible[mimeType],
+		strings.HasPrefix(mimeType, "video/"),
+		strings.HasPrefix(mimeType, "audio/"),
+		strings.HasPrefix(mimeType, "image/") && mimeType != "image/svg+xml" && mimeType != "image/bmp" && mimeType != "image/tiff",
+		strings.HasPrefix(mimeType, "application/vnd.openxmlformats"),
+		strings.HasPrefix(mimeType, "application/vnd.oasis.opendocument"):
+		return false
+	}
+
+	var trial countingWriter
+	zw, _ := gzip.NewWriterLevel(&trial, flate.DefaultCompression)
+	zw.Write(sample)
+	zw.Close()
+	return float64(trial.n) <= maxRatio*float64(len(sample))
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.w == nil {
+		c.n += int64(len(p))
+		return len(p), nil
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Writer compresses everything written to it into a new blob. Close must be
+// called to write the last chunk and the index; it does not close the
+// underlying writer.
+type Writer struct {
+	w    *countingWriter
+	zw   *gzip.Writer
+	buf  []byte
+	n    int
+	ends []uint64
+	size int64
+}
+
+// NewWriter writes the header of a compressed blob to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[4] = version
+	header[5] = algGzip
+	binary.BigEndian.PutUint32(header[6:], ChunkSize)
+
+	cw := &countingWriter{w: w}
+	if _, err := cw.Write(header); err != nil {
+		return nil, err
+	}
+	zw, _ := gzip.NewWriterLevel(cw, flate.DefaultCompression)
+	return &Writer{w: cw, zw: zw, buf: make([]byte, ChunkSize)}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.n == len(w.buf) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		w.size += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *Writer) flush() error {
+	w.zw.Reset(w.w)
+	if _, err := w.zw.Write(w.buf[:w.n]); err != nil {
+		return err
+	}
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	w.ends = append(w.ends, uint64(w.w.n))
+	w.n = 0
+	return nil
+}
+
+// Close writes the last chunk, the index and the footer.
+func (w *Writer) Close() error {
+	if w.n > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	tail := make([]byte, 0, 8*len(w.ends)+footerSize)
+	for _, end := range w.ends {
+		tail = binary.BigEndian.AppendUint64(tail, end)
+	}
+	tail = binary.BigEndian.AppendUint64(tail, uint64(w.size))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(len(w.ends)))
+	tail = append(tail, magic...)
+	_, err := w.w.Write(tail)
+	return err
+}
+
+// Written returns the compressed size, which is final once Close returned.
+func (w *Writer) Written() int64 {
+	return w.w.n
+}
+
+type reader struct {
+	b         blobcrypt.Blob
+	chunkSize int64
+	ends      []int64
+	size      int64
+	zr        *gzip.Reader
+	chunk     []byte
+	cached    int
+	off       int64
+}
+
+// OpenFile returns the original content of the blob at path, decrypting it
+// with k and decompressing it when its name ends in Ext.
+func OpenFile(path string, k *blobcrypt.Keyring) (blobcrypt.Blob, error) {
+	b, err := blobcrypt.Open(path, k)
+	if err != nil || !strings.HasSuffix(path, Ext) {
+		return b, err
+	}
+	r, err := Open(b)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Open returns the decompressed content of the compressed blob b. Closing it
+// closes b.
+func Open(b blobcrypt.Blob) (blobcrypt.Blob, error) {
+	header := make([]byte, headerSize)
+	if _, err := b.ReadAt(header, 0); err != nil {
+		return nil, corrupt(err)
+	}
+	if !bytes.Equal(header[:len(magic)], magic) || header[4] != version || header[5] != algGzip {
+		return nil, ErrCorrupt
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[6:]))
+
+	total, err := b.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	footer := make([]byte, footerSize)
+	if total < headerSize+footerSize {
+		return nil, ErrCorrupt
+	}
+	if _, err := b.ReadAt(footer, total-footerSize); err != nil {
+		return nil, corrupt(err)
+	}
+	size := int64(binary.BigEndian.Uint64(footer))
+	chunks := int64(binary.BigEndian.Uint64(footer[8:]))
+	if !bytes.Equal(footer[16:], magic) || chunkSize <= 0 || size < 0 || chunks != (size+chunkSize-1)/chunkSize {
+		return nil, ErrCorrupt
+	}
+
+	indexStart := total - footerSize - 8*chunks
+	if indexStart < headerSize {
+		return nil, ErrCorrupt
+	}
+	index := make([]byte, 8*chunks)
+	if _, err := b.ReadAt(index, indexStart); err != nil {
+		return nil, corrupt(err)
+	}
+	ends := make([]int64, chunks)
+	prev := int64(headerSize)
+	for i := range ends {
+		ends[i] = int64(binary.BigEndian.Uint64(index[8*i:]))
+		if ends[i] <= prev {
+			return nil, ErrCorrupt
+		}
+		prev = ends[i]
+	}
+	if prev != indexStart {
+		return nil, ErrCorrupt
+	}
+
+	return &reader{b: b, chunkSize: chunkSize, ends: ends, size: size, cached: -1}, nil
+}
+
+// corrupt turns a short read of the compressed stream into ErrCorrupt.
+func corrupt(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrCorrupt
+	}
+	return err
+}
+
+// load decompresses chunk index into r.chunk.
+func (r *reader) load(index int) error {
+	if index == r.cached {
+		return nil
+	}
+	r.cached = -1
+	start := int64(headerSize)
+	if index > 0 {
+		start = r.ends[index-1]
+	}
+	section := io.NewSectionReader(r.b, start, r.ends[index]-start)
+
+	var err error
+	if r.zr == nil {
+		r.zr, err = gzip.NewReader(section)
+	} else {
+		err = r.zr.Reset(section)
+	}
+	if err != nil {
+		return gzipError(err)
+	}
+	r.zr.Multistream(false)
+
+	want := min(r.chunkSize, r.size-int64(index)*r.chunkSize)
+	if int64(cap(r.chunk)) < want {
+		r.chunk = make([]byte, r.chunkSize)
+	}
+	r.chunk = r.chunk[:want]
+	if _, err := io.ReadFull(r.zr, r.chunk); err != nil {
+		return gzipError(err)
+	}
+	// Reading on checks the CRC and that the chunk holds nothing more
+	if n, err := r.zr.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		return gzipError(err)
+	}
+	r.cached = index
+	return nil
+}
+
+func gzipError(err error) error {
+	var flateErr flate.CorruptInputError
+	if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF || err == gzip.ErrChecksum ||
+		err == gzip.ErrHeader || errors.As(err, &flateErr) {
+		return ErrCorrupt
+	}
+	return err
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		if err := r.load(int(off / r.chunkSize)); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], r.chunk[off%r.chunkSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	// Stop at the chunk boundary to hand out data as it is decompressed
+	if end := (r.off/r.chunkSize + 1) * r.chunkSize; int64(len(p)) > end-r.off {
+		p = p[:end-r.off]
+	}
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *reader) Close() error {
+	return r.b.Close()
+}
+
+// CompressFile stores the blob at path, of type mimeType, compressed under
+// path+Ext and encrypted with k when k is set. It returns ErrNotWorthwhile,
+// writing nothing, unless the content compresses well. The original is left
+// for the caller to remove once nothing refers to it.
+func CompressFile(path, mimeType string, k *blobcrypt.Keyring) (string, int64, error) {
+	src, err := OpenFile(path, k)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	sample := make([]byte, SampleSize)
+	n, err := io.ReadFull(src, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", 0, err
+	}
+	if !Worthwhile(mimeType, sample[:n]) {
+		return "", 0, ErrNotWorthwhile
+	}
+	size, err := src.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = src.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".compress-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var dst io.Writer = tmp
+	var ew *blobcrypt.Writer
+	if k != nil {
+		if ew, err = blobcrypt.NewWriter(tmp, k); err != nil {
+			tmp.Close()
+			return "", 0, err
+		}
+		dst = ew
+	}
+	zw, err := NewWriter(dst)
+	if err == nil {
+		_, err = io.Copy(zw, src)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil && ew != nil {
+		err = ew.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	// The sample may compress better than the whole
+	if float64(zw.Written()) > maxRatio*float64(size) {
+		return "", 0, ErrNotWorthwhile
+	}
+
+	compressed := path + Ext
+	if err := os.Rename(tmp.Name(), compressed); err != nil {
+		return "", 0, err
+	}
+	return compressed, zw.Written(), nil
+}
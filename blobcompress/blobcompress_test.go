@@ -0,0 +1,137 @@
+package blobcompress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud-storage/blobcrypt"
+)
+
+// text returns n bytes of text that compresses well.
+func text(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < n; i++ {
+		b.WriteString("line ")
+		b.WriteString(strings.Repeat("x", i%50))
+		b.WriteString("\n")
+	}
+	return b.Bytes()[:n]
+}
+
+func noise(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func TestWorthwhile(t *testing.T) {
+	for _, tt := range []struct {
+		mime   string
+		sample []byte
+		want   bool
+	}{
+		{"text/plain; charset=utf-8", text(SampleSize), true},
+		{"image/svg+xml", text(SampleSize), true},
+		{"text/plain", text(minSize - 1), false},
+		{"application/octet-stream", noise(SampleSize), false},
+		{"application/zip", text(SampleSize), false},
+		{"video/mp4", text(SampleSize), false},
+		{"image/jpeg", text(SampleSize), false},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", text(SampleSize), false},
+	} {
+		if got := Worthwhile(tt.mime, tt.sample); got != tt.want {
+			t.Errorf("Worthwhile(%s, %d bytes) = %v, want %v", tt.mime, len(tt.sample), got, tt.want)
+		}
+	}
+}
+
+func TestCompressFile(t *testing.T) {
+	keys, err := blobcrypt.LoadKeyring(filepath.Join(t.TempDir(), "master.keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := text(3*ChunkSize + 1000)
+
+	for name, k := range map[string]*blobcrypt.Keyring{"plain": nil, "encrypted": keys} {
+		path := filepath.Join(t.TempDir(), "blob")
+		os.WriteFile(path, data, 0o600)
+		compressed, stored, err := CompressFile(path, "text/plain", k)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if info, _ := os.Stat(compressed); compressed != path+Ext || info.Size() < stored || stored > int64(len(data))/2 {
+			t.Errorf("%s: compressed to %s, %d bytes", name, compressed, stored)
+		}
+
+		b, err := OpenFile(compressed, k)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, err := io.ReadAll(b); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: read back %d bytes, %v", name, len(got), err)
+		}
+		p := make([]byte, ChunkSize+10)
+		if n, err := b.ReadAt(p, 2*ChunkSize-5); err != nil || !bytes.Equal(p[:n], data[2*ChunkSize-5:3*ChunkSize+5]) {
+			t.Errorf("%s: ReadAt across chunks = %d, %v", name, n, err)
+		}
+		if size, _ := b.Seek(0, io.SeekEnd); size != int64(len(data)) {
+			t.Errorf("%s: size = %d, want %d", name, size, len(data))
+		}
+		b.Close()
+	}
+
+	// Content that does not compress is left alone, even behind a good sample
+	for name, content := range map[string][]byte{
+		"noise":            noise(ChunkSize),
+		"noise after text": append(text(SampleSize), noise(16*SampleSize)...),
+	} {
+		path := filepath.Join(t.TempDir(), "blob")
+		os.WriteFile(path, content, 0o600)
+		if _, _, err := CompressFile(path, "application/octet-stream", nil); err != ErrNotWorthwhile {
+			t.Errorf("%s: %v, want ErrNotWorthwhile", name, err)
+		}
+		if _, err := os.Stat(path + Ext); !os.IsNotExist(err) {
+			t.Errorf("%s: left a compressed copy behind", name)
+		}
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	data := text(2*ChunkSize + 100)
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	blob := buf.Bytes()
+
+	for name, mutate := range map[string]func([]byte) []byte{
+		"flipped content bit": func(b []byte) []byte {
+			b[headerSize+100] ^= 1
+			return b
+		},
+		"truncated":  func(b []byte) []byte { return b[:len(b)-30] },
+		"no footer":  func(b []byte) []byte { return b[:len(b)-footerSize] },
+		"bad header": func(b []byte) []byte { b[5] = 9; return b },
+		"size grown": func(b []byte) []byte {
+			b[len(b)-footerSize+7]++
+			return b
+		},
+	} {
+		path := filepath.Join(t.TempDir(), "blob"+Ext)
+		os.WriteFile(path, mutate(append([]byte(nil), blob...)), 0o600)
+		b, err := OpenFile(path, nil)
+		if err == nil {
+			_, err = io.ReadAll(b)
+			b.Close()
+		}
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: %v, want ErrCorrupt", name, err)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+// Package blobcrypt stores blobs encrypted at rest with envelope encryption.
+//
+// Each blob gets a random AES-256 data key, wrapped by a master key from a
+// Keyring and kept in a fixed-size header:
+//
+//	magic "CSEB" | version | chunk size (uint32) | key ID length | key ID (32 bytes)
+//	| wrap nonce (12 bytes) | wrapped data key (48 bytes) | zero padding to 128 bytes
+//
+// The content follows as AES-256-GCM sealed chunks of ChunkSize bytes, the last
+// one shorter. Chunk nonces hold the chunk index and a flag marking the last
+// chunk, so chunks cannot be reordered and truncation is detected. Any chunk can
+// be decrypted on its own, which keeps range reads cheap, and rotating the master
+// key only rewrites the header.
+package blobcrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	ChunkSize  = 64 << 10
+	headerSize = 128
+	maxKeyID   = 32
+	tagSize    = 16
+	version    = 1
+)
+
+var magic = []byte("CSEB")
+
+var (
+	ErrCorrupt = errors.New("blobcrypt: blob is corrupt or was tampered with")
+	ErrNoKeys  = errors.New("blobcrypt: blob is encrypted but no master key is configured")
+)
+
+// Blob is the decrypted content of a stored blob.
+type Blob interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+}
+
+type header struct {
+	chunkSize int
+	keyID     string
+	nonce     []byte
+	wrapped   []byte
+}
+
+func (h *header) marshal() []byte {
+	b := make([]byte, headerSize)
+	copy(b, magic)
+	b[4] = version
+	binary.BigEndian.PutUint32(b[5:], uint32(h.chunkSize))
+	b[9] = byte(len(h.keyID))
+	copy(b[10:42], h.keyID)
+	copy(b[42:54], h.nonce)
+	copy(b[54:102], h.wrapped)
+	return b
+}
+
+// readHeader returns nil without an error when f holds a plaintext blob.
+func readHeader(f io.ReaderAt) (*header, error) {
+	b := make([]byte, headerSize)
+	n, err := f.ReadAt(b, 0)
+	if n < len(magic) || !bytes.Equal(b[:len(magic)], magic) {
+		return nil, nil
+	}
+	if n < headerSize {
+		if err == nil || err == io.EOF {
+			err = ErrCorrupt
+		}
+		return nil, err
+	}
+	if b[4] != version || int(b[9]) > maxKeyID {
+		return nil, ErrCorrupt
+	}
+	h := &header{
+		chunkSize: int(binary.BigEndian.Uint32(b[5:])),
+		keyID:     string(b[10 : 10+int(b[9])]),
+		nonce:     append([]byte(nil), b[42:54]...),
+		wrapped:   append([]byte(nil), b[54:102]...),
+	}
+	if h.chunkSize <= 0 || h.chunkSize > 16<<20 {
+		return nil, ErrCorrupt
+	}
+	return h, nil
+}
+
+func chunkNonce(nonce []byte, index int64, last bool) {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	if last {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+}
+
+// Writer encrypts everything written to it into a new blob. Close must be
+// called to seal the last chunk; it does not close the underlying writer.
+type Writer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	n     int
+	out   []byte
+	nonce []byte
+	index int64
+}
+
+// NewWriter writes the header of a blob with a fresh data key wrapped by the
+// active key of k.
+func NewWriter(w io.Writer, k *Keyring) (*Writer, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	h := header{chunkSize: ChunkSize}
+	if h.keyID, h.nonce, h.wrapped, err = k.wrap(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(h.marshal()); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:     w,
+		aead:  aead,
+		buf:   make([]byte, ChunkSize),
+		out:   make([]byte, 0, ChunkSize+tagSize),
+		nonce: make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data shows it is not the last
+		if w.n == len(w.buf) {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close seals the last chunk, which is empty only for an empty blob.
+func (w *Writer) Close() error {
+	return w.seal(true)
+}
+
+func (w *Writer) seal(last bool) error {
+	chunkNonce(w.nonce, w.index, last)
+	w.out = w.aead.Seal(w.out[:0], w.nonce, w.buf[:w.n], nil)
+	if _, err := w.w.Write(w.out); err != nil {
+		return err
+	}
+	w.index++
+	w.n = 0
+	return nil
+}
+
+type reader struct {
+	f         *os.File
+	aead      cipher.AEAD
+	chunkSize int64
+	chunks    int64
+	size      int64
+	nonce     []byte
+	sealed    []byte
+	chunk     []byte
+	cached    int64
+	off       int64
+}
+
+// Open returns the decrypted content of the blob at path. Plaintext blobs,
+// stored before encryption was enabled, are returned as they are. k may be nil
+// when no master key is configured.
+func Open(path string, k *Keyring) (Blob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if h == nil {
+		return f, nil
+	}
+	if k == nil {
+		f.Close()
+		return nil, ErrNoKeys
+	}
+
+	r, err := newReader(f, h, k)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func newReader(f *os.File, h *header, k *Keyring) (*reader, error) {
+	dataKey, err := k.unwrap(h.keyID, h.nonce, h.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every blob has at least one chunk, and only the last may be short
+	body := info.Size() - headerSize
+	sealedSize := int64(h.chunkSize + tagSize)
+	chunks := (body + sealedSize - 1) / sealedSize
+	last := body - (chunks-1)*sealedSize
+	if chunks < 1 || last < tagSize {
+		return nil, ErrCorrupt
+	}
+
+	return &reader{
+		f:         f,
+		aead:      aead,
+		chunkSize: int64(h.chunkSize),
+		chunks:    chunks,
+		size:      (chunks-1)*int64(h.chunkSize) + last - tagSize,
+		nonce:     make([]byte, aead.NonceSize()),
+		sealed:    make([]byte, sealedSize),
+		cached:    -1,
+	}, nil
+}
+
+// load decrypts chunk index into r.chunk.
+func (r *reader) load(index int64) error {
+	if index == r.cached {
+		return nil
+	}
+	r.cached = -1
+	sealedSize := r.chunkSize + tagSize
+	n, err := r.f.ReadAt(r.sealed, headerSize+index*sealedSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	chunkNonce(r.nonce, index, index == r.chunks-1)
+	if r.chunk, err = r.aead.Open(r.chunk[:0], r.nonce, r.sealed[:n], nil); err != nil {
+		return ErrCorrupt
+	}
+	r.cached = index
+	return nil
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		if err := r.load(off / r.chunkSize); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], r.chunk[off%r.chunkSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	// Stop at the chunk boundary to hand out data as it is decrypted
+	if end := (r.off/r.chunkSize + 1) * r.chunkSize; int64(len(p)) > end-r.off {
+		p = p[:end-r.off]
+	}
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *reader) Close() error {
+	return r.f.Close()
+}
+
+// Rewrap wraps the data key of the blob at path with the active master key,
+// rewriting only the header. It returns the ID of the key the blob was wrapped
+// with before, or "" when the blob is plaintext or already uses the active key.
+func Rewrap(path string, k *Keyring) (string, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h, err := readHeader(f)
+	if err != nil || h == nil || h.keyID == k.Active() {
+		return "", err
+	}
+	dataKey, err := k.unwrap(h.keyID, h.nonce, h.wrapped)
+	if err != nil {
+		return "", err
+	}
+
+	previous := h.keyID
+	if h.keyID, h.nonce, h.wrapped, err = k.wrap(dataKey); err != nil {
+		return "", err
+	}
+	if _, err := f.WriteAt(h.marshal(), 0); err != nil {
+		return "", err
+	}
+	return previous, f.Sync()
+}
+
+// EncryptFile replaces a plaintext blob with an encrypted one, reporting
+// whether it had to. The blob is swapped in with a rename, so readers holding
+// the old file open are not disturbed.
+func EncryptFile(path string, k *Keyring) (bool, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	if h, err := readHeader(src); err != nil || h != nil {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".encrypt-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	w, err := NewWriter(tmp, k)
+	if err == nil {
+		_, err = io.Copy(w, src)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
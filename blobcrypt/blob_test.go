@@ -0,0 +1,182 @@
+package blobcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	k, err := LoadKeyring(filepath.Join(t.TempDir(), "master.keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// encrypt stores data as a blob and returns its path.
+func encrypt(t *testing.T, k *Keyring, data []byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "blob")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// decrypt reads the whole blob at path.
+func decrypt(path string, k *Keyring) ([]byte, error) {
+	b, err := Open(path, k)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	return io.ReadAll(b)
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := testKeyring(t)
+	data := make([]byte, 3*ChunkSize+100)
+	rand.Read(data)
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, len(data)} {
+		got, err := decrypt(encrypt(t, k, data[:size]), k)
+		if err != nil || !bytes.Equal(got, data[:size]) {
+			t.Errorf("%d bytes came back as %d bytes, %v", size, len(got), err)
+		}
+	}
+
+	// Ranges across chunk boundaries, and seeking from the end
+	b, err := Open(encrypt(t, k, data), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	p := make([]byte, ChunkSize+20)
+	if n, err := b.ReadAt(p, ChunkSize-10); err != nil || !bytes.Equal(p[:n], data[ChunkSize-10:2*ChunkSize+10]) {
+		t.Errorf("ReadAt across chunks = %d, %v", n, err)
+	}
+	if n, err := b.ReadAt(p, int64(len(data)-5)); err != io.EOF || !bytes.Equal(p[:n], data[len(data)-5:]) {
+		t.Errorf("ReadAt at the end = %d, %v, want 5 and io.EOF", n, err)
+	}
+	if size, _ := b.Seek(0, io.SeekEnd); size != int64(len(data)) {
+		t.Errorf("size = %d, want %d", size, len(data))
+	}
+
+	// Blobs stored before encryption are read as they are
+	plain := filepath.Join(t.TempDir(), "plain")
+	os.WriteFile(plain, []byte("plain text"), 0o600)
+	if got, err := decrypt(plain, nil); err != nil || string(got) != "plain text" {
+		t.Errorf("plaintext blob = %q, %v", got, err)
+	}
+}
+
+func TestTamperAndTruncation(t *testing.T) {
+	k := testKeyring(t)
+	data := make([]byte, 2*ChunkSize+100)
+	rand.Read(data)
+	sealed, _ := os.ReadFile(encrypt(t, k, data))
+	sealedSize := ChunkSize + tagSize
+
+	for name, mutate := range map[string]func([]byte) []byte{
+		"flipped content bit": func(b []byte) []byte {
+			b[headerSize+sealedSize+7] ^= 1
+			return b
+		},
+		"flipped tag bit": func(b []byte) []byte {
+			b[len(b)-1] ^= 0x80
+			return b
+		},
+		"swapped chunks": func(b []byte) []byte {
+			first := append([]byte(nil), b[headerSize:headerSize+sealedSize]...)
+			copy(b[headerSize:], b[headerSize+sealedSize:headerSize+2*sealedSize])
+			copy(b[headerSize+sealedSize:], first)
+			return b
+		},
+		"last chunk dropped": func(b []byte) []byte {
+			return b[:headerSize+2*sealedSize]
+		},
+		"cut inside a chunk": func(b []byte) []byte {
+			return b[:len(b)-50]
+		},
+		"cut to a tag": func(b []byte) []byte {
+			return b[:headerSize+2*sealedSize+tagSize-1]
+		},
+		"cut inside the header": func(b []byte) []byte {
+			return b[:headerSize-1]
+		},
+		"wrapped key changed": func(b []byte) []byte {
+			b[60] ^= 1
+			return b
+		},
+	} {
+		path := filepath.Join(t.TempDir(), "blob")
+		os.WriteFile(path, mutate(append([]byte(nil), sealed...)), 0o600)
+		got, err := decrypt(path, k)
+		if err == nil {
+			t.Errorf("%s: read %d bytes without an error", name, len(got))
+		} else if name != "wrapped key changed" && !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: %v, want ErrCorrupt", name, err)
+		}
+	}
+
+	path := encrypt(t, k, data)
+	if _, err := decrypt(path, nil); err != ErrNoKeys {
+		t.Errorf("reading without keys = %v, want ErrNoKeys", err)
+	}
+	if _, err := decrypt(path, testKeyring(t)); err == nil {
+		t.Error("another keyring read the blob")
+	}
+}
+
+func TestRotateAndRewrap(t *testing.T) {
+	k := testKeyring(t)
+	old := k.Active()
+	path := encrypt(t, k, []byte("secret"))
+
+	if _, err := k.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if previous, err := Rewrap(path, k); err != nil || previous != old {
+		t.Errorf("Rewrap = %q, %v, want %q", previous, err, old)
+	}
+	if previous, err := Rewrap(path, k); err != nil || previous != "" {
+		t.Errorf("second Rewrap = %q, %v, want nothing to do", previous, err)
+	}
+
+	// The rewrapped blob reads with only the new key, after a reload from disk
+	reloaded, err := LoadKeyring(k.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, _ := NewKeyring(reloaded.Active(), reloaded.keys[reloaded.Active()])
+	if got, err := decrypt(path, single); err != nil || string(got) != "secret" {
+		t.Errorf("rewrapped blob = %q, %v", got, err)
+	}
+
+	plain := filepath.Join(t.TempDir(), "plain")
+	os.WriteFile(plain, []byte("was plain"), 0o600)
+	if did, err := EncryptFile(plain, k); !did || err != nil {
+		t.Fatalf("EncryptFile = %v, %v", did, err)
+	}
+	if did, err := EncryptFile(plain, k); did || err != nil {
+		t.Errorf("encrypting twice = %v, %v", did, err)
+	}
+	if got, err := decrypt(plain, k); err != nil || string(got) != "was plain" {
+		t.Errorf("encrypted file = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,208 @@
+package blobcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const keySize = 32
+
+var (
+	ErrUnknownKey = errors.New("blobcrypt: unknown master key")
+	ErrNoKeyFile  = errors.New("blobcrypt: master keys from the environment cannot be rotated")
+)
+
+// Keyring holds the master keys that wrap data keys. New blobs use the active
+// key; older keys stay so blobs wrapped with them can still be read.
+type Keyring struct {
+	mu     sync.RWMutex
+	path   string
+	active string
+	keys   map[string][]byte
+}
+
+// keyFile is the JSON layout of a key file, keys base64 encoded.
+type keyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// NewKeyring returns a keyring holding a single master key.
+func NewKeyring(id string, key []byte) (*Keyring, error) {
+	if len(key) != keySize || id == "" || len(id) > maxKeyID {
+		return nil, fmt.Errorf("blobcrypt: master key must be %d bytes with an ID of 1 to %d characters", keySize, maxKeyID)
+	}
+	return &Keyring{active: id, keys: map[string][]byte{id: key}}, nil
+}
+
+// LoadKeyring reads the key file at path, creating it with a fresh master key
+// when it does not exist yet.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path, keys: make(map[string][]byte)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if _, err := k.Rotate(); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("blobcrypt: %s: %w", path, err)
+	}
+	for id, encoded := range kf.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != keySize || len(id) > maxKeyID {
+			return nil, fmt.Errorf("blobcrypt: %s: invalid key %q", path, id)
+		}
+		k.keys[id] = key
+	}
+	if k.keys[kf.Active] == nil {
+		return nil, fmt.Errorf("blobcrypt: %s: active key %q is missing", path, kf.Active)
+	}
+	k.active = kf.Active
+	return k, nil
+}
+
+// Active returns the ID of the key that wraps new data keys.
+func (k *Keyring) Active() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// IDs returns the IDs of all keys in the ring.
+func (k *Keyring) IDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Rotate adds a new master key, makes it active and saves the key file. Blobs
+// keep their old wrapping until Rewrap is run on them.
+func (k *Keyring) Rotate() (string, error) {
+	if k.path == "" {
+		return "", ErrNoKeyFile
+	}
+	key := make([]byte, keySize)
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idBytes)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = key
+	previous := k.active
+	k.active = id
+	if err := k.save(); err != nil {
+		delete(k.keys, id)
+		k.active = previous
+		return "", err
+	}
+	return id, nil
+}
+
+// save writes the key file readable by the owner only; k.mu must be held.
+func (k *Keyring) save() error {
+	kf := keyFile{Active: k.active, Keys: make(map[string]string, len(k.keys))}
+	for id, key := range k.keys {
+		kf.Keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(k.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), ".keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
+
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	k.mu.RLock()
+	key := k.keys[id]
+	k.mu.RUnlock()
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+	return newGCM(key)
+}
+
+// wrap encrypts a data key with the active master key, bound to the key's ID.
+func (k *Keyring) wrap(dataKey []byte) (id string, nonce, wrapped []byte, err error) {
+	id = k.Active()
+	aead, err := k.aead(id)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, nil, err
+	}
+	return id, nonce, aead.Seal(nil, nonce, dataKey, []byte(id)), nil
+}
+
+func (k *Keyring) unwrap(id string, nonce, wrapped []byte) ([]byte, error) {
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := aead.Open(nil, nonce, wrapped, []byte(id))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,99 @@
+// Package cdc splits content into chunks at content-defined boundaries with
+// FastCDC, so an edit only changes the chunks around it and the rest of a file
+// deduplicates against its previous version.
+//
+// Boundaries depend on the gear table and the sizes below; changing either
+// does not break anything, but content chunked before no longer deduplicates
+// against content chunked after.
+package cdc
+
+import "io"
+
+const (
+	MinSize = 16 << 10
+	AvgSize = 64 << 10
+	MaxSize = 256 << 10
+
+	// Normalized chunking: a harder mask before AvgSize and an easier one after
+	// keep chunk sizes close to the average.
+	maskS = (1<<18 - 1) << (64 - 18)
+	maskL = (1<<14 - 1) << (64 - 14)
+)
+
+var gear [256]uint64
+
+func init() {
+	// splitmix64 from a fixed seed, so every client picks the same boundaries
+	seed := uint64(0x636c6f75642d7374)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gear[i] = z ^ z>>31
+	}
+}
+
+// cut returns the length of the chunk starting data.
+func cut(data []byte) int {
+	n := len(data)
+	if n <= MinSize {
+		return n
+	}
+	n = min(n, MaxSize)
+	normal := min(n, AvgSize)
+
+	var h uint64
+	i := MinSize
+	for ; i < normal; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Chunker reads content and hands it out chunk by chunk.
+type Chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, MaxSize)}
+}
+
+// Next returns the next chunk, valid until the following call, or io.EOF
+// after the last one. Empty content has no chunks.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < MaxSize && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.r.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
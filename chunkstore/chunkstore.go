@@ -0,0 +1,259 @@
+// Package chunkstore stores files as manifests listing content-defined chunks
+// (see package cdc) that are kept once per user:
+//
+//	storage/<user>/chunks/<first two hex digits>/<SHA-256>[.gzc]
+//
+// Chunks are stored like any other blob, compressed when worth it and encrypted
+// when a master key is configured. A manifest, named with Ext, is
+//
+//	magic "CSEM" | version | chunk count (uint32) | entries
+//
+// where each entry is the chunk's SHA-256 (32 bytes), size (uint32) and flags.
+package chunkstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cloud-storage/blobcompress"
+	"cloud-storage/blobcrypt"
+	"cloud-storage/cdc"
+)
+
+// Ext names manifests.
+const Ext = ".cdc"
+
+const (
+	version        = 1
+	headerSize     = 9
+	entrySize      = 32 + 4 + 1
+	flagCompressed = 1
+)
+
+var magic = []byte("CSEM")
+
+var ErrCorrupt = errors.New("chunkstore: manifest is corrupt")
+
+// Ref is one chunk of a file.
+type Ref struct {
+	Hash       string
+	Size       int64
+	Compressed bool
+}
+
+// ValidHash reports whether hash is a lowercase hex SHA-256, safe to use in a path.
+func ValidHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && strings.ToLower(hash) == hash
+}
+
+// ChunkPath returns where the chunk with hash is stored below userDir.
+func ChunkPath(userDir, hash string, compressed bool) string {
+	path := filepath.Join(userDir, "chunks", hash[:2], hash)
+	if compressed {
+		path += blobcompress.Ext
+	}
+	return path
+}
+
+// WriteManifest writes the manifest listing refs.
+func WriteManifest(w io.Writer, refs []Ref) error {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[4] = version
+	binary.BigEndian.PutUint32(header[5:], uint32(len(refs)))
+	bw.Write(header)
+
+	entry := make([]byte, entrySize)
+	for _, ref := range refs {
+		if _, err := hex.Decode(entry[:32], []byte(ref.Hash)); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(entry[32:], uint32(ref.Size))
+		entry[36] = 0
+		if ref.Compressed {
+			entry[36] = flagCompressed
+		}
+		bw.Write(entry)
+	}
+	return bw.Flush()
+}
+
+// ReadManifest reads the chunks listed by a manifest.
+func ReadManifest(r io.Reader) ([]Ref, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrCorrupt
+	}
+	if string(header[:4]) != string(magic) || header[4] != version {
+		return nil, ErrCorrupt
+	}
+
+	count := binary.BigEndian.Uint32(header[5:])
+	refs := make([]Ref, 0, min(count, 1<<16))
+	entry := make([]byte, entrySize)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(br, entry); err != nil {
+			return nil, ErrCorrupt
+		}
+		size := int64(binary.BigEndian.Uint32(entry[32:]))
+		if size == 0 || size > cdc.MaxSize {
+			return nil, ErrCorrupt
+		}
+		refs = append(refs, Ref{
+			Hash:       hex.EncodeToString(entry[:32]),
+			Size:       size,
+			Compressed: entry[36]&flagCompressed != 0,
+		})
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return nil, ErrCorrupt
+	}
+	return refs, nil
+}
+
+// LoadManifest reads the manifest at path, decrypting it with k.
+func LoadManifest(path string, k *blobcrypt.Keyring) ([]Ref, error) {
+	f, err := blobcrypt.Open(path, k)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadManifest(f)
+}
+
+// OpenFile returns the original content of the blob at path: reassembled from
+// its chunks for a manifest, otherwise decrypted and decompressed as needed.
+func OpenFile(path string, k *blobcrypt.Keyring) (blobcrypt.Blob, error) {
+	if !strings.HasSuffix(path, Ext) {
+		return blobcompress.OpenFile(path, k)
+	}
+	refs, err := LoadManifest(path, k)
+	if err != nil {
+		return nil, err
+	}
+	return Open(filepath.Dir(path), refs, k), nil
+}
+
+type reader struct {
+	dir    string
+	k      *blobcrypt.Keyring
+	refs   []Ref
+	starts []int64
+	size   int64
+	open   int // index of chunk, -1 for none
+	chunk  blobcrypt.Blob
+	off    int64
+}
+
+// Open returns the content made of refs, whose chunks are stored below dir.
+// Chunks are opened as they are read.
+func Open(dir string, refs []Ref, k *blobcrypt.Keyring) blobcrypt.Blob {
+	r := &reader{dir: dir, k: k, refs: refs, starts: make([]int64, len(refs)), open: -1}
+	for i, ref := range refs {
+		r.starts[i] = r.size
+		r.size += ref.Size
+	}
+	return r
+}
+
+// load makes chunk index the open one.
+func (r *reader) load(index int) error {
+	if index == r.open {
+		return nil
+	}
+	if r.chunk != nil {
+		r.chunk.Close()
+		r.chunk, r.open = nil, -1
+	}
+
+	ref := r.refs[index]
+	chunk, err := blobcompress.OpenFile(ChunkPath(r.dir, ref.Hash, ref.Compressed), r.k)
+	if err != nil {
+		return err
+	}
+	if size, err := chunk.Seek(0, io.SeekEnd); err != nil || size != ref.Size {
+		chunk.Close()
+		if err == nil {
+			err = blobcompress.ErrCorrupt
+		}
+		return err
+	}
+	r.chunk, r.open = chunk, index
+	return nil
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		index := sort.Search(len(r.starts), func(i int) bool { return r.starts[i] > off }) - 1
+		if err := r.load(index); err != nil {
+			return n, err
+		}
+		end := min(int64(len(p)-n), r.starts[index]+r.refs[index].Size-off)
+		c, err := r.chunk.ReadAt(p[n:n+int(end)], off-r.starts[index])
+		n += c
+		off += int64(c)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if c == 0 {
+			return n, blobcompress.ErrCorrupt
+		}
+	}
+	return n, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *reader) Close() error {
+	if r.chunk != nil {
+		return r.chunk.Close()
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"cloud-storage/cdc"
+)
+
+// Chunks are checked with the server this many at a time
+const chunkCheckBatch = 1000
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+
+	offset int64
+}
+
+// chunkFile splits the file into content-defined chunks, so that after an edit
+// only the chunks around it differ from those of the previous upload.
+func chunkFile(file *os.File) ([]chunkRef, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var refs []chunkRef
+	var offset int64
+	chunker := cdc.NewChunker(file)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return refs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(chunk)
+		refs = append(refs, chunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(chunk)), offset: offset})
+		offset += int64(len(chunk))
+	}
+}
+
+// uploadChunked uploads only the chunks of file the server does not have yet
+// and creates or replaces name from them.
+func (c *Client) uploadChunked(file *os.File, name string, expiry Expiry) error {
+	refs, err := chunkFile(file)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for start := 0; start < len(refs); start += chunkCheckBatch {
+		var hashes []string
+		for _, ref := range refs[start:min(start+chunkCheckBatch, len(refs))] {
+			hashes = append(hashes, ref.Hash)
+		}
+		var result struct {
+			Missing []string `json:"missing"`
+		}
+		if err := c.sendRequest("POST", "/api/v1/chunks/check", map[string][]string{"hashes": hashes}, &result); err != nil {
+			return err
+		}
+		missing = append(missing, result.Missing...)
+	}
+
+	// Chunks can be collected between the check and the commit; upload them again once
+	for attempt := 0; ; attempt++ {
+		if err := c.uploadChunks(file, refs, missing); err != nil {
+			return err
+		}
+		missing, err = c.commitChunks(name, refs, expiry)
+		if err != nil || len(missing) == 0 || attempt > 0 {
+			if err == nil && len(missing) > 0 {
+				err = fmt.Errorf("upload failed: %d chunks missing", len(missing))
+			}
+			return err
+		}
+	}
+}
+
+func (c *Client) uploadChunks(file *os.File, refs []chunkRef, hashes []string) error {
+	wanted := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		wanted[hash] = true
+	}
+
+	buf := make([]byte, cdc.MaxSize)
+	for _, ref := range refs {
+		if !wanted[ref.Hash] {
+			continue
+		}
+		delete(wanted, ref.Hash)
+
+		chunk := buf[:ref.Size]
+		if _, err := file.ReadAt(chunk, ref.offset); err != nil {
+			return err
+		}
+		req, err := http.NewRequest("PUT", c.BaseURL+"/api/v1/chunks/"+ref.Hash, bytes.NewReader(chunk))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			return fmt.Errorf("chunk upload failed: %d", resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// commitChunks creates the file from refs, returning the chunks the server
+// reports missing instead when it has lost some.
+func (c *Client) commitChunks(name string, refs []chunkRef, expiry Expiry) ([]string, error) {
+	body := map[string]interface{}{"name": name, "chunks": refs}
+	for field, value := range expiry.fields() {
+		body[field] = value
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", c.BaseURL+"/api/v1/files/chunked", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Missing []string `json:"missing"`
+	}
+	if resp.StatusCode == http.StatusConflict && json.NewDecoder(resp.Body).Decode(&result) == nil && len(result.Missing) > 0 {
+		return result.Missing, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upload failed: %d", resp.StatusCode)
+	}
+	return nil, nil
+}
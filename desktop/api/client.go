@@ -7,13 +7,17 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Client struct {
 	BaseURL string
 	Token   string
+
+	e2e *e2eKeys // set while end-to-end encryption is unlocked
 }
 
 type AuthResponse struct {
@@ -21,11 +25,31 @@ type AuthResponse struct {
 }
 
 type FileInfo struct {
-	ID           uint   `json:"id"`
-	Name         string `json:"name"`
-	Size         int64  `json:"size"`
-	LastModified string `json:"last_modified"`
-	Hash         string `json:"hash"`
+	ID           uint                   `json:"id"`
+	Name         string                 `json:"name"`
+	Size         int64                  `json:"size"`
+	LastModified string                 `json:"last_modified"`
+	Hash         string                 `json:"hash"`
+	MimeType     string                 `json:"mime_type"`
+	Metadata     map[string]interface{} `json:"metadata"`
+	IsDir        bool                   `json:"is_dir"`
+	ParentID     *uint                  `json:"parent_id"`
+	Starred      bool                   `json:"starred"`
+	Color        string                 `json:"color"`
+	Tags         []Tag                  `json:"tags"`
+	Corrupt      bool                   `json:"corrupt"`
+	ScanStatus   string                 `json:"scan_status"` // pending, clean, infected or error; empty when not scanned
+	ScanResult   string                 `json:"scan_result"`
+	ExpiresAt    string                 `json:"expires_at"`
+	MaxDownloads int                    `json:"max_downloads"`
+	Downloads    int                    `json:"download_count"`
+	Encrypted    bool                   `json:"-"` // end-to-end encrypted; Name is only readable once unlocked
+}
+
+type Tag struct {
+	ID        uint   `json:"id"`
+	Name      string `json:"name"`
+	FileCount int64  `json:"file_count"`
 }
 
 func NewClient(baseURL string) *Client {
@@ -57,7 +81,7 @@ func (c *Client) sendRequest(method, path string, payload interface{}, result in
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("request failed: %s", body)
 	}
@@ -81,25 +105,65 @@ func (c *Client) Login(username, password string) error {
 	return nil
 }
 
-func (c *Client) UploadFile(filePath string) error {
+// Expiry has the server delete an uploaded file at At, or after MaxDownloads
+// downloads. The zero value keeps it.
+type Expiry struct {
+	At           *time.Time
+	MaxDownloads int
+}
+
+func (e Expiry) fields() map[string]interface{} {
+	fields := map[string]interface{}{}
+	if e.At != nil {
+		fields["expires_at"] = e.At.UTC().Format(time.RFC3339)
+	}
+	if e.MaxDownloads > 0 {
+		fields["max_downloads"] = e.MaxDownloads
+	}
+	return fields
+}
+
+// UploadFile uploads a file, encrypting its content and name first while
+// end-to-end encryption is unlocked. Otherwise content the server already has
+// is not sent at all, and of other content only the chunks it lacks; an earlier
+// upload of the same name is replaced.
+func (c *Client) UploadFile(filePath string, expiry Expiry) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+	name := filepath.Base(filePath)
+	keys := c.e2e
+	if keys == nil {
+		if done, err := c.uploadExisting(file, name, expiry); err != nil || done {
+			return err
+		}
+		return c.uploadChunked(file, name, expiry)
+	}
 
-	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
+	salt, key, err := keys.newFileKey()
 	if err != nil {
 		return err
 	}
+	if name, err = sealName(key, salt, name); err != nil {
+		return err
+	}
 
-	_, err = io.Copy(part, file)
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", name)
 	if err != nil {
 		return err
 	}
+	if err := encryptContent(part, file, key, salt); err != nil {
+		return err
+	}
+	for field, value := range expiry.fields() {
+		writer.WriteField(field, fmt.Sprint(value))
+	}
 	writer.Close()
 
 	req, err := http.NewRequest("POST", c.BaseURL+"/api/v1/upload", body)
@@ -123,15 +187,52 @@ func (c *Client) UploadFile(filePath string) error {
 	return nil
 }
 
-func (c *Client) ListFiles() ([]FileInfo, error) {
-	var resp struct {
-		Files []FileInfo `json:"files"`
+// ListOptions selects a page of files. Sort is name, size, modified, type or
+// created; Cursor is the NextCursor of the previous page.
+type ListOptions struct {
+	Sort    string
+	Order   string
+	Limit   int
+	Cursor  string
+	Tag     string
+	Starred bool
+}
+
+type FilePage struct {
+	Files      []FileInfo `json:"files"`
+	Total      int64      `json:"total"`
+	NextCursor string     `json:"next_cursor"`
+}
+
+func (c *Client) ListFiles(opts ListOptions) (*FilePage, error) {
+	params := url.Values{}
+	if opts.Sort != "" {
+		params.Set("sort", opts.Sort)
 	}
-	err := c.sendRequest("GET", "/api/v1/files", nil, &resp)
-	if err != nil {
+	if opts.Order != "" {
+		params.Set("order", opts.Order)
+	}
+	if opts.Limit > 0 {
+		params.Set("limit", fmt.Sprint(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		params.Set("cursor", opts.Cursor)
+	}
+	if opts.Tag != "" {
+		params.Set("tag", opts.Tag)
+	}
+	if opts.Starred {
+		params.Set("starred", "true")
+	}
+
+	var page FilePage
+	if err := c.sendRequest("GET", "/api/v1/files?"+params.Encode(), nil, &page); err != nil {
 		return nil, err
 	}
-	return resp.Files, nil
+	for i := range page.Files {
+		c.decryptName(&page.Files[i], true)
+	}
+	return &page, nil
 }
 
 func (c *Client) Sync() error {
@@ -139,8 +240,7 @@ func (c *Client) Sync() error {
 	return c.sendRequest("POST", "/api/v1/sync", nil, &resp)
 }
 
-// In desktop/api/client.go
-
+// DownloadFile saves a file, decrypting it if it is end-to-end encrypted.
 func (c *Client) DownloadFile(fileID string, fileName string) error {
 	req, err := http.NewRequest("GET", c.BaseURL+"/api/v1/files/"+fileID+"/download", nil)
 	if err != nil {
@@ -164,10 +264,276 @@ func (c *Client) DownloadFile(fileID string, fileName string) error {
 	}
 	defer outFile.Close()
 
-	_, err = io.Copy(outFile, resp.Body)
+	return c.copyContent(outFile, resp.Body, func(keys *e2eKeys, salt []byte) ([]byte, error) {
+		return keys.fileKey(salt)
+	})
+}
+
+type Share struct {
+	ID         uint     `json:"id"`
+	OwnerID    uint     `json:"owner_id"`
+	Permission string   `json:"permission"`
+	File       FileInfo `json:"file"`
+}
+
+// SharedWithMe lists the files other users shared with the user.
+func (c *Client) SharedWithMe() ([]Share, error) {
+	var resp struct {
+		SharedWithMe []Share `json:"shared_with_me"`
+	}
+	if err := c.sendRequest("GET", "/api/v1/shares", nil, &resp); err != nil {
+		return nil, err
+	}
+	for i := range resp.SharedWithMe {
+		c.decryptName(&resp.SharedWithMe[i].File, false)
+	}
+	return resp.SharedWithMe, nil
+}
+
+// DownloadShare saves a file shared with the user, decrypting it with the key
+// its owner shared if it is end-to-end encrypted.
+func (c *Client) DownloadShare(share Share, fileName string) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/shares/%d/download", c.BaseURL, share.ID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %d", resp.StatusCode)
+	}
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	return c.copyContent(outFile, resp.Body, func(keys *e2eKeys, salt []byte) ([]byte, error) {
+		return c.sharedKey(keys, share.File.ID)
+	})
+}
+
+// DownloadArchive streams the given files and folders into w as one archive;
+// format is zip or tar.gz.
+func (c *Client) DownloadArchive(fileIDs []uint, format string, w io.Writer) error {
+	data, err := json.Marshal(map[string]interface{}{"file_ids": fileIDs, "format": format})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.BaseURL+"/api/v1/archive", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("archive failed: %d", resp.StatusCode)
+	}
+	_, err = io.Copy(w, resp.Body)
 	return err
 }
 
 func (c *Client) DeleteFile(fileID string) error {
 	return c.sendRequest("DELETE", "/api/v1/files/"+fileID, nil, nil)
 }
+
+// Thumbnail fetches a JPEG preview of an image file; size is small, medium or large.
+func (c *Client) Thumbnail(fileID uint, size string) ([]byte, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/files/%d/thumbnail?size=%s", c.BaseURL, fileID, size), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("thumbnail failed: %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+type SearchResult struct {
+	File      FileInfo `json:"file"`
+	Highlight string   `json:"highlight"`
+	Snippet   string   `json:"snippet"`
+}
+
+// QueryError is a search query the server could not parse; Position is 1-based.
+type QueryError struct {
+	Message  string `json:"error"`
+	Position int    `json:"position"`
+}
+
+func (e *QueryError) Error() string {
+	if e.Position == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (at position %d)", e.Message, e.Position)
+}
+
+// Search runs a query such as `report type:pdf size:>10MB in:/Projects` on the server.
+func (c *Client) Search(query string) ([]SearchResult, error) {
+	return c.search("q=" + url.QueryEscape(query))
+}
+
+func (c *Client) search(params string) ([]SearchResult, error) {
+	req, err := http.NewRequest("GET", c.BaseURL+"/api/v1/search?"+params, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest {
+		var queryErr QueryError
+		if err := json.NewDecoder(resp.Body).Decode(&queryErr); err != nil {
+			return nil, err
+		}
+		return nil, &queryErr
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("search failed: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Results []SearchResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	for i := range result.Results {
+		c.decryptName(&result.Results[i].File, true)
+	}
+	return result.Results, nil
+}
+
+// LabelRequest changes several files at once; nil fields are left as they are.
+type LabelRequest struct {
+	FileIDs    []uint   `json:"file_ids"`
+	AddTags    []string `json:"add_tags,omitempty"`
+	RemoveTags []string `json:"remove_tags,omitempty"`
+	Starred    *bool    `json:"starred,omitempty"`
+	Color      *string  `json:"color,omitempty"`
+}
+
+func (c *Client) LabelFiles(req LabelRequest) error {
+	var resp map[string]interface{}
+	return c.sendRequest("PATCH", "/api/v1/files/labels", req, &resp)
+}
+
+func (c *Client) ListTags() ([]Tag, error) {
+	var resp struct {
+		Tags []Tag `json:"tags"`
+	}
+	if err := c.sendRequest("GET", "/api/v1/tags", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Tags, nil
+}
+
+// BatchOperation is one step of a batch: delete, move, copy, tag or share.
+// A nil ParentID moves or copies to the root folder.
+type BatchOperation struct {
+	Op         string   `json:"op"`
+	FileID     uint     `json:"file_id"`
+	ParentID   *uint    `json:"parent_id,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	AddTags    []string `json:"add_tags,omitempty"`
+	RemoveTags []string `json:"remove_tags,omitempty"`
+	Username   string   `json:"username,omitempty"`
+	Permission string   `json:"permission,omitempty"`
+}
+
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	FileID uint   `json:"file_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Batch runs operations on the server. Large batches run in the background, in
+// which case only the job ID is returned; poll it with Job.
+func (c *Client) Batch(ops []BatchOperation) ([]BatchResult, uint, error) {
+	var resp struct {
+		Results []BatchResult `json:"results"`
+		JobID   uint          `json:"job_id"`
+	}
+	if err := c.sendRequest("POST", "/api/v1/batch", map[string]interface{}{"operations": ops}, &resp); err != nil {
+		return nil, 0, err
+	}
+	return resp.Results, resp.JobID, nil
+}
+
+type Job struct {
+	ID     uint          `json:"id"`
+	Status string        `json:"status"` // queued, running, succeeded, failed or cancelled
+	Total  int           `json:"total"`
+	Done   int           `json:"done"`
+	Result []BatchResult `json:"result"`
+	Error  string        `json:"error"`
+}
+
+// Finished reports whether the job will not make any more progress.
+func (j *Job) Finished() bool {
+	return j.Status != "queued" && j.Status != "running"
+}
+
+func (c *Client) Job(id uint) (*Job, error) {
+	var resp struct {
+		Job Job `json:"job"`
+	}
+	if err := c.sendRequest("GET", fmt.Sprintf("/api/v1/jobs/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Job, nil
+}
+
+func (c *Client) CancelJob(id uint) error {
+	return c.sendRequest("DELETE", fmt.Sprintf("/api/v1/jobs/%d", id), nil, nil)
+}
+
+type SavedSearch struct {
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+func (c *Client) ListSavedSearches() ([]SavedSearch, error) {
+	var resp struct {
+		SavedSearches []SavedSearch `json:"saved_searches"`
+	}
+	if err := c.sendRequest("GET", "/api/v1/saved-searches", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.SavedSearches, nil
+}
+
+func (c *Client) SaveSearch(name, query string) error {
+	var resp map[string]interface{}
+	return c.sendRequest("POST", "/api/v1/saved-searches", map[string]string{"name": name, "query": query}, &resp)
+}
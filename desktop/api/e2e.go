@@ -0,0 +1,560 @@
+package api
+
+// End-to-end encryption keeps file contents and names from the server.
+//
+// A passphrase unlocks, through Argon2id, a random root key and an X25519 key
+// pair that are kept sealed on the server. Every file gets a random salt and a
+// key derived from the root key and that salt with HKDF, so changing the
+// passphrase only reseals the root key. To share a file, its key is wrapped for
+// the recipient's public key and stored on the server.
+//
+// Encrypted names are "e2e." followed by base64url(salt | nonce | sealed name).
+// Encrypted content starts with a header
+//
+//	magic "CSE2E" | version | salt (16 bytes) | nonce prefix (15 bytes)
+//
+// followed by XChaCha20-Poly1305 sealed chunks of e2eChunkSize bytes, the last
+// one shorter or empty. Chunk nonces end in the chunk index and a flag marking
+// the last chunk, so reordering and truncation are detected.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	e2eNamePrefix   = "e2e."
+	e2eVersion      = 1
+	e2eChunkSize    = 64 << 10
+	e2eSaltSize     = 16
+	e2ePrefixSize   = chacha20poly1305.NonceSizeX - 9
+	e2eHeaderSize   = len(e2eMagic) + 1 + e2eSaltSize + e2ePrefixSize
+	e2eKeySize      = chacha20poly1305.KeySize
+	argonTime       = 3
+	argonMemory     = 64 << 10 // KiB
+	argonThreads    = 4
+	maxArgonTime    = 10
+	maxArgonMemory  = 1 << 20
+	sealedKeysSize  = 1 + 4 + 4 + 1 + e2eSaltSize + chacha20poly1305.NonceSizeX + 2*e2eKeySize + chacha20poly1305.Overhead
+	sealedKeysStart = 1 + 4 + 4 + 1 + e2eSaltSize
+)
+
+const e2eMagic = "CSE2E"
+
+var (
+	ErrE2ELocked       = errors.New("end-to-end encryption is locked, enter your passphrase first")
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	ErrE2ECorrupt      = errors.New("encrypted file is corrupt or was tampered with")
+	ErrNoFileKey       = errors.New("the owner has not shared the key of this encrypted file")
+)
+
+// e2eKeys are the unlocked secrets of the user.
+type e2eKeys struct {
+	root    []byte
+	public  [32]byte
+	private [32]byte
+
+	mu     sync.Mutex
+	shared map[uint][]byte // keys of files shared with the user, by file ID
+}
+
+type userKey struct {
+	PublicKey  string `json:"public_key"`
+	SealedKeys string `json:"sealed_keys"`
+}
+
+// E2EEnabled reports whether end-to-end encryption is unlocked, in which case
+// uploads are encrypted.
+func (c *Client) E2EEnabled() bool {
+	return c.e2e != nil
+}
+
+// UnlockE2E turns on end-to-end encryption with the user's passphrase. The first
+// unlock creates the keys, protected by passphrase, and stores them on the server.
+func (c *Client) UnlockE2E(passphrase string) error {
+	stored, err := c.userKey()
+	if err != nil {
+		return err
+	}
+
+	if stored == nil {
+		keys, err := newE2EKeys()
+		if err != nil {
+			return err
+		}
+		if err := c.saveUserKey(keys, passphrase); err != nil {
+			return err
+		}
+		c.e2e = keys
+		return nil
+	}
+
+	keys, err := openUserKey(stored, passphrase)
+	if err != nil {
+		return err
+	}
+	c.e2e = keys
+	return nil
+}
+
+// LockE2E forgets the unlocked keys; later uploads are not encrypted.
+func (c *Client) LockE2E() {
+	c.e2e = nil
+}
+
+// ChangeE2EPassphrase reseals the keys with a new passphrase. Files keep their
+// keys, so nothing is re-encrypted.
+func (c *Client) ChangeE2EPassphrase(passphrase string) error {
+	if c.e2e == nil {
+		return ErrE2ELocked
+	}
+	return c.saveUserKey(c.e2e, passphrase)
+}
+
+func newE2EKeys() (*e2eKeys, error) {
+	keys := &e2eKeys{root: make([]byte, e2eKeySize), shared: make(map[uint][]byte)}
+	if _, err := rand.Read(keys.root); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(keys.private[:]); err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&keys.public, &keys.private)
+	return keys, nil
+}
+
+// userKey fetches the user's stored keys, or nil when there are none yet.
+func (c *Client) userKey() (*userKey, error) {
+	req, err := http.NewRequest("GET", c.BaseURL+"/api/v1/e2e-keys", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching keys failed: %d", resp.StatusCode)
+	}
+	var result struct {
+		UserKey userKey `json:"user_key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result.UserKey, nil
+}
+
+// saveUserKey seals the root and private keys with a key derived from
+// passphrase and stores them with the public key:
+//
+//	version | Argon2id time (uint32) | memory (uint32, KiB) | threads | salt | nonce | sealed keys
+func (c *Client) saveUserKey(keys *e2eKeys, passphrase string) error {
+	sealed := make([]byte, sealedKeysStart, sealedKeysSize)
+	sealed[0] = e2eVersion
+	binary.BigEndian.PutUint32(sealed[1:], argonTime)
+	binary.BigEndian.PutUint32(sealed[5:], argonMemory)
+	sealed[9] = argonThreads
+	salt := sealed[10:sealedKeysStart]
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	aead, err := chacha20poly1305.NewX(argon2.IDKey([]byte(passphrase), salt, argonTime, argonMemory, argonThreads, e2eKeySize))
+	if err != nil {
+		return err
+	}
+	secrets := append(append([]byte(nil), keys.root...), keys.private[:]...)
+	sealed = append(sealed, nonce...)
+	sealed = aead.Seal(sealed, nonce, secrets, keys.public[:])
+
+	payload := userKey{
+		PublicKey:  base64.StdEncoding.EncodeToString(keys.public[:]),
+		SealedKeys: base64.StdEncoding.EncodeToString(sealed),
+	}
+	var resp map[string]interface{}
+	return c.sendRequest("PUT", "/api/v1/e2e-keys", payload, &resp)
+}
+
+func openUserKey(stored *userKey, passphrase string) (*e2eKeys, error) {
+	public, err := base64.StdEncoding.DecodeString(stored.PublicKey)
+	if err != nil || len(public) != 32 {
+		return nil, ErrE2ECorrupt
+	}
+	sealed, err := base64.StdEncoding.DecodeString(stored.SealedKeys)
+	if err != nil || len(sealed) != sealedKeysSize || sealed[0] != e2eVersion {
+		return nil, ErrE2ECorrupt
+	}
+	// The parameters come from the server, so bound what they may cost
+	time := binary.BigEndian.Uint32(sealed[1:])
+	memory := binary.BigEndian.Uint32(sealed[5:])
+	threads := sealed[9]
+	if time == 0 || time > maxArgonTime || memory == 0 || memory > maxArgonMemory || threads == 0 {
+		return nil, ErrE2ECorrupt
+	}
+	salt := sealed[10:sealedKeysStart]
+	nonce := sealed[sealedKeysStart : sealedKeysStart+chacha20poly1305.NonceSizeX]
+
+	aead, err := chacha20poly1305.NewX(argon2.IDKey([]byte(passphrase), salt, time, memory, threads, e2eKeySize))
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := aead.Open(nil, nonce, sealed[sealedKeysStart+len(nonce):], public)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	keys := &e2eKeys{root: secrets[:e2eKeySize], shared: make(map[uint][]byte)}
+	copy(keys.private[:], secrets[e2eKeySize:])
+	copy(keys.public[:], public)
+	return keys, nil
+}
+
+// fileKey derives the key of one of the user's own files from its salt.
+func (k *e2eKeys) fileKey(salt []byte) ([]byte, error) {
+	key := make([]byte, e2eKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k.root, salt, []byte("cloud-storage e2e file")), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newFileKey picks the salt of a new file and derives its key.
+func (k *e2eKeys) newFileKey() (salt, key []byte, err error) {
+	salt = make([]byte, e2eSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	key, err = k.fileKey(salt)
+	return salt, key, err
+}
+
+// sharedKey returns the key of a file shared with the user, fetching it from
+// the server the first time.
+func (c *Client) sharedKey(keys *e2eKeys, fileID uint) ([]byte, error) {
+	keys.mu.Lock()
+	key := keys.shared[fileID]
+	keys.mu.Unlock()
+	if key != nil {
+		return key, nil
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/files/%d/key", c.BaseURL, fileID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoFileKey
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching file key failed: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		FileKey struct {
+			WrappedKey string `json:"wrapped_key"`
+		} `json:"file_key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(result.FileKey.WrappedKey)
+	if err != nil {
+		return nil, ErrE2ECorrupt
+	}
+	key, ok := box.OpenAnonymous(nil, wrapped, &keys.public, &keys.private)
+	if !ok || len(key) != e2eKeySize {
+		return nil, ErrE2ECorrupt
+	}
+
+	keys.mu.Lock()
+	keys.shared[fileID] = key
+	keys.mu.Unlock()
+	return key, nil
+}
+
+// ShareFileKeys wraps the keys of the encrypted files among fileIDs for
+// username, so the files can be read once they are shared. Other files are
+// skipped.
+func (c *Client) ShareFileKeys(fileIDs []uint, username string) error {
+	var recipient *[32]byte
+	for _, id := range fileIDs {
+		var resp struct {
+			File FileInfo `json:"file"`
+		}
+		if err := c.sendRequest("GET", fmt.Sprintf("/api/v1/files/%d", id), nil, &resp); err != nil {
+			return err
+		}
+		salt, ok := nameSalt(resp.File.Name)
+		if !ok || resp.File.IsDir {
+			continue
+		}
+		keys := c.e2e
+		if keys == nil {
+			return ErrE2ELocked
+		}
+		key, err := keys.fileKey(salt)
+		if err != nil {
+			return err
+		}
+
+		if recipient == nil {
+			if recipient, err = c.publicKey(username); err != nil {
+				return err
+			}
+		}
+		wrapped, err := box.SealAnonymous(nil, key, recipient, rand.Reader)
+		if err != nil {
+			return err
+		}
+		payload := map[string]string{"username": username, "wrapped_key": base64.StdEncoding.EncodeToString(wrapped)}
+		var result map[string]interface{}
+		if err := c.sendRequest("PUT", fmt.Sprintf("/api/v1/files/%d/key", id), payload, &result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) publicKey(username string) (*[32]byte, error) {
+	var resp struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := c.sendRequest("GET", "/api/v1/e2e-keys/"+url.PathEscape(username), nil, &resp); err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp.PublicKey)
+	if err != nil || len(decoded) != 32 {
+		return nil, ErrE2ECorrupt
+	}
+	var key [32]byte
+	copy(key[:], decoded)
+	return &key, nil
+}
+
+func sealName(key, salt []byte, name string) (string, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", err
+	}
+	out := make([]byte, 0, len(salt)+aead.NonceSize()+len(name)+aead.Overhead())
+	out = append(out, salt...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, []byte(name), []byte("name"))
+	return e2eNamePrefix + base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// nameSalt returns the file salt from an encrypted name.
+func nameSalt(name string) ([]byte, bool) {
+	if !strings.HasPrefix(name, e2eNamePrefix) {
+		return nil, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(name[len(e2eNamePrefix):])
+	if err != nil || len(data) < e2eSaltSize+chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return nil, false
+	}
+	return data[:e2eSaltSize], true
+}
+
+func openName(key []byte, name string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(name[len(e2eNamePrefix):])
+	if err != nil {
+		return "", ErrE2ECorrupt
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := data[e2eSaltSize : e2eSaltSize+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[e2eSaltSize+aead.NonceSize():], []byte("name"))
+	if err != nil {
+		return "", ErrE2ECorrupt
+	}
+	return string(plain), nil
+}
+
+// decryptName marks file as encrypted and replaces its name with the plaintext
+// one if it can; owned tells whether the user owns the file or it was shared.
+// Names that cannot be decrypted are left as they are.
+func (c *Client) decryptName(file *FileInfo, owned bool) {
+	salt, ok := nameSalt(file.Name)
+	if !ok {
+		return
+	}
+	file.Encrypted = true
+	keys := c.e2e
+	if keys == nil {
+		return
+	}
+
+	var key []byte
+	var err error
+	if owned {
+		key, err = keys.fileKey(salt)
+	} else {
+		key, err = c.sharedKey(keys, file.ID)
+	}
+	if err != nil {
+		return
+	}
+	if name, err := openName(key, file.Name); err == nil {
+		file.Name = name
+	}
+}
+
+func chunkNonceX(nonce, prefix []byte, index uint64, last bool) {
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[len(prefix):], index)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+// encryptContent writes the header and sealed chunks of r to w.
+func encryptContent(w io.Writer, r io.Reader, key, salt []byte) error {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 0, e2eHeaderSize)
+	header = append(header, e2eMagic...)
+	header = append(header, e2eVersion)
+	header = append(header, salt...)
+	prefix := make([]byte, e2ePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, e2eChunkSize)
+	chunk := make([]byte, e2eChunkSize)
+	sealed := make([]byte, 0, e2eChunkSize+aead.Overhead())
+	nonce := make([]byte, aead.NonceSize())
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(br, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// A full chunk is the last one only if nothing follows it
+		last := n < len(chunk)
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		chunkNonceX(nonce, prefix, index, last)
+		sealed = aead.Seal(sealed[:0], nonce, chunk[:n], header)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptContent writes the plaintext of the encrypted content r to w; key
+// returns the file key for the salt in the header.
+func decryptContent(w io.Writer, r io.Reader, key func(salt []byte) ([]byte, error)) error {
+	header := make([]byte, e2eHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return ErrE2ECorrupt
+	}
+	salt := header[len(e2eMagic)+1 : len(e2eMagic)+1+e2eSaltSize]
+	prefix := header[len(e2eMagic)+1+e2eSaltSize:]
+	fileKey, err := key(salt)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(fileKey)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, e2eChunkSize+aead.Overhead())
+	sealed := make([]byte, e2eChunkSize+aead.Overhead())
+	chunk := make([]byte, 0, e2eChunkSize)
+	nonce := make([]byte, aead.NonceSize())
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(br, sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(sealed)
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		chunkNonceX(nonce, prefix, index, last)
+		if chunk, err = aead.Open(chunk[:0], nonce, sealed[:n], header); err != nil {
+			return ErrE2ECorrupt
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// copyContent copies a downloaded file to w, decrypting it when it is end-to-end
+// encrypted; key returns the file key for the salt in its header.
+func (c *Client) copyContent(w io.Writer, r io.Reader, key func(keys *e2eKeys, salt []byte) ([]byte, error)) error {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(e2eMagic) + 1)
+	if !bytes.Equal(head, append([]byte(e2eMagic), e2eVersion)) {
+		_, err := io.Copy(w, br)
+		return err
+	}
+
+	keys := c.e2e
+	if keys == nil {
+		return ErrE2ELocked
+	}
+	return decryptContent(w, br, func(salt []byte) ([]byte, error) { return key(keys, salt) })
+}
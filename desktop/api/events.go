@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Event struct {
+	ID        uint                   `json:"id"`
+	Type      string                 `json:"type"`
+	UserID    uint                   `json:"user_id"`
+	FileID    *uint                  `json:"file_id"`
+	Data      map[string]interface{} `json:"data"`
+	CreatedAt string                 `json:"created_at"`
+}
+
+const maxReconnectDelay = 30 * time.Second
+
+// Subscribe streams server events to onEvent until the returned cancel function is called.
+// Dropped connections are retried with backoff and resumed from the last received event.
+func (c *Client) Subscribe(onEvent func(Event)) (cancel func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		var lastID uint
+		delay := time.Second
+		for {
+			received, err := c.streamEvents(ctx, lastID, func(e Event) {
+				lastID = e.ID
+				onEvent(e)
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			if received {
+				delay = time.Second
+			}
+			if err != nil {
+				delay *= 2
+				if delay > maxReconnectDelay {
+					delay = maxReconnectDelay
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// streamEvents reads one SSE connection until it ends, reporting whether any event arrived.
+func (c *Client) streamEvents(ctx context.Context, lastID uint, onEvent func(Event)) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/api/v1/events", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if lastID > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(uint64(lastID), 10))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("event stream failed: %d", resp.StatusCode)
+	}
+
+	received := false
+	var data strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line terminates the event
+			if data.Len() > 0 {
+				var e Event
+				if err := json.Unmarshal([]byte(data.String()), &e); err == nil {
+					received = true
+					onEvent(e)
+				}
+				data.Reset()
+			}
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return received, scanner.Err()
+}
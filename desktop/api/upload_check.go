@@ -0,0 +1,59 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+type uploadCheck struct {
+	Exists    bool       `json:"exists"`
+	Challenge string     `json:"challenge"`
+	Nonce     string     `json:"nonce"`
+	Ranges    [][2]int64 `json:"ranges"`
+}
+
+// uploadExisting asks the server to create name from content it already has,
+// answering its proof of possession challenge, and reports whether it did so.
+func (c *Client) uploadExisting(file *os.File, name string, expiry Expiry) (bool, error) {
+	hash := sha256.New()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return false, err
+	}
+
+	req := map[string]interface{}{"hash": hex.EncodeToString(hash.Sum(nil)), "size": size, "name": name}
+	for field, value := range expiry.fields() {
+		req[field] = value
+	}
+	var check uploadCheck
+	if err := c.sendRequest("POST", "/api/v1/upload/check", req, &check); err != nil {
+		return false, err
+	}
+	if check.Exists || check.Challenge == "" {
+		return check.Exists, nil
+	}
+
+	nonce, err := hex.DecodeString(check.Nonce)
+	if err != nil {
+		return false, err
+	}
+	proof := sha256.New()
+	proof.Write(nonce)
+	for _, r := range check.Ranges {
+		if _, err := io.Copy(proof, io.NewSectionReader(file, r[0], r[1])); err != nil {
+			return false, err
+		}
+	}
+	req["challenge"] = check.Challenge
+	req["proof"] = hex.EncodeToString(proof.Sum(nil))
+	check = uploadCheck{}
+	if err := c.sendRequest("POST", "/api/v1/upload/check", req, &check); err != nil {
+		return false, err
+	}
+	return check.Exists, nil
+}
@@ -50,15 +50,15 @@ func (a *CloudApp) showMainView() {
 			if reader == nil {
 				return
 			}
-			defer reader.Close()
+			reader.Close()
 
-			err = a.client.UploadFile(reader.URI().Path())
-			if err != nil {
-				dialog.ShowError(err, a.window)
-				return
-			}
-
-			dialog.ShowInformation("Success", "File uploaded successfully", a.window)
+			ui.AskExpiry(a.window, func(expiry api.Expiry) {
+				if err := a.client.UploadFile(reader.URI().Path(), expiry); err != nil {
+					dialog.ShowError(err, a.window)
+					return
+				}
+				dialog.ShowInformation("Success", "File uploaded successfully", a.window)
+			})
 		}, a.window)
 		fd.Show()
 	})
@@ -81,11 +81,16 @@ func (a *CloudApp) showMainView() {
 		)
 	})
 
+	e2eBtn := widget.NewButton("End-to-End Encryption", func() {
+		ui.ShowE2EDialog(a.client, a.window, a.showMainView)
+	})
+
 	mainContainer := container.NewVBox(
 		widget.NewLabel("Cloud Storage"),
 		uploadBtn,
 		showFilesBtn,
 		showSyncBtn,
+		e2eBtn,
 	)
 
 	a.window.SetContent(mainContainer)
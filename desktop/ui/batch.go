@@ -0,0 +1,174 @@
+package ui
+
+import (
+	"cloud-storage/desktop/api"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const rootFolder = "/ (root)"
+
+// newSelectionMenu builds the button offering batch actions on the checked files.
+// folders lists the possible move and copy targets; done runs after each batch.
+func newSelectionMenu(client *api.Client, window fyne.Window, selection func() []uint, folders func() []api.FileInfo, done func()) *widget.Button {
+	apply := func(op func(id uint) api.BatchOperation) {
+		ids := selection()
+		ops := make([]api.BatchOperation, len(ids))
+		for i, id := range ids {
+			ops[i] = op(id)
+		}
+		go runBatch(client, window, ops, done)
+	}
+
+	// chooseFolder asks for a target folder; the root has a nil ID
+	chooseFolder := func(title string, then func(parentID *uint)) {
+		byName := map[string]*uint{rootFolder: nil}
+		options := []string{rootFolder}
+		for _, f := range folders() {
+			id := f.ID
+			label := fmt.Sprintf("%s (#%d)", f.Name, f.ID)
+			byName[label] = &id
+			options = append(options, label)
+		}
+		target := widget.NewSelect(options, nil)
+		target.SetSelected(rootFolder)
+		dialog.ShowForm(title, "OK", "Cancel", []*widget.FormItem{widget.NewFormItem("Folder", target)}, func(ok bool) {
+			if ok {
+				then(byName[target.Selected])
+			}
+		}, window)
+	}
+
+	var button *widget.Button
+	menu := fyne.NewMenu("",
+		fyne.NewMenuItem("Delete…", func() {
+			dialog.ShowConfirm("Delete Files",
+				fmt.Sprintf("Delete %d selected items?", len(selection())),
+				func(ok bool) {
+					if ok {
+						apply(func(id uint) api.BatchOperation { return api.BatchOperation{Op: "delete", FileID: id} })
+					}
+				}, window)
+		}),
+		fyne.NewMenuItem("Move to…", func() {
+			chooseFolder("Move To", func(parentID *uint) {
+				apply(func(id uint) api.BatchOperation {
+					return api.BatchOperation{Op: "move", FileID: id, ParentID: parentID}
+				})
+			})
+		}),
+		fyne.NewMenuItem("Copy to…", func() {
+			chooseFolder("Copy To", func(parentID *uint) {
+				apply(func(id uint) api.BatchOperation {
+					return api.BatchOperation{Op: "copy", FileID: id, ParentID: parentID}
+				})
+			})
+		}),
+		fyne.NewMenuItem("Tag…", func() {
+			tags := widget.NewEntry()
+			tags.SetPlaceHolder("Tags, comma separated")
+			dialog.ShowForm("Tag Files", "Tag", "Cancel", []*widget.FormItem{widget.NewFormItem("Tags", tags)}, func(ok bool) {
+				var names []string
+				for _, name := range strings.Split(tags.Text, ",") {
+					if name = strings.TrimSpace(name); name != "" {
+						names = append(names, name)
+					}
+				}
+				if ok && len(names) > 0 {
+					apply(func(id uint) api.BatchOperation { return api.BatchOperation{Op: "tag", FileID: id, AddTags: names} })
+				}
+			}, window)
+		}),
+		fyne.NewMenuItem("Share…", func() {
+			username := widget.NewEntry()
+			permission := widget.NewSelect([]string{"read", "write"}, nil)
+			permission.SetSelected("read")
+			dialog.ShowForm("Share Files", "Share", "Cancel", []*widget.FormItem{
+				widget.NewFormItem("User", username),
+				widget.NewFormItem("Permission", permission),
+			}, func(ok bool) {
+				if !ok || username.Text == "" {
+					return
+				}
+				go func() {
+					// Encrypted files are useless to the recipient without their keys
+					if err := client.ShareFileKeys(selection(), username.Text); err != nil {
+						dialog.ShowError(err, window)
+						return
+					}
+					apply(func(id uint) api.BatchOperation {
+						return api.BatchOperation{Op: "share", FileID: id, Username: username.Text, Permission: permission.Selected}
+					})
+				}()
+			}, window)
+		}),
+	)
+	button = widget.NewButtonWithIcon("Selected", theme.MenuIcon(), func() {
+		widget.ShowPopUpMenuAtRelativePosition(menu, window.Canvas(), fyne.NewPos(0, button.Size().Height), button)
+	})
+	return button
+}
+
+// runBatch sends ops in one request, following the background job when the
+// server hands one back, and reports any operations that failed.
+func runBatch(client *api.Client, window fyne.Window, ops []api.BatchOperation, done func()) {
+	defer done()
+
+	results, jobID, err := client.Batch(ops)
+	if err != nil {
+		dialog.ShowError(err, window)
+		return
+	}
+
+	if jobID != 0 {
+		bar := widget.NewProgressBar()
+		bar.Max = float64(len(ops))
+		progress := dialog.NewCustom("Working", "Cancel", bar, window)
+		finished := false
+		progress.SetOnClosed(func() {
+			// Closed by the user; keep polling until the job notices
+			if !finished {
+				client.CancelJob(jobID)
+			}
+		})
+		progress.Show()
+		for {
+			job, err := client.Job(jobID)
+			if err != nil {
+				finished = true
+				progress.Hide()
+				dialog.ShowError(err, window)
+				return
+			}
+			bar.SetValue(float64(job.Done))
+			if job.Finished() {
+				finished = true
+				progress.Hide()
+				if job.Status == "failed" {
+					dialog.ShowError(errors.New(job.Error), window)
+					return
+				}
+				results = job.Result
+				break
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+
+	var failures []string
+	for _, r := range results {
+		if r.Status == "failed" {
+			failures = append(failures, fmt.Sprintf("#%d %s: %s", r.FileID, r.Op, r.Error))
+		}
+	}
+	if len(failures) > 0 {
+		dialog.ShowInformation("Some Operations Failed", strings.Join(failures, "\n"), window)
+	}
+}
@@ -0,0 +1,95 @@
+package ui
+
+import (
+	"errors"
+
+	"cloud-storage/desktop/api"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+const minPassphrase = 8
+
+var errPassphraseTooShort = errors.New("the passphrase must have at least 8 characters")
+
+// ShowE2EDialog unlocks end-to-end encryption with the user's passphrase, or
+// locks it or changes the passphrase when it is already unlocked. done runs
+// after the state changed.
+func ShowE2EDialog(client *api.Client, window fyne.Window, done func()) {
+	if client.E2EEnabled() {
+		var unlocked dialog.Dialog
+		lock := widget.NewButton("Lock", func() {
+			unlocked.Hide()
+			client.LockE2E()
+			done()
+		})
+		change := widget.NewButton("Change Passphrase…", func() {
+			unlocked.Hide()
+			showChangePassphrase(client, window)
+		})
+		unlocked = dialog.NewCustom("End-to-End Encryption", "Close", container.NewVBox(
+			widget.NewLabel("Uploads are encrypted before they leave this computer."),
+			container.NewHBox(lock, change),
+		), window)
+		unlocked.Show()
+		return
+	}
+
+	passphrase := widget.NewPasswordEntry()
+	passphrase.SetPlaceHolder("Passphrase")
+	dialog.ShowForm("Unlock End-to-End Encryption", "Unlock", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Passphrase", passphrase),
+	}, func(ok bool) {
+		if !ok {
+			return
+		}
+		if len(passphrase.Text) < minPassphrase {
+			dialog.ShowError(errPassphraseTooShort, window)
+			return
+		}
+
+		progress := dialog.NewProgressInfinite("Unlocking", "Deriving keys from the passphrase", window)
+		progress.Show()
+		go func() {
+			err := client.UnlockE2E(passphrase.Text)
+			progress.Hide()
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			dialog.ShowInformation("Unlocked", "New uploads are encrypted end to end. Without the passphrase they cannot be recovered.", window)
+			done()
+		}()
+	}, window)
+}
+
+func showChangePassphrase(client *api.Client, window fyne.Window) {
+	passphrase := widget.NewPasswordEntry()
+	confirm := widget.NewPasswordEntry()
+	dialog.ShowForm("Change Passphrase", "Change", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("New passphrase", passphrase),
+		widget.NewFormItem("Repeat", confirm),
+	}, func(ok bool) {
+		if !ok {
+			return
+		}
+		if len(passphrase.Text) < minPassphrase {
+			dialog.ShowError(errPassphraseTooShort, window)
+			return
+		}
+		if passphrase.Text != confirm.Text {
+			dialog.ShowError(errors.New("the passphrases do not match"), window)
+			return
+		}
+		go func() {
+			if err := client.ChangeE2EPassphrase(passphrase.Text); err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			dialog.ShowInformation("Passphrase Changed", "Use the new passphrase to unlock from now on.", window)
+		}()
+	}, window)
+}
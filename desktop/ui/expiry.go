@@ -0,0 +1,86 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cloud-storage/desktop/api"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+var expiryOptions = []struct {
+	label string
+	after time.Duration
+}{
+	{"Never", 0},
+	{"1 hour", time.Hour},
+	{"1 day", 24 * time.Hour},
+	{"7 days", 7 * 24 * time.Hour},
+	{"30 days", 30 * 24 * time.Hour},
+}
+
+// AskExpiry lets the user choose whether an upload deletes itself after a
+// while or a number of downloads, then calls upload unless cancelled.
+func AskExpiry(window fyne.Window, upload func(api.Expiry)) {
+	var labels []string
+	for _, o := range expiryOptions {
+		labels = append(labels, o.label)
+	}
+	after := widget.NewSelect(labels, nil)
+	after.SetSelected(labels[0])
+	downloads := widget.NewEntry()
+	downloads.SetPlaceHolder("Unlimited")
+	downloads.Validator = func(s string) error {
+		if n, err := strconv.Atoi(s); s != "" && (err != nil || n < 0) {
+			return errors.New("enter a number of downloads")
+		}
+		return nil
+	}
+
+	dialog.ShowForm("Upload", "Upload", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Delete after", after),
+		widget.NewFormItem("Max downloads", downloads),
+	}, func(ok bool) {
+		if !ok {
+			return
+		}
+		var expiry api.Expiry
+		for _, o := range expiryOptions {
+			if o.label == after.Selected && o.after > 0 {
+				at := time.Now().Add(o.after)
+				expiry.At = &at
+			}
+		}
+		if err := downloads.Validate(); err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		if downloads.Text != "" {
+			expiry.MaxDownloads, _ = strconv.Atoi(downloads.Text)
+		}
+		upload(expiry)
+	}, window)
+}
+
+func formatExpiry(file api.FileInfo) string {
+	var parts []string
+	if file.ExpiresAt != "" {
+		parts = append(parts, "on "+formatTime(file.ExpiresAt))
+	}
+	if file.MaxDownloads > 0 {
+		parts = append(parts, fmt.Sprintf("after %d downloads (%d so far)", file.MaxDownloads, file.Downloads))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	s := "Deleted " + parts[0]
+	if len(parts) > 1 {
+		s += " or " + parts[1]
+	}
+	return s
+}
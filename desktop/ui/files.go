@@ -2,30 +2,81 @@ package ui
 
 import (
 	"cloud-storage/desktop/api"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 )
 
+// stopEvents cancels the event subscription of the file list currently on screen.
+var stopEvents func()
+
+const (
+	pageSize = 100
+	// Fetch the next page once scrolling gets this close to the end
+	pageMargin = 20
+)
+
+// sortOptions maps the sort choices shown to the server's sort keys.
+var sortOptions = []struct{ label, key string }{
+	{"Date added", "created"},
+	{"Name", "name"},
+	{"Size", "size"},
+	{"Modified", "modified"},
+	{"Type", "type"},
+}
+
 func ShowFileList(client *api.Client, window fyne.Window) fyne.CanvasObject {
 	var fileList []api.FileInfo
 	var filteredList []api.FileInfo
 	var refresh func()
 	var list *widget.List
+	var grid *widget.GridWrap
 	var expandedID = -1
 
+	// Pages of the unfiltered list; listSeq discards pages from before a refresh
+	var pageMu sync.Mutex
+	var nextCursor string
+	var loadingPage bool
+	var listSeq int
+	sortKey := "created"
+	var view api.ListOptions // Starred or Tag narrows the list
+	selected := map[uint]bool{}
+	var downloadSelected, selectionMenu *widget.Button
+	updateSelection := func() {
+		for _, b := range []*widget.Button{downloadSelected, selectionMenu} {
+			if len(selected) > 0 {
+				b.Enable()
+			} else {
+				b.Disable()
+			}
+		}
+	}
+	var searchEntry *widget.Entry
+	var loadMore func()
+
+	refreshViews := func() {
+		list.Refresh()
+		grid.Refresh()
+	}
+	thumbs := newThumbnailCache(client, func() { refreshViews() })
+
 	createFileItem := func(file api.FileInfo, isExpanded bool) fyne.CanvasObject {
 		// Basic info row
 		basicInfo := container.NewHBox(
-			widget.NewIcon(theme.DocumentIcon()),
+			widget.NewIcon(thumbs.icon(file, "small")),
 			widget.NewLabelWithStyle(file.Name, fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
 			widget.NewLabel(formatSize(file.Size)),
+			widget.NewLabel(formatLabels(file)),
+			widget.NewCheck("", nil),
 		)
 
 		// Detailed info (shown when expanded)
@@ -34,10 +85,15 @@ func ShowFileList(client *api.Client, window fyne.Window) fyne.CanvasObject {
 				"",
 				container.NewVBox(
 					widget.NewLabel("Last Modified: "+formatTime(file.LastModified)),
+					container.NewVBox(
+						widget.NewLabelWithStyle("Properties", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+						widget.NewLabel(formatProperties(file)),
+					),
 					container.NewHBox(
 						widget.NewButtonWithIcon("Download", theme.DownloadIcon(), nil),
 						widget.NewButtonWithIcon("Delete", theme.DeleteIcon(), nil),
 					),
+					newLabelEditor(),
 				),
 			),
 		)
@@ -57,25 +113,48 @@ func ShowFileList(client *api.Client, window fyne.Window) fyne.CanvasObject {
 			return createFileItem(api.FileInfo{}, false)
 		},
 		func(id widget.ListItemID, item fyne.CanvasObject) {
+			if id >= len(filteredList)-pageMargin {
+				loadMore()
+			}
 			file := filteredList[id]
 			vbox := item.(*fyne.Container)
 			basicInfo := vbox.Objects[0].(*fyne.Container)
 			detailsContainer := vbox.Objects[1].(*fyne.Container)
 
 			// Update basic info
+			icon := basicInfo.Objects[0].(*widget.Icon)
+			icon.SetResource(thumbs.icon(file, "small"))
+
 			nameLabel := basicInfo.Objects[1].(*widget.Label)
 			nameLabel.SetText(file.Name)
 
 			sizeLabel := basicInfo.Objects[2].(*widget.Label)
 			sizeLabel.SetText(formatSize(file.Size))
 
+			basicInfo.Objects[3].(*widget.Label).SetText(formatLabels(file))
+
+			check := basicInfo.Objects[4].(*widget.Check)
+			check.OnChanged = nil
+			check.SetChecked(selected[file.ID])
+			check.OnChanged = func(on bool) {
+				if on {
+					selected[file.ID] = true
+				} else {
+					delete(selected, file.ID)
+				}
+				updateSelection()
+			}
+
 			// Update details container
 			card := detailsContainer.Objects[0].(*widget.Card)
 			cardContent := card.Content.(*fyne.Container)
 			timeLabel := cardContent.Objects[0].(*widget.Label)
 			timeLabel.SetText("Last Modified: " + formatTime(file.LastModified))
 
-			buttons := cardContent.Objects[1].(*fyne.Container)
+			properties := cardContent.Objects[1].(*fyne.Container)
+			properties.Objects[1].(*widget.Label).SetText(formatProperties(file))
+
+			buttons := cardContent.Objects[2].(*fyne.Container)
 			downloadBtn := buttons.Objects[0].(*widget.Button)
 			deleteBtn := buttons.Objects[1].(*widget.Button)
 
@@ -104,12 +183,24 @@ func ShowFileList(client *api.Client, window fyne.Window) fyne.CanvasObject {
 								dialog.ShowError(err, window)
 								return
 							}
+							delete(selected, file.ID)
 							refresh()
 							dialog.ShowInformation("Success", "File deleted successfully", window)
 						}
 					}, window)
 			}
 
+			bindLabelEditor(cardContent.Objects[3].(*fyne.Container), file, func(req api.LabelRequest) {
+				req.FileIDs = []uint{file.ID}
+				go func() {
+					if err := client.LabelFiles(req); err != nil {
+						dialog.ShowError(err, window)
+						return
+					}
+					refresh()
+				}()
+			})
+
 			// Show/hide details based on expanded state
 			if id == expandedID {
 				detailsContainer.Show()
@@ -128,34 +219,184 @@ func ShowFileList(client *api.Client, window fyne.Window) fyne.CanvasObject {
 		list.Refresh()
 	}
 
-	searchEntry := widget.NewEntry()
-	searchEntry.SetPlaceHolder("Search files...")
+	grid = widget.NewGridWrap(
+		func() int {
+			return len(filteredList)
+		},
+		func() fyne.CanvasObject {
+			img := canvas.NewImageFromResource(theme.DocumentIcon())
+			img.FillMode = canvas.ImageFillContain
+			img.SetMinSize(fyne.NewSize(128, 128))
+			label := widget.NewLabel("")
+			label.Alignment = fyne.TextAlignCenter
+			label.Truncation = fyne.TextTruncateEllipsis
+			return container.NewVBox(img, label)
+		},
+		func(id widget.GridWrapItemID, item fyne.CanvasObject) {
+			if id >= len(filteredList)-pageMargin {
+				loadMore()
+			}
+			file := filteredList[id]
+			vbox := item.(*fyne.Container)
+
+			img := vbox.Objects[0].(*canvas.Image)
+			img.Resource = thumbs.icon(file, "medium")
+			img.Refresh()
+
+			vbox.Objects[1].(*widget.Label).SetText(file.Name)
+		},
+	)
+
+	// Selecting an image in the grid opens a larger preview
+	grid.OnSelected = func(id widget.GridWrapItemID) {
+		grid.Unselect(id)
+		file := filteredList[id]
+		if !isImage(file.Name) {
+			return
+		}
+		go func() {
+			data, err := client.Thumbnail(file.ID, "large")
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			preview := canvas.NewImageFromResource(fyne.NewStaticResource(file.Name, data))
+			preview.FillMode = canvas.ImageFillContain
+			preview.SetMinSize(fyne.NewSize(512, 512))
+			dialog.ShowCustom(file.Name, "Close", preview, window)
+		}()
+	}
+
+	searchEntry = widget.NewEntry()
+	searchEntry.SetPlaceHolder("Search, e.g. report type:pdf size:>10MB modified:<2025-01-01 in:/Projects")
+
+	queryError := widget.NewLabel("")
+	queryError.Importance = widget.DangerImportance
+	queryError.Wrapping = fyne.TextWrapWord
+	queryError.Hide()
+
+	// Queries go to the server once typing pauses; only the latest one is shown
+	var searchTimer *time.Timer
+	var searchSeq int
+	var searchMu sync.Mutex
 	searchEntry.OnChanged = func(text string) {
-		if text == "" {
+		searchMu.Lock()
+		defer searchMu.Unlock()
+		searchSeq++
+		seq := searchSeq
+		if searchTimer != nil {
+			searchTimer.Stop()
+		}
+
+		if strings.TrimSpace(text) == "" {
+			queryError.Hide()
+			pageMu.Lock()
 			filteredList = fileList
-		} else {
-			filteredList = nil
-			searchLower := strings.ToLower(text)
-			for _, file := range fileList {
-				if strings.Contains(strings.ToLower(file.Name), searchLower) {
-					filteredList = append(filteredList, file)
-				}
-			}
+			pageMu.Unlock()
+			refreshViews()
+			return
 		}
-		list.Refresh()
+
+		searchTimer = time.AfterFunc(300*time.Millisecond, func() {
+			results, err := client.Search(text)
+
+			searchMu.Lock()
+			defer searchMu.Unlock()
+			if seq != searchSeq {
+				return
+			}
+			var parseErr *api.QueryError
+			if errors.As(err, &parseErr) {
+				queryError.SetText("Query error: " + parseErr.Error())
+				queryError.Show()
+				return
+			}
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			queryError.Hide()
+			filteredList = make([]api.FileInfo, len(results))
+			for i, r := range results {
+				filteredList[i] = r.File
+			}
+			refreshViews()
+		})
 	}
 
-	refresh = func() {
-		files, err := client.ListFiles()
+	// fetchPage loads the page after cursor, or the first page when it is empty
+	fetchPage := func(cursor string) {
+		pageMu.Lock()
+		seq := listSeq
+		opts := api.ListOptions{Sort: sortKey, Limit: pageSize, Cursor: cursor, Tag: view.Tag, Starred: view.Starred}
+		pageMu.Unlock()
+
+		page, err := client.ListFiles(opts)
+
+		pageMu.Lock()
+		if seq != listSeq {
+			pageMu.Unlock()
+			return
+		}
+		loadingPage = false
 		if err != nil {
+			pageMu.Unlock()
 			dialog.ShowError(err, window)
 			return
 		}
-		fileList = files
-		filteredList = files
-		list.Refresh()
+		if cursor == "" {
+			fileList = page.Files
+		} else {
+			fileList = append(fileList, page.Files...)
+		}
+		nextCursor = page.NextCursor
+		searching := searchEntry.Text != ""
+		if !searching {
+			filteredList = fileList
+		}
+		pageMu.Unlock()
+
+		if searching && cursor == "" {
+			searchEntry.OnChanged(searchEntry.Text)
+			return
+		}
+		refreshViews()
 	}
 
+	loadMore = func() {
+		pageMu.Lock()
+		defer pageMu.Unlock()
+		if loadingPage || nextCursor == "" || searchEntry.Text != "" {
+			return
+		}
+		loadingPage = true
+		go fetchPage(nextCursor)
+	}
+
+	refresh = func() {
+		pageMu.Lock()
+		listSeq++
+		loadingPage = true
+		pageMu.Unlock()
+		fetchPage("")
+	}
+
+	sortLabels := make([]string, len(sortOptions))
+	for i, o := range sortOptions {
+		sortLabels[i] = o.label
+	}
+	sortSelect := widget.NewSelect(sortLabels, func(label string) {
+		for _, o := range sortOptions {
+			if o.label == label {
+				pageMu.Lock()
+				sortKey = o.key
+				pageMu.Unlock()
+			}
+		}
+		go refresh()
+	})
+	sortSelect.SetSelected(sortOptions[0].label)
+
 	toolbar := container.NewHBox(
 		widget.NewButtonWithIcon("Upload", theme.UploadIcon(), func() {
 			fd := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
@@ -173,34 +414,205 @@ func ShowFileList(client *api.Client, window fyne.Window) fyne.CanvasObject {
 					path = path[1:]
 				}
 
-				uploadDialog := dialog.NewProgressInfinite("Uploading", "Uploading "+path, window)
-				uploadDialog.Show()
+				AskExpiry(window, func(expiry api.Expiry) {
+					uploadDialog := dialog.NewProgressInfinite("Uploading", "Uploading "+path, window)
+					uploadDialog.Show()
 
-				go func() {
-					err = client.UploadFile(path)
-					uploadDialog.Hide()
-					if err != nil {
-						dialog.ShowError(err, window)
-						return
-					}
-					refresh()
-					dialog.ShowInformation("Success", "File uploaded successfully", window)
-				}()
+					go func() {
+						err := client.UploadFile(path, expiry)
+						uploadDialog.Hide()
+						if err != nil {
+							dialog.ShowError(err, window)
+							return
+						}
+						refresh()
+						dialog.ShowInformation("Success", "File uploaded successfully", window)
+					}()
+				})
 			}, window)
 			fd.Show()
 		}),
 		widget.NewButtonWithIcon("Refresh", theme.ViewRefreshIcon(), refresh),
-		searchEntry,
 	)
 
-	refresh()
+	listView := container.NewScroll(list)
+	content := container.NewStack(listView)
+	var viewButton *widget.Button
+	viewButton = widget.NewButtonWithIcon("Grid", theme.GridIcon(), func() {
+		if content.Objects[0] == listView {
+			content.Objects = []fyne.CanvasObject{grid}
+			viewButton.SetText("List")
+			viewButton.SetIcon(theme.ListIcon())
+		} else {
+			content.Objects = []fyne.CanvasObject{listView}
+			viewButton.SetText("Grid")
+			viewButton.SetIcon(theme.GridIcon())
+		}
+		content.Refresh()
+	})
+	toolbar.Add(viewButton)
+
+	// Checked files and folders download together as one archive
+	downloadSelected = widget.NewButtonWithIcon("Download as ZIP", theme.DownloadIcon(), func() {
+		ids := make([]uint, 0, len(selected))
+		for id := range selected {
+			ids = append(ids, id)
+		}
+		fd := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			if writer == nil {
+				return
+			}
+
+			progress := dialog.NewProgressInfinite("Downloading", "Downloading "+writer.URI().Name(), window)
+			progress.Show()
+			go func() {
+				err := client.DownloadArchive(ids, "zip", writer)
+				if closeErr := writer.Close(); err == nil {
+					err = closeErr
+				}
+				progress.Hide()
+				if err != nil {
+					dialog.ShowError(err, window)
+					return
+				}
+				dialog.ShowInformation("Success", "Archive downloaded successfully", window)
+			}()
+		}, window)
+		fd.SetFileName("download.zip")
+		fd.Show()
+	})
+	toolbar.Add(downloadSelected)
+
+	selectionMenu = newSelectionMenu(client, window,
+		func() []uint {
+			ids := make([]uint, 0, len(selected))
+			for id := range selected {
+				ids = append(ids, id)
+			}
+			return ids
+		},
+		func() []api.FileInfo {
+			pageMu.Lock()
+			defer pageMu.Unlock()
+			var folders []api.FileInfo
+			for _, f := range fileList {
+				if f.IsDir {
+					folders = append(folders, f)
+				}
+			}
+			return folders
+		},
+		func() {
+			selected = map[uint]bool{}
+			updateSelection()
+			refresh()
+		})
+	toolbar.Add(selectionMenu)
+	updateSelection()
+	toolbar.Add(sortSelect)
+
+	// The view picker switches between all files, starred files and one tag
+	const allFiles, starredFiles, tagPrefix = "All files", "Starred", "Tag: "
+	viewSelect := widget.NewSelect([]string{allFiles, starredFiles}, func(choice string) {
+		pageMu.Lock()
+		switch {
+		case choice == starredFiles:
+			view = api.ListOptions{Starred: true}
+		case strings.HasPrefix(choice, tagPrefix):
+			view = api.ListOptions{Tag: strings.TrimPrefix(choice, tagPrefix)}
+		default:
+			view = api.ListOptions{}
+		}
+		pageMu.Unlock()
+		go refresh()
+	})
+	viewSelect.SetSelected(allFiles)
+	loadTags := func() {
+		tags, err := client.ListTags()
+		if err != nil {
+			return
+		}
+		options := []string{allFiles, starredFiles}
+		for _, t := range tags {
+			if t.FileCount > 0 {
+				options = append(options, tagPrefix+t.Name)
+			}
+		}
+		viewSelect.SetOptions(options)
+	}
+	loadTags()
+	toolbar.Add(viewSelect)
+
+	// Saved searches fill the query bar, which then runs them
+	savedSelect := widget.NewSelect(nil, nil)
+	savedSelect.PlaceHolder = "Saved searches"
+	savedQueries := map[string]string{}
+	loadSaved := func() {
+		saved, err := client.ListSavedSearches()
+		if err != nil {
+			return
+		}
+		names := make([]string, len(saved))
+		for i, s := range saved {
+			names[i] = s.Name
+			savedQueries[s.Name] = s.Query
+		}
+		savedSelect.SetOptions(names)
+	}
+	savedSelect.OnChanged = func(name string) {
+		if query, ok := savedQueries[name]; ok {
+			searchEntry.SetText(query)
+		}
+	}
+
+	saveButton := widget.NewButtonWithIcon("Save", theme.DocumentSaveIcon(), func() {
+		if strings.TrimSpace(searchEntry.Text) == "" {
+			return
+		}
+		nameEntry := widget.NewEntry()
+		dialog.ShowForm("Save Search", "Save", "Cancel",
+			[]*widget.FormItem{widget.NewFormItem("Name", nameEntry)},
+			func(ok bool) {
+				if !ok || nameEntry.Text == "" {
+					return
+				}
+				if err := client.SaveSearch(nameEntry.Text, searchEntry.Text); err != nil {
+					dialog.ShowError(err, window)
+					return
+				}
+				loadSaved()
+			}, window)
+	})
+
+	queryBar := container.NewVBox(
+		container.NewBorder(nil, nil, nil, container.NewHBox(savedSelect, saveButton), searchEntry),
+		queryError,
+	)
+	loadSaved()
+
+	// Keep the list current when files change elsewhere
+	if stopEvents != nil {
+		stopEvents()
+	}
+	stopEvents = client.Subscribe(func(e api.Event) {
+		if strings.HasPrefix(e.Type, "file.") {
+			refresh()
+		}
+		if e.Type == "file.updated" {
+			loadTags()
+		}
+	})
 
 	return container.NewBorder(
-		toolbar,
+		container.NewVBox(toolbar, queryBar),
 		nil,
 		nil,
 		nil,
-		container.NewScroll(list),
+		content,
 	)
 }
 
@@ -217,6 +629,53 @@ func formatSize(size int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
 }
 
+// propertyLabels names the metadata keys the server extracts, in display order.
+var propertyLabels = []struct{ key, label string }{
+	{"width", "Width"},
+	{"height", "Height"},
+	{"duration_seconds", "Duration (s)"},
+	{"page_count", "Pages"},
+	{"pdf_version", "PDF Version"},
+	{"camera_make", "Camera Make"},
+	{"camera_model", "Camera Model"},
+	{"captured_at", "Captured"},
+	{"created_at", "Created"},
+	{"exposure_time", "Exposure (s)"},
+	{"f_number", "F-Number"},
+	{"iso", "ISO"},
+	{"focal_length", "Focal Length (mm)"},
+	{"gps_latitude", "Latitude"},
+	{"gps_longitude", "Longitude"},
+	{"gps_altitude", "Altitude (m)"},
+}
+
+func formatProperties(file api.FileInfo) string {
+	lines := []string{"Type: " + file.MimeType}
+	if file.MimeType == "" {
+		lines[0] = "Type: unknown"
+	}
+	switch file.ScanStatus {
+	case "":
+	case "pending":
+		lines = append(lines, "Malware scan: pending, download available once scanned")
+	case "infected":
+		lines = append(lines, "Malware scan: infected with "+file.ScanResult+", quarantined")
+	case "error":
+		lines = append(lines, "Malware scan: failed ("+file.ScanResult+")")
+	default:
+		lines = append(lines, "Malware scan: "+file.ScanStatus)
+	}
+	if expiry := formatExpiry(file); expiry != "" {
+		lines = append(lines, expiry)
+	}
+	for _, p := range propertyLabels {
+		if v, ok := file.Metadata[p.key]; ok {
+			lines = append(lines, fmt.Sprintf("%s: %v", p.label, v))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 func formatTime(timestamp string) string {
 	if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
 		return t.Format("2006-01-02 15:04:05")
@@ -0,0 +1,116 @@
+package ui
+
+import (
+	"cloud-storage/desktop/api"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const noColor = "No color"
+
+// labelColors are the color labels the server accepts.
+var labelColors = []string{"red", "orange", "yellow", "green", "blue", "purple", "gray"}
+
+// newLabelEditor builds the star, color and tag controls of the details card.
+// Its Objects are [tagsEntry, HBox(star, color), saveButton].
+func newLabelEditor() *fyne.Container {
+	tagsEntry := widget.NewEntry()
+	tagsEntry.SetPlaceHolder("Tags, comma separated")
+	colorSelect := widget.NewSelect(append([]string{noColor}, labelColors...), nil)
+	return container.NewBorder(nil, nil,
+		container.NewHBox(widget.NewButton("", nil), colorSelect),
+		widget.NewButtonWithIcon("Save Tags", theme.DocumentSaveIcon(), nil),
+		tagsEntry,
+	)
+}
+
+// bindLabelEditor shows file's labels in an editor from newLabelEditor and sends
+// changes to apply.
+func bindLabelEditor(editor *fyne.Container, file api.FileInfo, apply func(api.LabelRequest)) {
+	tagsEntry := editor.Objects[0].(*widget.Entry)
+	controls := editor.Objects[1].(*fyne.Container)
+	starButton := controls.Objects[0].(*widget.Button)
+	colorSelect := controls.Objects[1].(*widget.Select)
+	saveButton := editor.Objects[2].(*widget.Button)
+
+	if file.Starred {
+		starButton.SetText("★ Starred")
+	} else {
+		starButton.SetText("☆ Star")
+	}
+	starButton.OnTapped = func() {
+		starred := !file.Starred
+		apply(api.LabelRequest{Starred: &starred})
+	}
+
+	colorSelect.OnChanged = nil
+	if file.Color == "" {
+		colorSelect.SetSelected(noColor)
+	} else {
+		colorSelect.SetSelected(file.Color)
+	}
+	colorSelect.OnChanged = func(choice string) {
+		color := choice
+		if choice == noColor {
+			color = ""
+		}
+		if color != file.Color {
+			apply(api.LabelRequest{Color: &color})
+		}
+	}
+
+	current := tagNames(file)
+	tagsEntry.SetText(strings.Join(current, ", "))
+	saveButton.OnTapped = func() {
+		wanted := map[string]bool{}
+		var req api.LabelRequest
+		for _, name := range strings.Split(tagsEntry.Text, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				wanted[name] = true
+				req.AddTags = append(req.AddTags, name)
+			}
+		}
+		for _, name := range current {
+			if !wanted[name] {
+				req.RemoveTags = append(req.RemoveTags, name)
+			}
+		}
+		apply(req)
+	}
+}
+
+func tagNames(file api.FileInfo) []string {
+	names := make([]string, len(file.Tags))
+	for i, t := range file.Tags {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// formatLabels summarises a file's star, color and tags for its list row.
+func formatLabels(file api.FileInfo) string {
+	var parts []string
+	if file.Corrupt {
+		parts = append(parts, "⚠ damaged")
+	}
+	if file.ScanStatus == "infected" {
+		parts = append(parts, "☣ infected")
+	}
+	if file.Encrypted {
+		parts = append(parts, "🔒")
+	}
+	if file.Starred {
+		parts = append(parts, "★")
+	}
+	if file.Color != "" {
+		parts = append(parts, "●"+file.Color)
+	}
+	for _, name := range tagNames(file) {
+		parts = append(parts, "#"+name)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,68 @@
+package ui
+
+import (
+	"cloud-storage/desktop/api"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/theme"
+)
+
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".bmp": true, ".tif": true, ".tiff": true, ".webp": true,
+}
+
+func isImage(name string) bool {
+	return imageExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// thumbnailCache fetches thumbnails in the background and keeps them by content
+// hash, calling onLoad whenever a new one arrives.
+type thumbnailCache struct {
+	client    *api.Client
+	onLoad    func()
+	mu        sync.Mutex
+	resources map[string]fyne.Resource
+}
+
+func newThumbnailCache(client *api.Client, onLoad func()) *thumbnailCache {
+	return &thumbnailCache{
+		client:    client,
+		onLoad:    onLoad,
+		resources: make(map[string]fyne.Resource),
+	}
+}
+
+// icon returns the thumbnail for file if it is loaded, or a generic icon meanwhile.
+func (t *thumbnailCache) icon(file api.FileInfo, size string) fyne.Resource {
+	if !isImage(file.Name) || file.Hash == "" {
+		return theme.DocumentIcon()
+	}
+
+	key := file.Hash + "-" + size
+	t.mu.Lock()
+	res, ok := t.resources[key]
+	if !ok {
+		// Placeholder until the fetch completes, so each thumbnail is requested once
+		t.resources[key] = theme.DocumentIcon()
+	}
+	t.mu.Unlock()
+	if ok {
+		return res
+	}
+
+	go func() {
+		data, err := t.client.Thumbnail(file.ID, size)
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		t.resources[key] = fyne.NewStaticResource(key+".jpg", data)
+		t.mu.Unlock()
+		t.onLoad()
+	}()
+	return theme.DocumentIcon()
+}
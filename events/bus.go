@@ -0,0 +1,227 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"cloud-storage/models"
+
+	"gorm.io/gorm"
+)
+
+// Event types emitted by the server.
+const (
+	FileUploaded   = "file.uploaded"
+	FileDeleted    = "file.deleted"
+	FileMoved      = "file.moved"
+	FileUpdated    = "file.updated"
+	FileShared     = "file.shared"
+	FileInfected   = "file.infected"
+	FileDropped    = "file.dropped"
+	FolderCreated  = "folder.created"
+	UserRegistered = "user.registered"
+)
+
+type Event struct {
+	ID        uint                   `json:"id"`
+	Type      string                 `json:"type"`
+	UserID    uint                   `json:"user_id"`
+	FileID    *uint                  `json:"file_id,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+type Handler func(Event)
+
+// Bus fans out published events to every subscribed handler. Each handler runs
+// on a goroutine of its own, receiving events in the order they were published,
+// so handlers never hold up the request that published an event.
+type Bus struct {
+	DB *gorm.DB
+
+	mu          sync.RWMutex
+	nextID      int
+	subscribers map[int]*subscriber
+
+	// Set on buses returned by Hold
+	target *Bus
+	held   []Event
+}
+
+// subscriber queues events for one handler without bound, so a slow handler
+// neither blocks publishers nor loses events.
+type subscriber struct {
+	handler Handler
+	mu      sync.Mutex
+	queue   []Event
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func (s *subscriber) push(e Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, e := range queue {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			s.handler(e)
+		}
+	}
+}
+
+// NewBus creates a bus. When db is not nil every event is persisted before
+// delivery, giving it a monotonically increasing ID that streams can resume from.
+func NewBus(db *gorm.DB) *Bus {
+	return &Bus{
+		DB:          db,
+		subscribers: make(map[int]*subscriber),
+	}
+}
+
+// Subscribe registers a handler and returns a function that removes it.
+func (b *Bus) Subscribe(h Handler) func() {
+	s := &subscriber{handler: h, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go s.run()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = s
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, id)
+			b.mu.Unlock()
+			close(s.done)
+		})
+	}
+}
+
+func (b *Bus) Publish(e Event) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	if b.target != nil {
+		b.mu.Lock()
+		b.held = append(b.held, e)
+		b.mu.Unlock()
+		return
+	}
+
+	if b.DB != nil {
+		if err := b.persist(&e); err != nil {
+			log.Println("events: failed to persist event:", err)
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subscribers {
+		s.push(e)
+	}
+}
+
+func (b *Bus) persist(e *Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+
+	record := models.Event{
+		Type:      e.Type,
+		UserID:    e.UserID,
+		FileID:    e.FileID,
+		Data:      string(data),
+		CreatedAt: e.CreatedAt,
+	}
+	if err := b.DB.Create(&record).Error; err != nil {
+		return err
+	}
+
+	e.ID = record.ID
+	return nil
+}
+
+// Hold returns a bus that keeps the events published on it until release is
+// called, which publishes them on b when publish is set and drops them otherwise.
+// Work done in a database transaction publishes through it, so nothing is
+// announced that a rollback undoes.
+func (b *Bus) Hold() (held *Bus, release func(publish bool)) {
+	held = &Bus{target: b}
+	return held, func(publish bool) {
+		held.mu.Lock()
+		events := held.held
+		held.held = nil
+		held.mu.Unlock()
+		if publish {
+			for _, e := range events {
+				b.Publish(e)
+			}
+		}
+	}
+}
+
+// Since returns the persisted events of the given users with an ID greater than
+// lastID, oldest first, along with deletes of shared files, which the users they
+// were shared with may no longer be able to trace back to the owner.
+func (b *Bus) Since(userIDs []uint, lastID uint) ([]Event, error) {
+	var records []models.Event
+	err := b.DB.Where("id > ? AND (user_id IN ? OR (type = ? AND data LIKE ?))", lastID, userIDs, FileDeleted, `%"shared_with"%`).
+		Order("id").Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Event, 0, len(records))
+	for _, r := range records {
+		e := Event{
+			ID:        r.ID,
+			Type:      r.Type,
+			UserID:    r.UserID,
+			FileID:    r.FileID,
+			CreatedAt: r.CreatedAt,
+		}
+		json.Unmarshal([]byte(r.Data), &e.Data)
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// Retention is how long persisted events are kept for streams to resume from.
+const Retention = 30 * 24 * time.Hour
+
+// Prune deletes persisted events older than Retention. It runs as a job.
+func (b *Bus) Prune(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	res := b.DB.Where("created_at < ?", time.Now().Add(-Retention)).Delete(&models.Event{})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return map[string]int64{"deleted": res.RowsAffected}, nil
+}
@@ -0,0 +1,109 @@
+package events
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud-storage/models"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// collect subscribes to b and returns a function waiting for n events.
+func collect(t *testing.T, b *Bus) func(n int) []Event {
+	t.Helper()
+	ch := make(chan Event, 100)
+	t.Cleanup(b.Subscribe(func(e Event) { ch <- e }))
+	return func(n int) []Event {
+		t.Helper()
+		var got []Event
+		for len(got) < n {
+			select {
+			case e := <-ch:
+				got = append(got, e)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got %d events, want %d", len(got), n)
+			}
+		}
+		select {
+		case e := <-ch:
+			t.Errorf("unexpected event %+v", e)
+		case <-time.After(20 * time.Millisecond):
+		}
+		return got
+	}
+}
+
+func TestBusOrderAndSlowHandlers(t *testing.T) {
+	b := NewBus(nil)
+	// A handler that never returns holds up neither publishers nor other handlers
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	b.Subscribe(func(Event) { <-block })
+	wait := collect(t, b)
+
+	for i := 0; i < 50; i++ {
+		b.Publish(Event{Type: FileUploaded, Data: map[string]interface{}{"n": i}})
+	}
+	for i, e := range wait(50) {
+		if e.Data["n"] != i {
+			t.Fatalf("event %d has n = %v, want them in publishing order", i, e.Data["n"])
+		}
+	}
+}
+
+func TestBusHold(t *testing.T) {
+	b := NewBus(nil)
+	wait := collect(t, b)
+
+	held, release := b.Hold()
+	held.Publish(Event{Type: FileMoved})
+	wait(0)
+	release(false)
+	wait(0)
+
+	held, release = b.Hold()
+	held.Publish(Event{Type: FileMoved})
+	held.Publish(Event{Type: FileUpdated})
+	release(true)
+	if got := wait(2); got[0].Type != FileMoved || got[1].Type != FileUpdated {
+		t.Errorf("released %s, %s, want them in order", got[0].Type, got[1].Type)
+	}
+}
+
+func TestBusSince(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Event{}); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBus(db)
+	wait := collect(t, b)
+
+	b.Publish(Event{Type: FileUploaded, UserID: 1})
+	b.Publish(Event{Type: FileUploaded, UserID: 2})
+	b.Publish(Event{Type: FileDeleted, UserID: 2, Data: map[string]interface{}{"shared_with": []uint{1}}})
+	b.Publish(Event{Type: FileMoved, UserID: 1, Data: map[string]interface{}{"name": "a.txt"}})
+	live := wait(4)
+	if live[0].ID == 0 || live[3].ID <= live[0].ID {
+		t.Fatalf("persisted IDs %d and %d, want increasing IDs", live[0].ID, live[3].ID)
+	}
+
+	// User 1 resuming after its first event misses neither its own later
+	// events nor the delete of a file shared with it
+	got, err := b.Since([]uint{1}, live[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != live[2].ID || got[1].ID != live[3].ID {
+		t.Fatalf("Since = %+v, want events %d and %d", got, live[2].ID, live[3].ID)
+	}
+	if got[1].Data["name"] != "a.txt" {
+		t.Errorf("replayed data = %v", got[1].Data)
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const accessKeyAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+// CreateAccessKey issues an S3 access key pair for the S3 gateway.
+func (a *App) CreateAccessKey(c *gin.Context) {
+	idBytes := make([]byte, 18)
+	secretBytes := make([]byte, 30)
+	if _, err := rand.Read(idBytes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access key"})
+		return
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access key"})
+		return
+	}
+
+	var id strings.Builder
+	id.WriteString("CS")
+	for _, b := range idBytes {
+		id.WriteByte(accessKeyAlphabet[int(b)%len(accessKeyAlphabet)])
+	}
+
+	key := models.AccessKey{
+		UserID:      c.MustGet("userID").(uint),
+		AccessKeyID: id.String(),
+		SecretKey:   base64.StdEncoding.EncodeToString(secretBytes),
+	}
+	if err := a.DB.Create(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create access key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"access_key":        key,
+		"access_key_id":     key.AccessKeyID,
+		"secret_access_key": key.SecretKey,
+	})
+}
+
+func (a *App) ListAccessKeys(c *gin.Context) {
+	var keys []models.AccessKey
+	if err := a.DB.Where("user_id = ?", c.MustGet("userID").(uint)).Order("created_at desc").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch access keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"access_keys": keys})
+}
+
+func (a *App) DeleteAccessKey(c *gin.Context) {
+	var key models.AccessKey
+	if err := a.DB.Where("id = ? AND user_id = ?", c.Param("id"), c.MustGet("userID").(uint)).First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Access key not found"})
+		return
+	}
+
+	if err := a.DB.Unscoped().Delete(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete access key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Access key deleted successfully"})
+}
@@ -2,11 +2,30 @@
 package handlers
 
 import (
+	"cloud-storage/blobcrypt"
+	"cloud-storage/events"
+	"cloud-storage/jobs"
+	"cloud-storage/search"
+	"cloud-storage/thumbnails"
+
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type App struct {
-	DB     *gorm.DB
-	Router *gin.Engine
+	DB         *gorm.DB
+	Router     *gin.Engine
+	Events     *events.Bus
+	Thumbnails *thumbnails.Service
+	Search     *search.Index
+	Jobs       *jobs.Queue
+	// Keys encrypts new blobs at rest; nil stores them in plaintext
+	Keys *blobcrypt.Keyring
+	// Compress stores new blobs that compress well compressed
+	Compress bool
+	// ScanUploads saves new content pending its malware scan, so it is held
+	// back before the scanner has even heard of it
+	ScanUploads bool
+	// ScanFailOpen serves files whose scan failed instead of holding them back
+	ScanFailOpen bool
 }
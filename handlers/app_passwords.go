@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AppPasswordRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+func (a *App) CreateAppPassword(c *gin.Context) {
+	var req AppPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate password"})
+		return
+	}
+	token := hex.EncodeToString(buf)
+
+	appPassword := models.AppPassword{
+		UserID:    c.MustGet("userID").(uint),
+		Name:      req.Name,
+		TokenHash: models.HashToken(token),
+	}
+	if err := a.DB.Create(&appPassword).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create app password"})
+		return
+	}
+
+	// Only the hash is stored, so this is the one chance to see the password
+	c.JSON(http.StatusCreated, gin.H{
+		"app_password": appPassword,
+		"password":     token,
+	})
+}
+
+func (a *App) ListAppPasswords(c *gin.Context) {
+	var passwords []models.AppPassword
+	if err := a.DB.Where("user_id = ?", c.MustGet("userID").(uint)).Order("created_at desc").Find(&passwords).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch app passwords"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"app_passwords": passwords})
+}
+
+func (a *App) DeleteAppPassword(c *gin.Context) {
+	var appPassword models.AppPassword
+	if err := a.DB.Where("id = ? AND user_id = ?", c.Param("id"), c.MustGet("userID").(uint)).First(&appPassword).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "App password not found"})
+		return
+	}
+
+	if err := a.DB.Unscoped().Delete(&appPassword).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete app password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "App password deleted successfully"})
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud-storage/events"
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+	"cloud-storage/thumbnails"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestApp returns an App on a fresh database, with the working directory
+// moved to an empty one for its storage, and a user to act as.
+func newTestApp(t *testing.T) (*App, *models.User) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&models.User{}, &models.File{}, &models.Webhook{}, &models.WebhookDelivery{}, &models.Event{},
+		&models.AppPassword{}, &models.DavProperty{}, &models.AccessKey{}, &models.MultipartUpload{}, &models.SSHKey{},
+		&models.SavedSearch{}, &models.Tag{}, &models.Share{}, &models.Job{}, &models.JobSchedule{},
+		&models.UserKey{}, &models.FileKey{}, &models.Chunk{}, &models.RetentionRule{},
+		&models.FileRequest{}, &models.FileRequestUpload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &App{
+		DB:         db,
+		Router:     gin.New(),
+		Events:     events.NewBus(db),
+		Thumbnails: thumbnails.NewService(db, "storage/thumbnails"),
+		Jobs:       jobs.NewQueue(db),
+	}
+
+	user := &models.User{Username: "bob", Password: "-"}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return a, user
+}
+
+// as authenticates every request to the router as user.
+func as(user *models.User) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("userID", user.ID)
+		c.Next()
+	}
+}
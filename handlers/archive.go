@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ArchiveRequest struct {
+	FileIDs []uint `json:"file_ids" binding:"required"`
+	Format  string `json:"format"` // zip (default) or tar.gz
+	Name    string `json:"name"`
+}
+
+// archiveEntry is a file or folder placed at Name inside the archive.
+type archiveEntry struct {
+	Name string
+	File models.File
+}
+
+// archiveWriter adds entries to a ZIP or tar.gz stream.
+type archiveWriter interface {
+	Add(e archiveEntry) error
+	Close() error
+}
+
+// CreateArchive streams the selected files and folders, with everything below
+// the folders, as one archive. Nothing is staged on disk.
+func (a *App) CreateArchive(c *gin.Context) {
+	var req ArchiveRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.FileIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+
+	ext := ".zip"
+	switch req.Format {
+	case "", "zip":
+	case "tar.gz", "tgz":
+		ext = ".tar.gz"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format, use zip or tar.gz"})
+		return
+	}
+
+	var selected []models.File
+	if err := a.DB.Where("id IN ? AND user_id = ?", req.FileIDs, userID).Order("is_dir desc, name").Find(&selected).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		return
+	}
+	if len(selected) != len(uniqueIDs(req.FileIDs)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	// Resolve the whole tree first so lookup errors still get a proper response
+	names := archiveNames{}
+	var entries []archiveEntry
+	for _, file := range selected {
+		inside, err := a.insideSelection(&file, req.FileIDs)
+		if err == nil && !inside {
+			entries, err = a.collectArchive(entries, names, "", file)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+			return
+		}
+	}
+
+	// Held back content would otherwise cut the archive short once it has started
+	for _, e := range entries {
+		if !e.File.IsDir && heldBack(c, &e.File, a.readable(&e.File)) {
+			return
+		}
+	}
+
+	name := req.Name
+	if name == "" {
+		name = "download"
+		if len(selected) == 1 {
+			name = strings.TrimSuffix(selected[0].Name, path.Ext(selected[0].Name))
+		}
+	}
+	name = strings.TrimSuffix(name, ext) + ext
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	var w archiveWriter
+	if ext == ".zip" {
+		c.Header("Content-Type", "application/zip")
+		w = &zipArchive{zw: zip.NewWriter(c.Writer), copy: a.copyBlob}
+	} else {
+		c.Header("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(c.Writer)
+		w = &tarArchive{gz: gz, tar: tar.NewWriter(gz), copy: a.copyBlob}
+	}
+	c.Status(http.StatusOK)
+
+	for _, e := range entries {
+		if err := w.Add(e); err != nil {
+			// The response has started; a truncated archive tells the client it failed
+			log.Printf("archive: file %d: %v", e.File.ID, err)
+			return
+		}
+	}
+	if err := w.Close(); err != nil {
+		log.Println("archive:", err)
+	}
+}
+
+// collectArchive appends file, and everything below it when it is a folder, under dir.
+func (a *App) collectArchive(entries []archiveEntry, names archiveNames, dir string, file models.File) ([]archiveEntry, error) {
+	name := names.unique(dir, file.Name)
+	entries = append(entries, archiveEntry{Name: name, File: file})
+	if !file.IsDir {
+		return entries, nil
+	}
+
+	children, err := a.listChildren(file.UserID, &file.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if entries, err = a.collectArchive(entries, names, name, child); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// insideSelection reports whether one of file's parent folders is among ids, in
+// which case the file is already archived with that folder.
+func (a *App) insideSelection(file *models.File, ids []uint) (bool, error) {
+	selected := uniqueIDs(ids)
+	for id := file.ParentID; id != nil; {
+		if selected[*id] {
+			return true, nil
+		}
+		var parent models.File
+		if err := a.DB.Select("id", "parent_id").First(&parent, *id).Error; err != nil {
+			return false, err
+		}
+		id = parent.ParentID
+	}
+	return false, nil
+}
+
+// archiveNames hands out archive paths, numbering names that are already taken
+// in a folder as "name (1).ext".
+type archiveNames map[string]bool
+
+func (n archiveNames) unique(dir, name string) string {
+	name = strings.ReplaceAll(name, "/", "_")
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := path.Join(dir, name)
+	for i := 1; n[strings.ToLower(candidate)]; i++ {
+		candidate = path.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+	n[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// compressed reports whether a MIME type is already compressed, so deflating it
+// again would only cost time.
+func compressed(mimeType string) bool {
+	if mimeType == "image/bmp" || mimeType == "image/svg+xml" {
+		return false
+	}
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip", "application/gzip",
+		"application/x-7z-compressed", "application/x-rar-compressed", "application/x-xz", "application/x-bzip2"} {
+		if strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func modTime(file *models.File) time.Time {
+	if file.LastModified.IsZero() {
+		return file.UpdatedAt
+	}
+	return file.LastModified
+}
+
+// zipArchive writes ZIP entries; archive/zip switches to ZIP64 records by
+// itself once sizes or offsets pass 4 GiB.
+type zipArchive struct {
+	zw   *zip.Writer
+	copy func(io.Writer, *models.File) error
+}
+
+func (z *zipArchive) Add(e archiveEntry) error {
+	header := &zip.FileHeader{Name: e.Name, Modified: modTime(&e.File)}
+	if e.File.IsDir {
+		header.Name += "/"
+		header.SetMode(os.ModeDir | 0755)
+		_, err := z.zw.CreateHeader(header)
+		return err
+	}
+
+	header.SetMode(0644)
+	header.Method = zip.Deflate
+	if compressed(e.File.MimeType) {
+		header.Method = zip.Store
+	}
+	w, err := z.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return z.copy(w, &e.File)
+}
+
+func (z *zipArchive) Close() error {
+	return z.zw.Close()
+}
+
+type tarArchive struct {
+	gz   *gzip.Writer
+	tar  *tar.Writer
+	copy func(io.Writer, *models.File) error
+}
+
+func (t *tarArchive) Add(e archiveEntry) error {
+	header := &tar.Header{Name: e.Name, ModTime: modTime(&e.File), Format: tar.FormatPAX}
+	if e.File.IsDir {
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+		header.Mode = 0755
+		return t.tar.WriteHeader(header)
+	}
+
+	header.Typeflag = tar.TypeReg
+	header.Mode = 0644
+	header.Size = e.File.Size
+	if err := t.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	return t.copy(t.tar, &e.File)
+}
+
+func (t *tarArchive) Close() error {
+	if err := t.tar.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud-storage/models"
+)
+
+// readArchive returns the entries of a ZIP or tar.gz, folders mapped to "/".
+func readArchive(t *testing.T, format string, data []byte) map[string]string {
+	t.Helper()
+	entries := map[string]string{}
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := io.ReadAll(rc)
+			rc.Close()
+			entries[f.Name] = string(content)
+			if f.FileInfo().IsDir() {
+				entries[f.Name] = "/"
+			}
+		}
+		return entries
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		entries[h.Name] = string(content)
+		if h.Typeflag == tar.TypeDir {
+			entries[h.Name] = "/"
+		}
+	}
+}
+
+func TestCreateArchive(t *testing.T) {
+	a, user := newTestApp(t)
+	a.Router.POST("/archive", as(user), a.CreateArchive)
+
+	mkdir := func(parentID *uint, name string) *models.File {
+		t.Helper()
+		dir, err := a.makeDir(user.ID, parentID, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	write := func(parentID *uint, name, content string) *models.File {
+		t.Helper()
+		file, err := a.writeFile(user.ID, parentID, name, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	docs := mkdir(nil, "Docs")
+	sub := mkdir(&docs.ID, "sub")
+	inDocs := write(&docs.ID, "a.txt", "alpha")
+	write(&sub.ID, "b.txt", "beta")
+	notes := write(nil, "notes.txt", "root notes")
+	other := mkdir(nil, "Other")
+	otherNotes := write(&other.ID, "Notes.txt", "other notes")
+
+	archive := func(body string, want int) []byte {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest("POST", "/archive", strings.NewReader(body)))
+		if w.Code != want {
+			t.Fatalf("archive %s = %d %s, want %d", body, w.Code, w.Body, want)
+		}
+		return w.Body.Bytes()
+	}
+
+	// A file inside a selected folder comes once, and names that clash are numbered
+	want := map[string]string{
+		"Docs/":          "/",
+		"Docs/a.txt":     "alpha",
+		"Docs/sub/":      "/",
+		"Docs/sub/b.txt": "beta",
+		"Notes.txt":      "other notes",
+		"notes (1).txt":  "root notes",
+	}
+	ids := fmt.Sprintf("[%d, %d, %d, %d]", docs.ID, inDocs.ID, notes.ID, otherNotes.ID)
+	for _, format := range []string{"zip", "tar.gz"} {
+		got := readArchive(t, format, archive(fmt.Sprintf(`{"file_ids": %s, "format": %q}`, ids, format), http.StatusOK))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s entries = %v, want %v", format, got, want)
+		}
+	}
+
+	archive(fmt.Sprintf(`{"file_ids": [%d], "format": "rar"}`, notes.ID), http.StatusBadRequest)
+	archive(`{"file_ids": [9999]}`, http.StatusNotFound)
+
+	// Downloads through archives count, and held back files stop the archive before it starts
+	a.DB.Model(notes).Update("max_downloads", 5)
+	archive(fmt.Sprintf(`{"file_ids": [%d]}`, notes.ID), http.StatusOK)
+	a.DB.First(notes, notes.ID)
+	if notes.DownloadCount != 1 {
+		t.Errorf("download_count = %d after an archive, want 1", notes.DownloadCount)
+	}
+	a.DB.Model(inDocs).Update("scan_status", models.ScanPending)
+	archive(fmt.Sprintf(`{"file_ids": [%d]}`, docs.ID), http.StatusConflict)
+}
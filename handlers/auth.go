@@ -4,8 +4,10 @@ package handlers
 import (
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"cloud-storage/events"
 	"cloud-storage/models"
 
 	"github.com/dgrijalva/jwt-go"
@@ -32,7 +34,7 @@ func (a *App) Register(c *gin.Context) {
 	}
 
 	// Create new user
-	user := models.User{Username: req.Username}
+	user := models.User{Username: req.Username, IsAdmin: IsAdminUsername(req.Username)}
 	if err := user.HashPassword(req.Password); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
@@ -43,9 +45,25 @@ func (a *App) Register(c *gin.Context) {
 		return
 	}
 
+	a.Events.Publish(events.Event{
+		Type:   events.UserRegistered,
+		UserID: user.ID,
+		Data:   gin.H{"username": user.Username},
+	})
+
 	c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully"})
 }
 
+// IsAdminUsername reports whether the username is listed in the ADMIN_USERS environment variable.
+func IsAdminUsername(username string) bool {
+	for _, name := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if strings.TrimSpace(name) == username {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *App) Login(c *gin.Context) {
 	var req AuthRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
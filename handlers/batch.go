@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"cloud-storage/events"
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	maxBatchOperations = 1000
+	// Larger batches run as background jobs polled through GET /jobs/:id
+	syncBatchOperations = 50
+)
+
+// BatchOperation is one step of a batch. Move and copy take a target folder,
+// null for the root, and an optional new name.
+type BatchOperation struct {
+	Op         string   `json:"op"` // delete, move, copy, tag or share
+	FileID     uint     `json:"file_id"`
+	ParentID   *uint    `json:"parent_id"`
+	Name       string   `json:"name"`
+	AddTags    []string `json:"add_tags"`
+	RemoveTags []string `json:"remove_tags"`
+	Username   string   `json:"username"`
+	Permission string   `json:"permission"`
+}
+
+// BatchRequest runs operations in order. With Atomic set nothing runs unless
+// every operation passes validation, and the batch runs in one transaction, so
+// that a failing step undoes the others. Atomic batches may only move, tag and
+// share: deletes and copies touch storage, which cannot be rolled back.
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations" binding:"required"`
+	Atomic     bool             `json:"atomic"`
+}
+
+type batchResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	FileID uint   `json:"file_id"`
+	Status string `json:"status"` // ok, failed, skipped or rolled_back
+	Error  string `json:"error,omitempty"`
+	NewID  uint   `json:"new_file_id,omitempty"`
+}
+
+// batchJob is the payload of a batch; Steps holds the validated operations,
+// nil where validation failed.
+type batchJob struct {
+	Steps   []*BatchOperation `json:"steps"`
+	Results []batchResult     `json:"results"`
+	Atomic  bool              `json:"atomic"`
+}
+
+var errUserNotFound = errors.New("user not found")
+
+func (a *App) Batch(c *gin.Context) {
+	var req BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Operations) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if len(req.Operations) > maxBatchOperations {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A batch may hold at most %d operations", maxBatchOperations)})
+		return
+	}
+	if req.Atomic {
+		for _, op := range req.Operations {
+			if op.Op == "delete" || op.Op == "copy" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Atomic batches may only move, tag and share"})
+				return
+			}
+		}
+	}
+	userID := c.MustGet("userID").(uint)
+
+	// Check everything up front so an atomic batch fails before changing anything
+	batch := batchJob{
+		Steps:   make([]*BatchOperation, len(req.Operations)),
+		Results: make([]batchResult, len(req.Operations)),
+		Atomic:  req.Atomic,
+	}
+	invalid := false
+	for i, op := range req.Operations {
+		batch.Results[i] = batchResult{Index: i, Op: op.Op, FileID: op.FileID}
+		step, err := a.validateBatchOp(userID, op)
+		if err != nil {
+			batch.Results[i].Status = "failed"
+			batch.Results[i].Error = batchError(err)
+			invalid = true
+			continue
+		}
+		batch.Steps[i] = step
+	}
+	if invalid && req.Atomic {
+		for i := range batch.Results {
+			if batch.Results[i].Status == "" {
+				batch.Results[i].Status = "skipped"
+			}
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Batch has invalid operations, nothing was changed", "results": batch.Results})
+		return
+	}
+
+	if len(batch.Steps) > syncBatchOperations {
+		// A single attempt: a batch interrupted by a restart fails rather than running twice
+		job, err := a.Jobs.Enqueue(userID, "batch", batch, jobs.Options{Priority: jobs.PriorityHigh, Total: len(batch.Steps)})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue batch"})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID})
+		return
+	}
+	results, _ := a.runBatch(context.Background(), userID, &batch, func(int) {})
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// runBatchJob runs a batch queued by Batch.
+func (a *App) runBatchJob(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	var batch batchJob
+	if err := json.Unmarshal(job.Payload, &batch); err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	return a.runBatch(ctx, job.UserID, &batch, progress)
+}
+
+// runBatch performs the steps in order, skipping the rest once ctx is cancelled.
+func (a *App) runBatch(ctx context.Context, userID uint, batch *batchJob, progress func(done int)) ([]batchResult, error) {
+	if batch.Atomic && databaseOnly(batch.Steps) {
+		return a.runBatchTx(ctx, userID, batch, progress)
+	}
+
+	results := batch.Results
+	for i, step := range batch.Steps {
+		if ctx.Err() != nil {
+			if results[i].Status == "" {
+				results[i].Status = "skipped"
+			}
+			continue
+		}
+		if step != nil {
+			newID, err := a.runBatchStep(userID, step)
+			results[i].Status = "ok"
+			results[i].NewID = newID
+			if err != nil {
+				results[i].Status = "failed"
+				results[i].Error = batchError(err)
+			}
+		}
+		progress(i + 1)
+	}
+	return results, ctx.Err()
+}
+
+// runBatchTx performs the steps in one transaction, rolling all of them back
+// when one fails or ctx is cancelled. Their events are published on commit.
+func (a *App) runBatchTx(ctx context.Context, userID uint, batch *batchJob, progress func(done int)) ([]batchResult, error) {
+	results := batch.Results
+	bus, release := a.Events.Hold()
+	err := a.DB.Transaction(func(tx *gorm.DB) error {
+		txApp := *a
+		txApp.DB = tx
+		txApp.Events = bus
+		for i, step := range batch.Steps {
+			if err := ctx.Err(); err != nil {
+				results[i].Status = "skipped"
+				return err
+			}
+			if _, err := txApp.runBatchStep(userID, step); err != nil {
+				results[i].Status = "failed"
+				results[i].Error = batchError(err)
+				return err
+			}
+			results[i].Status = "ok"
+			progress(i + 1)
+		}
+		return nil
+	})
+	release(err == nil)
+
+	if err != nil {
+		for i := range results {
+			switch results[i].Status {
+			case "ok":
+				results[i].Status = "rolled_back"
+			case "":
+				results[i].Status = "skipped"
+			}
+		}
+	}
+	return results, ctx.Err()
+}
+
+// databaseOnly reports whether every step only changes database rows, so the
+// batch can run in a transaction.
+func databaseOnly(steps []*BatchOperation) bool {
+	for _, step := range steps {
+		if step == nil || (step.Op != "move" && step.Op != "tag" && step.Op != "share") {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *App) validateBatchOp(userID uint, op BatchOperation) (*BatchOperation, error) {
+	step := &op
+
+	var file models.File
+	if err := a.DB.Where("id = ? AND user_id = ?", op.FileID, userID).First(&file).Error; err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	switch op.Op {
+	case "delete":
+	case "move", "copy":
+		if op.ParentID != nil {
+			var parent models.File
+			if err := a.DB.Where("id = ? AND user_id = ? AND is_dir = ?", *op.ParentID, userID, true).First(&parent).Error; err != nil {
+				return nil, errors.New("target folder not found")
+			}
+		}
+		if step.Name == "" {
+			step.Name = file.Name
+		}
+		if within, err := a.isWithin(op.ParentID, &file); err != nil || within {
+			return nil, os.ErrInvalid
+		}
+		if existing, err := a.lookupChild(userID, op.ParentID, step.Name); err == nil && existing.ID != file.ID {
+			return nil, os.ErrExist
+		}
+	case "tag":
+		var err error
+		if step.AddTags, err = normalizeTags(op.AddTags); err != nil {
+			return nil, err
+		}
+		if step.RemoveTags, err = normalizeTags(op.RemoveTags); err != nil {
+			return nil, err
+		}
+	case "share":
+		var recipient models.User
+		if err := a.DB.Where("username = ?", op.Username).First(&recipient).Error; err != nil {
+			return nil, errUserNotFound
+		}
+		if recipient.ID == userID {
+			return nil, errShareWithSelf
+		}
+		if op.Permission != "" && op.Permission != "read" && op.Permission != "write" {
+			return nil, errInvalidPermission
+		}
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+	return step, nil
+}
+
+// runBatchStep performs one operation, returning the new file's ID for a copy.
+func (a *App) runBatchStep(userID uint, step *BatchOperation) (uint, error) {
+	// Earlier steps may have deleted or moved the file since validation
+	var file models.File
+	if err := a.DB.Where("id = ? AND user_id = ?", step.FileID, userID).First(&file).Error; err != nil {
+		return 0, os.ErrNotExist
+	}
+
+	switch step.Op {
+	case "delete":
+		return 0, a.removeTree(&file)
+	case "move":
+		return 0, a.moveFile(&file, step.ParentID, step.Name)
+	case "copy":
+		copied, err := a.copyTree(&file, step.ParentID, step.Name)
+		if err != nil {
+			return 0, err
+		}
+		return copied.ID, nil
+	case "tag":
+		if err := a.checkUntag(&file, step.RemoveTags); err != nil {
+			return 0, err
+		}
+		if err := applyTags(a.DB, userID, []models.File{file}, step.AddTags, step.RemoveTags); err != nil {
+			return 0, err
+		}
+		a.Events.Publish(events.Event{Type: events.FileUpdated, UserID: userID, FileID: &file.ID, Data: gin.H{"name": file.Name}})
+		return 0, nil
+	case "share":
+		var recipient models.User
+		if err := a.DB.Where("username = ?", step.Username).First(&recipient).Error; err != nil {
+			return 0, errUserNotFound
+		}
+		_, err := a.shareFile(&file, &recipient, step.Permission)
+		return 0, err
+	}
+	return 0, nil
+}
+
+func batchError(err error) string {
+	switch err {
+	case os.ErrNotExist:
+		return "file not found"
+	case os.ErrExist:
+		return "an item with that name already exists in the target folder"
+	case os.ErrInvalid:
+		return "a folder cannot be moved or copied into itself"
+	case errInvalidTag:
+		return "tags must be 1 to 64 characters"
+	case errQuotaExceeded:
+		return "storage quota exceeded"
+	}
+	return err.Error()
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-storage/models"
+)
+
+// newBatchApp returns an app serving POST /batch and a file of the user's to work on.
+func newBatchApp(t *testing.T) (*App, *models.User, models.File, func(body string, want int) []batchResult) {
+	t.Helper()
+	a, user := newTestApp(t)
+	a.Router.POST("/batch", as(user), a.Batch)
+
+	file := models.File{UserID: user.ID, Name: "a.txt", LastModified: time.Now()}
+	if err := a.DB.Create(&file).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	batch := func(body string, want int) []batchResult {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+		if w.Code != want {
+			t.Fatalf("batch = %d %s, want %d", w.Code, w.Body, want)
+		}
+		var resp struct {
+			Results []batchResult `json:"results"`
+			JobID   uint          `json:"job_id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.JobID != 0 {
+			// Run the queued job here rather than on the queue's workers
+			var job models.Job
+			if err := a.DB.First(&job, resp.JobID).Error; err != nil {
+				t.Fatal(err)
+			}
+			result, err := a.runBatchJob(context.Background(), &job, func(int) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return result.([]batchResult)
+		}
+		return resp.Results
+	}
+	return a, user, file, batch
+}
+
+func statuses(results []batchResult) string {
+	var s []string
+	for _, r := range results {
+		s = append(s, r.Status)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestBatchValidation(t *testing.T) {
+	a, _, file, batch := newBatchApp(t)
+	ops := fmt.Sprintf(`[{"op": "tag", "file_id": %d, "add_tags": ["x"]}, {"op": "move", "file_id": 9999}]`, file.ID)
+	tagged := func() int64 {
+		var count int64
+		a.DB.Model(&models.Tag{}).Where("name = ?", "x").Count(&count)
+		return count
+	}
+
+	// An atomic batch with an invalid step changes nothing
+	if got := statuses(batch(`{"atomic": true, "operations": `+ops+`}`, http.StatusBadRequest)); got != "skipped,failed" {
+		t.Errorf("atomic results = %s, want skipped,failed", got)
+	}
+	if tagged() != 0 {
+		t.Error("atomic batch with an invalid step tagged the file")
+	}
+
+	// Otherwise the valid steps run
+	if got := statuses(batch(`{"operations": `+ops+`}`, http.StatusOK)); got != "ok,failed" {
+		t.Errorf("results = %s, want ok,failed", got)
+	}
+	if tagged() != 1 {
+		t.Error("valid step of a batch did not run")
+	}
+}
+
+func TestBatchAtomicRollback(t *testing.T) {
+	a, user, file, batch := newBatchApp(t)
+	if err := applyTags(a.DB, user.ID, []models.File{file}, []string{"legal"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	rule := models.RetentionRule{Name: "contracts", Action: models.RetainKeep, Days: 30, Tag: "legal"}
+	if err := a.DB.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Untagging passes validation but fails when it runs, undoing the first step
+	results := batch(fmt.Sprintf(`{"atomic": true, "operations": [
+		{"op": "tag", "file_id": %d, "add_tags": ["draft"]},
+		{"op": "tag", "file_id": %d, "remove_tags": ["legal"]}]}`, file.ID, file.ID), http.StatusOK)
+	if got := statuses(results); got != "rolled_back,failed" {
+		t.Errorf("results = %s, want rolled_back,failed", got)
+	}
+	var count int64
+	a.DB.Model(&models.Tag{}).Where("name = ?", "draft").Count(&count)
+	if count != 0 {
+		t.Error("tag of a failed atomic batch was kept")
+	}
+
+	// Deletes and copies cannot be rolled back
+	for _, op := range []string{"delete", "copy"} {
+		batch(fmt.Sprintf(`{"atomic": true, "operations": [{"op": %q, "file_id": %d}]}`, op, file.ID), http.StatusBadRequest)
+	}
+	if err := a.DB.First(&file, file.ID).Error; err != nil {
+		t.Error("atomic delete ran")
+	}
+}
+
+func TestBatchQueued(t *testing.T) {
+	a, _, file, batch := newBatchApp(t)
+
+	var ops []string
+	for i := 0; i <= syncBatchOperations; i++ {
+		ops = append(ops, fmt.Sprintf(`{"op": "tag", "file_id": %d, "add_tags": ["t%d"]}`, file.ID, i))
+	}
+	results := batch(`{"operations": [`+strings.Join(ops, ",")+`]}`, http.StatusAccepted)
+	if len(results) != syncBatchOperations+1 || strings.Contains(statuses(results), "failed") {
+		t.Errorf("queued batch results = %s, want all ok", statuses(results))
+	}
+	var count int64
+	a.DB.Model(&models.Tag{}).Count(&count)
+	if count != syncBatchOperations+1 {
+		t.Errorf("%d tags after the queued batch, want %d", count, syncBatchOperations+1)
+	}
+}
@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud-storage/blobcompress"
+	"cloud-storage/cdc"
+	"cloud-storage/chunkstore"
+	"cloud-storage/metadata"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	chunkGCJob = "chunks.gc"
+	// Unreferenced chunks are kept this long for uploads in progress to commit
+	chunkGCGrace = time.Hour
+
+	maxChunkCheck = 10000
+	maxFileChunks = 200000
+	// Stay below SQLite's limit on bound parameters
+	chunkQueryBatch = 500
+)
+
+// ChunkCheckRequest lists the chunks a client is about to commit.
+type ChunkCheckRequest struct {
+	Hashes []string `json:"hashes" binding:"required"`
+}
+
+type ChunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// ChunkedFileRequest creates or replaces name inside a folder, null for the
+// root, with the content made of the chunks in order.
+type ChunkedFileRequest struct {
+	Name     string     `json:"name" binding:"required"`
+	ParentID *uint      `json:"parent_id"`
+	Chunks   []ChunkRef `json:"chunks"`
+	FileExpiry
+}
+
+func userDir(userID uint) string {
+	return filepath.Join("storage", fmt.Sprintf("%d", userID))
+}
+
+// findChunks returns the user's stored chunks among hashes, by hash. Found
+// chunks are touched so the garbage collector leaves them to the upload.
+func (a *App) findChunks(userID uint, hashes []string) (map[string]models.Chunk, error) {
+	found := make(map[string]models.Chunk)
+	for start := 0; start < len(hashes); start += chunkQueryBatch {
+		batch := hashes[start:min(start+chunkQueryBatch, len(hashes))]
+		var chunks []models.Chunk
+		if err := a.DB.Where("user_id = ? AND hash IN ?", userID, batch).Find(&chunks).Error; err != nil {
+			return nil, err
+		}
+		if len(chunks) == 0 {
+			continue
+		}
+		ids := make([]uint, len(chunks))
+		for i, chunk := range chunks {
+			found[chunk.Hash] = chunk
+			ids[i] = chunk.ID
+		}
+		if err := a.DB.Model(&models.Chunk{}).Where("id IN ?", ids).Update("updated_at", time.Now()).Error; err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// CheckChunks returns the chunks among hashes the user still has to upload.
+func (a *App) CheckChunks(c *gin.Context) {
+	var req ChunkCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if len(req.Hashes) > maxChunkCheck {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d chunks can be checked at once", maxChunkCheck)})
+		return
+	}
+	for _, hash := range req.Hashes {
+		if !chunkstore.ValidHash(hash) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chunk hash"})
+			return
+		}
+	}
+	userID := c.MustGet("userID").(uint)
+
+	found, err := a.findChunks(userID, req.Hashes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check chunks"})
+		return
+	}
+	missing := []string{}
+	seen := make(map[string]bool)
+	for _, hash := range req.Hashes {
+		if _, ok := found[hash]; !ok && !seen[hash] {
+			missing = append(missing, hash)
+			seen[hash] = true
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"missing": missing})
+}
+
+// UploadChunk stores the raw body as the chunk named by its SHA-256. Uploading
+// a chunk the user already has is a no-op.
+func (a *App) UploadChunk(c *gin.Context) {
+	hash := c.Param("hash")
+	if !chunkstore.ValidHash(hash) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chunk hash"})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+
+	if found, err := a.findChunks(userID, []string{hash}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save chunk"})
+		return
+	} else if _, ok := found[hash]; ok {
+		c.JSON(http.StatusOK, gin.H{"hash": hash, "size": found[hash].Size})
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, cdc.MaxSize))
+	if err != nil || len(data) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A chunk holds 1 to %d bytes", cdc.MaxSize)})
+		return
+	}
+	if err := a.checkQuota(userID, int64(len(data))); err == errQuotaExceeded {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Storage quota exceeded"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save chunk"})
+		return
+	}
+
+	chunk, err := a.storeChunk(userID, hash, data)
+	if err == errHashMismatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chunk does not match its hash"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save chunk"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"hash": chunk.Hash, "size": chunk.Size})
+}
+
+var errHashMismatch = errors.New("content does not match its hash")
+
+// storeChunk writes data below the user's chunk directory, compressed when worth
+// it, and records it with no references yet.
+func (a *App) storeChunk(userID uint, hash string, data []byte) (*models.Chunk, error) {
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != hash {
+		return nil, errHashMismatch
+	}
+	compress := a.Compress && blobcompress.Worthwhile("application/octet-stream", data)
+	chunkPath := chunkstore.ChunkPath(userDir(userID), hash, compress)
+	if err := os.MkdirAll(filepath.Dir(chunkPath), 0755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(chunkPath), ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	_, _, _, err = a.writeBlob(tmp, bytes.NewReader(data), compress)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), chunkPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	chunk := models.Chunk{UserID: userID, Hash: hash, Size: int64(len(data)), Path: chunkPath}
+	if err := a.DB.Create(&chunk).Error; err != nil {
+		// A concurrent upload of the same chunk got there first
+		if err := a.DB.Where("user_id = ? AND hash = ?", userID, hash).First(&chunk).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &chunk, nil
+}
+
+// CreateChunkedFile commits a file from chunks uploaded earlier. When chunks are
+// missing nothing is saved and they are listed with status 409.
+func (a *App) CreateChunkedFile(c *gin.Context) {
+	var req ChunkedFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.ContainsAny(req.Name, `/\`) || req.Name == "." || req.Name == ".." {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !req.valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+	if len(req.Chunks) > maxFileChunks {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A file may have at most %d chunks", maxFileChunks)})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+
+	if req.ParentID != nil {
+		var parent models.File
+		if err := a.DB.Where("id = ? AND user_id = ? AND is_dir = ?", *req.ParentID, userID, true).First(&parent).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Target folder not found"})
+			return
+		}
+	}
+	existing, err := a.lookupChild(userID, req.ParentID, req.Name)
+	if err != nil && err != os.ErrNotExist {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+	if existing != nil && existing.IsDir {
+		c.JSON(http.StatusConflict, gin.H{"error": "A folder with that name exists"})
+		return
+	}
+
+	var hashes []string
+	var size int64
+	for _, ref := range req.Chunks {
+		if !chunkstore.ValidHash(ref.Hash) || ref.Size <= 0 || ref.Size > cdc.MaxSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chunk"})
+			return
+		}
+		hashes = append(hashes, ref.Hash)
+		size += ref.Size
+	}
+	found, err := a.findChunks(userID, hashes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check chunks"})
+		return
+	}
+
+	refs := make([]chunkstore.Ref, len(req.Chunks))
+	missing := []string{}
+	for i, ref := range req.Chunks {
+		chunk, ok := found[ref.Hash]
+		if !ok {
+			missing = append(missing, ref.Hash)
+			continue
+		}
+		if chunk.Size != ref.Size {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Chunk size does not match: " + ref.Hash})
+			return
+		}
+		refs[i] = chunkstore.Ref{Hash: ref.Hash, Size: ref.Size, Compressed: strings.HasSuffix(chunk.Path, blobcompress.Ext)}
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Missing chunks", "missing": missing})
+		return
+	}
+
+	// Chunks no file references yet are already counted against the quota
+	added := size
+	for _, chunk := range found {
+		if chunk.RefCount <= 0 {
+			added -= chunk.Size
+		}
+	}
+	if err := a.checkQuota(userID, added); err == errQuotaExceeded {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Storage quota exceeded"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+
+	stored, err := a.storeManifest(userID, refs, size)
+	if err == errChunkGone {
+		c.JSON(http.StatusConflict, gin.H{"error": "Chunks were removed, check and upload them again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+
+	file, err := a.saveFile(userID, req.ParentID, req.Name, existing, stored)
+	if isRetained(err) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err == nil {
+		err = a.setExpiry(file, req.FileExpiry)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "file": file})
+}
+
+var errChunkGone = errors.New("chunk was garbage collected")
+
+// storeManifest references refs and writes their manifest, returning it as a
+// blob with the hash, type and metadata of the reassembled content.
+func (a *App) storeManifest(userID uint, refs []chunkstore.Ref, size int64) (blob, error) {
+	dir := userDir(userID)
+	content := chunkstore.Open(dir, refs, a.Keys)
+	defer content.Close()
+
+	sample := make([]byte, blobcompress.SampleSize)
+	n, err := content.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		return blob{}, err
+	}
+	mimeType, ext, err := metadata.Detect(bytes.NewReader(sample[:n]))
+	if err != nil {
+		return blob{}, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return blob{}, err
+	}
+	stored := blob{Hash: hex.EncodeToString(hash.Sum(nil)), Size: size, MimeType: mimeType,
+		Metadata: metadata.Extract(content, size, mimeType)}
+
+	// Every commit gets its own manifest, holding one reference per listing
+	if err := a.referenceChunks(userID, refs); err != nil {
+		return blob{}, err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	stored.Path = filepath.Join(dir, fmt.Sprintf("%s.%x%s%s", stored.Hash, suffix, ext, chunkstore.Ext))
+
+	err = a.writeManifest(stored.Path, refs)
+	if err != nil {
+		a.releaseChunks(dir, refs)
+		return blob{}, err
+	}
+	return stored, nil
+}
+
+func (a *App) writeManifest(manifestPath string, refs []chunkstore.Ref) error {
+	var buf bytes.Buffer
+	if err := chunkstore.WriteManifest(&buf, refs); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(manifestPath), ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, _, _, err = a.writeBlob(tmp, &buf, false)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), manifestPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// countRefs counts how often each chunk is listed.
+func countRefs(refs []chunkstore.Ref) map[string]int64 {
+	counts := make(map[string]int64)
+	for _, ref := range refs {
+		counts[ref.Hash]++
+	}
+	return counts
+}
+
+// referenceChunks adds a reference for every listing of a chunk in refs,
+// failing with errChunkGone if one was collected since it was checked.
+func (a *App) referenceChunks(userID uint, refs []chunkstore.Ref) error {
+	return a.DB.Transaction(func(tx *gorm.DB) error {
+		for hash, n := range countRefs(refs) {
+			res := tx.Model(&models.Chunk{}).Where("user_id = ? AND hash = ?", userID, hash).
+				Update("ref_count", gorm.Expr("ref_count + ?", n))
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return errChunkGone
+			}
+		}
+		return nil
+	})
+}
+
+// releaseChunks drops the references of a manifest stored in dir. Chunks left
+// unreferenced are removed by the next garbage collection after the grace period.
+func (a *App) releaseChunks(dir string, refs []chunkstore.Ref) error {
+	compressed := make(map[string]bool)
+	for _, ref := range refs {
+		compressed[ref.Hash] = ref.Compressed
+	}
+	for hash, n := range countRefs(refs) {
+		err := a.DB.Model(&models.Chunk{}).Where("path = ?", chunkstore.ChunkPath(dir, hash, compressed[hash])).
+			Updates(map[string]interface{}{"ref_count": gorm.Expr("ref_count - ?", n), "updated_at": time.Now()}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type chunkGCResult struct {
+	Removed    int   `json:"removed"`
+	FreedBytes int64 `json:"freed_bytes"`
+	Failed     int   `json:"failed"`
+}
+
+// runChunkGCJob removes the chunks no manifest has referenced for the grace
+// period, uploaded but never committed ones included.
+func (a *App) runChunkGCJob(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	var chunks []models.Chunk
+	cutoff := time.Now().Add(-chunkGCGrace)
+	if err := a.DB.Where("ref_count <= 0 AND updated_at < ?", cutoff).Find(&chunks).Error; err != nil {
+		return nil, err
+	}
+
+	var result chunkGCResult
+	for i, chunk := range chunks {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		// A commit may have referenced or touched the chunk since it was listed
+		res := a.DB.Unscoped().Where("id = ? AND ref_count <= 0 AND updated_at < ?", chunk.ID, cutoff).Delete(&models.Chunk{})
+		if res.Error != nil {
+			return result, res.Error
+		}
+		if res.RowsAffected > 0 {
+			if err := os.Remove(chunk.Path); err != nil && !os.IsNotExist(err) {
+				result.Failed++
+			} else {
+				result.Removed++
+				result.FreedBytes += chunk.Size
+			}
+		}
+		progress(i + 1)
+	}
+	return result, nil
+}
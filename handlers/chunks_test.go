@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChunksCountAgainstQuota(t *testing.T) {
+	a, user := newTestApp(t)
+	api := a.Router.Group("/api/v1", as(user))
+	api.PUT("/chunks/:hash", a.UploadChunk)
+	api.POST("/files/chunked", a.CreateChunkedFile)
+	api.GET("/quota", a.GetQuota)
+	a.DB.Model(user).Update("quota_bytes", 100)
+
+	request := func(method, path string, body []byte, want int) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(body)))
+		if w.Code != want {
+			t.Fatalf("%s %s: got %d, want %d: %s", method, path, w.Code, want, w.Body)
+		}
+		return w
+	}
+	hashOf := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	first, second := bytes.Repeat([]byte("a"), 60), bytes.Repeat([]byte("b"), 60)
+	request("PUT", "/api/v1/chunks/"+hashOf(first), first, http.StatusCreated)
+	// The first chunk is not part of a file yet but still takes up space
+	request("PUT", "/api/v1/chunks/"+hashOf(second), second, http.StatusRequestEntityTooLarge)
+
+	// Committing it does not count it twice
+	body := fmt.Sprintf(`{"name": "a.txt", "chunks": [{"hash": %q, "size": 60}]}`, hashOf(first))
+	request("POST", "/api/v1/files/chunked", []byte(body), http.StatusOK)
+
+	var quota struct {
+		UsedBytes int64 `json:"used_bytes"`
+	}
+	if err := json.Unmarshal(request("GET", "/api/v1/quota", nil, http.StatusOK).Body.Bytes(), &quota); err != nil {
+		t.Fatal(err)
+	}
+	if quota.UsedBytes != 60 {
+		t.Errorf("used_bytes = %d, want 60", quota.UsedBytes)
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"cloud-storage/blobcompress"
+	"cloud-storage/chunkstore"
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const compressJob = "compress"
+
+type compressResult struct {
+	Blobs      int      `json:"blobs"`
+	Compressed int      `json:"compressed"`
+	Skipped    int      `json:"skipped"`
+	Failed     int      `json:"failed"`
+	SavedBytes int64    `json:"saved_bytes"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// uncompressedBlobs lists every blob stored as it is, with its type and size.
+// Chunk manifests are left out, their chunks are compressed as they are uploaded.
+func (a *App) uncompressedBlobs() ([]models.File, error) {
+	var blobs []models.File
+	err := a.DB.Model(&models.File{}).Select("path, MAX(mime_type) AS mime_type, MAX(size) AS size").
+		Where("is_dir = ? AND path <> '' AND compression = '' AND path NOT LIKE ?", false, "%"+chunkstore.Ext).Group("path").Order("path").Find(&blobs).Error
+	return blobs, err
+}
+
+// runCompressJob compresses the blobs stored before compression was enabled,
+// or uploaded while it was off, that are worth it.
+func (a *App) runCompressJob(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	blobs, err := a.uncompressedBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	var result compressResult
+	for i, blob := range blobs {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		result.Blobs++
+
+		path, storedSize, err := blobcompress.CompressFile(blob.Path, blob.MimeType, a.Keys)
+		if err == nil {
+			// Every record of the blob moves to the compressed copy at once
+			err = a.DB.Model(&models.File{}).Where("path = ?", blob.Path).
+				Updates(map[string]interface{}{"path": path, "compression": blobcompress.Gzip, "stored_size": storedSize}).Error
+			if err != nil {
+				os.Remove(path)
+			}
+		}
+		switch {
+		case err == blobcompress.ErrNotWorthwhile, os.IsNotExist(err):
+			result.Skipped++
+		case err != nil:
+			result.Failed++
+			if len(result.Errors) < 100 {
+				result.Errors = append(result.Errors, blob.Path+": "+err.Error())
+			}
+		default:
+			a.releaseBlob(blob.Path)
+			result.Compressed++
+			result.SavedBytes += blob.Size - storedSize
+		}
+		progress(i + 1)
+	}
+	return result, nil
+}
+
+// AdminCompressionStats reports the space compression saves, counting each blob
+// once however many files refer to it.
+func (a *App) AdminCompressionStats(c *gin.Context) {
+	var stats struct {
+		Blobs         int64
+		OriginalBytes int64
+		StoredBytes   int64
+	}
+	compressed := a.DB.Model(&models.File{}).Distinct("path", "size", "stored_size").
+		Where("is_dir = ? AND path <> '' AND compression <> ''", false)
+	err := a.DB.Table("(?) AS blobs", compressed).
+		Select("COUNT(*) AS blobs, COALESCE(SUM(size), 0) AS original_bytes, COALESCE(SUM(stored_size), 0) AS stored_bytes").
+		Scan(&stats).Error
+	var uncompressed int64
+	if err == nil {
+		err = a.DB.Model(&models.File{}).Where("is_dir = ? AND path <> '' AND compression = '' AND path NOT LIKE ?", false, "%"+chunkstore.Ext).
+			Distinct("path").Count(&uncompressed).Error
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute compression stats"})
+		return
+	}
+
+	ratio := 0.0
+	if stats.OriginalBytes > 0 {
+		ratio = float64(stats.StoredBytes) / float64(stats.OriginalBytes)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":            a.Compress,
+		"compressed_blobs":   stats.Blobs,
+		"uncompressed_blobs": uncompressed,
+		"original_bytes":     stats.OriginalBytes,
+		"stored_bytes":       stats.StoredBytes,
+		"saved_bytes":        stats.OriginalBytes - stats.StoredBytes,
+		"ratio":              ratio,
+	})
+}
+
+// AdminStartCompression queues a job compressing the existing blobs worth it.
+func (a *App) AdminStartCompression(c *gin.Context) {
+	var pending int64
+	a.DB.Model(&models.Job{}).Where("type = ? AND status IN ?", compressJob, []string{models.JobQueued, models.JobRunning}).Count(&pending)
+	if pending > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Compression is already queued or running"})
+		return
+	}
+
+	blobs, err := a.uncompressedBlobs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count blobs"})
+		return
+	}
+	job, err := a.Jobs.Enqueue(0, compressJob, nil, jobs.Options{Priority: jobs.PriorityLow, Total: len(blobs)})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue compression"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID})
+}
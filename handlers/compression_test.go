@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"cloud-storage/blobcompress"
+	"cloud-storage/models"
+)
+
+func TestCompression(t *testing.T) {
+	a, user := newTestApp(t)
+	a.Router.GET("/admin/compression", a.AdminCompressionStats)
+	a.Router.POST("/admin/compression", a.AdminStartCompression)
+
+	write := func(name string, content []byte) *models.File {
+		t.Helper()
+		file, err := a.writeFile(user.ID, nil, name, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	readBack := func(file *models.File) []byte {
+		t.Helper()
+		a.DB.First(file, file.ID)
+		b, err := a.openBlob(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		data, _ := io.ReadAll(b)
+		return data
+	}
+	stats := func() map[string]float64 {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/compression", nil))
+		var resp map[string]float64
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// Blobs stored while compression was off are compressed by the job, every
+	// file sharing one moving with it
+	words := []byte(strings.Repeat("all work and no play\n", 5000))
+	noise := make([]byte, 100<<10)
+	rand.Read(noise)
+	first, second := write("a.txt", words), write("b.txt", words)
+	random := write("random.bin", noise)
+	oldPath := first.Path
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/compression", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("starting compression = %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/compression", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("starting compression twice = %d, want 409", w.Code)
+	}
+
+	var job models.Job
+	a.DB.Where("type = ?", compressJob).First(&job)
+	res, err := a.runCompressJob(context.Background(), &job, func(int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := res.(compressResult)
+	if result.Blobs != 2 || result.Compressed != 1 || result.Skipped != 1 || result.Failed != 0 || result.SavedBytes <= 0 {
+		t.Errorf("result = %+v, want one blob compressed and one skipped", result)
+	}
+
+	for _, file := range []*models.File{first, second} {
+		if got := readBack(file); !bytes.Equal(got, words) || file.Compression != blobcompress.Gzip || !strings.HasSuffix(file.Path, blobcompress.Ext) {
+			t.Errorf("%s is at %s, compression %q, reading %d bytes", file.Name, file.Path, file.Compression, len(got))
+		}
+	}
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("the uncompressed blob is still there: %v", err)
+	}
+	if got := readBack(random); !bytes.Equal(got, noise) || random.Compression != "" {
+		t.Errorf("random.bin has compression %q, reading %d bytes", random.Compression, len(got))
+	}
+
+	s := stats()
+	if s["compressed_blobs"] != 1 || s["uncompressed_blobs"] != 1 || s["original_bytes"] != float64(len(words)) ||
+		s["saved_bytes"] <= 0 || s["ratio"] <= 0 || s["ratio"] >= 1 {
+		t.Errorf("stats = %v", s)
+	}
+
+	// With compression on, new blobs worth it are compressed as they are stored
+	a.Compress = true
+	fresh := write("c.txt", bytes.ToUpper(words))
+	if got := readBack(fresh); !bytes.Equal(got, bytes.ToUpper(words)) || fresh.Compression != blobcompress.Gzip {
+		t.Errorf("c.txt has compression %q, reading %d bytes", fresh.Compression, len(got))
+	}
+	if fresh := write("d.bin", noise[:50<<10]); fresh.Compression != "" {
+		t.Errorf("noise was stored with compression %q", fresh.Compression)
+	}
+}
@@ -0,0 +1,652 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud-storage/blobcompress"
+	"cloud-storage/blobcrypt"
+	"cloud-storage/chunkstore"
+	"cloud-storage/events"
+	"cloud-storage/metadata"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// The drive helpers give WebDAV and the other protocol front ends a folder view
+// over models.File, using ParentID for the hierarchy and IsDir for folders.
+
+type blob struct {
+	Path     string
+	Hash     string
+	Size     int64
+	MimeType string
+	Metadata models.Metadata
+	// Compression is set, with the compressed size, when the blob is compressed
+	Compression string
+	StoredSize  int64
+}
+
+// storeBlob writes r into the user's storage directory under its SHA-256 name,
+// with the extension of the type sniffed from its content rather than the client's.
+// Identical content is stored once; the partial file is removed if the copy fails
+// or the content would exceed the user's quota. Content that compresses well is
+// stored compressed when compression is enabled.
+func (a *App) storeBlob(userID uint, r io.Reader) (blob, error) {
+	userDir := filepath.Join("storage", fmt.Sprintf("%d", userID))
+	if err := os.MkdirAll(userDir, 0755); err != nil {
+		return blob{}, err
+	}
+
+	// The start of the content gives its type and a trial compression
+	br := bufio.NewReaderSize(r, blobcompress.SampleSize)
+	sample, err := br.Peek(blobcompress.SampleSize)
+	if err != nil && err != io.EOF {
+		return blob{}, err
+	}
+	mimeType, ext, err := metadata.Detect(bytes.NewReader(sample))
+	if err != nil {
+		return blob{}, err
+	}
+	compress := a.Compress && blobcompress.Worthwhile(mimeType, sample)
+
+	tmp, err := os.CreateTemp(userDir, ".upload-*")
+	if err != nil {
+		return blob{}, err
+	}
+
+	// Stop reading once the content is past the quota rather than at its end
+	var body io.Reader = br
+	left, err := a.quotaLeft(userID)
+	if err == nil && left >= 0 {
+		body = io.LimitReader(br, left+1)
+	}
+	var size, storedSize int64
+	var fileHash string
+	if err == nil {
+		size, fileHash, storedSize, err = a.writeBlob(tmp, body, compress)
+	}
+	if err == nil && left >= 0 && size > left {
+		err = errQuotaExceeded
+	}
+	if err == nil {
+		// Make sure the content is on disk before the blob is named by its hash
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = a.checkQuota(userID, size)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return blob{}, err
+	}
+
+	content, err := blobcrypt.Open(tmp.Name(), a.Keys)
+	if err == nil && compress {
+		raw := content
+		if content, err = blobcompress.Open(raw); err != nil {
+			raw.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return blob{}, err
+	}
+	meta := metadata.Extract(content, size, mimeType)
+	content.Close()
+
+	stored := blob{Path: filepath.Join(userDir, fmt.Sprintf("%s%s", fileHash, ext)), Hash: fileHash,
+		Size: size, MimeType: mimeType, Metadata: meta}
+	if compress {
+		stored.Path += blobcompress.Ext
+		stored.Compression = blobcompress.Gzip
+		stored.StoredSize = storedSize
+	}
+	if err := os.Rename(tmp.Name(), stored.Path); err != nil {
+		os.Remove(tmp.Name())
+		return blob{}, err
+	}
+	return stored, nil
+}
+
+// writeBlob copies r to dst, compressed when compress is set and encrypted when
+// a master key is configured. It returns the size and SHA-256 of the original
+// content and its compressed size, 0 when it is not compressed.
+func (a *App) writeBlob(dst io.Writer, r io.Reader, compress bool) (int64, string, int64, error) {
+	var err error
+	var ew *blobcrypt.Writer
+	var zw *blobcompress.Writer
+	if a.Keys != nil {
+		if ew, err = blobcrypt.NewWriter(dst, a.Keys); err != nil {
+			return 0, "", 0, err
+		}
+		dst = ew
+	}
+	if compress {
+		if zw, err = blobcompress.NewWriter(dst); err != nil {
+			return 0, "", 0, err
+		}
+		dst = zw
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), r)
+	var storedSize int64
+	if err == nil && zw != nil {
+		err = zw.Close()
+		storedSize = zw.Written()
+	}
+	if err == nil && ew != nil {
+		err = ew.Close()
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), storedSize, err
+}
+
+var (
+	errScanPending = errors.New("file is waiting for its malware scan")
+	errScanFailed  = errors.New("file could not be scanned for malware")
+	errInfected    = errors.New("file is quarantined as infected")
+	errExpired     = errors.New("file has expired")
+)
+
+// openBlob returns the original content of file, decrypted, decompressed and
+// reassembled from its chunks. Files whose malware scan is pending or found
+// them infected cannot be opened, nor can expired files awaiting the sweeper.
+func (a *App) openBlob(file *models.File) (blobcrypt.Blob, error) {
+	if err := a.readable(file); err != nil {
+		return nil, err
+	}
+	return chunkstore.OpenFile(file.Path, a.Keys)
+}
+
+// readable tells why the content of file is held back, if it is.
+func (a *App) readable(file *models.File) error {
+	if file.Expired(time.Now()) {
+		return errExpired
+	}
+	switch file.ScanStatus {
+	case models.ScanPending:
+		return errScanPending
+	case models.ScanInfected:
+		return errInfected
+	case models.ScanFailed:
+		if !a.ScanFailOpen {
+			return errScanFailed
+		}
+	}
+	return nil
+}
+
+// unreadableScans lists the scan statuses whose content readable holds back.
+func (a *App) unreadableScans() []string {
+	if a.ScanFailOpen {
+		return []string{models.ScanPending, models.ScanInfected}
+	}
+	return []string{models.ScanPending, models.ScanInfected, models.ScanFailed}
+}
+
+// heldBack writes the response for the errors of readable, reporting whether
+// err was one of them.
+func heldBack(c *gin.Context, file *models.File, err error) bool {
+	switch err {
+	case errExpired:
+		c.JSON(http.StatusGone, gin.H{"error": "File has expired", "file_id": file.ID})
+	case errScanPending:
+		c.JSON(http.StatusConflict, gin.H{"error": "File is waiting for its malware scan, try again shortly", "file_id": file.ID})
+	case errScanFailed:
+		c.JSON(http.StatusForbidden, gin.H{"error": "File is held back: its malware scan failed (" + file.ScanResult + ")", "file_id": file.ID})
+	case errInfected:
+		c.JSON(http.StatusForbidden, gin.H{"error": "File is quarantined: malware found (" + file.ScanResult + ")", "file_id": file.ID})
+	default:
+		return false
+	}
+	return true
+}
+
+// serveBlob writes the content of file, honouring Range and conditional headers,
+// and counts the download against the file's limit.
+func (a *App) serveBlob(c *gin.Context, file *models.File) {
+	content, err := a.openBlob(file)
+	if heldBack(c, file, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer content.Close()
+
+	if err := a.countRequest(c.Request, file); heldBack(c, file, err) {
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	http.ServeContent(c.Writer, c.Request, file.Name, file.LastModified, content)
+}
+
+// releaseBlob deletes a blob from disk once no file record refers to it any more.
+func (a *App) releaseBlob(blobPath string) error {
+	if blobPath == "" {
+		return nil
+	}
+
+	var refs int64
+	if err := a.DB.Model(&models.File{}).Where("path = ?", blobPath).Count(&refs).Error; err != nil {
+		return err
+	}
+	if refs > 0 {
+		return nil
+	}
+
+	// A manifest gives up its chunks with it
+	var chunks []chunkstore.Ref
+	if strings.HasSuffix(blobPath, chunkstore.Ext) {
+		var err error
+		if chunks, err = chunkstore.LoadManifest(blobPath, a.Keys); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := a.releaseChunks(filepath.Dir(blobPath), chunks); err != nil {
+		return err
+	}
+
+	// Thumbnails are shared by every file with the same content
+	hash, _, _ := strings.Cut(filepath.Base(blobPath), ".")
+	if err := a.DB.Model(&models.File{}).Where("hash = ?", hash).Count(&refs).Error; err == nil && refs == 0 {
+		a.Thumbnails.Remove(hash)
+	}
+	return nil
+}
+
+// removeFile deletes a single file record and its blob if unshared.
+func (a *App) removeFile(file *models.File) error {
+	scope, err := a.retentionScope()
+	if err != nil {
+		return err
+	}
+	return a.removeWithin(scope, file)
+}
+
+// removeWithin is removeFile with the retention rules already loaded into scope.
+func (a *App) removeWithin(scope *retentionScope, file *models.File) error {
+	if err := scope.checkTree(file); err != nil {
+		return err
+	}
+	// Collected before the shares go, so recipients still hear of the delete
+	recipients, _ := a.shareRecipients(file.ID)
+	if err := a.DB.Delete(file).Error; err != nil {
+		return err
+	}
+	a.DB.Where("file_id = ?", file.ID).Delete(&models.DavProperty{})
+	a.DB.Model(file).Association("Tags").Clear()
+	a.DB.Unscoped().Where("file_id = ?", file.ID).Delete(&models.Share{})
+	a.DB.Unscoped().Where("file_id = ?", file.ID).Delete(&models.FileKey{})
+
+	data := gin.H{"name": file.Name}
+	if len(recipients) > 0 {
+		data["shared_with"] = recipients
+	}
+	a.Events.Publish(events.Event{
+		Type:   events.FileDeleted,
+		UserID: file.UserID,
+		FileID: &file.ID,
+		Data:   data,
+	})
+
+	return a.releaseBlob(file.Path)
+}
+
+// removeTree deletes a file, or a folder together with everything below it.
+func (a *App) removeTree(file *models.File) error {
+	scope, err := a.retentionScope()
+	if err != nil {
+		return err
+	}
+	// Check everything first, so a held file does not leave the folder half deleted
+	if err := scope.checkTree(file); err != nil {
+		return err
+	}
+	return a.removeAll(scope, file)
+}
+
+func (a *App) removeAll(scope *retentionScope, file *models.File) error {
+	if file.IsDir {
+		children, err := a.listChildren(file.UserID, &file.ID)
+		if err != nil {
+			return err
+		}
+		for i := range children {
+			if err := a.removeAll(scope, &children[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return a.removeWithin(scope, file)
+}
+
+func inFolder(db *gorm.DB, parentID *uint) *gorm.DB {
+	if parentID == nil {
+		return db.Where("parent_id IS NULL")
+	}
+	return db.Where("parent_id = ?", *parentID)
+}
+
+func (a *App) listChildren(userID uint, parentID *uint) ([]models.File, error) {
+	var files []models.File
+	err := inFolder(a.DB.Where("user_id = ?", userID), parentID).Order("is_dir desc, name").Find(&files).Error
+	return files, err
+}
+
+// lookupChild finds an entry by name inside a folder; os.ErrNotExist is returned when absent.
+func (a *App) lookupChild(userID uint, parentID *uint, name string) (*models.File, error) {
+	var file models.File
+	err := inFolder(a.DB.Where("user_id = ? AND name = ?", userID, name), parentID).Order("id desc").First(&file).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// lookupPath resolves a slash-separated path in the user's drive.
+// The root folder resolves to a nil file.
+func (a *App) lookupPath(userID uint, p string) (*models.File, error) {
+	var current *models.File
+	for _, name := range splitPath(p) {
+		if current != nil && !current.IsDir {
+			return nil, os.ErrNotExist
+		}
+		var parentID *uint
+		if current != nil {
+			parentID = &current.ID
+		}
+
+		next, err := a.lookupChild(userID, parentID, name)
+		if err != nil {
+			return nil, err
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// lookupParent resolves the folder that would contain p and returns it with p's base name.
+func (a *App) lookupParent(userID uint, p string) (*uint, string, error) {
+	parts := splitPath(p)
+	if len(parts) == 0 {
+		return nil, "", os.ErrInvalid
+	}
+
+	parent, err := a.lookupPath(userID, strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	if parent == nil {
+		return nil, parts[len(parts)-1], nil
+	}
+	if !parent.IsDir {
+		return nil, "", os.ErrNotExist
+	}
+	return &parent.ID, parts[len(parts)-1], nil
+}
+
+func (a *App) makeDir(userID uint, parentID *uint, name string) (*models.File, error) {
+	if _, err := a.lookupChild(userID, parentID, name); err == nil {
+		return nil, os.ErrExist
+	} else if err != os.ErrNotExist {
+		return nil, err
+	}
+
+	dir := models.File{
+		UserID:       userID,
+		Name:         name,
+		IsDir:        true,
+		ParentID:     parentID,
+		LastModified: time.Now(),
+	}
+	if err := a.DB.Create(&dir).Error; err != nil {
+		return nil, err
+	}
+
+	a.Events.Publish(events.Event{
+		Type:   events.FolderCreated,
+		UserID: userID,
+		FileID: &dir.ID,
+		Data:   gin.H{"name": name, "parent_id": parentID},
+	})
+	return &dir, nil
+}
+
+// writeFile stores r as name inside a folder, replacing the content of an existing file of that name.
+func (a *App) writeFile(userID uint, parentID *uint, name string, r io.Reader) (*models.File, error) {
+	existing, err := a.lookupChild(userID, parentID, name)
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	if existing != nil && existing.IsDir {
+		return nil, os.ErrExist
+	}
+
+	stored, err := a.storeBlob(userID, r)
+	if err != nil {
+		return nil, err
+	}
+	return a.saveFile(userID, parentID, name, existing, stored)
+}
+
+// saveFile records a stored blob as name inside a folder, as a new version of
+// existing when there is one. The blob is released if the record cannot be saved.
+func (a *App) saveFile(userID uint, parentID *uint, name string, existing *models.File, stored blob) (*models.File, error) {
+	file := existing
+	oldPath := ""
+	if file == nil {
+		file = &models.File{UserID: userID, Name: name, ParentID: parentID}
+	} else {
+		// Versions are replaced in place, so held and retained files are not
+		if err := a.checkRetention(file); err != nil {
+			a.releaseBlob(stored.Path)
+			return nil, err
+		}
+		oldPath = file.Path
+		file.Version++
+	}
+	file.Path = stored.Path
+	file.Hash = stored.Hash
+	file.Size = stored.Size
+	file.MimeType = stored.MimeType
+	file.Metadata = stored.Metadata
+	file.Compression = stored.Compression
+	file.StoredSize = stored.StoredSize
+	file.ScanStatus = ""
+	if a.ScanUploads {
+		file.ScanStatus = models.ScanPending
+	}
+	file.ScanResult = ""
+	file.ScannedAt = nil
+	file.ExpiresAt = nil
+	file.MaxDownloads = 0
+	file.DownloadCount = 0
+	file.LastModified = time.Now()
+
+	if err := a.DB.Save(file).Error; err != nil {
+		a.releaseBlob(stored.Path)
+		return nil, err
+	}
+	if oldPath != "" && oldPath != stored.Path {
+		a.releaseBlob(oldPath)
+	}
+
+	a.Events.Publish(events.Event{
+		Type:   events.FileUploaded,
+		UserID: userID,
+		FileID: &file.ID,
+		Data:   gin.H{"name": file.Name, "size": file.Size, "hash": file.Hash},
+	})
+
+	return file, nil
+}
+
+// isWithin reports whether folder parentID is file itself or lies below it.
+func (a *App) isWithin(parentID *uint, file *models.File) (bool, error) {
+	for id := parentID; id != nil; {
+		if *id == file.ID {
+			return true, nil
+		}
+		var parent models.File
+		if err := a.DB.Select("id", "parent_id").First(&parent, *id).Error; err != nil {
+			return false, err
+		}
+		id = parent.ParentID
+	}
+	return false, nil
+}
+
+// moveFile renames a file or folder and moves it under a new parent.
+func (a *App) moveFile(file *models.File, parentID *uint, name string) error {
+	// A folder cannot be moved into itself or one of its descendants
+	if within, err := a.isWithin(parentID, file); err != nil || within {
+		if err == nil {
+			err = os.ErrInvalid
+		}
+		return err
+	}
+	// Moving, or renaming a folder, could take files out of a rule's folder
+	moved := (parentID == nil) != (file.ParentID == nil) || (parentID != nil && *parentID != *file.ParentID)
+	if moved || (file.IsDir && name != file.Name) {
+		if err := a.checkRetention(file); err != nil {
+			return err
+		}
+	}
+
+	err := a.DB.Model(file).Updates(map[string]interface{}{
+		"parent_id": parentID,
+		"name":      name,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	a.Events.Publish(events.Event{
+		Type:   events.FileMoved,
+		UserID: file.UserID,
+		FileID: &file.ID,
+		Data:   gin.H{"name": name, "parent_id": parentID},
+	})
+	return nil
+}
+
+// copyTree copies a file, or a folder with everything below it, as name inside
+// parentID. Copies share the original's blob, so only the quota grows.
+func (a *App) copyTree(file *models.File, parentID *uint, name string) (*models.File, error) {
+	if within, err := a.isWithin(parentID, file); err != nil || within {
+		if err == nil {
+			err = os.ErrInvalid
+		}
+		return nil, err
+	}
+	if _, err := a.lookupChild(file.UserID, parentID, name); err == nil {
+		return nil, os.ErrExist
+	} else if err != os.ErrNotExist {
+		return nil, err
+	}
+
+	if file.IsDir {
+		dir, err := a.makeDir(file.UserID, parentID, name)
+		if err != nil {
+			return nil, err
+		}
+		children, err := a.listChildren(file.UserID, &file.ID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range children {
+			if _, err := a.copyTree(&children[i], &dir.ID, children[i].Name); err != nil {
+				return nil, err
+			}
+		}
+		return dir, nil
+	}
+
+	if err := a.checkQuota(file.UserID, file.Size); err != nil {
+		return nil, err
+	}
+	copied := models.File{
+		UserID:       file.UserID,
+		Name:         name,
+		Path:         file.Path,
+		Size:         file.Size,
+		Hash:         file.Hash,
+		MimeType:     file.MimeType,
+		Metadata:     file.Metadata,
+		Compression:  file.Compression,
+		StoredSize:   file.StoredSize,
+		ScanStatus:   file.ScanStatus,
+		ScanResult:   file.ScanResult,
+		ScannedAt:    file.ScannedAt,
+		ParentID:     parentID,
+		LastModified: time.Now(),
+	}
+	// The copy shares the blob, so it is as scanned as its source
+	if copied.ScanStatus == "" && a.ScanUploads {
+		copied.ScanStatus = models.ScanPending
+	}
+	if err := a.DB.Create(&copied).Error; err != nil {
+		return nil, err
+	}
+
+	a.Events.Publish(events.Event{
+		Type:   events.FileUploaded,
+		UserID: copied.UserID,
+		FileID: &copied.ID,
+		Data:   gin.H{"name": copied.Name, "size": copied.Size, "hash": copied.Hash},
+	})
+	return &copied, nil
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// makeDirAll walks names below parentID, creating any folders that are missing, and returns the last one.
+func (a *App) makeDirAll(userID uint, parentID *uint, names []string) (*uint, error) {
+	for _, name := range names {
+		dir, err := a.lookupChild(userID, parentID, name)
+		if err == os.ErrNotExist {
+			dir, err = a.makeDir(userID, parentID, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !dir.IsDir {
+			return nil, os.ErrExist
+		}
+		parentID = &dir.ID
+	}
+	return parentID, nil
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// End-to-end encrypted files are opaque to the server: it stores the keys the
+// desktop client needs without being able to use them.
+const (
+	publicKeySize  = 32 // X25519
+	maxSealedKeys  = 4 << 10
+	maxWrappedKey  = 1 << 10
+	e2eNotSetUpMsg = "End-to-end encryption is not set up"
+)
+
+type UserKeyRequest struct {
+	PublicKey  string `json:"public_key" binding:"required"`
+	SealedKeys string `json:"sealed_keys" binding:"required"`
+}
+
+type FileKeyRequest struct {
+	Username   string `json:"username" binding:"required"`
+	WrappedKey string `json:"wrapped_key" binding:"required"`
+}
+
+// validKey reports whether s is base64 of at most max bytes, or exactly max
+// bytes when exact is set.
+func validKey(s string, max int, exact bool) bool {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) == 0 || len(key) > max {
+		return false
+	}
+	return !exact || len(key) == max
+}
+
+// GetUserKey returns the user's public key and passphrase-sealed secret keys.
+func (a *App) GetUserKey(c *gin.Context) {
+	var key models.UserKey
+	if err := a.DB.Where("user_id = ?", c.MustGet("userID").(uint)).First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": e2eNotSetUpMsg})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_key": key})
+}
+
+// PutUserKey stores the user's keys, either the first time or after the
+// passphrase changed. File keys wrapped for a replaced public key can no longer
+// be opened, so they are dropped.
+func (a *App) PutUserKey(c *gin.Context) {
+	var req UserKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !validKey(req.PublicKey, publicKeySize, true) || !validKey(req.SealedKeys, maxSealedKeys, false) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key"})
+		return
+	}
+
+	userID := c.MustGet("userID").(uint)
+	key := models.UserKey{UserID: userID}
+	err := a.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(&key).FirstOrInit(&key).Error; err != nil {
+			return err
+		}
+		if key.ID != 0 && key.PublicKey != req.PublicKey {
+			if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&models.FileKey{}).Error; err != nil {
+				return err
+			}
+		}
+		key.PublicKey = req.PublicKey
+		key.SealedKeys = req.SealedKeys
+		return tx.Save(&key).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_key": key})
+}
+
+// GetPublicKey returns the public key of another user, for wrapping file keys
+// to share with them.
+func (a *App) GetPublicKey(c *gin.Context) {
+	var user models.User
+	if err := a.DB.Where("username = ?", c.Param("username")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	var key models.UserKey
+	if err := a.DB.Where("user_id = ?", user.ID).First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User has not set up end-to-end encryption"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user_id": user.ID, "username": user.Username, "public_key": key.PublicKey})
+}
+
+// PutFileKey stores the key of one of the user's files wrapped for another user.
+// It does not grant access to the file; share it as well.
+func (a *App) PutFileKey(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	var req FileKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !validKey(req.WrappedKey, maxWrappedKey, false) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key"})
+		return
+	}
+
+	var file models.File
+	if err := a.DB.Where("id = ? AND user_id = ? AND is_dir = ?", c.Param("id"), userID, false).First(&file).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	var recipient models.User
+	if err := a.DB.Where("username = ?", req.Username).First(&recipient).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if recipient.ID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot share with yourself"})
+		return
+	}
+
+	key := models.FileKey{FileID: file.ID, UserID: recipient.ID}
+	if err := a.DB.Where(&key).FirstOrInit(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file key"})
+		return
+	}
+	key.WrappedKey = req.WrappedKey
+	if err := a.DB.Save(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"file_key": key})
+}
+
+// GetFileKey returns the key of a file its owner wrapped for the user.
+func (a *App) GetFileKey(c *gin.Context) {
+	var key models.FileKey
+	if err := a.DB.Where("file_id = ? AND user_id = ?", c.Param("id"), c.MustGet("userID").(uint)).First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File key not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"file_key": key})
+}
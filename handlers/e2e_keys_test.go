@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestE2EKeys(t *testing.T) {
+	a, bob := newTestApp(t)
+	alice := &models.User{Username: "alice", Password: "-"}
+	a.DB.Create(alice)
+
+	routers := map[*models.User]*gin.Engine{}
+	for _, user := range []*models.User{bob, alice} {
+		r := gin.New()
+		r.Use(as(user))
+		r.GET("/e2e-keys", a.GetUserKey)
+		r.PUT("/e2e-keys", a.PutUserKey)
+		r.GET("/e2e-keys/:username", a.GetPublicKey)
+		r.PUT("/files/:id/key", a.PutFileKey)
+		r.GET("/files/:id/key", a.GetFileKey)
+		routers[user] = r
+	}
+	call := func(user *models.User, method, path, body string, want int) map[string]json.RawMessage {
+		t.Helper()
+		w := httptest.NewRecorder()
+		routers[user].ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if w.Code != want {
+			t.Fatalf("%s %s %s = %d %s, want %d", method, path, body, w.Code, w.Body, want)
+		}
+		var resp map[string]json.RawMessage
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+	key := func(n int, fill byte) string {
+		return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(fill), n)))
+	}
+
+	call(bob, "GET", "/e2e-keys", "", http.StatusNotFound)
+	call(bob, "GET", "/e2e-keys/alice", "", http.StatusNotFound)
+	for _, body := range []string{
+		`{"public_key": "` + key(31, 'a') + `", "sealed_keys": "` + key(64, 's') + `"}`,
+		`{"public_key": "` + key(32, 'a') + `", "sealed_keys": "not base64!"}`,
+		`{"public_key": "` + key(32, 'a') + `", "sealed_keys": "` + key(maxSealedKeys+1, 's') + `"}`,
+		`{"public_key": "` + key(32, 'a') + `"}`,
+	} {
+		call(alice, "PUT", "/e2e-keys", body, http.StatusBadRequest)
+	}
+	call(alice, "PUT", "/e2e-keys", `{"public_key": "`+key(32, 'a')+`", "sealed_keys": "`+key(64, 's')+`"}`, http.StatusOK)
+	if got := call(bob, "GET", "/e2e-keys/alice", "", http.StatusOK)["public_key"]; string(got) != `"`+key(32, 'a')+`"` {
+		t.Errorf("alice's public key = %s", got)
+	}
+
+	// Only the owner of a file can hand out its key, and only to someone else
+	file, err := a.writeFile(bob.ID, nil, "secret.bin", strings.NewReader("ciphertext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/files/%d/key", file.ID)
+	wrapped := `{"username": "alice", "wrapped_key": "` + key(48, 'w') + `"}`
+	call(alice, "PUT", path, `{"username": "bob", "wrapped_key": "`+key(48, 'w')+`"}`, http.StatusNotFound)
+	call(bob, "PUT", path, `{"username": "bob", "wrapped_key": "`+key(48, 'w')+`"}`, http.StatusBadRequest)
+	call(bob, "PUT", path, `{"username": "carol", "wrapped_key": "`+key(48, 'w')+`"}`, http.StatusNotFound)
+	call(bob, "PUT", path, `{"username": "alice", "wrapped_key": "`+key(maxWrappedKey+1, 'w')+`"}`, http.StatusBadRequest)
+	call(bob, "PUT", path, wrapped, http.StatusOK)
+	call(bob, "PUT", path, `{"username": "alice", "wrapped_key": "`+key(48, 'v')+`"}`, http.StatusOK)
+
+	var fileKey models.FileKey
+	json.Unmarshal(call(alice, "GET", path, "", http.StatusOK)["file_key"], &fileKey)
+	if fileKey.WrappedKey != key(48, 'v') {
+		t.Errorf("alice got wrapped key %q, want the replaced one", fileKey.WrappedKey)
+	}
+	call(bob, "GET", path, "", http.StatusNotFound)
+
+	// Replacing the public key drops file keys wrapped for the old one, but a
+	// new passphrase alone keeps them
+	call(alice, "PUT", "/e2e-keys", `{"public_key": "`+key(32, 'a')+`", "sealed_keys": "`+key(64, 't')+`"}`, http.StatusOK)
+	call(alice, "GET", path, "", http.StatusOK)
+	call(alice, "PUT", "/e2e-keys", `{"public_key": "`+key(32, 'b')+`", "sealed_keys": "`+key(64, 't')+`"}`, http.StatusOK)
+	call(alice, "GET", path, "", http.StatusNotFound)
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloud-storage/models"
+)
+
+func TestDownloadLimit(t *testing.T) {
+	a, user := newTestApp(t)
+	g := a.Router.Group("/dav", as(user))
+	for _, method := range WebDAVMethods {
+		g.Handle(method, "/*path", a.WebDAV)
+	}
+	a.Router.GET("/files/:id/download", as(user), a.DownloadFile)
+	srv := httptest.NewServer(a.Router)
+	t.Cleanup(srv.Close)
+
+	dav(t, srv, "PUT", "/dav/a.txt", nil, "limited", http.StatusCreated)
+	var file models.File
+	if err := a.DB.Where("name = ?", "a.txt").First(&file).Error; err != nil {
+		t.Fatal(err)
+	}
+	a.DB.Model(&file).Update("max_downloads", 2)
+	download := fmt.Sprintf("/files/%d/download", file.ID)
+
+	// Ranges would let a client take the file a piece at a time
+	ranged := map[string]string{"Range": "bytes=3-"}
+	if got := readBody(t, dav(t, srv, "GET", "/dav/a.txt", ranged, "", http.StatusOK)); got != "limited" {
+		t.Errorf("ranged WebDAV GET = %q, want the whole file", got)
+	}
+	dav(t, srv, "HEAD", "/dav/a.txt", nil, "", http.StatusOK)
+	if got := readBody(t, dav(t, srv, "GET", download, ranged, "", http.StatusOK)); got != "limited" {
+		t.Errorf("ranged GET = %q, want the whole file", got)
+	}
+
+	dav(t, srv, "GET", download, nil, "", http.StatusGone)
+	dav(t, srv, "GET", "/dav/a.txt", nil, "", http.StatusGone)
+	a.DB.First(&file, file.ID)
+	if file.DownloadCount != 2 {
+		t.Errorf("download_count = %d, want 2", file.DownloadCount)
+	}
+}
+
+func TestUploadExpiryOnExistingContent(t *testing.T) {
+	a, user := newTestApp(t)
+	a.Router.POST("/upload", as(user), a.UploadFile)
+
+	upload := func(fields map[string]string) {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "a.txt")
+		fw.Write([]byte("same content"))
+		for k, v := range fields {
+			mw.WriteField(k, v)
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", "/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload = %d %s", w.Code, w.Body)
+		}
+	}
+
+	upload(nil)
+	// The second upload resolves to the first file, which takes its limit
+	upload(map[string]string{"max_downloads": "1"})
+
+	var files []models.File
+	a.DB.Where("name = ?", "a.txt").Find(&files)
+	if len(files) != 1 || files[0].MaxDownloads != 1 {
+		t.Errorf("files = %+v, want one limited to a single download", files)
+	}
+}
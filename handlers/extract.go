@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits that keep a small archive from expanding into something huge.
+const (
+	maxExtractEntries = 10000
+	maxExtractSize    = 10 << 30
+	maxExtractRatio   = 100
+	// Archives below this size may expand past the ratio, since tiny archives of
+	// repetitive text legitimately compress very well
+	minExtractBudget = 64 << 20
+)
+
+var (
+	errTooManyEntries  = fmt.Errorf("archive has more than %d entries", maxExtractEntries)
+	errExtractTooLarge = errors.New("archive expands too much, refusing to extract it")
+)
+
+// extractResult reports what happened to one archive entry.
+type extractResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // created, updated, skipped or failed
+	FileID uint   `json:"file_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// extractor writes archive entries below a folder of the user's drive.
+type extractor struct {
+	app      *App
+	userID   uint
+	parentID *uint
+	budget   int64 // bytes left before the archive counts as a bomb
+	entries  int
+	results  []extractResult
+}
+
+// extractUpload unpacks an uploaded archive into the folder named by the target
+// form field, by default a new root folder named after the archive.
+func (a *App) extractUpload(c *gin.Context, file multipart.File, header *multipart.FileHeader) {
+	userID := c.MustGet("userID").(uint)
+
+	format := ""
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(strings.ToLower(header.Filename), ext) {
+			format = ext
+			break
+		}
+	}
+	if format == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported archive, use .zip, .tar or .tar.gz"})
+		return
+	}
+	target := c.DefaultPostForm("target", header.Filename[:len(header.Filename)-len(format)])
+
+	parentID, err := a.makeDirAll(userID, nil, splitPath(target))
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Target folder could not be created"})
+		return
+	}
+
+	x := &extractor{
+		app:      a,
+		userID:   userID,
+		parentID: parentID,
+		budget:   min(maxExtractSize, max(header.Size*maxExtractRatio, minExtractBudget)),
+		results:  []extractResult{},
+	}
+	switch format {
+	case ".zip":
+		err = x.extractZip(file, header.Size)
+	case ".tar":
+		err = x.extractTar(file)
+	default:
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(file); err == nil {
+			err = x.extractTar(gz)
+		}
+	}
+
+	status := http.StatusOK
+	response := gin.H{"folder_id": parentID, "results": x.results}
+	switch {
+	case err == errQuotaExceeded:
+		status = http.StatusRequestEntityTooLarge
+		response["error"] = "Storage quota exceeded"
+	case err != nil:
+		// Entries written before the failure are kept and listed in results
+		status = http.StatusUnprocessableEntity
+		response["error"] = err.Error()
+	}
+	c.JSON(status, response)
+}
+
+func (x *extractor) extractZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	if len(zr.File) > maxExtractEntries {
+		return errTooManyEntries
+	}
+
+	// The declared sizes allow rejecting an obvious bomb before writing anything;
+	// budgetReader still enforces the limit in case they lie
+	var total uint64
+	for _, f := range zr.File {
+		total += f.UncompressedSize64
+	}
+	if total > uint64(x.budget) {
+		return errExtractTooLarge
+	}
+
+	for _, f := range zr.File {
+		mode := f.Mode()
+		switch {
+		case mode&os.ModeSymlink != 0:
+			x.skip(f.Name, "symbolic links are not extracted")
+		case mode.IsDir():
+			x.dir(f.Name)
+		case !mode.IsRegular():
+			x.skip(f.Name, "not a regular file")
+		default:
+			rc, err := f.Open()
+			if err != nil {
+				x.fail(f.Name, err)
+				continue
+			}
+			err = x.file(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if x.entries++; x.entries > maxExtractEntries {
+			return errTooManyEntries
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			x.dir(hdr.Name)
+		case tar.TypeReg:
+			if hdr.Size > x.budget {
+				return errExtractTooLarge
+			}
+			if err := x.file(hdr.Name, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			x.skip(hdr.Name, "links are not extracted")
+		case tar.TypeXGlobalHeader:
+		default:
+			x.skip(hdr.Name, "not a regular file")
+		}
+	}
+}
+
+// entryPath splits an entry name into folder names, rejecting absolute paths and
+// any that climb out of the target with "..".
+func entryPath(name string) ([]string, bool) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return nil, false
+	}
+
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			return nil, false
+		default:
+			parts = append(parts, part)
+		}
+	}
+	return parts, len(parts) > 0
+}
+
+func (x *extractor) dir(name string) {
+	parts, ok := entryPath(name)
+	if !ok {
+		x.skip(name, "unsafe path")
+		return
+	}
+	if _, err := x.app.makeDirAll(x.userID, x.parentID, parts); err != nil {
+		x.fail(name, err)
+		return
+	}
+	x.results = append(x.results, extractResult{Name: name, Status: "created"})
+}
+
+// file writes one entry. Only errors that should stop the whole extraction are
+// returned; anything else is recorded in the entry's result.
+func (x *extractor) file(name string, r io.Reader) error {
+	parts, ok := entryPath(name)
+	if !ok {
+		x.skip(name, "unsafe path")
+		return nil
+	}
+
+	dirID, err := x.app.makeDirAll(x.userID, x.parentID, parts[:len(parts)-1])
+	if err != nil {
+		x.fail(name, err)
+		return nil
+	}
+
+	file, err := x.app.writeFile(x.userID, dirID, parts[len(parts)-1], &budgetReader{r: r, left: &x.budget})
+	if err == errExtractTooLarge || err == errQuotaExceeded {
+		x.fail(name, err)
+		return err
+	}
+	if err != nil {
+		x.fail(name, err)
+		return nil
+	}
+
+	status := "created"
+	if file.Version > 1 {
+		status = "updated"
+	}
+	x.results = append(x.results, extractResult{Name: name, Status: status, FileID: file.ID})
+	return nil
+}
+
+func (x *extractor) skip(name, reason string) {
+	x.results = append(x.results, extractResult{Name: name, Status: "skipped", Error: reason})
+}
+
+func (x *extractor) fail(name string, err error) {
+	msg := err.Error()
+	if err == os.ErrExist {
+		msg = "a file or folder of that name is in the way"
+	}
+	x.results = append(x.results, extractResult{Name: name, Status: "failed", Error: msg})
+}
+
+// budgetReader fails once more than the remaining budget has been read.
+type budgetReader struct {
+	r    io.Reader
+	left *int64
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if *b.left -= int64(n); *b.left < 0 {
+		return n, errExtractTooLarge
+	}
+	return n, err
+}
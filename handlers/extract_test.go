@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud-storage/models"
+)
+
+func TestEntryPath(t *testing.T) {
+	for name, want := range map[string][]string{
+		"a/b/c.txt":          {"a", "b", "c.txt"},
+		"./a//b/":            {"a", "b"},
+		`dir\file.txt`:       {"dir", "file.txt"},
+		"../evil.txt":        nil,
+		"a/../../evil.txt":   nil,
+		`..\evil.txt`:        nil,
+		"/etc/passwd":        nil,
+		`C:\Windows\win.ini`: nil,
+		"./":                 nil,
+	} {
+		parts, ok := entryPath(name)
+		if ok != (want != nil) || !reflect.DeepEqual(parts, want) {
+			t.Errorf("entryPath(%q) = %q, %v, want %q", name, parts, ok, want)
+		}
+	}
+}
+
+func TestBudgetReader(t *testing.T) {
+	left := int64(10)
+	r := &budgetReader{r: strings.NewReader("0123456789"), left: &left}
+	if data, err := io.ReadAll(r); err != nil || len(data) != 10 {
+		t.Errorf("reading exactly the budget = %d bytes, %v", len(data), err)
+	}
+
+	// The budget is shared, so the next entry starts with nothing left
+	r = &budgetReader{r: strings.NewReader("x"), left: &left}
+	if _, err := io.ReadAll(r); err != errExtractTooLarge {
+		t.Errorf("reading past the budget = %v, want errExtractTooLarge", err)
+	}
+}
+
+func TestExtractUpload(t *testing.T) {
+	a, user := newTestApp(t)
+	a.Router.POST("/upload", as(user), a.UploadFile)
+
+	upload := func(name string, archive []byte, want int) map[string]string {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("extract", "true")
+		part, _ := mw.CreateFormFile("file", name)
+		part.Write(archive)
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("extracting %s = %d %s, want %d", name, w.Code, w.Body, want)
+		}
+		var resp struct{ Results []extractResult }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		statuses := map[string]string{}
+		for _, r := range resp.Results {
+			statuses[r.Name] = r.Status
+		}
+		return statuses
+	}
+
+	// Entries that climb out of the target are skipped, the rest are written
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for name, content := range map[string]string{"docs/a.txt": "alpha", "../evil.txt": "x", "/abs.txt": "x"} {
+		f, _ := zw.Create(name)
+		f.Write([]byte(content))
+	}
+	zw.Close()
+	got := upload("bundle.zip", zipped.Bytes(), http.StatusOK)
+	want := map[string]string{"docs/a.txt": "created", "../evil.txt": "skipped", "/abs.txt": "skipped"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("zip results = %v, want %v", got, want)
+	}
+	var count int64
+	a.DB.Model(&models.File{}).Where("user_id = ? AND name = ?", user.ID, "evil.txt").Count(&count)
+	if count != 0 {
+		t.Error("an entry escaping the target was written")
+	}
+
+	// A small archive that expands past its budget is stopped
+	var bomb bytes.Buffer
+	zw = zip.NewWriter(&bomb)
+	f, _ := zw.Create("zeros.bin")
+	f.Write(make([]byte, minExtractBudget+1))
+	zw.Close()
+	upload("bomb.zip", bomb.Bytes(), http.StatusUnprocessableEntity)
+
+	// Tar headers are checked before anything is read
+	var tarred bytes.Buffer
+	tw := tar.NewWriter(&tarred)
+	tw.WriteHeader(&tar.Header{Name: "huge.bin", Mode: 0o644, Size: maxExtractSize + 1, Typeflag: tar.TypeReg})
+	tw.Flush()
+	upload("bomb.tar", tarred.Bytes(), http.StatusUnprocessableEntity)
+	a.DB.Model(&models.File{}).Where("user_id = ? AND name IN ?", user.ID, []string{"zeros.bin", "huge.bin"}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d entries of a bomb were written", count)
+	}
+}
@@ -0,0 +1,391 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud-storage/events"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// dropAttempts wrong passwords within dropWindow lock the address out of the
+	// file request for dropWindow from the last of them
+	dropAttempts = 5
+	dropWindow   = 15 * time.Minute
+)
+
+// dropFailures counts wrong file request passwords by token and client address.
+var (
+	dropFailuresMu sync.Mutex
+	dropFailures   = make(map[string]*dropFailure)
+)
+
+type dropFailure struct {
+	count  int
+	since  time.Time // of the first failure counted
+	locked time.Time // until when no password is tried
+}
+
+// dropLockedOut reports how long key must wait before trying a password again.
+func dropLockedOut(key string) time.Duration {
+	dropFailuresMu.Lock()
+	defer dropFailuresMu.Unlock()
+
+	if f, ok := dropFailures[key]; ok {
+		return max(time.Until(f.locked), 0)
+	}
+	return 0
+}
+
+// dropFailed records a wrong password for key, locking it out on the last one
+// allowed, and forgets failures older than the window.
+func dropFailed(key string) {
+	dropFailuresMu.Lock()
+	defer dropFailuresMu.Unlock()
+
+	now := time.Now()
+	for k, f := range dropFailures {
+		if now.Sub(f.since) >= dropWindow && now.After(f.locked) {
+			delete(dropFailures, k)
+		}
+	}
+	f, ok := dropFailures[key]
+	if !ok {
+		f = &dropFailure{since: now}
+		dropFailures[key] = f
+	}
+	if f.count++; f.count >= dropAttempts {
+		f.count, f.since, f.locked = 0, now, now.Add(dropWindow)
+	}
+}
+
+// FileRequestRequest creates a link through which people without an account
+// upload into FolderID. Extensions such as "pdf" limit the files accepted.
+type FileRequestRequest struct {
+	FolderID     uint       `json:"folder_id" binding:"required"`
+	Title        string     `json:"title"`
+	Password     string     `json:"password"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxFileSize  int64      `json:"max_file_size"`
+	Extensions   []string   `json:"extensions"`
+	RequireName  bool       `json:"require_name"`
+	RequireEmail bool       `json:"require_email"`
+}
+
+func (a *App) CreateFileRequest(c *gin.Context) {
+	var req FileRequestRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.MaxFileSize < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+	var extensions []string
+	for _, ext := range req.Extensions {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" || strings.ContainsAny(ext, `,./\`) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid extension: " + ext})
+			return
+		}
+		extensions = append(extensions, ext)
+	}
+	userID := c.MustGet("userID").(uint)
+
+	var folder models.File
+	if err := a.DB.Where("id = ? AND user_id = ? AND is_dir = ?", req.FolderID, userID, true).First(&folder).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Target folder not found"})
+		return
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create file request"})
+		return
+	}
+	token := hex.EncodeToString(buf)
+
+	request := models.FileRequest{
+		UserID:       userID,
+		FolderID:     folder.ID,
+		Title:        req.Title,
+		TokenHash:    models.HashToken(token),
+		ExpiresAt:    req.ExpiresAt,
+		MaxFileSize:  req.MaxFileSize,
+		Extensions:   strings.Join(extensions, ","),
+		RequireName:  req.RequireName,
+		RequireEmail: req.RequireEmail,
+	}
+	if err := request.SetPassword(req.Password); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+	if err := a.DB.Create(&request).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create file request"})
+		return
+	}
+
+	// Only the hash is stored, so this is the one chance to see the link
+	c.JSON(http.StatusCreated, gin.H{
+		"file_request": request,
+		"token":        token,
+		"url":          "/api/v1/drop/" + token,
+	})
+}
+
+func (a *App) ListFileRequests(c *gin.Context) {
+	var requests []models.FileRequest
+	if err := a.DB.Where("user_id = ?", c.MustGet("userID").(uint)).Order("created_at desc").Find(&requests).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch file requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"file_requests": requests})
+}
+
+// ListFileRequestUploads shows who uploaded what through a request.
+func (a *App) ListFileRequestUploads(c *gin.Context) {
+	var request models.FileRequest
+	if err := a.DB.Where("id = ? AND user_id = ?", c.Param("id"), c.MustGet("userID").(uint)).First(&request).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File request not found"})
+		return
+	}
+
+	var uploads []models.FileRequestUpload
+	if err := a.DB.Where("request_id = ?", request.ID).Order("created_at desc").Find(&uploads).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch uploads"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"uploads": uploads})
+}
+
+func (a *App) DeleteFileRequest(c *gin.Context) {
+	var request models.FileRequest
+	if err := a.DB.Where("id = ? AND user_id = ?", c.Param("id"), c.MustGet("userID").(uint)).First(&request).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File request not found"})
+		return
+	}
+
+	// The uploaded files stay in the folder
+	if err := a.DB.Unscoped().Delete(&request).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file request"})
+		return
+	}
+	a.DB.Unscoped().Where("request_id = ?", request.ID).Delete(&models.FileRequestUpload{})
+
+	c.JSON(http.StatusOK, gin.H{"message": "File request deleted successfully"})
+}
+
+// openFileRequest finds the request for the token in the URL, writing the
+// error response when it cannot be used.
+func (a *App) openFileRequest(c *gin.Context) (*models.FileRequest, bool) {
+	var request models.FileRequest
+	if err := a.DB.Where("token_hash = ?", models.HashToken(c.Param("token"))).First(&request).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File request not found"})
+		return nil, false
+	}
+	if request.ExpiresAt != nil && !time.Now().Before(*request.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "File request has expired"})
+		return nil, false
+	}
+	return &request, true
+}
+
+// GetFileRequest describes a request to the people uploading through it,
+// without revealing anything about the folder's contents.
+func (a *App) GetFileRequest(c *gin.Context) {
+	request, ok := a.openFileRequest(c)
+	if !ok {
+		return
+	}
+	var owner models.User
+	a.DB.Select("id", "username").First(&owner, request.UserID)
+
+	extensions := []string{}
+	if request.Extensions != "" {
+		extensions = strings.Split(request.Extensions, ",")
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"title":             request.Title,
+		"owner":             owner.Username,
+		"password_required": request.Password != "",
+		"expires_at":        request.ExpiresAt,
+		"max_file_size":     request.MaxFileSize,
+		"extensions":        extensions,
+		"require_name":      request.RequireName,
+		"require_email":     request.RequireEmail,
+	})
+}
+
+// DropFile stores a file uploaded through a request as a new file in its
+// folder, counted against the owner's quota. Names already taken are numbered
+// so nothing is replaced, and the response says nothing about other files.
+// The password comes in the X-Request-Password header, so that a wrong one is
+// refused before the upload is read.
+func (a *App) DropFile(c *gin.Context) {
+	request, ok := a.openFileRequest(c)
+	if !ok {
+		return
+	}
+	if request.Password != "" {
+		// The peer address, as headers naming the client can be made up per try
+		key := c.Param("token") + "|" + c.RemoteIP()
+		if wait := dropLockedOut(key); wait > 0 {
+			c.Header("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many wrong passwords, try again later"})
+			return
+		}
+		if !request.CheckPassword(c.GetHeader("X-Request-Password")) {
+			dropFailed(key)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Wrong password"})
+			return
+		}
+	}
+	if request.MaxFileSize > 0 {
+		// Leave room for the other form fields
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, request.MaxFileSize+1<<20)
+	}
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Files may be at most %d bytes", request.MaxFileSize)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+	defer file.Close()
+
+	name := strings.TrimSpace(c.PostForm("name"))
+	email := strings.TrimSpace(c.PostForm("email"))
+	if (request.RequireName && name == "") || (request.RequireEmail && email == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please give your name and email address"})
+		return
+	}
+	if email != "" {
+		if _, err := mail.ParseAddress(email); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+			return
+		}
+	}
+
+	fileName := path.Base(strings.ReplaceAll(header.Filename, `\`, "/"))
+	if fileName == "." || fileName == "/" || fileName == ".." {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name"})
+		return
+	}
+	if !allowedExtension(request, fileName) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Accepted file types: " + request.Extensions})
+		return
+	}
+	if request.MaxFileSize > 0 && header.Size > request.MaxFileSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Files may be at most %d bytes", request.MaxFileSize)})
+		return
+	}
+
+	var folder models.File
+	if err := a.DB.Where("id = ? AND user_id = ? AND is_dir = ?", request.FolderID, request.UserID, true).First(&folder).Error; err != nil {
+		c.JSON(http.StatusGone, gin.H{"error": "The folder of this file request no longer exists"})
+		return
+	}
+
+	if err := a.checkQuota(request.UserID, header.Size); err == errQuotaExceeded {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "The recipient's storage is full"})
+		return
+	}
+	stored, err := a.storeBlob(request.UserID, file)
+	if err == errQuotaExceeded {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "The recipient's storage is full"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+
+	target, err := a.freeName(request.UserID, &folder.ID, fileName)
+	if err != nil {
+		a.releaseBlob(stored.Path)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+	saved, err := a.saveFile(request.UserID, &folder.ID, target, nil, stored)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+		return
+	}
+
+	a.DB.Create(&models.FileRequestUpload{
+		RequestID: request.ID,
+		FileID:    saved.ID,
+		FileName:  saved.Name,
+		Size:      saved.Size,
+		Name:      name,
+		Email:     email,
+		IP:        c.ClientIP(),
+	})
+	a.DB.Model(request).UpdateColumn("uploads", gorm.Expr("uploads + 1"))
+
+	a.Events.Publish(events.Event{
+		Type:   events.FileDropped,
+		UserID: request.UserID,
+		FileID: &saved.ID,
+		Data: gin.H{
+			"name":       saved.Name,
+			"size":       saved.Size,
+			"request_id": request.ID,
+			"title":      request.Title,
+			"uploader":   name,
+			"email":      email,
+		},
+	})
+
+	c.JSON(http.StatusCreated, gin.H{"message": "File uploaded successfully", "size": saved.Size})
+}
+
+func allowedExtension(request *models.FileRequest, name string) bool {
+	if request.Extensions == "" {
+		return true
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	for _, allowed := range strings.Split(request.Extensions, ",") {
+		if ext == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// freeName numbers name as "name (1).ext" until no file in the folder has it.
+func (a *App) freeName(userID uint, parentID *uint, name string) (string, error) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; ; i++ {
+		_, err := a.lookupChild(userID, parentID, candidate)
+		if err == os.ErrNotExist {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
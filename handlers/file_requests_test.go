@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud-storage/models"
+)
+
+// unreadBody fails the test when the handler reads it.
+type unreadBody struct{ t *testing.T }
+
+func (b unreadBody) Read([]byte) (int, error) {
+	b.t.Error("upload read before the password was checked")
+	return 0, io.EOF
+}
+
+func TestDropFilePassword(t *testing.T) {
+	a, user := newTestApp(t)
+	a.Router.POST("/drop/:token", a.DropFile)
+
+	folder, err := a.makeDir(user.ID, nil, "Inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := models.FileRequest{UserID: user.ID, FolderID: folder.ID, TokenHash: models.HashToken("tok")}
+	if err := request.SetPassword("sesame"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DB.Create(&request).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var tries int
+	upload := func() (io.Reader, string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "report.txt")
+		fw.Write([]byte("quarterly numbers"))
+		mw.Close()
+		return &body, mw.FormDataContentType()
+	}
+
+	drop := func(password, addr string, body io.Reader, contentType string) int {
+		t.Helper()
+		// A made up forwarding header per try changes nothing
+		req := httptest.NewRequest("POST", "/drop/tok", body)
+		req.RemoteAddr = addr
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", tries))
+		tries++
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Request-Password", password)
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, req)
+		return w.Code
+	}
+	guess := func(addr string) int {
+		t.Helper()
+		return drop("guess", addr, unreadBody{t}, "multipart/form-data; boundary=x")
+	}
+
+	for i := 0; i < dropAttempts; i++ {
+		if code := guess("192.0.2.1:1000"); code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: got %d, want 401", i+1, code)
+		}
+	}
+	body, contentType := upload()
+	if code := drop("sesame", "192.0.2.1:1000", body, contentType); code != http.StatusTooManyRequests {
+		t.Errorf("after %d wrong passwords: got %d, want 429", dropAttempts, code)
+	}
+
+	// The lockout runs from the last wrong password, however long ago the first was
+	for i := 0; i < dropAttempts-1; i++ {
+		guess("192.0.2.3:1000")
+	}
+	dropFailuresMu.Lock()
+	dropFailures["tok|192.0.2.3"].since = time.Now().Add(-dropWindow + time.Minute)
+	dropFailuresMu.Unlock()
+	guess("192.0.2.3:1000")
+	if wait := dropLockedOut("tok|192.0.2.3"); wait < dropWindow-time.Minute {
+		t.Errorf("locked out for %v after the last wrong password, want %v", wait, dropWindow)
+	}
+
+	// Other addresses are not locked out
+	body, contentType = upload()
+	if code := drop("sesame", "192.0.2.2:1000", body, contentType); code != http.StatusCreated {
+		t.Errorf("right password: got %d, want 201", code)
+	}
+}
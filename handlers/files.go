@@ -1,15 +1,10 @@
 package handlers
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"fmt"
-	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"time"
 
+	"cloud-storage/events"
 	"cloud-storage/models"
 
 	"github.com/gin-gonic/gin"
@@ -25,47 +20,49 @@ func (a *App) UploadFile(c *gin.Context) {
 
 	userID := c.MustGet("userID").(uint)
 
-	// Create user directory if it doesn't exist
-	userDir := filepath.Join("storage", fmt.Sprintf("%d", userID))
-	if err := os.MkdirAll(userDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create directory"})
+	if c.PostForm("extract") == "true" {
+		a.extractUpload(c, file, header)
 		return
 	}
 
-	// Calculate file hash before saving
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate hash"})
+	var expiry FileExpiry
+	if err := c.ShouldBind(&expiry); err != nil || !expiry.valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
 		return
 	}
-	fileHash := hex.EncodeToString(hash.Sum(nil))
 
-	// Reset file pointer
-	file.Seek(0, 0)
-
-	// Check if file already exists
-	var existingFile models.File
-	if err := a.DB.Where("user_id = ? AND hash = ?", userID, fileHash).First(&existingFile).Error; err == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "File already exists",
-			"file":    existingFile,
-		})
+	if err := a.checkQuota(userID, header.Size); err == errQuotaExceeded {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Storage quota exceeded"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
 		return
 	}
 
-	// Save file with hash as filename
-	filename := fmt.Sprintf("%s%s", fileHash, filepath.Ext(header.Filename))
-	filePath := filepath.Join(userDir, filename)
-
-	outFile, err := os.Create(filePath)
+	// Hash while writing to disk
+	stored, err := a.storeBlob(userID, file)
+	if err == errQuotaExceeded {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Storage quota exceeded"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create file"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
 		return
 	}
-	defer outFile.Close()
 
-	if _, err := io.Copy(outFile, file); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+	// Check if file already exists
+	var existingFile models.File
+	if err := a.DB.Where("user_id = ? AND hash = ?", userID, stored.Hash).First(&existingFile).Error; err == nil {
+		a.releaseBlob(stored.Path)
+		// The upload's expiry applies to the copy it resolves to
+		if err := a.setExpiry(&existingFile, expiry); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "File already exists",
+			"file":    existingFile,
+		})
 		return
 	}
 
@@ -73,34 +70,80 @@ func (a *App) UploadFile(c *gin.Context) {
 	fileRecord := models.File{
 		UserID:       userID,
 		Name:         header.Filename,
-		Path:         filePath,
-		Size:         header.Size,
-		Hash:         fileHash,
+		Path:         stored.Path,
+		Size:         stored.Size,
+		Hash:         stored.Hash,
+		MimeType:     stored.MimeType,
+		Metadata:     stored.Metadata,
+		Compression:  stored.Compression,
+		StoredSize:   stored.StoredSize,
 		LastModified: time.Now(),
+		ExpiresAt:    expiry.ExpiresAt,
+		MaxDownloads: expiry.MaxDownloads,
+	}
+	if a.ScanUploads {
+		fileRecord.ScanStatus = models.ScanPending
 	}
 
 	if err := a.DB.Create(&fileRecord).Error; err != nil {
-		os.Remove(filePath) // Cleanup on DB error
+		a.releaseBlob(stored.Path) // Cleanup on DB error
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
 		return
 	}
 
+	a.Events.Publish(events.Event{
+		Type:   events.FileUploaded,
+		UserID: userID,
+		FileID: &fileRecord.ID,
+		Data:   gin.H{"name": fileRecord.Name, "size": fileRecord.Size, "hash": fileRecord.Hash},
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "File uploaded successfully",
 		"file":    fileRecord,
 	})
 }
 
+// ListFiles returns a page of the user's files. Pass next_cursor back as cursor
+// with the same sort and filters to get the following page.
 func (a *App) ListFiles(c *gin.Context) {
 	userID := c.MustGet("userID").(uint)
 
-	var files []models.File
-	if err := a.DB.Where("user_id = ?", userID).Order("created_at desc").Find(&files).Error; err != nil {
+	q, msg := parseListQuery(c, userID)
+	if q == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	var total int64
+	if err := a.DB.Model(&models.File{}).Scopes(q.scope).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		return
+	}
+
+	files, next, err := q.page(a.DB)
+	if err == errInvalidListQuery {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"files": files})
+	c.JSON(http.StatusOK, gin.H{"files": files, "total": total, "next_cursor": next})
+}
+
+func (a *App) GetFile(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var file models.File
+	if err := a.DB.Preload("Tags").Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&file).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"file": file})
 }
 
 func (a *App) DownloadFile(c *gin.Context) {
@@ -113,7 +156,10 @@ func (a *App) DownloadFile(c *gin.Context) {
 		return
 	}
 
-	c.File(file.Path)
+	if file.MimeType != "" {
+		c.Header("Content-Type", file.MimeType)
+	}
+	a.serveBlob(c, &file)
 }
 
 func (a *App) DeleteFile(c *gin.Context) {
@@ -126,15 +172,12 @@ func (a *App) DeleteFile(c *gin.Context) {
 		return
 	}
 
-	// Delete the actual file
-	if err := os.Remove(file.Path); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
+	// Delete the record, then the blob once nothing else refers to it
+	if err := a.removeTree(&file); isRetained(err) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 		return
-	}
-
-	// Delete the database record
-	if err := a.DB.Delete(&file).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete record"})
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
 		return
 	}
 
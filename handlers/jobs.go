@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxJobsPage = 1000
+
+// RegisterJobs installs the handlers for job types queued by request handlers.
+func (a *App) RegisterJobs() {
+	a.Jobs.Register("batch", a.runBatchJob)
+	a.Jobs.Register(scrubJob, a.runScrubJob)
+	a.Jobs.Register(rewrapJob, a.runRewrapJob)
+	a.Jobs.Register(compressJob, a.runCompressJob)
+	a.Jobs.Register(chunkGCJob, a.runChunkGCJob)
+	a.Jobs.Register(retentionJob, a.runRetentionJob)
+	a.Jobs.Register(expireJob, a.runExpireJob)
+	a.Jobs.Register(multipartGCJob, a.runMultipartGCJob)
+	a.Jobs.Register("events.prune", a.Events.Prune)
+}
+
+// GetJob reports the progress of a background job and its result once finished.
+func (a *App) GetJob(c *gin.Context) {
+	a.getJob(c, a.DB.Where("user_id = ?", c.MustGet("userID").(uint)))
+}
+
+func (a *App) AdminGetJob(c *gin.Context) {
+	a.getJob(c, a.DB)
+}
+
+func (a *App) getJob(c *gin.Context, scope *gorm.DB) {
+	var job models.Job
+	if err := scope.Where("id = ?", c.Param("id")).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+// CancelJob stops one of the user's jobs; a running job stops after its current step.
+func (a *App) CancelJob(c *gin.Context) {
+	a.cancelJob(c, a.DB.Where("user_id = ?", c.MustGet("userID").(uint)))
+}
+
+func (a *App) AdminCancelJob(c *gin.Context) {
+	a.cancelJob(c, a.DB)
+}
+
+func (a *App) cancelJob(c *gin.Context, scope *gorm.DB) {
+	var job models.Job
+	if err := scope.Where("id = ?", c.Param("id")).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	switch err := a.Jobs.Cancel(job.ID); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Job cancelled"})
+	case jobs.ErrFinished:
+		c.JSON(http.StatusConflict, gin.H{"error": "Job already finished"})
+	case jobs.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+	}
+}
+
+// AdminRetryJob queues a failed or cancelled job again.
+func (a *App) AdminRetryJob(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	switch err := a.Jobs.Retry(uint(id)); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Job queued"})
+	case jobs.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	}
+}
+
+// AdminListJobs lists jobs newest first, filtered by status, type or user, with
+// how many jobs are in each status.
+func (a *App) AdminListJobs(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > maxJobsPage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+
+	scope := a.DB.Model(&models.Job{})
+	if status := c.Query("status"); status != "" {
+		scope = scope.Where("status = ?", status)
+	}
+	if jobType := c.Query("type"); jobType != "" {
+		scope = scope.Where("type = ?", jobType)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		scope = scope.Where("user_id = ?", userID)
+	}
+
+	var list []models.Job
+	if err := scope.Omit("payload", "result").Order("id desc").Limit(limit).Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch jobs"})
+		return
+	}
+
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	if err := a.DB.Model(&models.Job{}).Select("status, COUNT(*) AS count").Group("status").Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch jobs"})
+		return
+	}
+	counts := map[string]int64{}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{"jobs": list, "counts": counts})
+}
+
+// AdminListJobSchedules lists the recurring jobs and when they next run.
+func (a *App) AdminListJobSchedules(c *gin.Context) {
+	var schedules []models.JobSchedule
+	if err := a.DB.Order("name").Find(&schedules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch schedules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules})
+}
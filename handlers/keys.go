@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"cloud-storage/blobcrypt"
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const rewrapJob = "keys.rewrap"
+
+// RewrapRequest chooses what a rewrap job does besides moving data keys to the
+// active master key.
+type RewrapRequest struct {
+	// EncryptPlaintext also encrypts blobs stored before encryption was enabled
+	EncryptPlaintext bool `json:"encrypt_plaintext"`
+}
+
+type rewrapResult struct {
+	Blobs     int            `json:"blobs"`
+	Rewrapped map[string]int `json:"rewrapped"` // by previous key ID
+	Encrypted int            `json:"encrypted"`
+	Failed    int            `json:"failed"`
+	Errors    []string       `json:"errors,omitempty"`
+}
+
+// blobPaths lists every blob, chunk and cached thumbnail on disk.
+func (a *App) blobPaths() ([]string, error) {
+	var paths, chunks []string
+	if err := a.DB.Model(&models.File{}).Where("is_dir = ? AND path <> ''", false).Distinct().Pluck("path", &paths).Error; err != nil {
+		return nil, err
+	}
+	if err := a.DB.Model(&models.Chunk{}).Pluck("path", &chunks).Error; err != nil {
+		return nil, err
+	}
+	paths = append(paths, chunks...)
+	thumbs, _ := filepath.Glob(filepath.Join(a.Thumbnails.Dir, "*.jpg"))
+	return append(paths, thumbs...), nil
+}
+
+func (a *App) runRewrapJob(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	if a.Keys == nil {
+		return nil, jobs.Permanent(blobcrypt.ErrNoKeys)
+	}
+	var req RewrapRequest
+	if len(job.Payload) > 0 {
+		if err := json.Unmarshal(job.Payload, &req); err != nil {
+			return nil, jobs.Permanent(err)
+		}
+	}
+	paths, err := a.blobPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	result := rewrapResult{Rewrapped: map[string]int{}}
+	for i, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		result.Blobs++
+
+		previous, err := blobcrypt.Rewrap(path, a.Keys)
+		if err == nil && previous != "" {
+			result.Rewrapped[previous]++
+		}
+		if err == nil && req.EncryptPlaintext {
+			var encrypted bool
+			if encrypted, err = blobcrypt.EncryptFile(path, a.Keys); encrypted {
+				result.Encrypted++
+			}
+		}
+		if err != nil && !os.IsNotExist(err) {
+			result.Failed++
+			if len(result.Errors) < 100 {
+				result.Errors = append(result.Errors, path+": "+err.Error())
+			}
+		}
+		progress(i + 1)
+	}
+	return result, nil
+}
+
+// AdminGetKeys shows the master key IDs and which one wraps new data keys.
+func (a *App) AdminGetKeys(c *gin.Context) {
+	if a.Keys == nil {
+		c.JSON(http.StatusOK, gin.H{"encryption": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"encryption": true, "active": a.Keys.Active(), "keys": a.Keys.IDs()})
+}
+
+// AdminRotateKeys adds a new master key and queues a job rewrapping every data
+// key with it. Content is not re-encrypted, and old keys stay in the key file
+// so blobs the job has not reached yet can still be read.
+func (a *App) AdminRotateKeys(c *gin.Context) {
+	if a.Keys == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Encryption at rest is not enabled"})
+		return
+	}
+
+	active, err := a.Keys.Rotate()
+	if err == blobcrypt.ErrNoKeyFile {
+		c.JSON(http.StatusConflict, gin.H{"error": "Keys from MASTER_KEY cannot be rotated, use a key file"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate keys"})
+		return
+	}
+
+	job, err := a.queueRewrap(RewrapRequest{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue rewrap"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"active": active, "job_id": job.ID})
+}
+
+// AdminRewrapKeys queues a rewrap without adding a key, e.g. to finish an
+// interrupted rotation or to encrypt blobs stored in plaintext.
+func (a *App) AdminRewrapKeys(c *gin.Context) {
+	if a.Keys == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Encryption at rest is not enabled"})
+		return
+	}
+	var req RewrapRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	job, err := a.queueRewrap(req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue rewrap"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID})
+}
+
+func (a *App) queueRewrap(req RewrapRequest) (*models.Job, error) {
+	paths, err := a.blobPaths()
+	if err != nil {
+		return nil, err
+	}
+	return a.Jobs.Enqueue(0, rewrapJob, req, jobs.Options{MaxAttempts: 3, Total: len(paths)})
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listSort is a sort key for ListFiles. value renders a file's key for a cursor
+// and parse reads it back.
+type listSort struct {
+	column string
+	value  func(f *models.File) string
+	parse  func(s string) (interface{}, error)
+}
+
+func parseText(s string) (interface{}, error) { return s, nil }
+
+func parseInt(s string) (interface{}, error) { return strconv.ParseInt(s, 10, 64) }
+
+func parseTime(s string) (interface{}, error) { return time.Parse(time.RFC3339Nano, s) }
+
+var listSorts = map[string]listSort{
+	"name": {"files.name COLLATE NOCASE", func(f *models.File) string { return f.Name }, parseText},
+	"size": {"files.size", func(f *models.File) string { return strconv.FormatInt(f.Size, 10) }, parseInt},
+	"modified": {"files.last_modified", func(f *models.File) string {
+		return f.LastModified.Format(time.RFC3339Nano)
+	}, parseTime},
+	"type": {"files.mime_type", func(f *models.File) string { return f.MimeType }, parseText},
+	"created": {"files.created_at", func(f *models.File) string {
+		return f.CreatedAt.Format(time.RFC3339Nano)
+	}, parseTime},
+}
+
+// listCursor marks the last file of a page. The file ID breaks ties so pages stay
+// stable when files are added between requests.
+type listCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func encodeCursor(cur listCursor) string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token string) (listCursor, error) {
+	var cur listCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cur, err
+	}
+	err = json.Unmarshal(data, &cur)
+	return cur, err
+}
+
+// listQuery is a parsed ListFiles request.
+type listQuery struct {
+	sort   string
+	desc   bool
+	limit  int
+	cursor *listCursor
+	scope  func(db *gorm.DB) *gorm.DB
+}
+
+var errInvalidListQuery = errors.New("invalid list query")
+
+// parseListQuery reads sort, order, limit, cursor and the filters parent, mime,
+// tag, starred, color, modified_after, modified_before, created_after and
+// created_before.
+func parseListQuery(c *gin.Context, userID uint) (*listQuery, string) {
+	q := &listQuery{sort: c.DefaultQuery("sort", "created"), limit: defaultListLimit}
+	if _, ok := listSorts[q.sort]; !ok {
+		return nil, "Invalid sort, use name, size, modified, type or created"
+	}
+
+	switch c.Query("order") {
+	case "":
+		// Names and types read best A to Z, the rest newest or largest first
+		q.desc = q.sort != "name" && q.sort != "type"
+	case "asc":
+	case "desc":
+		q.desc = true
+	default:
+		return nil, "Invalid order, use asc or desc"
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return nil, "Invalid limit"
+		}
+		q.limit = min(n, maxListLimit)
+	}
+
+	if token := c.Query("cursor"); token != "" {
+		cur, err := decodeCursor(token)
+		if err != nil || cur.Sort != q.sortKey() {
+			return nil, "Invalid cursor"
+		}
+		q.cursor = &cur
+	}
+
+	var conds []string
+	var args []interface{}
+	switch parent := c.Query("parent"); parent {
+	case "":
+	case "root":
+		conds = append(conds, "parent_id IS NULL")
+	default:
+		id, err := strconv.ParseUint(parent, 10, 64)
+		if err != nil {
+			return nil, "Invalid parent"
+		}
+		conds = append(conds, "parent_id = ?")
+		args = append(args, id)
+	}
+
+	if mime := c.Query("mime"); mime != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(mime)
+		conds = append(conds, `mime_type LIKE ? ESCAPE '\'`)
+		args = append(args, escaped+"%")
+	}
+
+	if tag := c.Query("tag"); tag != "" {
+		conds = append(conds, `id IN (SELECT file_tags.file_id FROM file_tags
+			JOIN tags ON tags.id = file_tags.tag_id WHERE tags.user_id = ? AND tags.name = ?)`)
+		args = append(args, userID, tag)
+	}
+
+	if raw := c.Query("starred"); raw != "" {
+		starred, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, "Invalid starred"
+		}
+		conds = append(conds, "starred = ?")
+		args = append(args, starred)
+	}
+
+	if color, ok := c.GetQuery("color"); ok {
+		if !models.ValidColor(color) {
+			return nil, "Invalid color"
+		}
+		conds = append(conds, "color = ?")
+		args = append(args, color)
+	}
+
+	for _, r := range []struct{ param, cond string }{
+		{"modified_after", "last_modified >= ?"},
+		{"modified_before", "last_modified < ?"},
+		{"created_after", "created_at >= ?"},
+		{"created_before", "created_at < ?"},
+	} {
+		raw := c.Query(r.param)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			if t, err = time.ParseInLocation("2006-01-02", raw, time.Local); err != nil {
+				return nil, "Invalid " + r.param + ", use RFC 3339 or YYYY-MM-DD"
+			}
+		}
+		conds = append(conds, r.cond)
+		args = append(args, t)
+	}
+
+	q.scope = func(db *gorm.DB) *gorm.DB {
+		db = db.Where("user_id = ?", userID)
+		if len(conds) > 0 {
+			db = db.Where(strings.Join(conds, " AND "), args...)
+		}
+		return db
+	}
+	return q, ""
+}
+
+// sortKey ties a cursor to the ordering it was issued for.
+func (q *listQuery) sortKey() string {
+	if q.desc {
+		return q.sort + ":desc"
+	}
+	return q.sort + ":asc"
+}
+
+// page fetches one page of files and the cursor for the next, "" on the last page.
+func (q *listQuery) page(db *gorm.DB) ([]models.File, string, error) {
+	s := listSorts[q.sort]
+	dir, cmp := "ASC", ">"
+	if q.desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	db = db.Scopes(q.scope)
+	if q.cursor != nil {
+		value, err := s.parse(q.cursor.Value)
+		if err != nil {
+			return nil, "", errInvalidListQuery
+		}
+		db = db.Where("("+s.column+" "+cmp+" ? OR ("+s.column+" = ? AND files.id "+cmp+" ?))",
+			value, value, q.cursor.ID)
+	}
+
+	var files []models.File
+	err := db.Preload("Tags").Order(s.column + " " + dir).Order("files.id " + dir).Limit(q.limit + 1).Find(&files).Error
+	if err != nil {
+		return nil, "", err
+	}
+	if len(files) <= q.limit {
+		return files, "", nil
+	}
+
+	files = files[:q.limit]
+	last := &files[len(files)-1]
+	return files, encodeCursor(listCursor{Sort: q.sortKey(), Value: s.value(last), ID: last.ID}), nil
+}
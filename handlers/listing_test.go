@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"cloud-storage/models"
+)
+
+func TestListFilesCursor(t *testing.T) {
+	a, user := newTestApp(t)
+	a.Router.GET("/files", as(user), a.ListFiles)
+
+	// Few distinct sizes and times, so most of a page's keys are ties broken by ID
+	base := time.Now().Truncate(time.Second)
+	create := func(name string, i int) *models.File {
+		t.Helper()
+		file := &models.File{UserID: user.ID, Name: name, Size: int64(i % 3), LastModified: base.Add(time.Duration(i%4) * time.Second)}
+		if err := a.DB.Create(file).Error; err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	var existing []*models.File
+	for i := 0; i < 23; i++ {
+		existing = append(existing, create(fmt.Sprintf("file%02d", i), i))
+	}
+
+	for _, sort := range []string{"name", "size", "modified", "created"} {
+		t.Run(sort, func(t *testing.T) {
+			seen := map[uint]bool{}
+			cursor := ""
+			for page := 0; ; page++ {
+				query := url.Values{"sort": {sort}, "limit": {"5"}, "cursor": {cursor}}
+				w := httptest.NewRecorder()
+				a.Router.ServeHTTP(w, httptest.NewRequest("GET", "/files?"+query.Encode(), nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("page %d = %d %s", page, w.Code, w.Body)
+				}
+				var resp struct {
+					Files      []models.File `json:"files"`
+					NextCursor string        `json:"next_cursor"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				for _, f := range resp.Files {
+					if seen[f.ID] {
+						t.Errorf("%s listed twice", f.Name)
+					}
+					seen[f.ID] = true
+				}
+				if resp.NextCursor == "" {
+					break
+				}
+				cursor = resp.NextCursor
+				// Files added between pages must not shift the ones still to come
+				create(fmt.Sprintf("%s-added%d", sort, page), page)
+			}
+
+			for _, f := range existing {
+				if !seen[f.ID] {
+					t.Errorf("%s never listed", f.Name)
+				}
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, httptest.NewRequest("GET", "/files?sort=size&cursor="+encodeCursor(listCursor{Sort: "name:asc"}), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("cursor of another sort = %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+type QuotaRequest struct {
+	QuotaBytes *int64 `json:"quota_bytes" binding:"required"`
+}
+
+// usedBytes counts the user's files, and the chunks they uploaded that no file
+// references yet.
+func (a *App) usedBytes(userID uint) (int64, error) {
+	var used, pending int64
+	err := a.DB.Model(&models.File{}).Where("user_id = ? AND is_dir = ?", userID, false).
+		Select("COALESCE(SUM(size), 0)").Scan(&used).Error
+	if err != nil {
+		return 0, err
+	}
+	err = a.DB.Model(&models.Chunk{}).Where("user_id = ? AND ref_count <= 0", userID).
+		Select("COALESCE(SUM(size), 0)").Scan(&pending).Error
+	return used + pending, err
+}
+
+// checkQuota fails when adding size bytes would take the user over their quota.
+func (a *App) checkQuota(userID uint, size int64) error {
+	var user models.User
+	if err := a.DB.Select("id", "quota_bytes").First(&user, userID).Error; err != nil {
+		return err
+	}
+	if user.QuotaBytes <= 0 {
+		return nil
+	}
+
+	used, err := a.usedBytes(userID)
+	if err != nil {
+		return err
+	}
+	if used+size > user.QuotaBytes {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// quotaLeft returns how many more bytes the user may store, or -1 when their
+// storage is unlimited.
+func (a *App) quotaLeft(userID uint) (int64, error) {
+	var user models.User
+	if err := a.DB.Select("id", "quota_bytes").First(&user, userID).Error; err != nil {
+		return 0, err
+	}
+	if user.QuotaBytes <= 0 {
+		return -1, nil
+	}
+
+	used, err := a.usedBytes(userID)
+	if err != nil {
+		return 0, err
+	}
+	if used > user.QuotaBytes {
+		return 0, nil
+	}
+	return user.QuotaBytes - used, nil
+}
+
+func (a *App) GetQuota(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var user models.User
+	if err := a.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	used, err := a.usedBytes(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"quota_bytes": user.QuotaBytes, "used_bytes": used})
+}
+
+func (a *App) AdminSetQuota(c *gin.Context) {
+	var req QuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil || *req.QuotaBytes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	result := a.DB.Model(&models.User{}).Where("id = ?", c.Param("id")).Update("quota_bytes", *req.QuotaBytes)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Quota updated successfully"})
+}
@@ -0,0 +1,461 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const retentionJob = "retention"
+
+var errLegalHold = &retainedError{}
+
+// retainedError refuses to delete or replace a file on legal hold, or one a
+// keep rule is in force for. It counts as os.ErrPermission to the protocols.
+type retainedError struct {
+	Rule  string
+	Until time.Time
+}
+
+func (e *retainedError) Error() string {
+	if e.Rule == "" {
+		return "file is under legal hold"
+	}
+	return fmt.Sprintf("file is retained by rule %q until %s", e.Rule, e.Until.Format("2006-01-02"))
+}
+
+func (e *retainedError) Is(target error) bool { return target == os.ErrPermission }
+
+func isRetained(err error) bool {
+	var retained *retainedError
+	return errors.As(err, &retained)
+}
+
+// RetentionRuleRequest defines a rule; at least one of Folder, Tag and MimeType
+// must be set. Folder is a path in each user's drive, such as "Invoices/2024".
+type RetentionRuleRequest struct {
+	Name     string `json:"name" binding:"required"`
+	Action   string `json:"action" binding:"required"` // keep or delete
+	Days     int    `json:"days" binding:"required"`
+	Folder   string `json:"folder"`
+	Tag      string `json:"tag"`
+	MimeType string `json:"mime_type"`
+}
+
+type LegalHoldRequest struct {
+	Hold *bool `json:"hold" binding:"required"`
+}
+
+// retentionScope evaluates the rules against files, caching the folders it
+// looks up on the way to the root.
+type retentionScope struct {
+	app     *App
+	rules   []models.RetentionRule
+	folders map[uint]models.File
+	now     time.Time
+}
+
+func (a *App) retentionScope() (*retentionScope, error) {
+	var rules []models.RetentionRule
+	if err := a.DB.Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return &retentionScope{app: a, rules: rules, folders: make(map[uint]models.File), now: time.Now()}, nil
+}
+
+// locate returns the path of the folder holding file, "" for the root, and
+// whether the file or a folder above it is on legal hold.
+func (s *retentionScope) locate(file *models.File) (string, bool, error) {
+	held := file.LegalHold
+	var names []string
+	for id := file.ParentID; id != nil; {
+		folder, ok := s.folders[*id]
+		if !ok {
+			if err := s.app.DB.Select("id", "parent_id", "name", "legal_hold").First(&folder, *id).Error; err != nil {
+				return "", false, err
+			}
+			s.folders[*id] = folder
+		}
+		names = append(names, folder.Name)
+		held = held || folder.LegalHold
+		id = folder.ParentID
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/"), held, nil
+}
+
+// matches reports whether rule applies to file, which lies in folder.
+func (s *retentionScope) matches(rule *models.RetentionRule, file *models.File, folder string) (bool, error) {
+	if file.IsDir {
+		return false, nil
+	}
+	if rule.Folder != "" && folder != rule.Folder && !strings.HasPrefix(folder, rule.Folder+"/") {
+		return false, nil
+	}
+	if rule.MimeType != "" && !strings.HasPrefix(file.MimeType, rule.MimeType) {
+		return false, nil
+	}
+	if rule.Tag != "" {
+		if file.Tags == nil {
+			if err := s.app.DB.Model(file).Association("Tags").Find(&file.Tags); err != nil {
+				return false, err
+			}
+		}
+		for _, tag := range file.Tags {
+			if tag.Name == rule.Tag {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// check fails when file may not be deleted or replaced: it is on legal hold,
+// or a keep rule matching it has not run out yet.
+func (s *retentionScope) check(file *models.File) error {
+	folder, held, err := s.locate(file)
+	if err != nil {
+		return err
+	}
+	if held {
+		return errLegalHold
+	}
+	return s.keeping(file, folder, nil)
+}
+
+// keeping fails with the keep rule in force for file, in folder, that keeps it
+// the longest, considering only the rules accepted by only unless it is nil.
+func (s *retentionScope) keeping(file *models.File, folder string, only func(*models.RetentionRule) bool) error {
+	var retained *retainedError
+	for i := range s.rules {
+		rule := &s.rules[i]
+		if rule.Action != models.RetainKeep || only != nil && !only(rule) {
+			continue
+		}
+		ok, err := s.matches(rule, file, folder)
+		if err != nil {
+			return err
+		}
+		until := file.LastModified.AddDate(0, 0, rule.Days)
+		if ok && until.After(s.now) && (retained == nil || until.After(retained.Until)) {
+			retained = &retainedError{Rule: rule.Name, Until: until}
+		}
+	}
+	if retained != nil {
+		return retained
+	}
+	return nil
+}
+
+// checkUntag fails when taking the tags named off file would release it from a
+// keep rule still in force for it.
+func (s *retentionScope) checkUntag(file *models.File, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	folder, _, err := s.locate(file)
+	if err != nil {
+		return err
+	}
+	return s.keeping(file, folder, func(rule *models.RetentionRule) bool {
+		return rule.Tag != "" && slices.Contains(names, rule.Tag)
+	})
+}
+
+// checkTree checks file and, for a folder, everything below it.
+func (s *retentionScope) checkTree(file *models.File) error {
+	if err := s.check(file); err != nil {
+		return err
+	}
+	if !file.IsDir {
+		return nil
+	}
+	children, err := s.app.listChildren(file.UserID, &file.ID)
+	if err != nil {
+		return err
+	}
+	for i := range children {
+		if err := s.checkTree(&children[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRetention fails when file, or anything below a folder, is held or
+// retained, so that it can neither be deleted nor moved out of a rule's folder.
+func (a *App) checkRetention(file *models.File) error {
+	scope, err := a.retentionScope()
+	if err != nil {
+		return err
+	}
+	return scope.checkTree(file)
+}
+
+// checkUntag fails when taking the tags named off file would release it from a
+// keep rule still in force for it.
+func (a *App) checkUntag(file *models.File, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	scope, err := a.retentionScope()
+	if err != nil {
+		return err
+	}
+	return scope.checkUntag(file, names)
+}
+
+// ruleCandidates lists the files of every user that rule may match, last
+// modified before cutoff unless it is zero. Folders are left to the caller.
+func (a *App) ruleCandidates(rule *models.RetentionRule, cutoff time.Time) ([]models.File, error) {
+	q := a.DB.Preload("Tags").Where("is_dir = ?", false)
+	if !cutoff.IsZero() {
+		q = q.Where("last_modified < ?", cutoff)
+	}
+	if rule.MimeType != "" {
+		q = q.Where("mime_type LIKE ?", rule.MimeType+"%")
+	}
+	if rule.Tag != "" {
+		tagged := a.DB.Table("file_tags").Select("file_tags.file_id").
+			Joins("JOIN tags ON tags.id = file_tags.tag_id").Where("tags.name = ?", rule.Tag)
+		q = q.Where("id IN (?)", tagged)
+	}
+	var files []models.File
+	err := q.Order("id").Find(&files).Error
+	return files, err
+}
+
+type retentionRuleResult struct {
+	RuleID       uint   `json:"rule_id"`
+	Name         string `json:"name"`
+	Deleted      int    `json:"deleted"`
+	DeletedBytes int64  `json:"deleted_bytes"`
+	Blocked      int    `json:"blocked"` // on legal hold or kept by another rule
+	Failed       int    `json:"failed"`
+}
+
+// runRetentionJob deletes the files delete rules have come due for.
+func (a *App) runRetentionJob(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	scope, err := a.retentionScope()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []retentionRuleResult{}
+	for i := range scope.rules {
+		rule := &scope.rules[i]
+		if rule.Action != models.RetainDelete {
+			continue
+		}
+		files, err := a.ruleCandidates(rule, scope.now.AddDate(0, 0, -rule.Days))
+		if err != nil {
+			return results, err
+		}
+
+		result := retentionRuleResult{RuleID: rule.ID, Name: rule.Name}
+		for j := range files {
+			if err := ctx.Err(); err != nil {
+				return results, err
+			}
+			file := &files[j]
+			folder, _, err := scope.locate(file)
+			if err != nil {
+				continue
+			}
+			if ok, _ := scope.matches(rule, file, folder); !ok {
+				continue
+			}
+			err = a.removeWithin(scope, file)
+			switch {
+			case isRetained(err):
+				result.Blocked++
+			case err != nil:
+				result.Failed++
+			default:
+				result.Deleted++
+				result.DeletedBytes += file.Size
+			}
+		}
+		results = append(results, result)
+		progress(len(results))
+	}
+	return results, nil
+}
+
+func (a *App) AdminListRetentionRules(c *gin.Context) {
+	var rules []models.RetentionRule
+	if err := a.DB.Order("id").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch retention rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func (a *App) AdminCreateRetentionRule(c *gin.Context) {
+	var req RetentionRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Days <= 0 ||
+		(req.Action != models.RetainKeep && req.Action != models.RetainDelete) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A rule needs a name, keep or delete as action and a positive number of days"})
+		return
+	}
+	rule := models.RetentionRule{
+		Name:     req.Name,
+		Action:   req.Action,
+		Days:     req.Days,
+		Folder:   strings.Join(splitPath(req.Folder), "/"),
+		Tag:      strings.TrimSpace(req.Tag),
+		MimeType: strings.TrimSpace(req.MimeType),
+	}
+	if rule.Folder == "" && rule.Tag == "" && rule.MimeType == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A rule must match a folder, a tag or a type"})
+		return
+	}
+
+	if err := a.DB.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create retention rule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"rule": rule})
+}
+
+func (a *App) AdminDeleteRetentionRule(c *gin.Context) {
+	result := a.DB.Delete(&models.RetentionRule{}, c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete retention rule"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Retention rule deleted successfully"})
+}
+
+// AdminSetLegalHold puts a file or folder on legal hold, or releases it.
+func (a *App) AdminSetLegalHold(c *gin.Context) {
+	var req LegalHoldRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	result := a.DB.Model(&models.File{}).Where("id = ?", c.Param("id")).Update("legal_hold", *req.Hold)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update legal hold"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Legal hold updated successfully", "legal_hold": *req.Hold})
+}
+
+type retentionRuleReport struct {
+	Rule  models.RetentionRule `json:"rule"`
+	Files int                  `json:"files"`
+	Bytes int64                `json:"bytes"`
+	// Files a keep rule still protects, or a delete rule has come due for
+	Retained int                  `json:"retained,omitempty"`
+	Due      int                  `json:"due,omitempty"`
+	LastRun  *retentionRuleResult `json:"last_run,omitempty"`
+}
+
+// AdminRetentionReport lists what each rule matches now, and what the last
+// enforcement deleted.
+func (a *App) AdminRetentionReport(c *gin.Context) {
+	scope, err := a.retentionScope()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build retention report"})
+		return
+	}
+
+	var last models.Job
+	lastRun := make(map[uint]retentionRuleResult)
+	if err := a.DB.Where("type = ? AND status = ?", retentionJob, models.JobSucceeded).Order("id desc").First(&last).Error; err == nil {
+		var results []retentionRuleResult
+		json.Unmarshal(last.Result, &results)
+		for _, r := range results {
+			lastRun[r.RuleID] = r
+		}
+	}
+
+	reports := []retentionRuleReport{}
+	for i := range scope.rules {
+		rule := &scope.rules[i]
+		files, err := a.ruleCandidates(rule, time.Time{})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build retention report"})
+			return
+		}
+
+		report := retentionRuleReport{Rule: *rule}
+		due := scope.now.AddDate(0, 0, -rule.Days)
+		for j := range files {
+			file := &files[j]
+			folder, _, err := scope.locate(file)
+			if err != nil {
+				continue
+			}
+			if ok, _ := scope.matches(rule, file, folder); !ok {
+				continue
+			}
+			report.Files++
+			report.Bytes += file.Size
+			if file.LastModified.After(due) {
+				if rule.Action == models.RetainKeep {
+					report.Retained++
+				}
+			} else if rule.Action == models.RetainDelete {
+				report.Due++
+			}
+		}
+		if r, ok := lastRun[rule.ID]; ok {
+			report.LastRun = &r
+		}
+		reports = append(reports, report)
+	}
+
+	var held int64
+	a.DB.Model(&models.File{}).Where("legal_hold = ?", true).Count(&held)
+	c.JSON(http.StatusOK, gin.H{"rules": reports, "legal_holds": held, "last_enforced_at": last.FinishedAt})
+}
+
+// AdminEnforceRetention queues a run of the delete rules now rather than at
+// the next scheduled one.
+func (a *App) AdminEnforceRetention(c *gin.Context) {
+	var pending int64
+	a.DB.Model(&models.Job{}).Where("type = ? AND status IN ?", retentionJob, []string{models.JobQueued, models.JobRunning}).Count(&pending)
+	if pending > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Retention is already queued or running"})
+		return
+	}
+
+	var rules int64
+	a.DB.Model(&models.RetentionRule{}).Where("action = ?", models.RetainDelete).Count(&rules)
+	job, err := a.Jobs.Enqueue(0, retentionJob, nil, jobs.Options{Priority: jobs.PriorityLow, Total: int(rules)})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue retention"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID})
+}
@@ -0,0 +1,901 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud-storage/blobcrypt"
+	"cloud-storage/middleware"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The S3 gateway maps each top-level folder of the user's drive to a bucket and
+// the path below it to the object key. Requests are path-style under /s3/.
+
+const (
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys    = 1000
+	s3MaxParts   = 10000
+
+	multipartGCJob = "multipart.gc"
+	// Multipart uploads without a new part for this long are abandoned
+	multipartTTL = 7 * 24 * time.Hour
+)
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListObjectsResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3InitiateMultipartResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type s3LocationResult struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+// S3 dispatches an S3 API request. It must run behind S3AuthMiddleware.
+func (a *App) S3(c *gin.Context) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(c.Param("path"), "/"), "/")
+	query := c.Request.URL.Query()
+
+	switch {
+	case bucket == "":
+		if c.Request.Method != "GET" {
+			middleware.AbortS3(c, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed")
+			return
+		}
+		a.s3ListBuckets(c)
+
+	case key == "":
+		switch c.Request.Method {
+		case "GET":
+			if query.Has("location") {
+				a.s3Write(c, http.StatusOK, s3LocationResult{Xmlns: s3Namespace})
+				return
+			}
+			a.s3ListObjects(c, bucket)
+		case "HEAD":
+			if _, ok := a.s3Bucket(c, bucket); ok {
+				c.Status(http.StatusOK)
+			}
+		case "PUT":
+			a.s3CreateBucket(c, bucket)
+		case "DELETE":
+			a.s3DeleteBucket(c, bucket)
+		default:
+			middleware.AbortS3(c, http.StatusNotImplemented, "NotImplemented", "This bucket operation is not supported")
+		}
+
+	default:
+		switch {
+		case c.Request.Method == "PUT" && query.Has("uploadId"):
+			a.s3UploadPart(c, bucket, key)
+		case c.Request.Method == "PUT" && c.GetHeader("X-Amz-Copy-Source") != "":
+			middleware.AbortS3(c, http.StatusNotImplemented, "NotImplemented", "CopyObject is not supported")
+		case c.Request.Method == "PUT":
+			a.s3PutObject(c, bucket, key)
+		case c.Request.Method == "GET" || c.Request.Method == "HEAD":
+			a.s3GetObject(c, bucket, key)
+		case c.Request.Method == "DELETE" && query.Has("uploadId"):
+			a.s3AbortMultipart(c, bucket, key)
+		case c.Request.Method == "DELETE":
+			a.s3DeleteObject(c, bucket, key)
+		case c.Request.Method == "POST" && query.Has("uploads"):
+			a.s3InitiateMultipart(c, bucket, key)
+		case c.Request.Method == "POST" && query.Has("uploadId"):
+			a.s3CompleteMultipart(c, bucket, key)
+		default:
+			middleware.AbortS3(c, http.StatusNotImplemented, "NotImplemented", "This object operation is not supported")
+		}
+	}
+}
+
+func (a *App) s3Write(c *gin.Context, status int, body interface{}) {
+	c.Header("Content-Type", "application/xml")
+	c.Status(status)
+	c.Writer.WriteString(xml.Header)
+	xml.NewEncoder(c.Writer).Encode(body)
+}
+
+func (a *App) s3ListBuckets(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var user models.User
+	if err := a.DB.First(&user, userID).Error; err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to load user")
+		return
+	}
+
+	folders, err := a.listChildren(userID, nil)
+	if err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to list buckets")
+		return
+	}
+
+	result := s3ListBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: strconv.FormatUint(uint64(user.ID), 10), DisplayName: user.Username},
+	}
+	for _, f := range folders {
+		if f.IsDir {
+			result.Buckets = append(result.Buckets, s3Bucket{Name: f.Name, CreationDate: f.CreatedAt.UTC().Format(s3TimeFormat)})
+		}
+	}
+	a.s3Write(c, http.StatusOK, result)
+}
+
+// s3Bucket resolves a bucket to its top-level folder, writing NoSuchBucket when absent.
+func (a *App) s3Bucket(c *gin.Context, bucket string) (*models.File, bool) {
+	folder, err := a.lookupChild(c.MustGet("userID").(uint), nil, bucket)
+	if err != nil || !folder.IsDir {
+		middleware.AbortS3(c, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return nil, false
+	}
+	return folder, true
+}
+
+func (a *App) s3CreateBucket(c *gin.Context, bucket string) {
+	if strings.ContainsAny(bucket, `\`) || bucket == "." || bucket == ".." {
+		middleware.AbortS3(c, http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid")
+		return
+	}
+
+	if _, err := a.makeDir(c.MustGet("userID").(uint), nil, bucket); err == os.ErrExist {
+		middleware.AbortS3(c, http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists")
+		return
+	} else if err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to create bucket")
+		return
+	}
+
+	c.Header("Location", "/"+bucket)
+	c.Status(http.StatusOK)
+}
+
+func (a *App) s3DeleteBucket(c *gin.Context, bucket string) {
+	folder, ok := a.s3Bucket(c, bucket)
+	if !ok {
+		return
+	}
+
+	children, err := a.listChildren(folder.UserID, &folder.ID)
+	if err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to list bucket")
+		return
+	}
+	if len(children) > 0 {
+		middleware.AbortS3(c, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty")
+		return
+	}
+
+	if err := a.removeFile(folder); err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to delete bucket")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// s3Entry is either an object or, when IsPrefix is set, a common prefix.
+type s3Entry struct {
+	Key      string
+	File     *models.File
+	IsPrefix bool
+}
+
+// s3ListObjects implements ListObjectsV2, and ListObjects (v1) through the marker parameter.
+func (a *App) s3ListObjects(c *gin.Context, bucket string) {
+	folder, ok := a.s3Bucket(c, bucket)
+	if !ok {
+		return
+	}
+
+	prefix := c.Query("prefix")
+	delimiter := c.Query("delimiter")
+	maxKeys := s3MaxKeys
+	if raw := c.Query("max-keys"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			middleware.AbortS3(c, http.StatusBadRequest, "InvalidArgument", "Invalid max-keys")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	startAfter := c.Query("start-after")
+	if c.Query("list-type") != "2" {
+		startAfter = c.Query("marker")
+	}
+	token := c.Query("continuation-token")
+	if token != "" {
+		decoded, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			middleware.AbortS3(c, http.StatusBadRequest, "InvalidArgument", "Invalid continuation token")
+			return
+		}
+		startAfter = string(decoded)
+	}
+
+	// Start from the deepest folder the prefix names instead of walking the whole bucket
+	base := prefix[:strings.LastIndex(prefix, "/")+1]
+	start, err := a.lookupPath(folder.UserID, bucket+"/"+base)
+	var entries []s3Entry
+	if err == nil && start != nil && start.IsDir {
+		entries, err = a.s3Walk(start, base, prefix, delimiter)
+	} else if err == os.ErrNotExist || (start != nil && !start.IsDir) {
+		err = nil
+	}
+	if err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to list objects")
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	result := s3ListObjectsResult{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		ContinuationToken: token,
+		StartAfter:        c.Query("start-after"),
+	}
+	for _, e := range entries {
+		if e.Key <= startAfter {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if e.IsPrefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: e.Key})
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          e.Key,
+				LastModified: e.File.LastModified.UTC().Format(s3TimeFormat),
+				ETag:         s3ETag(e.File),
+				Size:         e.File.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		result.KeyCount++
+		startAfter = e.Key
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(startAfter))
+	}
+
+	a.s3Write(c, http.StatusOK, result)
+}
+
+// s3Walk lists the keys below a folder that match prefix, rolling keys up to common prefixes at the delimiter.
+func (a *App) s3Walk(folder *models.File, keyPrefix, prefix, delimiter string) ([]s3Entry, error) {
+	children, err := a.listChildren(folder.UserID, &folder.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []s3Entry
+	for i := range children {
+		child := &children[i]
+		key := keyPrefix + child.Name
+		if child.IsDir {
+			key += "/"
+		}
+
+		// Skip subtrees that cannot contain a matching key
+		if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+			continue
+		}
+
+		if delimiter != "" && strings.HasPrefix(key, prefix) {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entries = append(entries, s3Entry{Key: key[:len(prefix)+i+len(delimiter)], IsPrefix: true})
+				continue
+			}
+		}
+
+		if !child.IsDir {
+			entries = append(entries, s3Entry{Key: key, File: child})
+			continue
+		}
+
+		nested, err := a.s3Walk(child, key, prefix, delimiter)
+		if err != nil {
+			return nil, err
+		}
+		// Empty folders show up as zero-byte directory markers
+		if len(nested) == 0 && strings.HasPrefix(key, prefix) {
+			nested = append(nested, s3Entry{Key: key, File: child})
+		}
+		entries = append(entries, nested...)
+	}
+
+	// Common prefixes are only reported once
+	seen := map[string]bool{}
+	unique := entries[:0]
+	for _, e := range entries {
+		if e.IsPrefix {
+			if seen[e.Key] {
+				continue
+			}
+			seen[e.Key] = true
+		}
+		unique = append(unique, e)
+	}
+	return unique, nil
+}
+
+// s3Object resolves bucket/key to a file record, writing NoSuchKey when absent.
+func (a *App) s3Object(c *gin.Context, bucket, key string) (*models.File, bool) {
+	if _, ok := a.s3Bucket(c, bucket); !ok {
+		return nil, false
+	}
+
+	file, err := a.lookupPath(c.MustGet("userID").(uint), bucket+"/"+key)
+	if err != nil || file == nil || file.IsDir != strings.HasSuffix(key, "/") {
+		middleware.AbortS3(c, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return nil, false
+	}
+	return file, true
+}
+
+func (a *App) s3GetObject(c *gin.Context, bucket, key string) {
+	file, ok := a.s3Object(c, bucket, key)
+	if !ok {
+		return
+	}
+
+	c.Header("ETag", s3ETag(file))
+	c.Header("Last-Modified", file.LastModified.UTC().Format(http.TimeFormat))
+	contentType := file.MimeType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(file.Name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+
+	if file.IsDir {
+		c.Header("Content-Length", "0")
+		c.Status(http.StatusOK)
+		return
+	}
+
+	blob, err := a.openBlob(file)
+	if err == errExpired {
+		middleware.AbortS3(c, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+	if err == errScanPending || err == errInfected || err == errScanFailed {
+		middleware.AbortS3(c, http.StatusForbidden, "AccessDenied", err.Error())
+		return
+	}
+	if err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to open object")
+		return
+	}
+	defer blob.Close()
+	if err := a.countRequest(c.Request, file); err == errExpired {
+		middleware.AbortS3(c, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	} else if err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to open object")
+		return
+	}
+
+	// ServeContent handles Range, HEAD and conditional requests
+	http.ServeContent(c.Writer, c.Request, "", file.LastModified, blob)
+}
+
+// s3ObjectParent creates the folders leading to key below the bucket and returns the object's parent and name.
+func (a *App) s3ObjectParent(c *gin.Context, bucket, key string) (*uint, string, bool) {
+	folder, ok := a.s3Bucket(c, bucket)
+	if !ok {
+		return nil, "", false
+	}
+
+	parts := splitPath(key)
+	if len(parts) == 0 {
+		middleware.AbortS3(c, http.StatusBadRequest, "InvalidArgument", "Invalid object key")
+		return nil, "", false
+	}
+
+	parentID, err := a.makeDirAll(folder.UserID, &folder.ID, parts[:len(parts)-1])
+	if err != nil {
+		middleware.AbortS3(c, http.StatusConflict, "InvalidArgument", "An object already exists where a folder is needed")
+		return nil, "", false
+	}
+	return parentID, parts[len(parts)-1], true
+}
+
+func (a *App) s3PutObject(c *gin.Context, bucket, key string) {
+	parentID, name, ok := a.s3ObjectParent(c, bucket, key)
+	if !ok {
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+
+	// A trailing slash with no content is a folder marker
+	if strings.HasSuffix(key, "/") {
+		if _, err := a.makeDirAll(userID, parentID, []string{name}); err != nil {
+			middleware.AbortS3(c, http.StatusConflict, "InvalidArgument", "An object already exists with this name")
+			return
+		}
+		c.Header("ETag", `"`+emptyHash+`"`)
+		c.Status(http.StatusOK)
+		return
+	}
+
+	file, err := a.writeFile(userID, parentID, name, payloadVerifier(c, c.Request.Body))
+	if err == errBadDigest {
+		middleware.AbortS3(c, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match the content")
+		return
+	}
+	if err == errQuotaExceeded {
+		middleware.AbortS3(c, http.StatusForbidden, "QuotaExceeded", "Storage quota exceeded")
+		return
+	}
+	if isRetained(err) {
+		middleware.AbortS3(c, http.StatusForbidden, "AccessDenied", err.Error())
+		return
+	}
+	if err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to store object")
+		return
+	}
+
+	c.Header("ETag", s3ETag(file))
+	c.Status(http.StatusOK)
+}
+
+func (a *App) s3DeleteObject(c *gin.Context, bucket, key string) {
+	if _, ok := a.s3Bucket(c, bucket); !ok {
+		return
+	}
+
+	// Deleting a missing key is not an error in S3
+	file, err := a.lookupPath(c.MustGet("userID").(uint), bucket+"/"+key)
+	if err == nil && file != nil && file.IsDir == strings.HasSuffix(key, "/") {
+		if file.IsDir {
+			err = a.removeTree(file)
+		} else {
+			err = a.removeFile(file)
+		}
+		if isRetained(err) {
+			middleware.AbortS3(c, http.StatusForbidden, "AccessDenied", err.Error())
+			return
+		}
+		if err != nil {
+			middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to delete object")
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (a *App) s3InitiateMultipart(c *gin.Context, bucket, key string) {
+	if _, ok := a.s3Bucket(c, bucket); !ok {
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to create upload")
+		return
+	}
+
+	upload := models.MultipartUpload{
+		UploadID: hex.EncodeToString(buf),
+		UserID:   c.MustGet("userID").(uint),
+		Bucket:   bucket,
+		Key:      key,
+	}
+	if err := os.MkdirAll(multipartDir(upload.UserID, upload.UploadID), 0700); err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to create upload")
+		return
+	}
+	if err := a.DB.Create(&upload).Error; err != nil {
+		os.RemoveAll(multipartDir(upload.UserID, upload.UploadID))
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to create upload")
+		return
+	}
+
+	a.s3Write(c, http.StatusOK, s3InitiateMultipartResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: upload.UploadID,
+	})
+}
+
+func (a *App) s3Upload(c *gin.Context, bucket, key string) (*models.MultipartUpload, bool) {
+	var upload models.MultipartUpload
+	if err := a.DB.Where("upload_id = ? AND user_id = ? AND bucket = ? AND key = ?",
+		c.Query("uploadId"), c.MustGet("userID").(uint), bucket, key).First(&upload).Error; err != nil {
+		middleware.AbortS3(c, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+		return nil, false
+	}
+	return &upload, true
+}
+
+func (a *App) s3UploadPart(c *gin.Context, bucket, key string) {
+	upload, ok := a.s3Upload(c, bucket, key)
+	if !ok {
+		return
+	}
+
+	partNumber, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxParts {
+		middleware.AbortS3(c, http.StatusBadRequest, "InvalidArgument", "Part number must be between 1 and 10000")
+		return
+	}
+
+	partPath := filepath.Join(multipartDir(upload.UserID, upload.UploadID), strconv.Itoa(partNumber))
+
+	// The parts staged so far count against the quota along with the stored files
+	left, err := a.quotaLeft(upload.UserID)
+	if err == nil && left >= 0 {
+		var staged int64
+		staged, err = a.stagedPartBytes(upload.UserID, partPath)
+		left -= staged
+	}
+	if err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to store part")
+		return
+	}
+	body := payloadVerifier(c, c.Request.Body)
+	if left >= 0 {
+		if left == 0 || c.Request.ContentLength > left {
+			middleware.AbortS3(c, http.StatusForbidden, "QuotaExceeded", "Storage quota exceeded")
+			return
+		}
+		body = io.LimitReader(body, left+1)
+	}
+
+	part, err := a.stage(upload.UserID, ".part-*")
+	if err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to store part")
+		return
+	}
+
+	sum := md5.New()
+	n, err := io.Copy(io.MultiWriter(part, sum), body)
+	if err == nil && left >= 0 && n > left {
+		err = errQuotaExceeded
+	}
+	if err != nil {
+		part.Remove()
+	} else {
+		// Replaces an earlier upload of the part in one step
+		err = part.Commit(partPath)
+	}
+	if err != nil {
+		if err == errQuotaExceeded {
+			middleware.AbortS3(c, http.StatusForbidden, "QuotaExceeded", "Storage quota exceeded")
+			return
+		}
+		if err == errBadDigest {
+			middleware.AbortS3(c, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match the content")
+			return
+		}
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to store part")
+		return
+	}
+
+	// Keeps the upload from being collected as abandoned
+	a.DB.Model(upload).Update("updated_at", time.Now())
+
+	c.Header("ETag", `"`+hex.EncodeToString(sum.Sum(nil))+`"`)
+	c.Status(http.StatusOK)
+}
+
+// stagedPartBytes adds up the parts of the user's multipart uploads in
+// progress, except the one at replacing, which a new upload of the part replaces.
+func (a *App) stagedPartBytes(userID uint, replacing string) (int64, error) {
+	var uploadIDs []string
+	if err := a.DB.Model(&models.MultipartUpload{}).Where("user_id = ?", userID).Pluck("upload_id", &uploadIDs).Error; err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, id := range uploadIDs {
+		entries, err := os.ReadDir(multipartDir(userID, id))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		for _, entry := range entries {
+			if filepath.Join(multipartDir(userID, id), entry.Name()) == replacing {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+	}
+	return total, nil
+}
+
+func (a *App) s3CompleteMultipart(c *gin.Context, bucket, key string) {
+	upload, ok := a.s3Upload(c, bucket, key)
+	if !ok {
+		return
+	}
+
+	var req s3CompleteMultipartRequest
+	if err := xml.NewDecoder(c.Request.Body).Decode(&req); err != nil || len(req.Parts) == 0 {
+		middleware.AbortS3(c, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+		return
+	}
+
+	// Parts must be listed in ascending order and match what was uploaded
+	var readers []io.Reader
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			middleware.AbortS3(c, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+			return
+		}
+
+		part, err := blobcrypt.Open(filepath.Join(multipartDir(upload.UserID, upload.UploadID), strconv.Itoa(p.PartNumber)), a.Keys)
+		if os.IsNotExist(err) {
+			middleware.AbortS3(c, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d was not uploaded", p.PartNumber))
+			return
+		}
+		if err != nil {
+			middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to read part")
+			return
+		}
+		defer part.Close()
+
+		sum := md5.New()
+		if _, err := io.Copy(sum, part); err != nil {
+			middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to read part")
+			return
+		}
+		if strings.Trim(p.ETag, `"`) != hex.EncodeToString(sum.Sum(nil)) {
+			middleware.AbortS3(c, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("ETag mismatch for part %d", p.PartNumber))
+			return
+		}
+		part.Seek(0, io.SeekStart)
+		readers = append(readers, part)
+	}
+
+	parentID, name, ok := a.s3ObjectParent(c, bucket, key)
+	if !ok {
+		return
+	}
+	file, err := a.writeFile(upload.UserID, parentID, name, io.MultiReader(readers...))
+	if err == errQuotaExceeded {
+		middleware.AbortS3(c, http.StatusForbidden, "QuotaExceeded", "Storage quota exceeded")
+		return
+	}
+	if isRetained(err) {
+		middleware.AbortS3(c, http.StatusForbidden, "AccessDenied", err.Error())
+		return
+	}
+	if err != nil {
+		middleware.AbortS3(c, http.StatusInternalServerError, "InternalError", "Failed to assemble object")
+		return
+	}
+
+	a.DB.Unscoped().Delete(upload)
+	os.RemoveAll(multipartDir(upload.UserID, upload.UploadID))
+
+	a.s3Write(c, http.StatusOK, s3CompleteMultipartResult{
+		Xmlns:    s3Namespace,
+		Location: path.Join("/s3", bucket, key),
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     s3ETag(file),
+	})
+}
+
+func (a *App) s3AbortMultipart(c *gin.Context, bucket, key string) {
+	upload, ok := a.s3Upload(c, bucket, key)
+	if !ok {
+		return
+	}
+
+	a.DB.Unscoped().Delete(upload)
+	os.RemoveAll(multipartDir(upload.UserID, upload.UploadID))
+	c.Status(http.StatusNoContent)
+}
+
+type multipartGCResult struct {
+	Aborted    int   `json:"aborted"`
+	FreedBytes int64 `json:"freed_bytes"`
+	Failed     int   `json:"failed"`
+}
+
+// runMultipartGCJob aborts the multipart uploads that have not had a part for
+// multipartTTL, and removes staged content as old that nothing owns.
+func (a *App) runMultipartGCJob(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	var uploads []models.MultipartUpload
+	cutoff := time.Now().Add(-multipartTTL)
+	if err := a.DB.Where("updated_at < ?", cutoff).Find(&uploads).Error; err != nil {
+		return nil, err
+	}
+
+	var result multipartGCResult
+	for i, upload := range uploads {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		// A part may have arrived since the upload was listed
+		res := a.DB.Unscoped().Where("id = ? AND updated_at < ?", upload.ID, cutoff).Delete(&models.MultipartUpload{})
+		if res.Error != nil {
+			return result, res.Error
+		}
+		if res.RowsAffected > 0 {
+			dir := multipartDir(upload.UserID, upload.UploadID)
+			freed := dirSize(dir)
+			if err := os.RemoveAll(dir); err != nil {
+				result.Failed++
+			} else {
+				result.Aborted++
+				result.FreedBytes += freed
+			}
+		}
+		progress(i + 1)
+	}
+
+	// Part directories left behind by a crash between creating one and its
+	// record, and uploads over WebDAV or SFTP cut off before they were saved
+	dirs, _ := filepath.Glob(filepath.Join("storage", "*", ".staging", "multipart", "*"))
+	staged, _ := filepath.Glob(filepath.Join("storage", "*", ".staging", "*"))
+	for _, path := range append(dirs, staged...) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().After(cutoff) || (info.IsDir() && info.Name() == "multipart") {
+			continue
+		}
+		if info.IsDir() {
+			var count int64
+			a.DB.Model(&models.MultipartUpload{}).Where("upload_id = ?", info.Name()).Count(&count)
+			if count > 0 {
+				continue
+			}
+		}
+		freed := info.Size()
+		if info.IsDir() {
+			freed = dirSize(path)
+		}
+		if os.RemoveAll(path) == nil {
+			result.FreedBytes += freed
+		}
+	}
+	return result, nil
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func s3ETag(file *models.File) string {
+	if file.IsDir {
+		return `"` + emptyHash + `"`
+	}
+	return `"` + file.Hash + `"`
+}
+
+var errBadDigest = fmt.Errorf("payload does not match x-amz-content-sha256")
+
+// digestReader fails at EOF when the content does not hash to the signed payload hash,
+// so the upload is discarded before a record is written.
+type digestReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(d.h.Sum(nil)) != d.expected {
+		return n, errBadDigest
+	}
+	return n, err
+}
+
+func payloadVerifier(c *gin.Context, body io.Reader) io.Reader {
+	expected := c.GetString("s3PayloadHash")
+	if len(expected) != sha256.Size*2 {
+		// UNSIGNED-PAYLOAD, or streaming payloads whose chunks were already verified
+		return body
+	}
+	return &digestReader{r: body, h: sha256.New(), expected: strings.ToLower(expected)}
+}
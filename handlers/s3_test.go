@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-storage/middleware"
+	"cloud-storage/models"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// newS3Client serves the gateway and returns an AWS SDK client signed with an
+// access key of the test user.
+func newS3Client(t *testing.T) (*App, *models.User, *s3.Client) {
+	t.Helper()
+	a, user := newTestApp(t)
+	a.Router.Group("/s3", middleware.S3AuthMiddleware(a.DB)).Any("/*path", a.S3)
+	srv := httptest.NewServer(a.Router)
+	t.Cleanup(srv.Close)
+
+	key := models.AccessKey{UserID: user.ID, AccessKeyID: "AKIDTEST", SecretKey: "secret"}
+	if err := a.DB.Create(&key).Error; err != nil {
+		t.Fatal(err)
+	}
+	client := s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL + "/s3"),
+		Region:       "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: key.AccessKeyID, SecretAccessKey: key.SecretKey}, nil
+		}),
+		UsePathStyle: true,
+	})
+	return a, user, client
+}
+
+func s3ErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+func TestS3SDKObjects(t *testing.T) {
+	_, _, client := newS3Client(t)
+	ctx := context.Background()
+
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("photos")}); err != nil {
+		t.Fatal("CreateBucket:", err)
+	}
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("2024/beach.txt"),
+		Body:   strings.NewReader("sand and sea"),
+	})
+	if err != nil {
+		t.Fatal("PutObject:", err)
+	}
+
+	list, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("photos"), Prefix: aws.String("2024/")})
+	if err != nil {
+		t.Fatal("ListObjectsV2:", err)
+	}
+	if len(list.Contents) != 1 || aws.ToString(list.Contents[0].Key) != "2024/beach.txt" || aws.ToInt64(list.Contents[0].Size) != 12 {
+		t.Fatalf("ListObjectsV2 = %+v", list.Contents)
+	}
+
+	get, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/beach.txt")})
+	if err != nil {
+		t.Fatal("GetObject:", err)
+	}
+	data, _ := io.ReadAll(get.Body)
+	get.Body.Close()
+	if string(data) != "sand and sea" {
+		t.Errorf("GetObject = %q", data)
+	}
+
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/beach.txt")}); err != nil {
+		t.Fatal("DeleteObject:", err)
+	}
+	_, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/beach.txt")})
+	if code := s3ErrorCode(err); code != "NoSuchKey" {
+		t.Errorf("GetObject after delete: %v, want NoSuchKey", err)
+	}
+}
+
+func TestS3SDKMultipart(t *testing.T) {
+	a, user, client := newS3Client(t)
+	ctx := context.Background()
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("backups")}); err != nil {
+		t.Fatal("CreateBucket:", err)
+	}
+
+	upload, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("backups"), Key: aws.String("db.dump")})
+	if err != nil {
+		t.Fatal("CreateMultipartUpload:", err)
+	}
+	parts := [][]byte{bytes.Repeat([]byte("a"), 5<<20), []byte("tail")}
+	var completed []types.CompletedPart
+	for i, content := range parts {
+		part, err := client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String("backups"),
+			Key:        aws.String("db.dump"),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(int32(i + 1)),
+			Body:       bytes.NewReader(content),
+		})
+		if err != nil {
+			t.Fatalf("UploadPart %d: %v", i+1, err)
+		}
+		completed = append(completed, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(int32(i + 1))})
+	}
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("backups"),
+		Key:             aws.String("db.dump"),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		t.Fatal("CompleteMultipartUpload:", err)
+	}
+
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("backups"), Key: aws.String("db.dump")})
+	if err != nil {
+		t.Fatal("HeadObject:", err)
+	}
+	if got := aws.ToInt64(head.ContentLength); got != 5<<20+4 {
+		t.Errorf("assembled object is %d bytes, want %d", got, 5<<20+4)
+	}
+
+	// Parts count against the quota before the upload is completed
+	a.DB.Model(user).Update("quota_bytes", 5<<20+4+1024)
+	upload, err = client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("backups"), Key: aws.String("big")})
+	if err != nil {
+		t.Fatal("CreateMultipartUpload:", err)
+	}
+	for i, size := range []int{1000, 1000} {
+		_, err = client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String("backups"),
+			Key:        aws.String("big"),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(int32(i + 1)),
+			Body:       bytes.NewReader(make([]byte, size)),
+		})
+		if i == 0 && err != nil {
+			t.Fatal("UploadPart within quota:", err)
+		}
+	}
+	if code := s3ErrorCode(err); code != "QuotaExceeded" {
+		t.Errorf("UploadPart over quota: %v, want QuotaExceeded", err)
+	}
+
+	// Abandoned uploads are collected with their parts
+	a.DB.Model(&models.MultipartUpload{}).Where("upload_id = ?", aws.ToString(upload.UploadId)).
+		UpdateColumn("updated_at", time.Now().Add(-multipartTTL-time.Hour))
+	result, err := a.runMultipartGCJob(ctx, &models.Job{}, func(int) {})
+	if err != nil {
+		t.Fatal("runMultipartGCJob:", err)
+	}
+	if gc := result.(multipartGCResult); gc.Aborted != 1 || gc.FreedBytes != 1000 {
+		t.Errorf("runMultipartGCJob = %+v, want one upload of 1000 bytes aborted", gc)
+	}
+	_, err = client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String("backups"),
+		Key:        aws.String("big"),
+		UploadId:   upload.UploadId,
+		PartNumber: aws.Int32(2),
+		Body:       strings.NewReader("late"),
+	})
+	if code := s3ErrorCode(err); code != "NoSuchUpload" {
+		t.Errorf("UploadPart after collection: %v, want NoSuchUpload", err)
+	}
+}
+
+func TestS3SDKPresigned(t *testing.T) {
+	_, _, client := newS3Client(t)
+	ctx := context.Background()
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("share")}); err != nil {
+		t.Fatal("CreateBucket:", err)
+	}
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("share"), Key: aws.String("a.txt"), Body: strings.NewReader("shared")}); err != nil {
+		t.Fatal("PutObject:", err)
+	}
+
+	presign := func(signedAt time.Time) string {
+		t.Helper()
+		req, err := s3.NewPresignClient(client).PresignGetObject(ctx,
+			&s3.GetObjectInput{Bucket: aws.String("share"), Key: aws.String("a.txt")},
+			s3.WithPresignExpires(time.Hour),
+			func(o *s3.PresignOptions) {
+				o.Presigner = presignerAt{v4.NewSigner(), signedAt}
+			})
+		if err != nil {
+			t.Fatal("PresignGetObject:", err)
+		}
+		return req.URL
+	}
+	fetch := func(url string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	if status, body := fetch(presign(time.Now())); status != http.StatusOK || body != "shared" {
+		t.Errorf("presigned GET = %d %q", status, body)
+	}
+	if status, _ := fetch(presign(time.Now().Add(-2 * time.Hour))); status != http.StatusForbidden {
+		t.Errorf("expired presigned GET = %d, want 403", status)
+	}
+	// Dated ahead, the URL would outlive its expiry
+	if status, _ := fetch(presign(time.Now().Add(24 * time.Hour))); status != http.StatusForbidden {
+		t.Errorf("future-dated presigned GET = %d, want 403", status)
+	}
+}
+
+// presignerAt signs URLs as if at a fixed time.
+type presignerAt struct {
+	*v4.Signer
+	at time.Time
+}
+
+func (p presignerAt) PresignHTTP(ctx context.Context, credentials aws.Credentials, r *http.Request,
+	payloadHash, service, region string, _ time.Time, optFns ...func(*v4.SignerOptions)) (string, http.Header, error) {
+	return p.Signer.PresignHTTP(ctx, credentials, r, payloadHash, service, region, p.at, optFns...)
+}
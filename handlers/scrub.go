@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+	"cloud-storage/scrub"
+
+	"github.com/gin-gonic/gin"
+)
+
+const scrubJob = "scrub"
+
+func (a *App) runScrubJob(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	var opts scrub.Options
+	if len(job.Payload) > 0 {
+		if err := json.Unmarshal(job.Payload, &opts); err != nil {
+			return nil, jobs.Permanent(err)
+		}
+	}
+	return a.scrubber().Run(ctx, opts, progress)
+}
+
+func (a *App) scrubber() *scrub.Scrubber {
+	s := scrub.NewScrubber(a.DB, "storage")
+	s.Keys = a.Keys
+	return s
+}
+
+// AdminStartScrub queues a scrub of all blobs with the repairs chosen in the body.
+func (a *App) AdminStartScrub(c *gin.Context) {
+	var opts scrub.Options
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&opts); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	var pending int64
+	a.DB.Model(&models.Job{}).Where("type = ? AND status IN ?", scrubJob, []string{models.JobQueued, models.JobRunning}).Count(&pending)
+	if pending > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A scrub is already queued or running"})
+		return
+	}
+
+	total, err := a.scrubber().Count()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count blobs"})
+		return
+	}
+	job, err := a.Jobs.Enqueue(0, scrubJob, opts, jobs.Options{Priority: jobs.PriorityLow, Total: total})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue scrub"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID})
+}
+
+// AdminListScrubs returns the latest scrubs with their reports, newest first.
+func (a *App) AdminListScrubs(c *gin.Context) {
+	var scrubs []models.Job
+	if err := a.DB.Where("type = ?", scrubJob).Order("id desc").Limit(10).Find(&scrubs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch scrubs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"scrubs": scrubs})
+}
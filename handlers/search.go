@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"cloud-storage/models"
+	"cloud-storage/search"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// SearchFiles runs q, or the saved search given by saved, in the query language
+// described by search.Parse.
+func (a *App) SearchFiles(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSearchLimit)))
+	if err != nil || limit < 1 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	query := c.Query("q")
+	if id := c.Query("saved"); id != "" {
+		var saved models.SavedSearch
+		if err := a.DB.Where("id = ? AND user_id = ?", id, userID).First(&saved).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Saved search not found"})
+			return
+		}
+		query = saved.Query
+	}
+
+	results, err := a.Search.Search(userID, query, limit, offset)
+	if err != nil {
+		a.searchError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+func (a *App) searchError(c *gin.Context, err error) {
+	var parseErr *search.ParseError
+	switch {
+	case errors.As(err, &parseErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": parseErr.Msg, "position": parseErr.Pos})
+	case err == search.ErrEmptyQuery:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing search query"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+	}
+}
+
+type SavedSearchRequest struct {
+	Name  string `json:"name" binding:"required"`
+	Query string `json:"query" binding:"required"`
+}
+
+func (a *App) CreateSavedSearch(c *gin.Context) {
+	var req SavedSearchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+
+	// Running the query once checks it parses and that folders it names exist
+	if _, err := a.Search.Search(userID, req.Query, 1, 0); err != nil {
+		a.searchError(c, err)
+		return
+	}
+
+	saved := models.SavedSearch{UserID: userID, Name: req.Name, Query: req.Query}
+	if err := a.DB.Create(&saved).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A saved search with this name already exists"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"saved_search": saved})
+}
+
+func (a *App) ListSavedSearches(c *gin.Context) {
+	var saved []models.SavedSearch
+	if err := a.DB.Where("user_id = ?", c.MustGet("userID").(uint)).Order("name").Find(&saved).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch saved searches"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"saved_searches": saved})
+}
+
+func (a *App) DeleteSavedSearch(c *gin.Context) {
+	var saved models.SavedSearch
+	if err := a.DB.Where("id = ? AND user_id = ?", c.Param("id"), c.MustGet("userID").(uint)).First(&saved).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Saved search not found"})
+		return
+	}
+
+	if err := a.DB.Unscoped().Delete(&saved).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete saved search"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Saved search deleted successfully"})
+}
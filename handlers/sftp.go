@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"cloud-storage/models"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const sftpHostKeyPath = "storage/ssh_host_ed25519_key"
+
+// ServeSFTP accepts SSH connections on addr and serves each user's drive over the sftp subsystem.
+// Users authenticate with their account password or a registered public key.
+func (a *App) ServeSFTP(addr string) error {
+	hostKey, err := loadHostKey(sftpHostKeyPath)
+	if err != nil {
+		return err
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			var user models.User
+			if err := a.DB.Where("username = ?", conn.User()).First(&user).Error; err != nil {
+				return nil, errors.New("invalid credentials")
+			}
+			if err := user.CheckPassword(string(password)); err != nil {
+				return nil, errors.New("invalid credentials")
+			}
+			return sftpPermissions(user.ID), nil
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			var user models.User
+			if err := a.DB.Where("username = ?", conn.User()).First(&user).Error; err != nil {
+				return nil, errors.New("unknown public key")
+			}
+			var sshKey models.SSHKey
+			if err := a.DB.Where("user_id = ? AND fingerprint = ?", user.ID, ssh.FingerprintSHA256(key)).First(&sshKey).Error; err != nil {
+				return nil, errors.New("unknown public key")
+			}
+			return sftpPermissions(user.ID), nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go a.handleSSHConn(conn, config)
+	}
+}
+
+func sftpPermissions(userID uint) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{"user-id": strconv.FormatUint(uint64(userID), 10)}}
+}
+
+// loadHostKey reads the server's host key, generating one on first start.
+func loadHostKey(path string) (ssh.Signer, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(private)
+}
+
+func (a *App) handleSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	userID, err := strconv.ParseUint(serverConn.Permissions.Extensions["user-id"], 10, 64)
+	if err != nil {
+		return
+	}
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			log.Println("sftp: failed to accept channel:", err)
+			continue
+		}
+
+		go func() {
+			// Only the sftp subsystem is offered; shells and exec are refused
+			for req := range channelRequests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					session := &sftpSession{app: a, userID: uint(userID), rw: channel, handles: map[string]*sftpHandle{}}
+					if err := session.serve(); err != nil {
+						log.Println("sftp:", err)
+					}
+					channel.Close()
+					return
+				}
+			}
+		}()
+	}
+}
+
+// sftpError maps drive errors to SFTP status codes.
+func sftpError(err error) (uint32, string) {
+	switch {
+	case err == nil:
+		return sshFxOK, "OK"
+	case errors.Is(err, os.ErrNotExist):
+		return sshFxNoSuchFile, "No such file"
+	case errors.Is(err, os.ErrExist):
+		return sshFxFailure, "File exists"
+	case errors.Is(err, os.ErrPermission), errors.Is(err, errQuotaExceeded):
+		return sshFxPermissionDenied, err.Error()
+	default:
+		return sshFxFailure, fmt.Sprint(err)
+	}
+}
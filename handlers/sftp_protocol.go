@@ -0,0 +1,612 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"cloud-storage/blobcrypt"
+	"cloud-storage/models"
+)
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02) packet types, status codes and flags.
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpRead     = 5
+	sshFxpWrite    = 6
+	sshFxpLstat    = 7
+	sshFxpFstat    = 8
+	sshFxpSetstat  = 9
+	sshFxpFsetstat = 10
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpRemove   = 13
+	sshFxpMkdir    = 14
+	sshFxpRmdir    = 15
+	sshFxpRealpath = 16
+	sshFxpStat     = 17
+	sshFxpRename   = 18
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpData     = 103
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+
+	sshFxOK               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+	sshFxBadMessage       = 5
+	sshFxOpUnsupported    = 8
+
+	sshFxfRead   = 0x01
+	sshFxfWrite  = 0x02
+	sshFxfAppend = 0x04
+	sshFxfCreat  = 0x08
+	sshFxfTrunc  = 0x10
+	sshFxfExcl   = 0x20
+
+	sshFileXferAttrSize        = 0x01
+	sshFileXferAttrUIDGID      = 0x02
+	sshFileXferAttrPermissions = 0x04
+	sshFileXferAttrACModTime   = 0x08
+	sshFileXferAttrExtended    = 0x80000000
+
+	sftpMaxPacket = 256 * 1024
+	sftpMaxRead   = 32 * 1024
+)
+
+var errBadMessage = errors.New("bad message")
+
+// sftpHandle is an open file or directory. Writes go to a temporary file that
+// is committed through writeFile when the handle is closed.
+type sftpHandle struct {
+	file     *models.File
+	blob     blobcrypt.Blob
+	tmp      *stagedFile
+	parentID *uint
+	name     string
+	listed   bool
+	dir      bool
+	// Writes may not reach past the user's remaining quota; -1 when unlimited
+	limit int64
+}
+
+type sftpSession struct {
+	app     *App
+	userID  uint
+	rw      io.ReadWriter
+	handles map[string]*sftpHandle
+	next    int
+}
+
+func (s *sftpSession) serve() error {
+	defer s.closeAll()
+
+	for {
+		packet, err := readSFTPPacket(s.rw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.handle(packet); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *sftpSession) closeAll() {
+	for id, h := range s.handles {
+		if h.blob != nil {
+			h.blob.Close()
+		}
+		if h.tmp != nil {
+			h.tmp.Remove()
+		}
+		delete(s.handles, id)
+	}
+}
+
+func readSFTPPacket(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 || length > sftpMaxPacket {
+		return nil, errBadMessage
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// sftpBuffer decodes packet fields in order, remembering the first error.
+type sftpBuffer struct {
+	data []byte
+	err  error
+}
+
+func (b *sftpBuffer) uint32() uint32 {
+	if len(b.data) < 4 {
+		b.err = errBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint32(b.data)
+	b.data = b.data[4:]
+	return v
+}
+
+func (b *sftpBuffer) uint64() uint64 {
+	if len(b.data) < 8 {
+		b.err = errBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint64(b.data)
+	b.data = b.data[8:]
+	return v
+}
+
+func (b *sftpBuffer) string() string {
+	n := b.uint32()
+	if b.err != nil || uint32(len(b.data)) < n {
+		b.err = errBadMessage
+		return ""
+	}
+	v := string(b.data[:n])
+	b.data = b.data[n:]
+	return v
+}
+
+// sftpPacket builds an outgoing packet.
+type sftpPacket []byte
+
+func (p sftpPacket) byte(v byte) sftpPacket {
+	return append(p, v)
+}
+
+func (p sftpPacket) uint32(v uint32) sftpPacket {
+	return binary.BigEndian.AppendUint32(p, v)
+}
+
+func (p sftpPacket) uint64(v uint64) sftpPacket {
+	return binary.BigEndian.AppendUint64(p, v)
+}
+
+func (p sftpPacket) string(v string) sftpPacket {
+	return append(p.uint32(uint32(len(v))), v...)
+}
+
+func (p sftpPacket) attrs(file *models.File) sftpPacket {
+	mode := uint32(0100644)
+	var size uint64
+	mtime := time.Now()
+	if file == nil || file.IsDir {
+		mode = 040755
+	}
+	if file != nil {
+		size = uint64(file.Size)
+		mtime = file.LastModified
+		if mtime.IsZero() {
+			mtime = file.UpdatedAt
+		}
+	}
+	return p.uint32(sshFileXferAttrSize | sshFileXferAttrPermissions | sshFileXferAttrACModTime).
+		uint64(size).
+		uint32(mode).
+		uint32(uint32(mtime.Unix())).
+		uint32(uint32(mtime.Unix()))
+}
+
+func (s *sftpSession) send(p sftpPacket) error {
+	_, err := s.rw.Write(sftpPacket(nil).uint32(uint32(len(p))).append(p))
+	return err
+}
+
+func (p sftpPacket) append(other sftpPacket) sftpPacket {
+	return append(p, other...)
+}
+
+func (s *sftpSession) sendStatus(id uint32, err error) error {
+	code, message := sftpError(err)
+	if err == io.EOF {
+		code, message = sshFxEOF, "EOF"
+	}
+	return s.send(sftpPacket(nil).byte(sshFxpStatus).uint32(id).uint32(code).string(message).string(""))
+}
+
+func (s *sftpSession) sendStatusCode(id, code uint32, message string) error {
+	return s.send(sftpPacket(nil).byte(sshFxpStatus).uint32(id).uint32(code).string(message).string(""))
+}
+
+func (s *sftpSession) sendHandle(id uint32, h *sftpHandle) error {
+	s.next++
+	key := strconv.Itoa(s.next)
+	s.handles[key] = h
+	return s.send(sftpPacket(nil).byte(sshFxpHandle).uint32(id).string(key))
+}
+
+func (s *sftpSession) sendAttrs(id uint32, file *models.File) error {
+	return s.send(sftpPacket(nil).byte(sshFxpAttrs).uint32(id).attrs(file))
+}
+
+func (s *sftpSession) handle(packet []byte) error {
+	kind := packet[0]
+	b := &sftpBuffer{data: packet[1:]}
+
+	if kind == sshFxpInit {
+		return s.send(sftpPacket(nil).byte(sshFxpVersion).uint32(3))
+	}
+
+	id := b.uint32()
+	if b.err != nil {
+		return b.err
+	}
+
+	var err error
+	switch kind {
+	case sshFxpRealpath:
+		err = s.realpath(id, b)
+	case sshFxpStat, sshFxpLstat:
+		err = s.stat(id, b)
+	case sshFxpFstat:
+		err = s.fstat(id, b)
+	case sshFxpSetstat, sshFxpFsetstat:
+		// Permissions and times are not stored, so attribute changes are accepted and ignored
+		err = s.sendStatus(id, nil)
+	case sshFxpOpendir:
+		err = s.opendir(id, b)
+	case sshFxpReaddir:
+		err = s.readdir(id, b)
+	case sshFxpOpen:
+		err = s.open(id, b)
+	case sshFxpRead:
+		err = s.read(id, b)
+	case sshFxpWrite:
+		err = s.write(id, b)
+	case sshFxpClose:
+		err = s.close(id, b)
+	case sshFxpRemove:
+		err = s.remove(id, b, false)
+	case sshFxpRmdir:
+		err = s.remove(id, b, true)
+	case sshFxpMkdir:
+		err = s.mkdir(id, b)
+	case sshFxpRename:
+		err = s.rename(id, b)
+	default:
+		err = s.sendStatusCode(id, sshFxOpUnsupported, "Operation unsupported")
+	}
+
+	if err == errBadMessage {
+		return s.sendStatusCode(id, sshFxBadMessage, "Bad message")
+	}
+	return err
+}
+
+// resolveSFTPPath turns an SFTP path into a drive path; relative paths start at the root.
+func resolveSFTPPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func (s *sftpSession) realpath(id uint32, b *sftpBuffer) error {
+	p := b.string()
+	if b.err != nil {
+		return b.err
+	}
+	p = resolveSFTPPath(p)
+	return s.send(sftpPacket(nil).byte(sshFxpName).uint32(id).uint32(1).string(p).string(p).attrs(nil))
+}
+
+func (s *sftpSession) stat(id uint32, b *sftpBuffer) error {
+	p := b.string()
+	if b.err != nil {
+		return b.err
+	}
+	file, err := s.app.lookupPath(s.userID, resolveSFTPPath(p))
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	return s.sendAttrs(id, file)
+}
+
+func (s *sftpSession) fstat(id uint32, b *sftpBuffer) error {
+	h, ok := s.handles[b.string()]
+	if b.err != nil {
+		return b.err
+	}
+	if !ok {
+		return s.sendStatusCode(id, sshFxFailure, "Invalid handle")
+	}
+	if h.tmp != nil {
+		return s.sendAttrs(id, &models.File{Name: h.name, Size: h.tmp.Size(), LastModified: time.Now()})
+	}
+	return s.sendAttrs(id, h.file)
+}
+
+func (s *sftpSession) opendir(id uint32, b *sftpBuffer) error {
+	p := b.string()
+	if b.err != nil {
+		return b.err
+	}
+	dir, err := s.app.lookupPath(s.userID, resolveSFTPPath(p))
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	if dir != nil && !dir.IsDir {
+		return s.sendStatusCode(id, sshFxFailure, "Not a directory")
+	}
+	return s.sendHandle(id, &sftpHandle{file: dir, dir: true})
+}
+
+func (s *sftpSession) readdir(id uint32, b *sftpBuffer) error {
+	h, ok := s.handles[b.string()]
+	if b.err != nil {
+		return b.err
+	}
+	if !ok || !h.dir {
+		return s.sendStatusCode(id, sshFxFailure, "Invalid handle")
+	}
+
+	// The whole listing is returned in one NAME packet, then EOF
+	if h.listed {
+		return s.sendStatus(id, io.EOF)
+	}
+	var parentID *uint
+	if h.file != nil {
+		parentID = &h.file.ID
+	}
+	entries, err := s.app.listChildren(s.userID, parentID)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	h.listed = true
+
+	p := sftpPacket(nil).byte(sshFxpName).uint32(id).uint32(uint32(len(entries)))
+	for i := range entries {
+		e := &entries[i]
+		p = p.string(e.Name).string(sftpLongName(e)).attrs(e)
+	}
+	return s.send(p)
+}
+
+// sftpLongName formats an entry like `ls -l`, which some clients display verbatim.
+func sftpLongName(f *models.File) string {
+	mode := "-rw-r--r--"
+	if f.IsDir {
+		mode = "drwxr-xr-x"
+	}
+	return fmt.Sprintf("%s 1 owner owner %12d %s %s", mode, f.Size, f.LastModified.Format("Jan _2 15:04"), f.Name)
+}
+
+func (s *sftpSession) open(id uint32, b *sftpBuffer) error {
+	p := resolveSFTPPath(b.string())
+	pflags := b.uint32()
+	if b.err != nil {
+		return b.err
+	}
+
+	file, err := s.app.lookupPath(s.userID, p)
+	if err != nil && (err != os.ErrNotExist || pflags&sshFxfCreat == 0) {
+		return s.sendStatus(id, err)
+	}
+	if file == nil && err == nil || file != nil && file.IsDir {
+		return s.sendStatusCode(id, sshFxFailure, "Is a directory")
+	}
+	if file != nil && pflags&(sshFxfCreat|sshFxfExcl) == sshFxfCreat|sshFxfExcl {
+		return s.sendStatus(id, os.ErrExist)
+	}
+
+	if pflags&(sshFxfWrite|sshFxfAppend) == 0 {
+		return s.sendHandle(id, &sftpHandle{file: file})
+	}
+
+	parentID, name, err := s.app.lookupParent(s.userID, p)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	limit, err := s.app.quotaLeft(s.userID)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	tmp, err := s.app.stage(s.userID, "sftp-*")
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+
+	// Without truncation the existing content is the starting point for the write
+	if file != nil && pflags&sshFxfTrunc == 0 {
+		blob, err := s.app.openBlob(file)
+		if err == nil {
+			_, err = io.Copy(tmp, blob)
+			blob.Close()
+		}
+		if err != nil {
+			tmp.Remove()
+			return s.sendStatus(id, err)
+		}
+	}
+
+	return s.sendHandle(id, &sftpHandle{file: file, tmp: tmp, parentID: parentID, name: name, limit: limit})
+}
+
+// copyBlob writes the content of file to dst as a download of it.
+func (a *App) copyBlob(dst io.Writer, file *models.File) error {
+	blob, err := a.openBlob(file)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	if err := a.countDownload(file); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, blob)
+	return err
+}
+
+func (s *sftpSession) read(id uint32, b *sftpBuffer) error {
+	h, ok := s.handles[b.string()]
+	offset := b.uint64()
+	length := b.uint32()
+	if b.err != nil {
+		return b.err
+	}
+	if !ok || h.dir {
+		return s.sendStatusCode(id, sshFxFailure, "Invalid handle")
+	}
+
+	// Staged uploads are encrypted as they are written and only read back once closed
+	if h.tmp != nil {
+		return s.sendStatusCode(id, sshFxFailure, "Handle open for writing")
+	}
+	// The first read of a handle is the download
+	if h.blob == nil {
+		blob, err := s.app.openBlob(h.file)
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		if err := s.app.countDownload(h.file); err != nil {
+			blob.Close()
+			return s.sendStatus(id, err)
+		}
+		h.blob = blob
+	}
+
+	if length > sftpMaxRead {
+		length = sftpMaxRead
+	}
+	data := make([]byte, length)
+	n, err := h.blob.ReadAt(data, int64(offset))
+	if n == 0 && err != nil {
+		return s.sendStatus(id, err)
+	}
+	return s.send(sftpPacket(nil).byte(sshFxpData).uint32(id).string(string(data[:n])))
+}
+
+func (s *sftpSession) write(id uint32, b *sftpBuffer) error {
+	h, ok := s.handles[b.string()]
+	offset := b.uint64()
+	data := b.string()
+	if b.err != nil {
+		return b.err
+	}
+	if !ok || h.tmp == nil {
+		return s.sendStatusCode(id, sshFxPermissionDenied, "Handle not open for writing")
+	}
+
+	// The staged file only grows at its end, so writes must be sequential
+	if offset != uint64(h.tmp.Size()) {
+		return s.sendStatusCode(id, sshFxFailure, "Writes must be sequential")
+	}
+	if h.limit >= 0 && (offset > uint64(h.limit) || uint64(len(data)) > uint64(h.limit)-offset) {
+		return s.sendStatus(id, errQuotaExceeded)
+	}
+	_, err := h.tmp.Write([]byte(data))
+	return s.sendStatus(id, err)
+}
+
+func (s *sftpSession) close(id uint32, b *sftpBuffer) error {
+	key := b.string()
+	if b.err != nil {
+		return b.err
+	}
+	h, ok := s.handles[key]
+	if !ok {
+		return s.sendStatusCode(id, sshFxFailure, "Invalid handle")
+	}
+	delete(s.handles, key)
+
+	if h.blob != nil {
+		h.blob.Close()
+	}
+	if h.tmp == nil {
+		return s.sendStatus(id, nil)
+	}
+
+	// Uploads are committed through the same hashing, dedup and quota path as the API
+	defer h.tmp.Remove()
+	content, err := h.tmp.Open(s.app.Keys)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	defer content.Close()
+	_, err = s.app.writeFile(s.userID, h.parentID, h.name, content)
+	return s.sendStatus(id, err)
+}
+
+func (s *sftpSession) remove(id uint32, b *sftpBuffer, dir bool) error {
+	p := b.string()
+	if b.err != nil {
+		return b.err
+	}
+	file, err := s.app.lookupPath(s.userID, resolveSFTPPath(p))
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	if file == nil {
+		return s.sendStatus(id, os.ErrPermission)
+	}
+	if file.IsDir != dir {
+		return s.sendStatusCode(id, sshFxFailure, "Wrong file type")
+	}
+
+	if dir {
+		children, err := s.app.listChildren(s.userID, &file.ID)
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		if len(children) > 0 {
+			return s.sendStatusCode(id, sshFxFailure, "Directory not empty")
+		}
+	}
+	return s.sendStatus(id, s.app.removeFile(file))
+}
+
+func (s *sftpSession) mkdir(id uint32, b *sftpBuffer) error {
+	p := b.string()
+	if b.err != nil {
+		return b.err
+	}
+	parentID, name, err := s.app.lookupParent(s.userID, resolveSFTPPath(p))
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	_, err = s.app.makeDir(s.userID, parentID, name)
+	return s.sendStatus(id, err)
+}
+
+func (s *sftpSession) rename(id uint32, b *sftpBuffer) error {
+	oldPath := resolveSFTPPath(b.string())
+	newPath := resolveSFTPPath(b.string())
+	if b.err != nil {
+		return b.err
+	}
+
+	file, err := s.app.lookupPath(s.userID, oldPath)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	if file == nil {
+		return s.sendStatus(id, os.ErrPermission)
+	}
+	parentID, name, err := s.app.lookupParent(s.userID, newPath)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	if _, err := s.app.lookupChild(s.userID, parentID, name); err == nil {
+		return s.sendStatus(id, os.ErrExist)
+	}
+	return s.sendStatus(id, s.app.moveFile(file, parentID, name))
+}
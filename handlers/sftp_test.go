@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"bytes"
+	"testing"
+
+	"cloud-storage/models"
+)
+
+func TestSFTPWritesAreSequential(t *testing.T) {
+	a, user := newTestApp(t)
+	var out bytes.Buffer
+	s := &sftpSession{app: a, userID: user.ID, rw: &out, handles: map[string]*sftpHandle{}}
+
+	// call sends a request and returns the reply's status code, or its handle
+	call := func(kind byte, p sftpPacket) (uint32, string) {
+		t.Helper()
+		if err := s.handle(sftpPacket(nil).byte(kind).uint32(1).append(p)); err != nil {
+			t.Fatal(err)
+		}
+		packet, err := readSFTPPacket(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &sftpBuffer{data: packet[5:]}
+		if packet[0] == sshFxpHandle {
+			return sshFxOK, b.string()
+		}
+		return b.uint32(), ""
+	}
+
+	code, handle := call(sshFxpOpen, sftpPacket(nil).string("/a.txt").uint32(sshFxfWrite|sshFxfCreat|sshFxfTrunc).uint32(0))
+	if code != sshFxOK || handle == "" {
+		t.Fatalf("open = %d, want a handle", code)
+	}
+	write := func(offset uint64, data string) uint32 {
+		t.Helper()
+		code, _ := call(sshFxpWrite, sftpPacket(nil).string(handle).uint64(offset).string(data))
+		return code
+	}
+
+	// A gap would be filled with zeros, however large the offset
+	if code := write(1<<62, "far"); code != sshFxFailure {
+		t.Errorf("write past the end = %d, want failure", code)
+	}
+	if code := write(0, "hello"); code != sshFxOK {
+		t.Errorf("write at the start = %d, want ok", code)
+	}
+	if code := write(5, " world"); code != sshFxOK {
+		t.Errorf("write at the end = %d, want ok", code)
+	}
+	if code := write(3, "p"); code != sshFxFailure {
+		t.Errorf("write before the end = %d, want failure", code)
+	}
+	if code, _ := call(sshFxpClose, sftpPacket(nil).string(handle)); code != sshFxOK {
+		t.Fatalf("close = %d, want ok", code)
+	}
+
+	var file models.File
+	if err := a.DB.Where("name = ?", "a.txt").First(&file).Error; err != nil {
+		t.Fatal(err)
+	}
+	if file.Size != int64(len("hello world")) {
+		t.Errorf("size = %d, want %d", file.Size, len("hello world"))
+	}
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+
+	"cloud-storage/events"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errShareWithSelf     = errors.New("cannot share with yourself")
+	errInvalidPermission = errors.New("permission must be read or write")
+)
+
+// shareFile gives recipient access to file, updating the permission of an
+// existing share. Both users get a file.shared event.
+func (a *App) shareFile(file *models.File, recipient *models.User, permission string) (*models.Share, error) {
+	if permission == "" {
+		permission = "read"
+	}
+	if permission != "read" && permission != "write" {
+		return nil, errInvalidPermission
+	}
+	if recipient.ID == file.UserID {
+		return nil, errShareWithSelf
+	}
+
+	share := models.Share{FileID: file.ID, SharedWithID: recipient.ID}
+	if err := a.DB.Where(&share).Attrs(models.Share{OwnerID: file.UserID}).FirstOrInit(&share).Error; err != nil {
+		return nil, err
+	}
+	share.Permission = permission
+	if err := a.DB.Save(&share).Error; err != nil {
+		return nil, err
+	}
+
+	data := gin.H{"name": file.Name, "share_id": share.ID, "owner_id": file.UserID,
+		"shared_with_id": recipient.ID, "permission": permission}
+	a.Events.Publish(events.Event{Type: events.FileShared, UserID: file.UserID, FileID: &file.ID, Data: data})
+	a.Events.Publish(events.Event{Type: events.FileShared, UserID: recipient.ID, FileID: &file.ID, Data: data})
+	return &share, nil
+}
+
+// shareRecipients lists the users a file is shared with, directly or through a
+// folder above it. Deleted files are looked up too, for their events.
+func (a *App) shareRecipients(fileID uint) ([]uint, error) {
+	var recipients []uint
+	for id := &fileID; id != nil; {
+		var shared []uint
+		if err := a.DB.Model(&models.Share{}).Where("file_id = ?", *id).Pluck("shared_with_id", &shared).Error; err != nil {
+			return recipients, err
+		}
+		recipients = append(recipients, shared...)
+
+		var file models.File
+		if err := a.DB.Unscoped().Select("id", "parent_id").First(&file, *id).Error; err != nil {
+			return recipients, err
+		}
+		id = file.ParentID
+	}
+	return recipients, nil
+}
+
+// ListShares returns the files others shared with the user and those the user shared.
+func (a *App) ListShares(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var withMe, byMe []models.Share
+	if err := a.DB.Preload("File").Where("shared_with_id = ?", userID).Order("created_at desc").Find(&withMe).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shares"})
+		return
+	}
+	if err := a.DB.Preload("File").Where("owner_id = ?", userID).Order("created_at desc").Find(&byMe).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shares"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shared_with_me": withMe, "shared_by_me": byMe})
+}
+
+// DeleteShare revokes a share; either the owner or the recipient may do so.
+func (a *App) DeleteShare(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var share models.Share
+	if err := a.DB.Where("id = ? AND (owner_id = ? OR shared_with_id = ?)", c.Param("id"), userID, userID).First(&share).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+
+	if err := a.DB.Unscoped().Delete(&share).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete share"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share deleted successfully"})
+}
+
+// DownloadShare serves a file shared with the user.
+func (a *App) DownloadShare(c *gin.Context) {
+	var share models.Share
+	if err := a.DB.Preload("File").Where("id = ? AND shared_with_id = ?", c.Param("id"), c.MustGet("userID").(uint)).First(&share).Error; err != nil || share.File.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+	if share.File.IsDir {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Shared folders cannot be downloaded as a file"})
+		return
+	}
+
+	if share.File.MimeType != "" {
+		c.Header("Content-Type", share.File.MimeType)
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": share.File.Name}))
+	a.serveBlob(c, &share.File)
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+type SSHKeyRequest struct {
+	Name      string `json:"name" binding:"required"`
+	PublicKey string `json:"public_key" binding:"required"`
+}
+
+func (a *App) CreateSSHKey(c *gin.Context) {
+	var req SSHKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	// Accept a single line in authorized_keys format
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid public key"})
+		return
+	}
+
+	fingerprint := ssh.FingerprintSHA256(publicKey)
+	var existing models.SSHKey
+	if err := a.DB.Where("fingerprint = ?", fingerprint).First(&existing).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Public key already registered"})
+		return
+	}
+
+	key := models.SSHKey{
+		UserID:      c.MustGet("userID").(uint),
+		Name:        req.Name,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+		Fingerprint: fingerprint,
+	}
+	if err := a.DB.Create(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save public key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"ssh_key": key})
+}
+
+func (a *App) ListSSHKeys(c *gin.Context) {
+	var keys []models.SSHKey
+	if err := a.DB.Where("user_id = ?", c.MustGet("userID").(uint)).Order("created_at desc").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch public keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ssh_keys": keys})
+}
+
+func (a *App) DeleteSSHKey(c *gin.Context) {
+	var key models.SSHKey
+	if err := a.DB.Where("id = ? AND user_id = ?", c.Param("id"), c.MustGet("userID").(uint)).First(&key).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Public key not found"})
+		return
+	}
+
+	if err := a.DB.Unscoped().Delete(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete public key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Public key deleted successfully"})
+}
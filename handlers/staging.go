@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"cloud-storage/blobcrypt"
+)
+
+// stagingDir holds uploads in progress below the user's storage directory, so
+// they sit with the blobs they become and are encrypted the same way.
+func stagingDir(userID uint) string {
+	return filepath.Join(userDir(userID), ".staging")
+}
+
+// multipartDir holds the parts of an S3 multipart upload.
+func multipartDir(userID uint, uploadID string) string {
+	return filepath.Join(stagingDir(userID), "multipart", uploadID)
+}
+
+// stagedFile is content being uploaded, written to the staging directory
+// through a blobcrypt.Writer when a master key is configured. It only grows
+// at its end; Open seals it for reading.
+type stagedFile struct {
+	name string
+	f    *os.File
+	enc  *blobcrypt.Writer
+	w    io.Writer
+	size int64
+}
+
+// stage creates a staged file named after pattern, as os.CreateTemp does.
+func (a *App) stage(userID uint, pattern string) (*stagedFile, error) {
+	dir := stagingDir(userID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &stagedFile{name: f.Name(), f: f, w: f}
+	if a.Keys != nil {
+		if s.enc, err = blobcrypt.NewWriter(f, a.Keys); err != nil {
+			s.Remove()
+			return nil, err
+		}
+		s.w = s.enc
+	}
+	return s, nil
+}
+
+func (s *stagedFile) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// seal finishes writing and closes the file.
+func (s *stagedFile) seal() error {
+	var err error
+	if s.enc != nil {
+		err = s.enc.Close()
+		s.enc = nil
+	}
+	if s.f != nil {
+		if closeErr := s.f.Close(); err == nil {
+			err = closeErr
+		}
+		s.f = nil
+	}
+	return err
+}
+
+// Open seals the file and returns its content. The file is still removed with Remove.
+func (s *stagedFile) Open(keys *blobcrypt.Keyring) (blobcrypt.Blob, error) {
+	if err := s.seal(); err != nil {
+		return nil, err
+	}
+	return blobcrypt.Open(s.name, keys)
+}
+
+// Commit seals the file and moves it to path.
+func (s *stagedFile) Commit(path string) error {
+	if err := s.seal(); err != nil {
+		os.Remove(s.name)
+		return err
+	}
+	if err := os.Rename(s.name, path); err != nil {
+		os.Remove(s.name)
+		return err
+	}
+	return nil
+}
+
+// Remove discards the file.
+func (s *stagedFile) Remove() {
+	s.seal()
+	os.Remove(s.name)
+}
+
+func (s *stagedFile) Size() int64 {
+	return s.size
+}
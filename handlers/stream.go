@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud-storage/events"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	streamBuffer    = 64
+	keepalivePeriod = 15 * time.Second
+)
+
+// StreamEvents pushes the user's events as Server-Sent Events.
+// Clients resume after a disconnect by sending the Last-Event-ID header.
+func (a *App) StreamEvents(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	lastID, resume := lastEventID(c)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	a.streamEvents(c.Request.Context(), userID, lastID, resume,
+		func(e events.Event) error {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+			return nil
+		},
+		func() error {
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+			return nil
+		},
+	)
+}
+
+// StreamEventsWS is the WebSocket alternative to StreamEvents; each event is sent as a JSON text frame.
+// The resume point is passed as the last_event_id query parameter.
+func (a *App) StreamEventsWS(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	lastID, resume := lastEventID(c)
+
+	// The connection is authenticated by the bearer token, so there is no origin to check
+	server := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			ctx, cancel := context.WithCancel(c.Request.Context())
+			defer cancel()
+
+			// Reading is the only way to notice the peer closing the connection
+			go func() {
+				var discard string
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+				cancel()
+			}()
+
+			a.streamEvents(ctx, userID, lastID, resume,
+				func(e events.Event) error {
+					return websocket.JSON.Send(ws, e)
+				},
+				func() error {
+					return websocket.Message.Send(ws, `{"type":"keepalive"}`)
+				},
+			)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// streamEvents replays events after lastID when resuming and then forwards live ones
+// until ctx ends or a send fails.
+func (a *App) streamEvents(ctx context.Context, userID, lastID uint, resume bool, send func(events.Event) error, ping func() error) {
+	live := make(chan events.Event, streamBuffer)
+	overflow := make(chan struct{}, 1)
+
+	// Subscribe before replaying so nothing published in between is missed
+	unsubscribe := a.Events.Subscribe(func(e events.Event) {
+		if !a.eventVisibleTo(e, userID) {
+			return
+		}
+		select {
+		case live <- forRecipient(e, userID):
+		default:
+			// A slow client is disconnected and catches up through Last-Event-ID on reconnect
+			select {
+			case overflow <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	// Starts the response, so the client knows it is subscribed before any event comes
+	if err := ping(); err != nil {
+		return
+	}
+
+	if resume {
+		// Events of users who shared with this one may concern it too
+		var owners []uint
+		a.DB.Model(&models.Share{}).Where("shared_with_id = ?", userID).Distinct().Pluck("owner_id", &owners)
+		backlog, err := a.Events.Since(append(owners, userID), lastID)
+		if err != nil {
+			return
+		}
+		for _, e := range backlog {
+			if !a.eventVisibleTo(e, userID) {
+				continue
+			}
+			if err := send(forRecipient(e, userID)); err != nil {
+				return
+			}
+			lastID = e.ID
+		}
+	}
+
+	keepalive := time.NewTicker(keepalivePeriod)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-overflow:
+			return
+		case e := <-live:
+			if e.ID != 0 && e.ID <= lastID {
+				continue
+			}
+			if err := send(e); err != nil {
+				return
+			}
+			lastID = e.ID
+		case <-keepalive.C:
+			if err := ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// eventVisibleTo reports whether userID may see e: it is about their own files,
+// or about a file shared with them directly or through a folder above it.
+// Shares notify both users with events of their own.
+func (a *App) eventVisibleTo(e events.Event, userID uint) bool {
+	if e.UserID == userID {
+		return true
+	}
+	if e.FileID == nil || e.Type == events.FileShared {
+		return false
+	}
+	// Deleted files take their shares with them, so their events say who had them
+	if shared, ok := e.Data["shared_with"]; ok {
+		return containsID(shared, userID)
+	}
+	recipients, _ := a.shareRecipients(*e.FileID)
+	return containsID(recipients, userID)
+}
+
+// forRecipient hides from other users whom else a file was shared with.
+func forRecipient(e events.Event, userID uint) events.Event {
+	if e.UserID == userID || e.Data["shared_with"] == nil {
+		return e
+	}
+	data := make(map[string]interface{}, len(e.Data))
+	for k, v := range e.Data {
+		if k != "shared_with" {
+			data[k] = v
+		}
+	}
+	e.Data = data
+	return e
+}
+
+// containsID looks for id in a list of IDs, as published or read back from JSON.
+func containsID(list interface{}, id uint) bool {
+	switch ids := list.(type) {
+	case []uint:
+		for _, v := range ids {
+			if v == id {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, v := range ids {
+			if n, ok := v.(float64); ok && uint(n) == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lastEventID returns the client's resume point and whether one was supplied.
+func lastEventID(c *gin.Context) (uint, bool) {
+	raw := c.GetHeader("Last-Event-ID")
+	if raw == "" {
+		raw = c.Query("last_event_id")
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return uint(id), true
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-storage/events"
+	"cloud-storage/models"
+)
+
+func TestStreamEvents(t *testing.T) {
+	a, user := newTestApp(t)
+	a.Router.GET("/events", as(user), a.StreamEvents)
+	srv := httptest.NewServer(a.Router)
+	t.Cleanup(srv.Close)
+
+	other := &models.User{Username: "alice", Password: "-"}
+	if err := a.DB.Create(other).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// open connects and returns the id and event lines of what is pushed
+	open := func(lastID string) <-chan string {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events", nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type = %q", ct)
+		}
+		lines := make(chan string, 100)
+		go func() {
+			defer resp.Body.Close()
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if line := scanner.Text(); strings.HasPrefix(line, "id: ") || strings.HasPrefix(line, "event: ") {
+					lines <- line
+				}
+			}
+		}()
+		return lines
+	}
+	next := func(lines <-chan string) string {
+		t.Helper()
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event pushed")
+			return ""
+		}
+	}
+
+	lines := open("")
+	// The stream is subscribed by the time the response starts
+	a.Events.Publish(events.Event{Type: events.FileUploaded, UserID: other.ID})
+	a.Events.Publish(events.Event{Type: events.FileUploaded, UserID: user.ID})
+	id := strings.TrimPrefix(next(lines), "id: ")
+	if got := next(lines); got != "event: "+events.FileUploaded {
+		t.Errorf("pushed %q, want the upload", got)
+	}
+
+	// Reconnecting with the last ID seen replays what was missed, and only that
+	a.Events.Publish(events.Event{Type: events.FolderCreated, UserID: user.ID})
+	resumed := open(id)
+	next(resumed)
+	if got := next(resumed); got != "event: "+events.FolderCreated {
+		t.Errorf("replayed %q, want the folder created while away", got)
+	}
+	select {
+	case line := <-resumed:
+		t.Errorf("replayed %q as well", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SyncRequest asks for the changes since an earlier sync; without Since every
+// file is returned.
+type SyncRequest struct {
+	Since *time.Time `json:"since"`
+}
+
+// Sync reports the user's files changed and deleted since Since, and the time
+// to pass as Since next.
+func (a *App) Sync(c *gin.Context) {
+	var req SyncRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+	now := time.Now()
+
+	q := a.DB.Where("user_id = ?", userID)
+	if req.Since != nil {
+		q = q.Where("updated_at > ?", *req.Since)
+	}
+	var changed []models.File
+	if err := q.Order("id").Find(&changed).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync"})
+		return
+	}
+
+	deleted := []uint{}
+	if req.Since != nil {
+		err := a.DB.Unscoped().Model(&models.File{}).Where("user_id = ? AND deleted_at > ?", userID, *req.Since).
+			Pluck("id", &deleted).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"changed": changed, "deleted": deleted, "synced_at": now})
+}
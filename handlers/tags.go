@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud-storage/events"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxTagLength = 64
+
+// LabelRequest changes the tags, star and color of several files at once. Fields
+// left out are not changed.
+type LabelRequest struct {
+	FileIDs    []uint   `json:"file_ids" binding:"required"`
+	AddTags    []string `json:"add_tags"`
+	RemoveTags []string `json:"remove_tags"`
+	Starred    *bool    `json:"starred"`
+	Color      *string  `json:"color"`
+}
+
+var errInvalidTag = errors.New("invalid tag")
+
+func normalizeTags(names []string) ([]string, error) {
+	var out []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || len(name) > maxTagLength {
+			return nil, errInvalidTag
+		}
+		out = append(out, name)
+	}
+	return out, nil
+}
+
+func (a *App) LabelFiles(c *gin.Context) {
+	var req LabelRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.FileIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+
+	addTags, err := normalizeTags(req.AddTags)
+	if err == nil {
+		req.RemoveTags, err = normalizeTags(req.RemoveTags)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tags must be 1 to 64 characters"})
+		return
+	}
+	if req.Color != nil && !models.ValidColor(*req.Color) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid color, use one of " + strings.Join(models.Colors, ", ")})
+		return
+	}
+
+	var files []models.File
+	if err := a.DB.Where("id IN ? AND user_id = ?", req.FileIDs, userID).Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		return
+	}
+	if len(files) != len(uniqueIDs(req.FileIDs)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if len(req.RemoveTags) > 0 {
+		scope, err := a.retentionScope()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update files"})
+			return
+		}
+		for i := range files {
+			if err := scope.checkUntag(&files[i], req.RemoveTags); isRetained(err) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "file_id": files[i].ID})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update files"})
+				return
+			}
+		}
+	}
+
+	err = a.DB.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{}
+		if req.Starred != nil {
+			updates["starred"] = *req.Starred
+		}
+		if req.Color != nil {
+			updates["color"] = *req.Color
+		}
+		if len(updates) > 0 {
+			if err := tx.Model(&models.File{}).Where("id IN ?", req.FileIDs).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		return applyTags(tx, userID, files, addTags, req.RemoveTags)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update files"})
+		return
+	}
+
+	files = nil
+	if err := a.DB.Preload("Tags").Where("id IN ? AND user_id = ?", req.FileIDs, userID).Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		return
+	}
+	for i := range files {
+		a.Events.Publish(events.Event{
+			Type:   events.FileUpdated,
+			UserID: userID,
+			FileID: &files[i].ID,
+			Data:   gin.H{"name": files[i].Name},
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"files": files})
+}
+
+// applyTags adds and removes tags by name on each of files.
+func applyTags(tx *gorm.DB, userID uint, files []models.File, addNames, removeNames []string) error {
+	add, err := findOrCreateTags(tx, userID, addNames)
+	if err != nil {
+		return err
+	}
+	var remove []models.Tag
+	if len(removeNames) > 0 {
+		if err := tx.Where("user_id = ? AND name IN ?", userID, removeNames).Find(&remove).Error; err != nil {
+			return err
+		}
+	}
+
+	for i := range files {
+		if len(add) > 0 {
+			if err := tx.Model(&files[i]).Association("Tags").Append(add); err != nil {
+				return err
+			}
+		}
+		if len(remove) > 0 {
+			if err := tx.Model(&files[i]).Association("Tags").Delete(remove); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findOrCreateTags returns the user's tags with the given names, creating missing ones.
+func findOrCreateTags(tx *gorm.DB, userID uint, names []string) ([]models.Tag, error) {
+	tags := make([]models.Tag, 0, len(names))
+	for _, name := range names {
+		tag := models.Tag{UserID: userID, Name: name}
+		if err := tx.Where(&tag).FirstOrCreate(&tag).Error; err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func uniqueIDs(ids []uint) map[uint]bool {
+	seen := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	return seen
+}
+
+type tagSummary struct {
+	ID        uint   `json:"id"`
+	Name      string `json:"name"`
+	FileCount int64  `json:"file_count"`
+}
+
+// ListTags returns the user's tags with how many files carry each.
+func (a *App) ListTags(c *gin.Context) {
+	var tags []tagSummary
+	err := a.DB.Model(&models.Tag{}).
+		Select("tags.id, tags.name, COUNT(files.id) AS file_count").
+		Joins("LEFT JOIN file_tags ON file_tags.tag_id = tags.id").
+		Joins("LEFT JOIN files ON files.id = file_tags.file_id AND files.deleted_at IS NULL").
+		Where("tags.user_id = ?", c.MustGet("userID").(uint)).
+		Group("tags.id").
+		Order("tags.name COLLATE NOCASE").
+		Scan(&tags).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tags"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
+
+// DeleteTag removes a tag from every file and deletes it, unless a keep rule
+// names the tag.
+func (a *App) DeleteTag(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var tag models.Tag
+	if err := a.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&tag).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+		return
+	}
+	var rule models.RetentionRule
+	if err := a.DB.Where("action = ? AND tag = ?", models.RetainKeep, tag.Name).First(&rule).Error; err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Tag is used by retention rule %q", rule.Name)})
+		return
+	} else if err != gorm.ErrRecordNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete tag"})
+		return
+	}
+
+	var fileIDs []uint
+	err := a.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table("file_tags").Where("tag_id = ?", tag.ID).Pluck("file_id", &fileIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM file_tags WHERE tag_id = ?", tag.ID).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&tag).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete tag"})
+		return
+	}
+
+	for i := range fileIDs {
+		a.Events.Publish(events.Event{Type: events.FileUpdated, UserID: userID, FileID: &fileIDs[i]})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tag deleted successfully"})
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-storage/models"
+)
+
+func TestTagsKeptByRetention(t *testing.T) {
+	a, user := newTestApp(t)
+	api := a.Router.Group("/api/v1", as(user))
+	api.PATCH("/files/labels", a.LabelFiles)
+	api.DELETE("/tags/:id", a.DeleteTag)
+	api.POST("/batch", a.Batch)
+
+	request := func(method, path, body string, want int) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if w.Code != want {
+			t.Fatalf("%s %s: got %d, want %d: %s", method, path, w.Code, want, w.Body)
+		}
+		return w.Body.String()
+	}
+
+	file := models.File{UserID: user.ID, Name: "contract.pdf", LastModified: time.Now()}
+	if err := a.DB.Create(&file).Error; err != nil {
+		t.Fatal(err)
+	}
+	request("PATCH", "/api/v1/files/labels", fmt.Sprintf(`{"file_ids": [%d], "add_tags": ["legal", "draft"]}`, file.ID), http.StatusOK)
+	rule := models.RetentionRule{Name: "contracts", Action: models.RetainKeep, Days: 30, Tag: "legal"}
+	if err := a.DB.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	request("PATCH", "/api/v1/files/labels", fmt.Sprintf(`{"file_ids": [%d], "remove_tags": ["legal"]}`, file.ID), http.StatusForbidden)
+	body := request("POST", "/api/v1/batch", fmt.Sprintf(`{"operations": [{"op": "tag", "file_id": %d, "remove_tags": ["legal"]}]}`, file.ID), http.StatusOK)
+	if !strings.Contains(body, `"status":"failed"`) {
+		t.Errorf("batch untag = %s, want the step to fail", body)
+	}
+	// Other tags come off freely
+	request("PATCH", "/api/v1/files/labels", fmt.Sprintf(`{"file_ids": [%d], "remove_tags": ["draft"]}`, file.ID), http.StatusOK)
+
+	var legal models.Tag
+	if err := a.DB.Where("name = ?", "legal").First(&legal).Error; err != nil {
+		t.Fatal(err)
+	}
+	request("DELETE", fmt.Sprintf("/api/v1/tags/%d", legal.ID), "", http.StatusConflict)
+
+	// Once the rule has run out the tag is the user's again
+	a.DB.Model(&file).UpdateColumn("last_modified", time.Now().AddDate(0, 0, -31))
+	request("PATCH", "/api/v1/files/labels", fmt.Sprintf(`{"file_ids": [%d], "remove_tags": ["legal"]}`, file.ID), http.StatusOK)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud-storage/blobcrypt"
+	"cloud-storage/models"
+	"cloud-storage/thumbnails"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StartThumbnails renders thumbnails of uploads in the background. Files are
+// read through openBlob, so content held back is not rendered.
+func (a *App) StartThumbnails() {
+	a.Thumbnails.Open = func(file *models.File) (io.ReadCloser, error) { return a.openBlob(file) }
+	a.Thumbnails.Start(a.Events, a.Jobs)
+}
+
+func (a *App) GetThumbnail(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	var file models.File
+	if err := a.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&file).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	// Thumbnails are cached by content, so they may exist for files held back
+	if heldBack(c, &file, a.readable(&file)) {
+		return
+	}
+
+	size := thumbnailSize(c.DefaultQuery("size", thumbnails.DefaultSize))
+	thumb, err := a.Thumbnails.Path(&file, size)
+	switch err {
+	case nil:
+	case thumbnails.ErrUnknownSize:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown thumbnail size"})
+		return
+	case thumbnails.ErrUnsupported:
+		c.JSON(http.StatusNotFound, gin.H{"error": "No thumbnail available for this file"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate thumbnail"})
+		return
+	}
+
+	// Content never changes for a given hash, so clients may cache indefinitely
+	c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	c.Header("ETag", `"`+file.Hash+"-"+size+`"`)
+	c.Header("Content-Type", "image/jpeg")
+	content, err := blobcrypt.Open(thumb, a.Thumbnails.Keys)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read thumbnail"})
+		return
+	}
+	defer content.Close()
+	http.ServeContent(c.Writer, c.Request, "", time.Time{}, content)
+}
+
+// thumbnailSize accepts a size name or a pixel count, which is rounded up to the
+// nearest size that is rendered.
+func thumbnailSize(param string) string {
+	px, err := strconv.ParseUint(param, 10, 32)
+	if err != nil {
+		return param
+	}
+
+	// Smallest size that covers the request, falling back to the largest
+	fit, largest := "", ""
+	for name, n := range thumbnails.Sizes {
+		if n >= uint(px) && (fit == "" || n < thumbnails.Sizes[fit]) {
+			fit = name
+		}
+		if largest == "" || n > thumbnails.Sizes[largest] {
+			largest = name
+		}
+	}
+	if fit == "" {
+		return largest
+	}
+	return fit
+}
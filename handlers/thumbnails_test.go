@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud-storage/models"
+)
+
+func TestThumbnails(t *testing.T) {
+	a, user := newTestApp(t)
+	a.StartThumbnails()
+	a.Router.GET("/files/:id/thumbnail", as(user), a.GetThumbnail)
+
+	src := image.NewRGBA(image.Rect(0, 0, 600, 300))
+	for x := 0; x < 600; x++ {
+		src.Set(x, x%300, color.RGBA{R: 200, A: 255})
+	}
+	var encoded bytes.Buffer
+	png.Encode(&encoded, src)
+	picture, err := a.writeFile(user.ID, nil, "wide.png", &encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := a.writeFile(user.ID, nil, "notes.txt", strings.NewReader("not a picture"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(file *models.File, size string, want int) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/files/%d/thumbnail?size=%s", file.ID, size), nil))
+		if w.Code != want {
+			t.Fatalf("thumbnail of %s at %s = %d %s, want %d", file.Name, size, w.Code, w.Body, want)
+		}
+		return w
+	}
+
+	// Sizes bound the longer side, and pixel counts round up to the next size
+	for size, want := range map[string]image.Point{"small": {64, 32}, "large": {1024, 512}, "100": {256, 128}, "5000": {1024, 512}} {
+		w := get(picture, size, http.StatusOK)
+		thumb, err := jpeg.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", size, err)
+		}
+		// Larger boxes than the image keep its size
+		want.X, want.Y = min(want.X, 600), min(want.Y, 300)
+		if got := thumb.Bounds().Size(); got != want {
+			t.Errorf("%s thumbnail is %v, want %v", size, got, want)
+		}
+	}
+
+	get(picture, "huge", http.StatusBadRequest)
+	get(text, "small", http.StatusNotFound)
+
+	// Files waiting for their scan have no thumbnails either
+	a.DB.Model(picture).Update("scan_status", models.ScanPending)
+	get(picture, "small", http.StatusConflict)
+}
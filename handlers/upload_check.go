@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud-storage/chunkstore"
+	"cloud-storage/models"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	possessionRanges   = 4
+	possessionRangeLen = 4096
+	challengeTTL       = 10 * time.Minute
+)
+
+// UploadCheckRequest announces an upload by the SHA-256 and size of its content.
+// When the server holds other users' copies of the content, a second request
+// must answer the challenge of the first with Proof.
+type UploadCheckRequest struct {
+	Hash      string `json:"hash" binding:"required"`
+	Size      int64  `json:"size"`
+	Name      string `json:"name" binding:"required"`
+	ParentID  *uint  `json:"parent_id"`
+	Challenge string `json:"challenge"`
+	Proof     string `json:"proof"`
+	FileExpiry
+}
+
+// uploadChallenge asks for the SHA-256 of Nonce followed by the content's bytes
+// in Ranges, given as offset and length.
+type uploadChallenge struct {
+	jwt.StandardClaims
+	UserID uint       `json:"uid"`
+	Hash   string     `json:"hash"`
+	Size   int64      `json:"size"`
+	Nonce  string     `json:"nonce"`
+	Ranges [][2]int64 `json:"ranges"`
+}
+
+// challengeKey signs challenges with a key of their own, so a challenge is
+// never mistaken for a login token.
+func challengeKey() []byte {
+	return []byte("upload-check:" + os.Getenv("JWT_SECRET"))
+}
+
+func newUploadChallenge(userID uint, hash string, size int64) (*uploadChallenge, string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	challenge := &uploadChallenge{
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(challengeTTL).Unix()},
+		UserID:         userID,
+		Hash:           hash,
+		Size:           size,
+		Nonce:          hex.EncodeToString(nonce),
+	}
+	length := min(size, possessionRangeLen)
+	for i := 0; i < possessionRanges; i++ {
+		offset, err := rand.Int(rand.Reader, big.NewInt(size-length+1))
+		if err != nil {
+			return nil, "", err
+		}
+		challenge.Ranges = append(challenge.Ranges, [2]int64{offset.Int64(), length})
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, challenge).SignedString(challengeKey())
+	return challenge, token, err
+}
+
+// possessionProof answers challenge from content.
+func possessionProof(content io.ReaderAt, challenge *uploadChallenge) (string, error) {
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write(nonce)
+	for _, r := range challenge.Ranges {
+		if _, err := io.Copy(hash, io.NewSectionReader(content, r[0], r[1])); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// CheckUpload creates a file from content already stored, so the client does not
+// have to send it. Content the user stored before is linked right away; content
+// only other users stored is linked once the client proves it has it by hashing
+// random ranges, which keeps a hash alone from unlocking someone else's file.
+// Content stored nowhere gets a challenge too, and any answer to it, like a
+// wrong answer for content stored elsewhere, gets exists false, so the responses
+// do not reveal whether other users have a file. The client then uploads as usual.
+func (a *App) CheckUpload(c *gin.Context) {
+	var req UploadCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !chunkstore.ValidHash(req.Hash) || req.Size < 0 ||
+		strings.ContainsAny(req.Name, `/\`) || req.Name == "." || req.Name == ".." {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !req.valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+
+	if req.ParentID != nil {
+		var parent models.File
+		if err := a.DB.Where("id = ? AND user_id = ? AND is_dir = ?", *req.ParentID, userID, true).First(&parent).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Target folder not found"})
+			return
+		}
+	}
+	existing, err := a.lookupChild(userID, req.ParentID, req.Name)
+	if err != nil && err != os.ErrNotExist {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check upload"})
+		return
+	}
+	if existing != nil && existing.IsDir {
+		c.JSON(http.StatusConflict, gin.H{"error": "A folder with that name exists"})
+		return
+	}
+
+	// Only content that could be downloaded is copied: not unscanned, infected or expired
+	stored := func(db *gorm.DB) *gorm.DB {
+		return db.Where("hash = ? AND size = ? AND is_dir = ? AND corrupt = ? AND path <> ''", req.Hash, req.Size, false, false).
+			Where("scan_status NOT IN ?", a.unreadableScans()).
+			Where("(expires_at IS NULL OR expires_at > ?) AND (max_downloads = 0 OR download_count < max_downloads)", time.Now())
+	}
+	var source models.File
+	if err := a.DB.Scopes(stored).Where("user_id = ?", userID).First(&source).Error; err != nil {
+		if req.Challenge == "" && req.Size > 0 {
+			challenge, token, err := newUploadChallenge(userID, req.Hash, req.Size)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check upload"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"exists": false, "challenge": token, "nonce": challenge.Nonce, "ranges": challenge.Ranges})
+			return
+		}
+
+		var challenge uploadChallenge
+		if req.Size > 0 {
+			token, err := jwt.ParseWithClaims(req.Challenge, &challenge, func(*jwt.Token) (interface{}, error) {
+				return challengeKey(), nil
+			})
+			if err != nil || !token.Valid || token.Method != jwt.SigningMethodHS256 ||
+				challenge.UserID != userID || challenge.Hash != req.Hash || challenge.Size != req.Size {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired challenge"})
+				return
+			}
+		}
+
+		// Any copy proves possession equally well
+		if err := a.DB.Scopes(stored).Order("id").First(&source).Error; err != nil {
+			c.JSON(http.StatusOK, gin.H{"exists": false})
+			return
+		}
+		if req.Size > 0 {
+			content, err := a.openBlob(&source)
+			if err != nil {
+				c.JSON(http.StatusOK, gin.H{"exists": false})
+				return
+			}
+			proof, err := possessionProof(content, &challenge)
+			content.Close()
+			if err != nil {
+				c.JSON(http.StatusOK, gin.H{"exists": false})
+				return
+			}
+			// A wrong proof gets the answer content stored nowhere gets
+			if req.Proof != proof {
+				c.JSON(http.StatusOK, gin.H{"exists": false})
+				return
+			}
+		}
+	}
+
+	if err := a.checkQuota(userID, req.Size); err == errQuotaExceeded {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Storage quota exceeded"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check upload"})
+		return
+	}
+	file, err := a.saveFile(userID, req.ParentID, req.Name, existing, blob{
+		Path:        source.Path,
+		Hash:        source.Hash,
+		Size:        source.Size,
+		MimeType:    source.MimeType,
+		Metadata:    source.Metadata,
+		Compression: source.Compression,
+		StoredSize:  source.StoredSize,
+	})
+	if isRetained(err) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err == nil {
+		err = a.setExpiry(file, req.FileExpiry)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file metadata"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"exists": true, "message": "File uploaded successfully", "file": file})
+}
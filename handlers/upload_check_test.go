@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-storage/models"
+)
+
+func TestCheckUploadSkipsUnreadableCopies(t *testing.T) {
+	a, user := newTestApp(t)
+	a.Router.POST("/upload/check", as(user), a.CheckUpload)
+	hash := strings.Repeat("ab", 32)
+
+	past := time.Now().Add(-time.Hour)
+	for _, file := range []models.File{
+		{Name: "pending.txt", ScanStatus: models.ScanPending},
+		{Name: "infected.txt", ScanStatus: models.ScanInfected},
+		{Name: "expired.txt", ExpiresAt: &past},
+		{Name: "used-up.txt", MaxDownloads: 1, DownloadCount: 1},
+	} {
+		file.UserID, file.Hash, file.Size, file.Path = user.ID, hash, 5, "storage/x"
+		if err := a.DB.Create(&file).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"name": "copy.txt", "hash": %q, "size": 5}`, hash)
+	a.Router.ServeHTTP(w, httptest.NewRequest("POST", "/upload/check", strings.NewReader(body)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"exists":false`) {
+		t.Fatalf("check = %d %s, want the content to be uploaded", w.Code, w.Body)
+	}
+	var count int64
+	a.DB.Model(&models.File{}).Where("name = ?", "copy.txt").Count(&count)
+	if count != 0 {
+		t.Error("a file was created from content that cannot be downloaded")
+	}
+}
+
+func TestCheckUploadHidesOtherUsersCopies(t *testing.T) {
+	a, user := newTestApp(t)
+	a.Router.POST("/upload/check", as(user), a.CheckUpload)
+
+	alice := &models.User{Username: "alice", Password: "-"}
+	if err := a.DB.Create(alice).Error; err != nil {
+		t.Fatal(err)
+	}
+	content := []byte(strings.Repeat("alice's secret ", 1000))
+	if _, err := a.writeFile(alice.ID, nil, "secret.txt", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	stored, missing := hex.EncodeToString(sum[:]), strings.Repeat("cd", 32)
+
+	check := func(hash string, answer func(*uploadChallenge) string) (int, string) {
+		t.Helper()
+		post := func(body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, httptest.NewRequest("POST", "/upload/check", strings.NewReader(body)))
+			return w
+		}
+		w := post(fmt.Sprintf(`{"name": "mine.txt", "hash": %q, "size": %d}`, hash, len(content)))
+		var challenge struct {
+			uploadChallenge
+			Token string `json:"challenge"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &challenge); err != nil || challenge.Token == "" {
+			t.Fatalf("check without proof = %d %s, want a challenge", w.Code, w.Body)
+		}
+		w = post(fmt.Sprintf(`{"name": "mine.txt", "hash": %q, "size": %d, "challenge": %q, "proof": %q}`,
+			hash, len(content), challenge.Token, answer(&challenge.uploadChallenge)))
+		return w.Code, w.Body.String()
+	}
+	wrong := func(*uploadChallenge) string { return strings.Repeat("0", 64) }
+
+	storedCode, storedBody := check(stored, wrong)
+	missingCode, missingBody := check(missing, wrong)
+	if storedCode != missingCode || storedBody != missingBody {
+		t.Errorf("wrong proofs answered %d %s with a copy stored and %d %s without", storedCode, storedBody, missingCode, missingBody)
+	}
+
+	// The copy is there for a client that does hold the content
+	code, body := check(stored, func(challenge *uploadChallenge) string {
+		proof, err := possessionProof(bytes.NewReader(content), challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof
+	})
+	if code != http.StatusOK || !strings.Contains(body, `"file"`) {
+		t.Errorf("right proof = %d %s, want the file created", code, body)
+	}
+}
@@ -0,0 +1,418 @@
+package handlers
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud-storage/blobcrypt"
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+	"gorm.io/gorm"
+)
+
+// WebDAVMethods lists the methods routed to the WebDAV handler.
+var WebDAVMethods = []string{
+	"OPTIONS", "GET", "HEAD", "POST", "PUT", "DELETE",
+	"MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "PROPFIND", "PROPPATCH",
+}
+
+var (
+	davLocksMu sync.Mutex
+	davLocks   = map[uint]webdav.LockSystem{}
+)
+
+// WebDAV serves the user's drive under /dav/ (class 1 and 2).
+// It must run behind BasicAuthMiddleware.
+func (a *App) WebDAV(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: &davFS{app: a, userID: userID},
+		LockSystem: davLockSystem(userID),
+	}
+
+	// Held back content is refused, and downloads counted, before the handler
+	// starts the response
+	if c.Request.Method == http.MethodGet {
+		file, err := a.lookupPath(userID, strings.TrimPrefix(c.Request.URL.Path, handler.Prefix))
+		if err == nil && file != nil && !file.IsDir {
+			err := a.readable(file)
+			if err == nil {
+				err = a.countRequest(c.Request, file)
+			}
+			if heldBack(c, file, err) {
+				return
+			} else if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	handler.ServeHTTP(c.Writer, c.Request)
+}
+
+// davLockSystem returns the user's lock table; users' paths overlap so locks cannot be shared.
+func davLockSystem(userID uint) webdav.LockSystem {
+	davLocksMu.Lock()
+	defer davLocksMu.Unlock()
+
+	ls, ok := davLocks[userID]
+	if !ok {
+		ls = webdav.NewMemLS()
+		davLocks[userID] = ls
+	}
+	return ls
+}
+
+// davFS adapts one user's drive to webdav.FileSystem.
+type davFS struct {
+	app    *App
+	userID uint
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	parentID, base, err := fs.app.lookupParent(fs.userID, name)
+	if err != nil {
+		return err
+	}
+	_, err = fs.app.makeDir(fs.userID, parentID, base)
+	return err
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	file, err := fs.app.lookupPath(fs.userID, name)
+	if err != nil && (err != os.ErrNotExist || flag&os.O_CREATE == 0) {
+		return nil, err
+	}
+	if err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, os.ErrExist
+	}
+
+	// PROPPATCH opens files O_RDWR without truncating, which only needs the dead properties
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 || (file != nil && flag&os.O_TRUNC == 0) {
+		return &davFile{fs: fs, file: file}, nil
+	}
+
+	// Writes are buffered and committed through writeFile on Close
+	if (file != nil && file.IsDir) || (file == nil && err == nil) {
+		return nil, os.ErrPermission
+	}
+	parentID, base, err := fs.app.lookupParent(fs.userID, name)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := fs.app.stage(fs.userID, "dav-*")
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{fs: fs, file: file, parentID: parentID, name: base, tmp: tmp}, nil
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	file, err := fs.app.lookupPath(fs.userID, name)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return os.ErrPermission
+	}
+	return fs.app.removeTree(file)
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	file, err := fs.app.lookupPath(fs.userID, oldName)
+	if err != nil {
+		return err
+	}
+	if file == nil {
+		return os.ErrPermission
+	}
+
+	parentID, base, err := fs.app.lookupParent(fs.userID, newName)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.app.lookupChild(fs.userID, parentID, base); err == nil {
+		return os.ErrExist
+	}
+	return fs.app.moveFile(file, parentID, base)
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	file, err := fs.app.lookupPath(fs.userID, name)
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{file: file}, nil
+}
+
+// davFile is an open drive entry. A nil file is the root folder; a non-nil tmp
+// means the file is open for writing.
+type davFile struct {
+	fs   *davFS
+	file *models.File
+
+	blob    blobcrypt.Blob
+	entries []os.FileInfo
+	listed  bool
+
+	parentID     *uint
+	name         string
+	tmp          *stagedFile
+	pendingProps []webdav.Property
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if err := f.openBlob(); err != nil {
+		return 0, err
+	}
+	return f.blob.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.tmp != nil {
+		// Staged content only grows at its end, which is all a PUT needs
+		if offset == 0 && (whence == io.SeekCurrent || whence == io.SeekEnd) {
+			return f.tmp.Size(), nil
+		}
+		return 0, os.ErrInvalid
+	}
+	if err := f.openBlob(); err != nil {
+		return 0, err
+	}
+	return f.blob.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if f.tmp == nil {
+		return 0, os.ErrPermission
+	}
+	return f.tmp.Write(p)
+}
+
+func (f *davFile) openBlob() error {
+	if f.file == nil || f.file.IsDir {
+		return os.ErrInvalid
+	}
+	if f.blob == nil {
+		blob, err := f.fs.app.openBlob(f.file)
+		if err != nil {
+			return err
+		}
+		f.blob = blob
+	}
+	return nil
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.file != nil && !f.file.IsDir {
+		return nil, os.ErrInvalid
+	}
+
+	if !f.listed {
+		var parentID *uint
+		if f.file != nil {
+			parentID = &f.file.ID
+		}
+		children, err := f.fs.app.listChildren(f.fs.userID, parentID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range children {
+			f.entries = append(f.entries, davFileInfo{file: &children[i]})
+		}
+		f.listed = true
+	}
+
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	if f.tmp != nil {
+		return davFileInfo{file: &models.File{Name: f.name, Size: f.tmp.Size(), LastModified: time.Now()}}, nil
+	}
+	return davFileInfo{file: f.file}, nil
+}
+
+func (f *davFile) Close() error {
+	if f.blob != nil {
+		f.blob.Close()
+	}
+	if f.tmp == nil {
+		return nil
+	}
+
+	tmp := f.tmp
+	f.tmp = nil
+	defer tmp.Remove()
+	content, err := tmp.Open(f.fs.app.Keys)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	file, err := f.fs.app.writeFile(f.fs.userID, f.parentID, f.name, content)
+	if err != nil {
+		return err
+	}
+	f.file = file
+
+	// Properties copied onto a new file can only be saved once its record exists
+	if len(f.pendingProps) > 0 {
+		return f.saveProps([]webdav.Proppatch{{Props: f.pendingProps}})
+	}
+	return nil
+}
+
+func (f *davFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := map[xml.Name]webdav.Property{}
+	if f.file == nil {
+		return props, nil
+	}
+
+	var stored []models.DavProperty
+	if err := f.fs.app.DB.Where("file_id = ?", f.file.ID).Find(&stored).Error; err != nil {
+		return nil, err
+	}
+	for _, p := range stored {
+		name := xml.Name{Space: p.Space, Local: p.Local}
+		props[name] = webdav.Property{XMLName: name, Lang: p.Lang, InnerXML: []byte(p.InnerXML)}
+	}
+	return props, nil
+}
+
+func (f *davFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: http.StatusOK}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+
+	switch {
+	case f.tmp != nil && f.file == nil:
+		for _, patch := range patches {
+			if !patch.Remove {
+				f.pendingProps = append(f.pendingProps, patch.Props...)
+			}
+		}
+	case f.file == nil:
+		pstat.Status = http.StatusForbidden
+	default:
+		if err := f.saveProps(patches); err != nil {
+			return nil, err
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+func (f *davFile) saveProps(patches []webdav.Proppatch) error {
+	return f.fs.app.DB.Transaction(func(tx *gorm.DB) error {
+		for _, patch := range patches {
+			for _, p := range patch.Props {
+				if err := tx.Where("file_id = ? AND space = ? AND local = ?", f.file.ID, p.XMLName.Space, p.XMLName.Local).
+					Delete(&models.DavProperty{}).Error; err != nil {
+					return err
+				}
+				if patch.Remove {
+					continue
+				}
+				prop := models.DavProperty{
+					FileID:   f.file.ID,
+					Space:    p.XMLName.Space,
+					Local:    p.XMLName.Local,
+					Lang:     p.Lang,
+					InnerXML: string(p.InnerXML),
+				}
+				if err := tx.Create(&prop).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// davFileInfo describes a drive entry; a nil file is the root folder.
+type davFileInfo struct {
+	file *models.File
+}
+
+func (i davFileInfo) Name() string {
+	if i.file == nil {
+		return "/"
+	}
+	return i.file.Name
+}
+
+func (i davFileInfo) Size() int64 {
+	if i.file == nil {
+		return 0
+	}
+	return i.file.Size
+}
+
+func (i davFileInfo) Mode() os.FileMode {
+	if i.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i davFileInfo) ModTime() time.Time {
+	if i.file == nil {
+		return time.Time{}
+	}
+	if i.file.LastModified.IsZero() {
+		return i.file.UpdatedAt
+	}
+	return i.file.LastModified
+}
+
+func (i davFileInfo) IsDir() bool {
+	return i.file == nil || i.file.IsDir
+}
+
+func (i davFileInfo) Sys() interface{} {
+	return nil
+}
+
+// ContentType reports the sniffed type; webdav falls back to the extension without one.
+func (i davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if i.file == nil || i.file.MimeType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.file.MimeType, nil
+}
+
+// ETag uses the content hash so unchanged content keeps its ETag across renames.
+func (i davFileInfo) ETag(ctx context.Context) (string, error) {
+	if i.file == nil || i.file.IsDir || i.file.Hash == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + i.file.Hash + `"`, nil
+}
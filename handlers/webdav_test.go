@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newDAVServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	a, user := newTestApp(t)
+	dav := a.Router.Group("/dav", as(user))
+	for _, method := range WebDAVMethods {
+		dav.Handle(method, "/*path", a.WebDAV)
+	}
+	srv := httptest.NewServer(a.Router)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// dav sends a WebDAV request, failing the test unless it answers want.
+func dav(t *testing.T, srv *httptest.Server, method, path string, headers map[string]string, body string, want int) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != want {
+		data, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s %s: got %d, want %d: %s", method, path, resp.StatusCode, want, data)
+	}
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWebDAVPropfind(t *testing.T) {
+	srv := newDAVServer(t)
+	dav(t, srv, "MKCOL", "/dav/docs", nil, "", http.StatusCreated)
+	dav(t, srv, "PUT", "/dav/docs/a.txt", nil, "hello", http.StatusCreated)
+
+	props := `<?xml version="1.0"?><propfind xmlns="DAV:"><prop><getcontentlength/><resourcetype/></prop></propfind>`
+	body := readBody(t, dav(t, srv, "PROPFIND", "/dav/docs/", map[string]string{"Depth": "1"}, props, http.StatusMultiStatus))
+	for _, want := range []string{"/dav/docs/a.txt", "<D:getcontentlength>5</D:getcontentlength>", "<D:collection"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("PROPFIND response lacks %q:\n%s", want, body)
+		}
+	}
+
+	dav(t, srv, "PROPFIND", "/dav/missing", map[string]string{"Depth": "0"}, props, http.StatusNotFound)
+}
+
+func TestWebDAVLock(t *testing.T) {
+	srv := newDAVServer(t)
+	dav(t, srv, "PUT", "/dav/a.txt", nil, "one", http.StatusCreated)
+
+	lockInfo := `<?xml version="1.0"?><lockinfo xmlns="DAV:"><lockscope><exclusive/></lockscope><locktype><write/></locktype><owner>test</owner></lockinfo>`
+	resp := dav(t, srv, "LOCK", "/dav/a.txt", map[string]string{"Timeout": "Second-60"}, lockInfo, http.StatusOK)
+	token := resp.Header.Get("Lock-Token")
+	if token == "" {
+		t.Fatal("LOCK returned no Lock-Token")
+	}
+
+	dav(t, srv, "PUT", "/dav/a.txt", nil, "two", http.StatusLocked)
+	dav(t, srv, "LOCK", "/dav/a.txt", nil, lockInfo, http.StatusLocked)
+	dav(t, srv, "PUT", "/dav/a.txt", map[string]string{"If": "(" + token + ")"}, "two", http.StatusCreated)
+	dav(t, srv, "UNLOCK", "/dav/a.txt", map[string]string{"Lock-Token": token}, "", http.StatusNoContent)
+	dav(t, srv, "PUT", "/dav/a.txt", nil, "three", http.StatusCreated)
+
+	if got := readBody(t, dav(t, srv, "GET", "/dav/a.txt", nil, "", http.StatusOK)); got != "three" {
+		t.Errorf("GET after unlock = %q, want %q", got, "three")
+	}
+}
+
+func TestWebDAVMove(t *testing.T) {
+	srv := newDAVServer(t)
+	dav(t, srv, "MKCOL", "/dav/docs", nil, "", http.StatusCreated)
+	dav(t, srv, "PUT", "/dav/a.txt", nil, "moved", http.StatusCreated)
+	dav(t, srv, "PUT", "/dav/docs/taken.txt", nil, "stays", http.StatusCreated)
+
+	dav(t, srv, "MOVE", "/dav/a.txt", map[string]string{"Destination": srv.URL + "/dav/docs/b.txt"}, "", http.StatusCreated)
+	dav(t, srv, "GET", "/dav/a.txt", nil, "", http.StatusNotFound)
+	if got := readBody(t, dav(t, srv, "GET", "/dav/docs/b.txt", nil, "", http.StatusOK)); got != "moved" {
+		t.Errorf("GET moved file = %q, want %q", got, "moved")
+	}
+
+	dav(t, srv, "MOVE", "/dav/docs/b.txt", map[string]string{"Destination": srv.URL + "/dav/docs/taken.txt", "Overwrite": "F"}, "", http.StatusPreconditionFailed)
+
+	// Folders move with their contents
+	dav(t, srv, "MOVE", "/dav/docs/", map[string]string{"Destination": srv.URL + "/dav/archive/"}, "", http.StatusCreated)
+	if got := readBody(t, dav(t, srv, "GET", "/dav/archive/taken.txt", nil, "", http.StatusOK)); got != "stays" {
+		t.Errorf("GET file in moved folder = %q, want %q", got, "stays")
+	}
+}
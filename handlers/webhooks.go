@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud-storage/events"
+	"cloud-storage/models"
+	"cloud-storage/webhooks"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type WebhookRequest struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events" binding:"required"`
+	Secret string   `json:"secret"`
+}
+
+var webhookEvents = map[string]bool{
+	"*":                   true,
+	events.FileUploaded:   true,
+	events.FileDeleted:    true,
+	events.FileShared:     true,
+	events.FileInfected:   true,
+	events.FileDropped:    true,
+	events.UserRegistered: true,
+}
+
+func (a *App) CreateWebhook(c *gin.Context) {
+	a.createWebhook(c, false)
+}
+
+func (a *App) AdminCreateWebhook(c *gin.Context) {
+	a.createWebhook(c, true)
+}
+
+func (a *App) createWebhook(c *gin.Context, global bool) {
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := webhooks.CheckURL(c.Request.Context(), req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook URL: " + err.Error()})
+		return
+	}
+
+	if len(req.Events) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one event is required"})
+		return
+	}
+	for _, e := range req.Events {
+		if !webhookEvents[e] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event: " + e})
+			return
+		}
+	}
+
+	// Generate a signing secret if the caller didn't supply one
+	if req.Secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+			return
+		}
+		req.Secret = hex.EncodeToString(buf)
+	}
+
+	hook := models.Webhook{
+		UserID: c.MustGet("userID").(uint),
+		URL:    req.URL,
+		Secret: req.Secret,
+		Events: strings.Join(req.Events, ","),
+		Global: global,
+		Active: true,
+	}
+	if err := a.DB.Create(&hook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+
+	// The secret is only ever returned on creation
+	c.JSON(http.StatusCreated, gin.H{
+		"webhook": hook,
+		"secret":  hook.Secret,
+	})
+}
+
+func (a *App) ListWebhooks(c *gin.Context) {
+	a.listWebhooks(c, a.DB.Where("user_id = ? AND global = ?", c.MustGet("userID").(uint), false))
+}
+
+func (a *App) AdminListWebhooks(c *gin.Context) {
+	a.listWebhooks(c, a.DB.Where("global = ?", true))
+}
+
+func (a *App) listWebhooks(c *gin.Context, scope *gorm.DB) {
+	var hooks []models.Webhook
+	if err := scope.Order("created_at desc").Find(&hooks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": hooks})
+}
+
+func (a *App) DeleteWebhook(c *gin.Context) {
+	a.deleteWebhook(c, a.DB.Where("user_id = ? AND global = ?", c.MustGet("userID").(uint), false))
+}
+
+func (a *App) AdminDeleteWebhook(c *gin.Context) {
+	a.deleteWebhook(c, a.DB.Where("global = ?", true))
+}
+
+func (a *App) deleteWebhook(c *gin.Context, scope *gorm.DB) {
+	var hook models.Webhook
+	if err := scope.Where("id = ?", c.Param("id")).First(&hook).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	if err := a.DB.Delete(&hook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// ListDeliveries returns deliveries for the caller's webhooks, defaulting to the dead-letter list.
+func (a *App) ListDeliveries(c *gin.Context) {
+	a.listDeliveries(c, a.ownWebhookIDs(c))
+}
+
+func (a *App) AdminListDeliveries(c *gin.Context) {
+	a.listDeliveries(c, a.DB.Model(&models.Webhook{}).Select("id"))
+}
+
+func (a *App) listDeliveries(c *gin.Context, hookIDs *gorm.DB) {
+	status := c.DefaultQuery("status", models.DeliveryDead)
+
+	var deliveries []models.WebhookDelivery
+	if err := a.DB.Where("webhook_id IN (?) AND status = ?", hookIDs, status).
+		Order("updated_at desc").Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deliveries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// RedeliverWebhook puts a delivery back on the queue with a fresh attempt budget.
+func (a *App) RedeliverWebhook(c *gin.Context) {
+	a.redeliver(c, a.ownWebhookIDs(c))
+}
+
+func (a *App) AdminRedeliverWebhook(c *gin.Context) {
+	a.redeliver(c, a.DB.Model(&models.Webhook{}).Select("id"))
+}
+
+func (a *App) redeliver(c *gin.Context, hookIDs *gorm.DB) {
+	var delivery models.WebhookDelivery
+	if err := a.DB.Where("id = ? AND webhook_id IN (?)", c.Param("id"), hookIDs).First(&delivery).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+
+	delivery.Status = models.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now()
+	if err := a.DB.Save(&delivery).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue delivery"})
+		return
+	}
+	if err := webhooks.QueueDelivery(a.Jobs, c.MustGet("userID").(uint), &delivery); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue delivery"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Delivery queued", "delivery": delivery})
+}
+
+func (a *App) ownWebhookIDs(c *gin.Context) *gorm.DB {
+	return a.DB.Model(&models.Webhook{}).Select("id").
+		Where("user_id = ? AND global = ?", c.MustGet("userID").(uint), false)
+}
@@ -0,0 +1,51 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// Monday 6 January 2025
+	from := time.Date(2025, 1, 6, 10, 17, 30, 0, time.UTC)
+	for spec, want := range map[string]string{
+		"*/15 * * * *":     "2025-01-06 10:30",
+		"0 9-17/4 * * *":   "2025-01-06 13:00",
+		"30 2 * * 7":       "2025-01-12 02:30",
+		"0 0 1,15 * *":     "2025-01-15 00:00",
+		"0 0 13 * 5":       "2025-01-10 00:00", // the 13th or any Friday
+		"0 0 29 2 *":       "2028-02-29 00:00",
+		"@daily":           "2025-01-07 00:00",
+		"@monthly":         "2025-02-01 00:00",
+		"@every 90m":       "2025-01-06 11:47",
+		" 5 10 * * 1-5 ":   "2025-01-07 10:05",
+		"0 12 * jan-feb *": "",
+	} {
+		cron, err := ParseCron(spec)
+		if want == "" {
+			if err == nil {
+				t.Errorf("ParseCron(%q) succeeded", spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", spec, err)
+			continue
+		}
+		if got := cron.Next(from).Format("2006-01-02 15:04"); got != want {
+			t.Errorf("%q next runs %s, want %s", spec, got, want)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "0 0 0 * *", "*/0 * * * *", "5-1 * * * *", "@every 10ms", "@sometimes"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("ParseCron(%q) succeeded", spec)
+		}
+	}
+
+	// 31 February never comes
+	cron, _ := ParseCron("0 0 31 2 *")
+	if next := cron.Next(from); !next.IsZero() {
+		t.Errorf("31 February next runs %v", next)
+	}
+}
@@ -0,0 +1,374 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cloud-storage/models"
+
+	"gorm.io/gorm"
+)
+
+// Priorities; jobs with a higher priority are picked up first.
+const (
+	PriorityLow    = -10
+	PriorityNormal = 0
+	PriorityHigh   = 10
+)
+
+const (
+	BaseBackoff  = 5 * time.Second
+	maxBackoff   = time.Hour
+	pollInterval = time.Second
+	// Progress is written to the database at most this often
+	progressInterval = 500 * time.Millisecond
+	// Finished jobs are kept this long for clients and admins to inspect
+	retention         = 7 * 24 * time.Hour
+	scheduledAttempts = 3
+	pruneJob          = "jobs.prune"
+)
+
+var (
+	ErrNotFound = errors.New("job not found")
+	ErrFinished = errors.New("job already finished")
+)
+
+// Handler does the work of one job type. It should return soon after ctx is
+// cancelled and may report how many of job.Total items are done through progress.
+// The result is stored as JSON with the job.
+type Handler func(ctx context.Context, job *models.Job, progress func(done int)) (interface{}, error)
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying, failing the job straight away.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Options tune a queued job.
+type Options struct {
+	Priority int
+	// MaxAttempts counts the first run; zero means the job is not retried
+	MaxAttempts int
+	// RunAt delays the job; the zero time runs it as soon as a worker is free
+	RunAt time.Time
+	Total int
+}
+
+// Queue runs jobs stored in the database on a pool of workers, so queued work
+// survives restarts.
+type Queue struct {
+	DB      *gorm.DB
+	Workers int
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	running  map[uint]context.CancelFunc
+	wake     chan struct{}
+}
+
+func NewQueue(db *gorm.DB) *Queue {
+	q := &Queue{
+		DB:       db,
+		Workers:  4,
+		handlers: make(map[string]Handler),
+		running:  make(map[uint]context.CancelFunc),
+		wake:     make(chan struct{}, 1),
+	}
+	q.Register(pruneJob, q.prune)
+	return q
+}
+
+// Register sets the handler for jobs of jobType.
+func (q *Queue) Register(jobType string, h Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[jobType] = h
+}
+
+// Start requeues jobs interrupted by the last shutdown and launches the workers
+// and the scheduler.
+func (q *Queue) Start() {
+	var stale []models.Job
+	if err := q.DB.Where("status = ?", models.JobRunning).Find(&stale).Error; err != nil {
+		log.Println("jobs: failed to load interrupted jobs:", err)
+	}
+	for i := range stale {
+		q.retry(&stale[i], errors.New("interrupted by server restart"))
+		q.save(&stale[i])
+	}
+
+	if err := q.Schedule("prune-jobs", "@hourly", pruneJob, nil); err != nil {
+		log.Println("jobs: failed to schedule pruning:", err)
+	}
+
+	for i := 0; i < q.Workers; i++ {
+		go q.work()
+	}
+	go q.runSchedules()
+}
+
+// Enqueue stores a new job for the workers. userID is 0 for system jobs.
+func (q *Queue) Enqueue(userID uint, jobType string, payload interface{}, opts Options) (*models.Job, error) {
+	job := &models.Job{
+		UserID:      userID,
+		Type:        jobType,
+		Status:      models.JobQueued,
+		Priority:    opts.Priority,
+		RunAt:       opts.RunAt,
+		MaxAttempts: opts.MaxAttempts,
+		Total:       opts.Total,
+	}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		job.Payload = raw
+	}
+	if err := q.enqueue(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (q *Queue) enqueue(job *models.Job) error {
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	if job.MaxAttempts < 1 {
+		job.MaxAttempts = 1
+	}
+	if err := q.DB.Create(job).Error; err != nil {
+		return err
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Cancel stops a job. A queued job is cancelled at once; a running one when its
+// handler notices.
+func (q *Queue) Cancel(id uint) error {
+	res := q.DB.Model(&models.Job{}).Where("id = ? AND status = ?", id, models.JobQueued).
+		Updates(map[string]interface{}{"status": models.JobCancelled, "finished_at": time.Now()})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	cancel, ok := q.running[id]
+	q.mu.Unlock()
+	if ok {
+		cancel()
+		return nil
+	}
+	if err := q.DB.First(&models.Job{}, id).Error; err != nil {
+		return ErrNotFound
+	}
+	return ErrFinished
+}
+
+// Retry queues a failed or cancelled job again with a fresh set of attempts.
+func (q *Queue) Retry(id uint) error {
+	res := q.DB.Model(&models.Job{}).Where("id = ? AND status IN ?", id, []string{models.JobFailed, models.JobCancelled}).
+		Updates(map[string]interface{}{"status": models.JobQueued, "attempts": 0, "done": 0, "run_at": time.Now(),
+			"last_error": "", "result": nil, "started_at": nil, "finished_at": nil})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		if err := q.DB.First(&models.Job{}, id).Error; err != nil {
+			return ErrNotFound
+		}
+		return errors.New("only failed or cancelled jobs can be retried")
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *Queue) work() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, ctx, err := q.claim()
+		if err != nil {
+			log.Println("jobs: failed to claim job:", err)
+		}
+		if job != nil {
+			q.run(ctx, job)
+			continue
+		}
+
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim marks the most urgent due job as running and returns it, or nil when
+// there is nothing to do.
+func (q *Queue) claim() (*models.Job, context.Context, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var job models.Job
+	err := q.DB.Where("status = ? AND run_at <= ?", models.JobQueued, time.Now()).
+		Order("priority desc, run_at, id").First(&job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The job may have been cancelled since it was read
+	now := time.Now()
+	res := q.DB.Model(&models.Job{}).Where("id = ? AND status = ?", job.ID, models.JobQueued).
+		Updates(map[string]interface{}{"status": models.JobRunning, "attempts": job.Attempts + 1, "started_at": now})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, nil, res.Error
+	}
+	job.Status = models.JobRunning
+	job.Attempts++
+	job.StartedAt = &now
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.running[job.ID] = cancel
+	return &job, ctx, nil
+}
+
+func (q *Queue) run(ctx context.Context, job *models.Job) {
+	defer func() {
+		q.mu.Lock()
+		q.running[job.ID]()
+		delete(q.running, job.ID)
+		q.mu.Unlock()
+	}()
+
+	q.mu.Lock()
+	h := q.handlers[job.Type]
+	q.mu.Unlock()
+
+	var result interface{}
+	var err error
+	if h == nil {
+		err = Permanent(fmt.Errorf("no handler for job type %q", job.Type))
+	} else {
+		result, err = call(ctx, h, job, q.progress(job))
+	}
+
+	job.Result = nil
+	if result != nil {
+		if raw, err := json.Marshal(result); err == nil {
+			job.Result = raw
+		}
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		now := time.Now()
+		job.Status = models.JobCancelled
+		job.FinishedAt = &now
+		job.LastError = "cancelled"
+	case err == nil:
+		now := time.Now()
+		job.Status = models.JobSucceeded
+		job.FinishedAt = &now
+		job.LastError = ""
+	default:
+		log.Printf("jobs: %s job %d failed (attempt %d of %d): %v", job.Type, job.ID, job.Attempts, job.MaxAttempts, err)
+		q.retry(job, err)
+	}
+	q.save(job)
+}
+
+// call runs h, turning a panic into a permanent failure so it cannot take the worker down.
+func call(ctx context.Context, h Handler, job *models.Job, progress func(int)) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = Permanent(fmt.Errorf("panic: %v", r))
+		}
+	}()
+	return h(ctx, job, progress)
+}
+
+func (q *Queue) progress(job *models.Job) func(done int) {
+	var last time.Time
+	return func(done int) {
+		job.Done = done
+		if time.Since(last) < progressInterval && done < job.Total {
+			return
+		}
+		last = time.Now()
+		if err := q.DB.Model(&models.Job{}).Where("id = ?", job.ID).Update("done", done).Error; err != nil {
+			log.Println("jobs: failed to record progress:", err)
+		}
+	}
+}
+
+// retry queues job again after a backoff, or fails it once it is out of attempts.
+func (q *Queue) retry(job *models.Job, err error) {
+	job.LastError = err.Error()
+	var permanent permanentError
+	if job.Attempts < job.MaxAttempts && !errors.As(err, &permanent) {
+		job.Status = models.JobQueued
+		job.RunAt = time.Now().Add(Backoff(job.Attempts))
+		return
+	}
+	now := time.Now()
+	job.Status = models.JobFailed
+	job.FinishedAt = &now
+}
+
+func (q *Queue) save(job *models.Job) {
+	if err := q.DB.Save(job).Error; err != nil {
+		log.Printf("jobs: failed to update job %d: %v", job.ID, err)
+	}
+}
+
+// Backoff returns the delay before the next attempt, doubling after every failure.
+func Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts > 20 {
+		return maxBackoff
+	}
+	d := BaseBackoff * time.Duration(1<<uint(attempts-1))
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// prune deletes finished jobs past their retention.
+func (q *Queue) prune(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	res := q.DB.Unscoped().Where("status IN ? AND finished_at < ?",
+		[]string{models.JobSucceeded, models.JobFailed, models.JobCancelled}, time.Now().Add(-retention)).
+		Delete(&models.Job{})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return map[string]int64{"deleted": res.RowsAffected}, nil
+}
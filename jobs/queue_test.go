@@ -0,0 +1,166 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-storage/models"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestQueue(t *testing.T) *Queue {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Job{}, &models.JobSchedule{}); err != nil {
+		t.Fatal(err)
+	}
+	return NewQueue(db)
+}
+
+// runNext claims the next due job and runs it as a worker would.
+func runNext(t *testing.T, q *Queue) *models.Job {
+	t.Helper()
+	job, ctx, err := q.claim()
+	if err != nil || job == nil {
+		t.Fatalf("claim = %v, %v, want a job", job, err)
+	}
+	q.run(ctx, job)
+	return job
+}
+
+func TestQueuePriority(t *testing.T) {
+	q := newTestQueue(t)
+	var order []string
+	q.Register("test", func(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+		order = append(order, strings.Trim(string(job.Payload), `"`))
+		return nil, nil
+	})
+
+	q.Enqueue(0, "test", "low", Options{Priority: PriorityLow})
+	q.Enqueue(0, "test", "normal", Options{})
+	q.Enqueue(0, "test", "later", Options{Priority: PriorityHigh, RunAt: time.Now().Add(time.Hour)})
+	q.Enqueue(0, "test", "high", Options{Priority: PriorityHigh})
+	q.Enqueue(0, "test", "normal2", Options{})
+	for range 4 {
+		runNext(t, q)
+	}
+	if got := strings.Join(order, ","); got != "high,normal,normal2,low" {
+		t.Errorf("ran %s, want high,normal,normal2,low", got)
+	}
+	if job, _, _ := q.claim(); job != nil {
+		t.Errorf("claimed %s before it was due", job.Payload)
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	q := newTestQueue(t)
+	fail := errors.New("flaky")
+	q.Register("flaky", func(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+		return nil, fail
+	})
+	q.Register("broken", func(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+		return nil, Permanent(fail)
+	})
+	q.Register("panics", func(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+		panic("oops")
+	})
+
+	// A failed attempt is queued again after the backoff, until attempts run out
+	job, _ := q.Enqueue(0, "flaky", nil, Options{MaxAttempts: 2})
+	before := time.Now()
+	runNext(t, q)
+	q.DB.First(job, job.ID)
+	if job.Status != models.JobQueued || job.Attempts != 1 || job.LastError != "flaky" {
+		t.Fatalf("after one failure the job is %s, attempt %d, error %q", job.Status, job.Attempts, job.LastError)
+	}
+	if wait := job.RunAt.Sub(before); wait < BaseBackoff || wait > BaseBackoff+time.Second {
+		t.Errorf("retried after %v, want %v", wait, BaseBackoff)
+	}
+	q.DB.Model(job).Update("run_at", time.Now())
+	runNext(t, q)
+	q.DB.First(job, job.ID)
+	if job.Status != models.JobFailed || job.Attempts != 2 || job.FinishedAt == nil {
+		t.Errorf("after its last attempt the job is %s, attempt %d", job.Status, job.Attempts)
+	}
+
+	// Permanent errors and panics are not retried, nor are jobs nobody handles
+	for _, jobType := range []string{"broken", "panics", "unknown"} {
+		job, _ := q.Enqueue(0, jobType, nil, Options{MaxAttempts: 5})
+		runNext(t, q)
+		q.DB.First(job, job.ID)
+		if job.Status != models.JobFailed || job.Attempts != 1 {
+			t.Errorf("%s job is %s after attempt %d, want failed after 1", jobType, job.Status, job.Attempts)
+		}
+	}
+
+	// A retried job starts over with fresh attempts
+	if err := q.Retry(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	q.DB.First(job, job.ID)
+	if job.Status != models.JobQueued || job.Attempts != 0 || job.LastError != "" {
+		t.Errorf("retried job is %s, attempt %d, error %q", job.Status, job.Attempts, job.LastError)
+	}
+	if err := q.Retry(job.ID); err == nil {
+		t.Error("retrying a queued job succeeded")
+	}
+
+	for attempts, want := range map[int]time.Duration{0: BaseBackoff, 1: BaseBackoff, 3: 4 * BaseBackoff, 30: maxBackoff} {
+		if got := Backoff(attempts); got != want {
+			t.Errorf("Backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	q := newTestQueue(t)
+	started := make(chan struct{})
+	q.Register("slow", func(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	queued, _ := q.Enqueue(0, "slow", nil, Options{Priority: PriorityLow})
+	running, _ := q.Enqueue(0, "slow", nil, Options{})
+
+	done := make(chan struct{})
+	go func() {
+		runNext(t, q)
+		close(done)
+	}()
+	<-started
+	if err := q.Cancel(queued.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Cancel(running.ID); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	for _, job := range []*models.Job{queued, running} {
+		q.DB.First(job, job.ID)
+		if job.Status != models.JobCancelled || job.FinishedAt == nil {
+			t.Errorf("job %d is %s after cancelling", job.ID, job.Status)
+		}
+	}
+	if err := q.Cancel(running.ID); err != ErrFinished {
+		t.Errorf("cancelling a finished job = %v, want ErrFinished", err)
+	}
+	if err := q.Cancel(999); err != ErrNotFound {
+		t.Errorf("cancelling a missing job = %v, want ErrNotFound", err)
+	}
+	if job, _, _ := q.claim(); job != nil {
+		t.Errorf("claimed cancelled job %d", job.ID)
+	}
+}
@@ -0,0 +1,108 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud-storage/models"
+
+	"gorm.io/gorm"
+)
+
+// Schedule queues a system job of jobType whenever spec comes due, see ParseCron.
+// The next run time is kept in the database, so a restart neither skips a run
+// that came due while the server was down nor repeats one. Changing the spec of
+// an existing schedule reschedules it.
+func (q *Queue) Schedule(name, spec, jobType string, payload interface{}) error {
+	cron, err := ParseCron(spec)
+	if err != nil {
+		return err
+	}
+	next := cron.Next(time.Now())
+	if next.IsZero() {
+		return fmt.Errorf("cron spec %q never runs", spec)
+	}
+	var raw json.RawMessage
+	if payload != nil {
+		if raw, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	var s models.JobSchedule
+	err = q.DB.Where("name = ?", name).First(&s).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		s = models.JobSchedule{Name: name, Spec: spec, Type: jobType, Payload: raw, NextRunAt: next}
+		return q.DB.Create(&s).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.Spec != spec {
+		s.NextRunAt = next
+	}
+	s.Spec, s.Type, s.Payload = spec, jobType, raw
+	return q.DB.Save(&s).Error
+}
+
+// Unschedule removes a schedule; jobs it already queued still run.
+func (q *Queue) Unschedule(name string) error {
+	return q.DB.Unscoped().Where("name = ?", name).Delete(&models.JobSchedule{}).Error
+}
+
+func (q *Queue) runSchedules() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var due []models.JobSchedule
+		if err := q.DB.Where("next_run_at <= ?", time.Now()).Find(&due).Error; err != nil {
+			log.Println("jobs: failed to load schedules:", err)
+			continue
+		}
+		for i := range due {
+			q.fire(&due[i])
+		}
+	}
+}
+
+func (q *Queue) fire(s *models.JobSchedule) {
+	cron, err := ParseCron(s.Spec)
+	if err != nil {
+		log.Printf("jobs: schedule %s: %v", s.Name, err)
+		return
+	}
+
+	// Don't pile up runs behind one that is still waiting or going
+	var pending int64
+	q.DB.Model(&models.Job{}).Where("schedule = ? AND status IN ?", s.Name,
+		[]string{models.JobQueued, models.JobRunning}).Count(&pending)
+	if pending == 0 {
+		job := &models.Job{
+			Type:        s.Type,
+			Payload:     s.Payload,
+			Status:      models.JobQueued,
+			Priority:    PriorityLow,
+			MaxAttempts: scheduledAttempts,
+			Schedule:    s.Name,
+		}
+		if err := q.enqueue(job); err != nil {
+			log.Printf("jobs: schedule %s: failed to queue job: %v", s.Name, err)
+			return
+		}
+	}
+
+	now := time.Now()
+	s.LastRunAt = &now
+	s.NextRunAt = cron.Next(now)
+	if s.NextRunAt.IsZero() {
+		s.NextRunAt = now.AddDate(100, 0, 0)
+	}
+	if err := q.DB.Save(s).Error; err != nil {
+		log.Printf("jobs: schedule %s: failed to update: %v", s.Name, err)
+	}
+}
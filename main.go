@@ -1,11 +1,22 @@
 package main
 
 import (
+	"cloud-storage/blobcrypt"
+	"cloud-storage/chunkstore"
+	"cloud-storage/events"
 	"cloud-storage/handlers"
+	"cloud-storage/jobs"
 	"cloud-storage/middleware"
 	"cloud-storage/models"
+	"cloud-storage/scanner"
+	"cloud-storage/search"
+	"cloud-storage/thumbnails"
+	"cloud-storage/webhooks"
+	"encoding/base64"
+	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/sqlite"
@@ -17,52 +28,302 @@ type App struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "scrub" {
+		runScrub("storage.db", os.Args[2:])
+		return
+	}
+
 	app := App{}
 	app.Initialize("storage.db")
 	app.Run(":8080")
 }
 
+// openDB opens the SQLite database in WAL mode, so readers don't block the
+// writer, and with a busy timeout, so job workers, the scheduler and requests
+// wait for each other's writes instead of failing with "database is locked".
+// The scrub subcommand opens it alongside a running server the same way.
+func openDB(dbName string) (*gorm.DB, error) {
+	return gorm.Open(sqlite.Open(dbName+"?_busy_timeout=5000&_journal_mode=WAL"), &gorm.Config{})
+}
+
 func (a *App) Initialize(dbName string) {
 	a.Router = gin.Default()
 
 	var err error
-	a.DB, err = gorm.Open(sqlite.Open(dbName), &gorm.Config{})
+	a.DB, err = openDB(dbName)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
+	keys, err := loadKeys()
+	if err != nil {
+		log.Fatal("Failed to load master keys:", err)
+	}
+
 	a.App = handlers.App{
-		DB:     a.DB,
-		Router: a.Router,
+		DB:         a.DB,
+		Router:     a.Router,
+		Events:     events.NewBus(a.DB),
+		Thumbnails: thumbnails.NewService(a.DB, "storage/thumbnails"),
+		Jobs:       jobs.NewQueue(a.DB),
+		Keys:       keys,
+		// COMPRESSION=off stores new blobs as they are
+		Compress: os.Getenv("COMPRESSION") != "off",
 	}
+	a.Thumbnails.Keys = keys
+
+	a.DB.AutoMigrate(&models.User{}, &models.File{}, &models.Webhook{}, &models.WebhookDelivery{}, &models.Event{},
+		&models.AppPassword{}, &models.DavProperty{}, &models.AccessKey{}, &models.MultipartUpload{}, &models.SSHKey{},
+		&models.SavedSearch{}, &models.Tag{}, &models.Share{}, &models.Job{}, &models.JobSchedule{},
+		&models.UserKey{}, &models.FileKey{}, &models.Chunk{}, &models.RetentionRule{},
+		&models.FileRequest{}, &models.FileRequestUpload{})
+
+	// Rows from before mime_type had a default would break sorting by type
+	a.DB.Unscoped().Model(&models.File{}).Where("mime_type IS NULL").Update("mime_type", "")
 
-	a.DB.AutoMigrate(&models.User{}, &models.File{})
+	// Promote users listed in ADMIN_USERS that registered before being listed
+	if admins := os.Getenv("ADMIN_USERS"); admins != "" {
+		a.DB.Model(&models.User{}).Where("username IN ?", strings.Split(admins, ",")).Update("is_admin", true)
+	}
 
 	if err := os.MkdirAll("storage", 0755); err != nil {
 		log.Fatal("Failed to create storage directory:", err)
 	}
 
+	// WEBHOOK_ALLOW_PRIVATE=true lets webhooks reach internal addresses
+	webhooks.AllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+	webhooks.NewDispatcher(a.DB, a.Jobs).Start(a.Events)
+	a.StartThumbnails()
+	if s := newScanner(); s != nil {
+		scan := scanner.NewService(a.DB, s, "storage/quarantine/infected")
+		scan.Keys = keys
+		scan.Start(a.Events, a.Jobs)
+		a.ScanUploads = true
+		// SCAN_FAIL_OPEN=true serves files whose scan failed; they are held back otherwise
+		a.ScanFailOpen = os.Getenv("SCAN_FAIL_OPEN") == "true"
+	}
+	a.RegisterJobs()
+	a.Jobs.Start()
+
+	// A report-only scrub every week unless SCRUB_SCHEDULE says otherwise; "off" disables it
+	scrubSpec := os.Getenv("SCRUB_SCHEDULE")
+	if scrubSpec == "" {
+		scrubSpec = "@weekly"
+	}
+	if scrubSpec == "off" {
+		err = a.Jobs.Unschedule("scrub")
+	} else {
+		err = a.Jobs.Schedule("scrub", scrubSpec, "scrub", nil)
+	}
+	if err != nil {
+		log.Println("Failed to schedule scrub:", err)
+	}
+	if err := a.Jobs.Schedule("chunks.gc", "@hourly", "chunks.gc", nil); err != nil {
+		log.Println("Failed to schedule chunk garbage collection:", err)
+	}
+	if err := a.Jobs.Schedule("retention", "@daily", "retention", nil); err != nil {
+		log.Println("Failed to schedule retention:", err)
+	}
+	if err := a.Jobs.Schedule("files.expire", "@every 10m", "files.expire", nil); err != nil {
+		log.Println("Failed to schedule expired file cleanup:", err)
+	}
+	if err := a.Jobs.Schedule("multipart.gc", "@daily", "multipart.gc", nil); err != nil {
+		log.Println("Failed to schedule multipart upload cleanup:", err)
+	}
+	if err := a.Jobs.Schedule("events.prune", "@daily", "events.prune", nil); err != nil {
+		log.Println("Failed to schedule event pruning:", err)
+	}
+
+	a.Search = search.NewIndex(a.DB)
+	a.Search.Open = func(file *models.File) (io.ReadCloser, error) { return chunkstore.OpenFile(file.Path, keys) }
+	a.Search.Start(a.Events)
+
+	if sftpAddr := os.Getenv("SFTP_ADDR"); sftpAddr != "" {
+		go func() {
+			if err := a.ServeSFTP(sftpAddr); err != nil {
+				log.Println("SFTP server stopped:", err)
+			}
+		}()
+	}
+
 	a.Router.POST("/api/v1/register", a.Register)
 	a.Router.POST("/api/v1/login", a.Login)
+	a.Router.GET("/api/v1/drop/:token", a.GetFileRequest)
+	a.Router.POST("/api/v1/drop/:token", a.DropFile)
 
 	authGroup := a.Router.Group("/api/v1").Use(middleware.JWTAuthMiddleware())
 	{
 		authGroup.POST("/upload", a.UploadFile)
+		authGroup.POST("/upload/check", a.CheckUpload)
+		authGroup.POST("/chunks/check", a.CheckChunks)
+		authGroup.PUT("/chunks/:hash", a.UploadChunk)
+		authGroup.POST("/files/chunked", a.CreateChunkedFile)
 		authGroup.GET("/files", a.ListFiles)
 		authGroup.POST("/sync", a.Sync)
+		authGroup.GET("/files/:id", a.GetFile)
 		authGroup.GET("/files/:id/download", a.DownloadFile)
+		authGroup.POST("/archive", a.CreateArchive)
+		authGroup.POST("/batch", a.Batch)
+		authGroup.GET("/jobs/:id", a.GetJob)
+		authGroup.DELETE("/jobs/:id", a.CancelJob)
+		authGroup.GET("/shares", a.ListShares)
+		authGroup.DELETE("/shares/:id", a.DeleteShare)
+		authGroup.GET("/shares/:id/download", a.DownloadShare)
+		authGroup.GET("/files/:id/thumbnail", a.GetThumbnail)
 		authGroup.DELETE("/files/:id", a.DeleteFile)
+		authGroup.PATCH("/files/labels", a.LabelFiles)
+		authGroup.GET("/tags", a.ListTags)
+		authGroup.DELETE("/tags/:id", a.DeleteTag)
+		authGroup.GET("/search", a.SearchFiles)
+		authGroup.POST("/saved-searches", a.CreateSavedSearch)
+		authGroup.GET("/saved-searches", a.ListSavedSearches)
+		authGroup.DELETE("/saved-searches/:id", a.DeleteSavedSearch)
+		authGroup.GET("/events", a.StreamEvents)
+		authGroup.GET("/events/ws", a.StreamEventsWS)
+
+		authGroup.POST("/app-passwords", a.CreateAppPassword)
+		authGroup.GET("/app-passwords", a.ListAppPasswords)
+		authGroup.DELETE("/app-passwords/:id", a.DeleteAppPassword)
+		authGroup.POST("/file-requests", a.CreateFileRequest)
+		authGroup.GET("/file-requests", a.ListFileRequests)
+		authGroup.GET("/file-requests/:id/uploads", a.ListFileRequestUploads)
+		authGroup.DELETE("/file-requests/:id", a.DeleteFileRequest)
+
+		authGroup.POST("/access-keys", a.CreateAccessKey)
+		authGroup.GET("/access-keys", a.ListAccessKeys)
+		authGroup.DELETE("/access-keys/:id", a.DeleteAccessKey)
+
+		authGroup.POST("/ssh-keys", a.CreateSSHKey)
+		authGroup.GET("/ssh-keys", a.ListSSHKeys)
+		authGroup.DELETE("/ssh-keys/:id", a.DeleteSSHKey)
+
+		authGroup.GET("/quota", a.GetQuota)
+
+		authGroup.GET("/e2e-keys", a.GetUserKey)
+		authGroup.PUT("/e2e-keys", a.PutUserKey)
+		authGroup.GET("/e2e-keys/:username", a.GetPublicKey)
+		authGroup.PUT("/files/:id/key", a.PutFileKey)
+		authGroup.GET("/files/:id/key", a.GetFileKey)
+
+		authGroup.POST("/webhooks", a.CreateWebhook)
+		authGroup.GET("/webhooks", a.ListWebhooks)
+		authGroup.DELETE("/webhooks/:id", a.DeleteWebhook)
+		authGroup.GET("/webhooks/deliveries", a.ListDeliveries)
+		authGroup.POST("/webhooks/deliveries/:id/redeliver", a.RedeliverWebhook)
+	}
+
+	davGroup := a.Router.Group("/dav", middleware.BasicAuthMiddleware(a.DB))
+	for _, method := range handlers.WebDAVMethods {
+		davGroup.Handle(method, "/*path", a.WebDAV)
+	}
+
+	s3Group := a.Router.Group("/s3", middleware.S3AuthMiddleware(a.DB))
+	s3Group.Any("/*path", a.S3)
+
+	adminGroup := a.Router.Group("/api/v1/admin").Use(middleware.JWTAuthMiddleware(), middleware.AdminMiddleware(a.DB))
+	{
+		adminGroup.POST("/webhooks", a.AdminCreateWebhook)
+		adminGroup.GET("/webhooks", a.AdminListWebhooks)
+		adminGroup.DELETE("/webhooks/:id", a.AdminDeleteWebhook)
+		adminGroup.GET("/webhooks/deliveries", a.AdminListDeliveries)
+		adminGroup.POST("/webhooks/deliveries/:id/redeliver", a.AdminRedeliverWebhook)
+		adminGroup.PUT("/users/:id/quota", a.AdminSetQuota)
+		adminGroup.GET("/keys", a.AdminGetKeys)
+		adminGroup.POST("/keys/rotate", a.AdminRotateKeys)
+		adminGroup.POST("/keys/rewrap", a.AdminRewrapKeys)
+		adminGroup.GET("/compression", a.AdminCompressionStats)
+		adminGroup.POST("/compression", a.AdminStartCompression)
+		adminGroup.POST("/scrub", a.AdminStartScrub)
+		adminGroup.GET("/scrub", a.AdminListScrubs)
+		adminGroup.GET("/retention/rules", a.AdminListRetentionRules)
+		adminGroup.POST("/retention/rules", a.AdminCreateRetentionRule)
+		adminGroup.DELETE("/retention/rules/:id", a.AdminDeleteRetentionRule)
+		adminGroup.GET("/retention/report", a.AdminRetentionReport)
+		adminGroup.POST("/retention/enforce", a.AdminEnforceRetention)
+		adminGroup.PUT("/files/:id/legal-hold", a.AdminSetLegalHold)
+		adminGroup.GET("/jobs", a.AdminListJobs)
+		adminGroup.GET("/jobs/schedules", a.AdminListJobSchedules)
+		adminGroup.GET("/jobs/:id", a.AdminGetJob)
+		adminGroup.POST("/jobs/:id/cancel", a.AdminCancelJob)
+		adminGroup.POST("/jobs/:id/retry", a.AdminRetryJob)
+	}
+}
+
+// loadKeys returns the master keys that encrypt blobs at rest: a single key from
+// MASTER_KEY (base64), or else the key file at MASTER_KEY_FILE, created with a
+// fresh key on first start. MASTER_KEY_FILE=off stores new blobs in plaintext.
+func loadKeys() (*blobcrypt.Keyring, error) {
+	if encoded := os.Getenv("MASTER_KEY"); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		return blobcrypt.NewKeyring("env", key)
+	}
+
+	path := os.Getenv("MASTER_KEY_FILE")
+	if path == "off" {
+		return nil, nil
+	}
+	if path == "" {
+		path = "master.keys"
+	}
+	return blobcrypt.LoadKeyring(path)
+}
+
+// newScanner returns the malware scanner uploads are checked with: the clamd at
+// CLAMD_ADDR, or else the command line in SCAN_COMMAND. Without either uploads
+// are not scanned.
+func newScanner() scanner.Scanner {
+	if addr := os.Getenv("CLAMD_ADDR"); addr != "" {
+		return scanner.NewClamd(addr)
+	}
+	if cmd := os.Getenv("SCAN_COMMAND"); cmd != "" {
+		return scanner.NewCommand(cmd)
 	}
+	return nil
 }
 
 func (a *App) Run(addr string) {
 	log.Printf("Server running on %s\nEndpoints:\n"+
 		"POST /api/v1/register - Register new user\n"+
 		"POST /api/v1/login - Login\n"+
-		"POST /api/v1/upload - Upload file (requires auth)\n"+
-		"GET /api/v1/files - List files (requires auth)\n"+
+		"POST /api/v1/upload - Upload file, extract=true unpacks a zip or tar into target (requires auth)\n"+
+		"POST /api/v1/upload/check - Create a file from content already stored, by SHA-256 and size (requires auth)\n"+
+		"POST /api/v1/chunks/check - Chunks the server lacks, PUT /api/v1/chunks/:hash uploads one (requires auth)\n"+
+		"POST /api/v1/files/chunked - Create a file from uploaded chunks (requires auth)\n"+
+		"GET /api/v1/files?sort=&cursor= - List files a page at a time (requires auth)\n"+
+		"GET /api/v1/files/:id - File details with type and metadata (requires auth)\n"+
 		"GET /api/v1/files/:id/download - Download file (requires auth)\n"+
-		"POST /api/v1/sync - Sync files (requires auth)\n", addr)
+		"POST /api/v1/archive - Download files and folders as one ZIP or tar.gz (requires auth)\n"+
+		"POST /api/v1/batch - Delete, move, copy, tag or share many files at once (requires auth)\n"+
+		"GET /api/v1/jobs/:id - Progress of a background job, DELETE cancels it (requires auth)\n"+
+		"GET /api/v1/shares - Files shared with you and by you (requires auth)\n"+
+		"GET /api/v1/files/:id/thumbnail?size= - Image thumbnail, small/medium/large (requires auth)\n"+
+		"PATCH /api/v1/files/labels - Tag, star or color several files (requires auth)\n"+
+		"GET /api/v1/tags - List tags with file counts (requires auth)\n"+
+		"POST /api/v1/sync - Sync files (requires auth)\n"+
+		"GET /api/v1/search?q= - Search, e.g. q=report type:pdf size:>10MB in:/Projects (requires auth)\n"+
+		"POST /api/v1/saved-searches - Save a search query (requires auth)\n"+
+		"GET /api/v1/events - Stream file events over SSE (requires auth)\n"+
+		"GET /api/v1/events/ws - Stream file events over WebSocket (requires auth)\n"+
+		"PUT /api/v1/files/:id/key - Share an end-to-end encrypted file's key with a user, GET the key shared with you (requires auth)\n"+
+		"POST /api/v1/app-passwords - Create app password for WebDAV (requires auth)\n"+
+		"POST /api/v1/file-requests - Link for uploads into a folder without an account (requires auth)\n"+
+		"POST /api/v1/drop/:token - Upload through a file request link\n"+
+		"/dav/ - WebDAV access to your files (basic auth with app password only, not access keys)\n"+
+		"POST /api/v1/access-keys - Create S3 access key (requires auth)\n"+
+		"/s3/ - S3-compatible API, path-style (SigV4 with access key)\n"+
+		"POST /api/v1/ssh-keys - Register SSH public key for SFTP, served when SFTP_ADDR is set, e.g. :2022 (requires auth)\n"+
+		"GET /api/v1/quota - Show storage usage and quota (requires auth)\n"+
+		"POST /api/v1/webhooks - Register webhook (requires auth)\n"+
+		"GET /api/v1/webhooks/deliveries - List dead-letter deliveries (requires auth)\n"+
+		"POST /api/v1/webhooks/deliveries/:id/redeliver - Redeliver webhook (requires auth)\n"+
+		"POST /api/v1/admin/webhooks - Register global webhook (requires admin)\n"+
+		"GET /api/v1/admin/jobs?status=&type= - Inspect background jobs and their schedules (requires admin)\n"+
+		"POST /api/v1/admin/keys/rotate - New master key for encryption at rest, rewrapping data keys (requires admin)\n"+
+		"POST /api/v1/admin/retention/rules - Keep or delete files by folder, tag or type (requires admin)\n"+
+		"POST /api/v1/admin/scrub - Verify stored blobs and find orphans, see also the scrub subcommand (requires admin)\n", addr)
 	if err := a.Router.Run(addr); err != nil {
 		log.Fatal("Failed to start server:", err)
 	}
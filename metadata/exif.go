@@ -0,0 +1,265 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"cloud-storage/models"
+)
+
+// EXIF tags that are copied into the metadata
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+
+	// TIFF images keep EXIF near the start; nothing past this is read
+	maxTIFFHeader = 1 << 20
+)
+
+// extractEXIF reads camera, capture time and GPS position from a JPEG's APP1
+// segment or from a TIFF header.
+func extractEXIF(r io.Reader, meta models.Metadata) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	var data []byte
+	switch {
+	case header[0] == 0xFF && header[1] == 0xD8:
+		data = jpegEXIF(io.MultiReader(bytes.NewReader(header[2:]), r))
+	case string(header) == "II*\x00" || string(header) == "MM\x00*":
+		rest, _ := io.ReadAll(io.LimitReader(r, maxTIFFHeader))
+		data = append(header, rest...)
+	}
+	if data == nil {
+		return
+	}
+
+	t, ok := newTIFF(data)
+	if !ok {
+		return
+	}
+	ifd0 := t.ifd(t.order.Uint32(data[4:]))
+
+	if v := ifd0.string(tagMake); v != "" {
+		meta["camera_make"] = v
+	}
+	if v := ifd0.string(tagModel); v != "" {
+		meta["camera_model"] = v
+	}
+	if v, ok := ifd0.uint(tagOrientation); ok {
+		meta["orientation"] = v
+	}
+	captured := ifd0.string(tagDateTime)
+
+	if offset, ok := ifd0.uint(tagExifIFD); ok {
+		exif := t.ifd(offset)
+		if v := exif.string(tagDateTimeOriginal); v != "" {
+			captured = v
+		}
+		if v, ok := exif.rational(tagExposureTime, 0); ok {
+			meta["exposure_time"] = v
+		}
+		if v, ok := exif.rational(tagFNumber, 0); ok {
+			meta["f_number"] = v
+		}
+		if v, ok := exif.uint(tagISO); ok {
+			meta["iso"] = v
+		}
+		if v, ok := exif.rational(tagFocalLength, 0); ok {
+			meta["focal_length"] = v
+		}
+	}
+
+	if captured != "" {
+		if ts, err := time.Parse("2006:01:02 15:04:05", strings.TrimSpace(captured)); err == nil {
+			meta["captured_at"] = ts.Format("2006-01-02T15:04:05")
+		}
+	}
+
+	if offset, ok := ifd0.uint(tagGPSIFD); ok {
+		gps := t.ifd(offset)
+		if lat, ok := gps.coordinate(tagGPSLatitude, tagGPSLatitudeRef, "S"); ok {
+			if lon, ok := gps.coordinate(tagGPSLongitude, tagGPSLongitudeRef, "W"); ok {
+				meta["gps_latitude"] = lat
+				meta["gps_longitude"] = lon
+			}
+		}
+		if alt, ok := gps.rational(tagGPSAltitude, 0); ok {
+			if ref, ok := gps.uint(tagGPSAltitudeRef); ok && ref == 1 {
+				alt = -alt
+			}
+			meta["gps_altitude"] = alt
+		}
+	}
+}
+
+// jpegEXIF walks the JPEG markers up to the image data and returns the TIFF
+// structure inside the Exif APP1 segment.
+func jpegEXIF(r io.Reader) []byte {
+	marker := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, marker); err != nil || marker[0] != 0xFF {
+			return nil
+		}
+		// Start of scan: no metadata follows
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:]))
+		if length < 2 {
+			return nil
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+	}
+}
+
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTIFF(data []byte) (*tiff, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	switch string(data[:2]) {
+	case "II":
+		return &tiff{data: data, order: binary.LittleEndian}, true
+	case "MM":
+		return &tiff{data: data, order: binary.BigEndian}, true
+	}
+	return nil, false
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+type ifd struct {
+	t       *tiff
+	entries map[uint16]ifdEntry
+}
+
+// typeSizes gives the byte size of each TIFF field type
+var typeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func (t *tiff) ifd(offset uint32) ifd {
+	dir := ifd{t: t, entries: map[uint16]ifdEntry{}}
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return dir
+	}
+	n := uint32(t.order.Uint16(t.data[offset:]))
+	for i := uint32(0); i < n; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(t.data)) {
+			break
+		}
+		entry := t.data[start : start+12]
+		tag := t.order.Uint16(entry)
+		typ := t.order.Uint16(entry[2:])
+		count := t.order.Uint32(entry[4:])
+		size, ok := typeSizes[typ]
+		if !ok {
+			continue
+		}
+
+		// Values of up to four bytes are stored inline, larger ones at an offset
+		total := uint64(size) * uint64(count)
+		value := entry[8 : 8+min(total, 4)]
+		if total > 4 {
+			at := uint64(t.order.Uint32(entry[8:]))
+			if at+total > uint64(len(t.data)) {
+				continue
+			}
+			value = t.data[at : at+total]
+		}
+		dir.entries[tag] = ifdEntry{typ: typ, count: count, value: value}
+	}
+	return dir
+}
+
+func (d ifd) string(tag uint16) string {
+	e, ok := d.entries[tag]
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (d ifd) uint(tag uint16) (uint32, bool) {
+	e, ok := d.entries[tag]
+	if !ok || e.count == 0 {
+		return 0, false
+	}
+	switch e.typ {
+	case 1, 7:
+		return uint32(e.value[0]), true
+	case 3:
+		return uint32(d.t.order.Uint16(e.value)), true
+	case 4, 9:
+		return d.t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+// rational returns the i-th rational value of tag as a float.
+func (d ifd) rational(tag uint16, i int) (float64, bool) {
+	e, ok := d.entries[tag]
+	if !ok || (e.typ != 5 && e.typ != 10) || uint32(i) >= e.count {
+		return 0, false
+	}
+	num := d.t.order.Uint32(e.value[i*8:])
+	den := d.t.order.Uint32(e.value[i*8+4:])
+	if den == 0 {
+		return 0, false
+	}
+	if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+	return float64(num) / float64(den), true
+}
+
+// coordinate converts a degrees/minutes/seconds GPS value to signed decimal degrees.
+func (d ifd) coordinate(tag, refTag uint16, negative string) (float64, bool) {
+	deg, ok1 := d.rational(tag, 0)
+	minutes, ok2 := d.rational(tag, 1)
+	seconds, ok3 := d.rational(tag, 2)
+	if !ok1 || !ok2 || !ok3 {
+		return 0, false
+	}
+	v := deg + minutes/60 + seconds/3600
+	if d.string(refTag) == negative {
+		v = -v
+	}
+	return math.Round(v*1e6) / 1e6, true
+}
@@ -0,0 +1,62 @@
+package metadata
+
+import (
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"strings"
+
+	"cloud-storage/models"
+
+	"github.com/gabriel-vasile/mimetype"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// Detect sniffs the MIME type of content read from r and returns it with the
+// conventional extension for that type ("" when there is none).
+func Detect(r io.Reader) (string, string, error) {
+	mtype, err := mimetype.DetectReader(r)
+	if err != nil {
+		return "", "", err
+	}
+	return mtype.String(), mtype.Extension(), nil
+}
+
+// Extract reads structured properties from the size bytes of content in r.
+// Formats it does not understand, and files it fails to parse, yield no metadata
+// rather than an error.
+func Extract(r io.ReaderAt, size int64, mimeType string) models.Metadata {
+	meta := models.Metadata{}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		extractImage(io.NewSectionReader(r, 0, size), meta)
+	case mimeType == "video/mp4", mimeType == "video/quicktime", mimeType == "audio/mp4",
+		mimeType == "video/3gpp", mimeType == "video/x-m4v", mimeType == "audio/x-m4a":
+		extractMP4(r, size, meta)
+	case mimeType == "application/pdf":
+		extractPDF(io.NewSectionReader(r, 0, size), meta)
+	}
+
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+func extractImage(f *io.SectionReader, meta models.Metadata) {
+	if config, _, err := image.DecodeConfig(f); err == nil {
+		meta["width"] = config.Width
+		meta["height"] = config.Height
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return
+	}
+	extractEXIF(f, meta)
+}
@@ -0,0 +1,173 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// tiffIFD lays out a little-endian IFD starting at offset base of the TIFF
+// data, with values over four bytes stored after it.
+func tiffIFD(base uint32, entries []tiffEntry) []byte {
+	le := binary.LittleEndian
+	dataAt := base + 2 + 12*uint32(len(entries)) + 4
+	dir := le.AppendUint16(nil, uint16(len(entries)))
+	var data []byte
+	for _, e := range entries {
+		dir = le.AppendUint16(dir, e.tag)
+		dir = le.AppendUint16(dir, e.typ)
+		dir = le.AppendUint32(dir, e.count)
+		if len(e.value) <= 4 {
+			dir = append(dir, append(e.value, make([]byte, 4-len(e.value))...)...)
+			continue
+		}
+		dir = le.AppendUint32(dir, dataAt+uint32(len(data)))
+		data = append(data, e.value...)
+	}
+	dir = le.AppendUint32(dir, 0)
+	return append(dir, data...)
+}
+
+func ascii(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func rationals(tag uint16, v ...uint32) tiffEntry {
+	var b []byte
+	for _, n := range v {
+		b = binary.LittleEndian.AppendUint32(b, n)
+	}
+	return tiffEntry{tag, 5, uint32(len(v) / 2), b}
+}
+
+func long(tag uint16, v uint32) tiffEntry {
+	return tiffEntry{tag, 4, 1, binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+// photo returns a JPEG with an EXIF segment naming the camera, the time it was
+// taken and where.
+func photo(t *testing.T) []byte {
+	t.Helper()
+	gps := []tiffEntry{
+		ascii(tagGPSLatitudeRef, "N"),
+		rationals(tagGPSLatitude, 48, 1, 51, 1, 296, 10),
+		ascii(tagGPSLongitudeRef, "E"),
+		rationals(tagGPSLongitude, 2, 1, 17, 1, 402, 10),
+	}
+	exif := []tiffEntry{ascii(tagDateTimeOriginal, "2021:06:01 12:30:00"), rationals(tagFNumber, 18, 10)}
+	ifd0 := func(exifAt, gpsAt uint32) []tiffEntry {
+		return []tiffEntry{ascii(tagMake, "Canon"), ascii(tagModel, "EOS R5"), long(tagExifIFD, exifAt), long(tagGPSIFD, gpsAt)}
+	}
+
+	// Sub-IFD pointers are inline, so the first IFD's size does not depend on them
+	size0 := uint32(len(tiffIFD(8, ifd0(0, 0))))
+	exifAt := 8 + size0
+	gpsAt := exifAt + uint32(len(tiffIFD(exifAt, exif)))
+	data := append([]byte("II*\x00\x08\x00\x00\x00"), tiffIFD(8, ifd0(exifAt, gpsAt))...)
+	data = append(data, tiffIFD(exifAt, exif)...)
+	data = append(data, tiffIFD(gpsAt, gps)...)
+
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 40, 30)), nil); err != nil {
+		t.Fatal(err)
+	}
+	app1 := append([]byte("Exif\x00\x00"), data...)
+	segment := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(app1)+2))
+	return append(append(append([]byte{}, img.Bytes()[:2]...), append(segment, app1...)...), img.Bytes()[2:]...)
+}
+
+func box(kind string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(8+len(data))), append([]byte(kind), data...)...)
+}
+
+// movie returns an MP4 with its moov box after the media data, and an audio
+// track ahead of the video one.
+func movie() []byte {
+	be := binary.BigEndian
+	mvhd := make([]byte, 100)
+	be.PutUint32(mvhd[4:], 3660681600) // 2020-01-01 in seconds since 1904
+	be.PutUint32(mvhd[12:], 1000)
+	be.PutUint32(mvhd[16:], 12500)
+	tkhd := func(width, height uint32) []byte {
+		b := make([]byte, 84)
+		be.PutUint32(b[76:], width<<16)
+		be.PutUint32(b[80:], height<<16)
+		return b
+	}
+	return bytes.Join([][]byte{
+		box("ftyp", []byte("isom\x00\x00\x02\x00")),
+		box("mdat", make([]byte, 1000)),
+		box("moov", box("mvhd", mvhd), box("trak", box("tkhd", tkhd(0, 0))), box("trak", box("tkhd", tkhd(1920, 1080)))),
+	}, nil)
+}
+
+const document = "%PDF-1.7\n1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+	"2 0 obj << /Type /Pages /Kids [3 0 R 4 0 R 5 0 R] /Count 3 >> endobj\n" +
+	"3 0 obj << /Type /Page /Parent 2 0 R >> endobj\n%%EOF\n"
+
+func TestDetect(t *testing.T) {
+	var picture bytes.Buffer
+	png.Encode(&picture, image.NewGray(image.Rect(0, 0, 1, 1)))
+	for _, tt := range []struct {
+		content   []byte
+		mime, ext string
+	}{
+		{picture.Bytes(), "image/png", ".png"},
+		{[]byte(document), "application/pdf", ".pdf"},
+		{movie(), "video/mp4", ".mp4"},
+		{[]byte("plain words\n"), "text/plain; charset=utf-8", ".txt"},
+	} {
+		mime, ext, err := Detect(bytes.NewReader(tt.content))
+		if err != nil || mime != tt.mime || ext != tt.ext {
+			t.Errorf("Detect = %q, %q, %v, want %q, %q", mime, ext, err, tt.mime, tt.ext)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content []byte
+		mime    string
+		want    map[string]string
+	}{
+		{"photo", photo(t), "image/jpeg", map[string]string{
+			"width": "40", "height": "30", "camera_make": "Canon", "camera_model": "EOS R5",
+			"captured_at": "2021-06-01T12:30:00", "f_number": "1.8",
+			"gps_latitude": "48.858222", "gps_longitude": "2.2945",
+		}},
+		{"movie", movie(), "video/mp4", map[string]string{
+			"duration_seconds": "12.5", "created_at": "2020-01-01T00:00:00Z", "width": "1920", "height": "1080",
+		}},
+		{"document", []byte(document), "application/pdf", map[string]string{"pdf_version": "1.7", "page_count": "3"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := Extract(bytes.NewReader(tt.content), int64(len(tt.content)), tt.mime)
+			for k, want := range tt.want {
+				if got := fmt.Sprint(meta[k]); got != want {
+					t.Errorf("%s = %s, want %s", k, got, want)
+				}
+			}
+
+			// Damaged files yield less, never a panic
+			for n := range tt.content {
+				Extract(bytes.NewReader(tt.content[:n]), int64(n), tt.mime)
+			}
+		})
+	}
+
+	if meta := Extract(bytes.NewReader([]byte("words")), 5, "text/plain"); meta != nil {
+		t.Errorf("Extract of text = %v, want nil", meta)
+	}
+}
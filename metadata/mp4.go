@@ -0,0 +1,162 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"cloud-storage/models"
+)
+
+// The moov box holds only headers and sample tables; larger ones are not read
+const maxMoovSize = 64 << 20
+
+// mp4Epoch is the reference time for ISO base media file timestamps.
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// extractMP4 reads duration, creation time and video resolution from the movie
+// header boxes of an ISO base media file (MP4, MOV, M4A, 3GP).
+func extractMP4(f io.ReaderAt, size int64, meta models.Metadata) {
+	// The moov box may sit before or after the media data, so walk the top level
+	var moov []byte
+	for offset := int64(0); offset < size; {
+		size, kind, header, ok := readBoxHeader(f, offset, size)
+		if !ok {
+			return
+		}
+		if kind == "moov" {
+			if size-header > maxMoovSize {
+				return
+			}
+			moov = make([]byte, size-header)
+			if _, err := f.ReadAt(moov, offset+header); err != nil {
+				return
+			}
+			break
+		}
+		offset += size
+	}
+	if moov == nil {
+		return
+	}
+
+	for _, box := range mp4Children(moov) {
+		switch box.kind {
+		case "mvhd":
+			parseMVHD(box.data, meta)
+		case "trak":
+			for _, child := range mp4Children(box.data) {
+				if child.kind == "tkhd" {
+					parseTKHD(child.data, meta)
+				}
+			}
+		}
+	}
+}
+
+func readBoxHeader(r io.ReaderAt, offset, limit int64) (size int64, kind string, header int64, ok bool) {
+	buf := make([]byte, 16)
+	if _, err := r.ReadAt(buf[:8], offset); err != nil {
+		return 0, "", 0, false
+	}
+	size = int64(binary.BigEndian.Uint32(buf))
+	kind = string(buf[4:8])
+	header = 8
+
+	switch size {
+	case 0:
+		// Box extends to the end of the file
+		size = limit - offset
+	case 1:
+		if _, err := r.ReadAt(buf[8:16], offset+8); err != nil {
+			return 0, "", 0, false
+		}
+		size = int64(binary.BigEndian.Uint64(buf[8:]))
+		header = 16
+	}
+	if size < header || offset+size > limit {
+		return 0, "", 0, false
+	}
+	return size, kind, header, true
+}
+
+type mp4Box struct {
+	kind string
+	data []byte
+}
+
+func mp4Children(data []byte) []mp4Box {
+	var boxes []mp4Box
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		if size == 1 {
+			if len(data) < 16 {
+				break
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		} else if size == 0 {
+			size = uint64(len(data))
+		}
+		if size < header || size > uint64(len(data)) {
+			break
+		}
+		boxes = append(boxes, mp4Box{kind: string(data[4:8]), data: data[header:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+func parseMVHD(data []byte, meta models.Metadata) {
+	if len(data) < 4 {
+		return
+	}
+
+	var created, timescale, duration uint64
+	if data[0] == 1 {
+		if len(data) < 32 {
+			return
+		}
+		created = binary.BigEndian.Uint64(data[4:])
+		timescale = uint64(binary.BigEndian.Uint32(data[20:]))
+		duration = binary.BigEndian.Uint64(data[24:])
+	} else {
+		if len(data) < 20 {
+			return
+		}
+		created = uint64(binary.BigEndian.Uint32(data[4:]))
+		timescale = uint64(binary.BigEndian.Uint32(data[12:]))
+		duration = uint64(binary.BigEndian.Uint32(data[16:]))
+	}
+
+	if timescale > 0 {
+		meta["duration_seconds"] = math.Round(float64(duration)/float64(timescale)*1000) / 1000
+	}
+	if created > 0 {
+		meta["created_at"] = time.Unix(mp4Epoch.Unix()+int64(created), 0).UTC().Format(time.RFC3339)
+	}
+}
+
+// parseTKHD records the dimensions of the first track that has any; audio tracks are 0x0.
+func parseTKHD(data []byte, meta models.Metadata) {
+	if _, ok := meta["width"]; ok || len(data) < 4 {
+		return
+	}
+
+	// Width and height are 16.16 fixed point after the timing fields and the matrix
+	offset := 76
+	if data[0] == 1 {
+		offset = 88
+	}
+	if len(data) < offset+8 {
+		return
+	}
+	width := binary.BigEndian.Uint32(data[offset:]) >> 16
+	height := binary.BigEndian.Uint32(data[offset+4:]) >> 16
+	if width > 0 && height > 0 {
+		meta["width"] = width
+		meta["height"] = height
+	}
+}
@@ -0,0 +1,50 @@
+package metadata
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+
+	"cloud-storage/models"
+)
+
+// Only this much of a PDF is scanned for its page tree
+const maxPDFScan = 64 << 20
+
+var (
+	pdfVersion   = regexp.MustCompile(`^%PDF-(\d\.\d)`)
+	pdfPagesNode = regexp.MustCompile(`/Type\s*/Pages\b`)
+	pdfCount     = regexp.MustCompile(`/Count\s+(\d+)`)
+	pdfPage      = regexp.MustCompile(`/Type\s*/Page\b`)
+)
+
+// extractPDF reads the version and page count. The root of the page tree has the
+// largest /Count; when the tree sits in compressed object streams it falls back to
+// counting uncompressed page objects.
+func extractPDF(f io.Reader, meta models.Metadata) {
+	data, err := io.ReadAll(io.LimitReader(f, maxPDFScan))
+	if err != nil {
+		return
+	}
+
+	if m := pdfVersion.FindSubmatch(data); m != nil {
+		meta["pdf_version"] = string(m[1])
+	}
+
+	pages := 0
+	for _, loc := range pdfPagesNode.FindAllIndex(data, -1) {
+		// /Count is in the same dictionary, close to /Type
+		start, end := max(loc[0]-512, 0), min(loc[1]+512, len(data))
+		for _, m := range pdfCount.FindAllSubmatch(data[start:end], -1) {
+			if n, err := strconv.Atoi(string(m[1])); err == nil && n > pages {
+				pages = n
+			}
+		}
+	}
+	if pages == 0 {
+		pages = len(pdfPage.FindAllIndex(data, -1))
+	}
+	if pages > 0 {
+		meta["page_count"] = pages
+	}
+}
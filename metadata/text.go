@@ -0,0 +1,200 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MaxText caps how much extracted text is returned for indexing
+	MaxText = 1 << 20
+	// Inflated PDF streams are capped to bound memory on compression bombs
+	maxPDFInflate = 16 << 20
+)
+
+// textTypes lists non-text/* types whose content is readable text.
+var textTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-sh":       true,
+	"application/x-php":      true,
+	"application/x-python":   true,
+	"application/toml":       true,
+	"application/yaml":       true,
+	"application/x-yaml":     true,
+}
+
+// HasText reports whether ExtractText understands files of mimeType.
+func HasText(mimeType string) bool {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return strings.HasPrefix(mimeType, "text/") || textTypes[mimeType] || mimeType == "application/pdf"
+}
+
+// ExtractText returns the searchable text of plain text, Markdown, source code
+// and PDF content, truncated to MaxText bytes.
+func ExtractText(r io.Reader, mimeType string) string {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	switch {
+	case mimeType == "application/pdf":
+		data, err := io.ReadAll(io.LimitReader(r, maxPDFScan))
+		if err != nil {
+			return ""
+		}
+		return truncateText(pdfText(data))
+	case HasText(mimeType):
+		data, err := io.ReadAll(io.LimitReader(r, MaxText))
+		if err != nil {
+			return ""
+		}
+		return truncateText(string(data))
+	}
+	return ""
+}
+
+func truncateText(s string) string {
+	if len(s) > MaxText {
+		s = s[:MaxText]
+	}
+	// Also drops a rune cut in half by the limit
+	return strings.ToValidUTF8(s, "")
+}
+
+var pdfStream = regexp.MustCompile(`(?s)<<(.{0,1000}?)>>\s*stream\r?\n`)
+
+// pdfText pulls the strings shown by text operators out of each page content
+// stream. It handles the common simple-font case; text in CID fonts or compressed
+// object streams is not recovered.
+func pdfText(data []byte) string {
+	var out strings.Builder
+	for _, loc := range pdfStream.FindAllSubmatchIndex(data, -1) {
+		dict := data[loc[2]:loc[3]]
+		start := loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		if bytes.Contains(dict, []byte("/Image")) || bytes.Contains(dict, []byte("/FontFile")) {
+			continue
+		}
+
+		content := data[start : start+end]
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			zr, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			content, _ = io.ReadAll(io.LimitReader(zr, maxPDFInflate))
+			zr.Close()
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue
+		}
+
+		if bytes.Contains(content, []byte("BT")) {
+			pdfShowText(content, &out)
+		}
+		if out.Len() > MaxText {
+			break
+		}
+	}
+	return out.String()
+}
+
+// pdfShowText appends the operands of Tj, TJ, ' and " inside BT/ET blocks.
+func pdfShowText(content []byte, out *strings.Builder) {
+	var pending []string
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; c {
+		case '(':
+			s, n := pdfLiteral(content[i:])
+			pending = append(pending, s)
+			i += n - 1
+		case '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		default:
+			if i > 0 && !isPDFDelimiter(content[i-1]) {
+				continue
+			}
+			op := pdfOperator(content[i:])
+			if op == "" {
+				continue
+			}
+			switch op {
+			case "Tj", "TJ", "'", `"`:
+				out.WriteString(strings.Join(pending, ""))
+				out.WriteByte(' ')
+			case "T*", "Td", "TD", "ET":
+				out.WriteByte('\n')
+			}
+			pending = pending[:0]
+			i += len(op) - 1
+		}
+	}
+}
+
+// pdfOperator returns the operator starting at data if it is one that delimits text.
+func pdfOperator(data []byte) string {
+	for _, op := range []string{"TJ", "Tj", "T*", "Td", "TD", "ET", "'", `"`} {
+		if bytes.HasPrefix(data, []byte(op)) && (len(data) == len(op) || isPDFDelimiter(data[len(op)])) {
+			return op
+		}
+	}
+	return ""
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte(" \t\r\n\f()<>[]{}/%", c) >= 0
+}
+
+// pdfLiteral decodes a (...) string with nested parentheses and escapes,
+// returning it and the number of bytes consumed.
+func pdfLiteral(data []byte) (string, int) {
+	var sb strings.Builder
+	depth := 0
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\' && i+1 < len(data):
+			i++
+			switch e := data[i]; e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r', 't', 'b', 'f':
+				sb.WriteByte(' ')
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v, j := 0, 0
+					for ; j < 3 && i+j < len(data) && data[i+j] >= '0' && data[i+j] <= '7'; j++ {
+						v = v*8 + int(data[i+j]-'0')
+					}
+					sb.WriteRune(rune(v))
+					i += j - 1
+				} else {
+					sb.WriteByte(e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				sb.WriteByte(c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return sb.String(), i + 1
+			}
+			sb.WriteByte(c)
+		default:
+			// Simple fonts use a Latin-1 compatible encoding for the printable range
+			sb.WriteRune(rune(c))
+		}
+	}
+	return sb.String(), len(data)
+}
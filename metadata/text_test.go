@@ -0,0 +1,42 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/zlib"
+	"strings"
+	"testing"
+)
+
+func TestExtractText(t *testing.T) {
+	page := "BT /F1 12 Tf 72 712 Td (Quarterly \\(draft\\)) Tj T* [(re) -20 (port)] TJ ET"
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write([]byte("BT (compressed words) Tj ET"))
+	zw.Close()
+	pdf := "%PDF-1.4\n1 0 obj << /Length 80 >> stream\n" + page + "\nendstream endobj\n" +
+		"2 0 obj << /Filter /FlateDecode >> stream\n" + deflated.String() + "\nendstream endobj\n" +
+		"3 0 obj << /Subtype /Image /Length 5 >> stream\n(img) Tj\nendstream endobj\n"
+
+	got := ExtractText(strings.NewReader(pdf), "application/pdf")
+	for _, want := range []string{"Quarterly (draft)", "report", "compressed words"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("PDF text %q lacks %q", got, want)
+		}
+	}
+	if strings.Contains(got, "img") {
+		t.Errorf("PDF text %q includes an image stream", got)
+	}
+
+	if got := ExtractText(strings.NewReader(`{"key": "value"}`), "application/json; charset=utf-8"); got != `{"key": "value"}` {
+		t.Errorf("JSON text = %q", got)
+	}
+	if got := ExtractText(strings.NewReader("\x89PNG"), "image/png"); got != "" {
+		t.Errorf("image text = %q, want none", got)
+	}
+
+	// Text is capped without leaving half a rune at the end
+	long := "a" + strings.Repeat("é", MaxText)
+	if got := ExtractText(strings.NewReader(long), "text/plain"); len(got) > MaxText || !strings.HasSuffix(got, "é") {
+		t.Errorf("capped text is %d bytes ending %q", len(got), got[len(got)-2:])
+	}
+}
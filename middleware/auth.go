@@ -4,9 +4,13 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
+
+	"cloud-storage/models"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func JWTAuthMiddleware() gin.HandlerFunc {
@@ -36,3 +40,45 @@ func JWTAuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// AdminMiddleware must run after JWTAuthMiddleware and rejects non-admin users.
+func AdminMiddleware(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user models.User
+		if err := db.First(&user, c.MustGet("userID").(uint)).Error; err != nil || !user.IsAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// BasicAuthMiddleware authenticates with a username and one of the user's app passwords.
+// It is meant for clients such as WebDAV mounts that cannot send bearer tokens.
+// S3 access keys are not accepted, their secrets only sign requests.
+func BasicAuthMiddleware(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, token, ok := c.Request.BasicAuth()
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="Cloud Storage"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		var user models.User
+		var appPassword models.AppPassword
+		if err := db.Where("username = ?", username).First(&user).Error; err != nil ||
+			db.Where("user_id = ? AND token_hash = ?", user.ID, models.HashToken(token)).First(&appPassword).Error != nil {
+			c.Header("WWW-Authenticate", `Basic realm="Cloud Storage"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		now := time.Now()
+		db.Model(&appPassword).Update("last_used_at", &now)
+
+		c.Set("userID", user.ID)
+		c.Next()
+	}
+}
@@ -0,0 +1,403 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud-storage/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	sigV4Algorithm    = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat   = "20060102T150405Z"
+	maxClockSkew      = 15 * time.Minute
+	maxChunkSize      = 16 << 20
+	emptyPayloadHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	UnsignedPayload   = "UNSIGNED-PAYLOAD"
+	streamingPrefix   = "STREAMING-"
+	streamingSigned   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsigned = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// S3Error is the XML error body returned by the S3 API.
+type S3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+func AbortS3(c *gin.Context, status int, code, message string) {
+	c.Header("Content-Type", "application/xml")
+	if c.Request.Method == "HEAD" {
+		c.AbortWithStatus(status)
+		return
+	}
+	c.Status(status)
+	c.Writer.WriteString(xml.Header)
+	xml.NewEncoder(c.Writer).Encode(S3Error{Code: code, Message: message, Resource: c.Request.URL.Path})
+	c.Abort()
+}
+
+type sigV4Auth struct {
+	accessKeyID   string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	expires       time.Duration
+	presigned     bool
+}
+
+func (s *sigV4Auth) scope() string {
+	return strings.Join([]string{s.date, s.region, s.service, "aws4_request"}, "/")
+}
+
+// S3AuthMiddleware verifies AWS Signature Version 4 requests, signed either in
+// the Authorization header or as a presigned URL, against the user's access keys.
+// Streaming (aws-chunked) bodies are decoded and their chunk signatures checked.
+func S3AuthMiddleware(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth, err := parseSigV4(c.Request)
+		if err != nil {
+			AbortS3(c, http.StatusForbidden, "AccessDenied", err.Error())
+			return
+		}
+
+		var key models.AccessKey
+		if err := db.Where("access_key_id = ?", auth.accessKeyID).First(&key).Error; err != nil {
+			AbortS3(c, http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist")
+			return
+		}
+
+		signedAt, err := time.Parse(sigV4TimeFormat, auth.amzDate)
+		if err != nil || !strings.HasPrefix(auth.amzDate, auth.date) {
+			AbortS3(c, http.StatusForbidden, "AccessDenied", "Invalid X-Amz-Date")
+			return
+		}
+		now := time.Now()
+		if auth.presigned {
+			// A URL dated ahead would stay valid past its expiry
+			if signedAt.Sub(now) > maxClockSkew {
+				AbortS3(c, http.StatusForbidden, "AccessDenied", "Request is not yet valid")
+				return
+			}
+			if now.After(signedAt.Add(auth.expires)) {
+				AbortS3(c, http.StatusForbidden, "AccessDenied", "Request has expired")
+				return
+			}
+		} else if now.Sub(signedAt) > maxClockSkew || signedAt.Sub(now) > maxClockSkew {
+			AbortS3(c, http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large")
+			return
+		}
+
+		signingKey := deriveSigningKey(key.SecretKey, auth.date, auth.region, auth.service)
+		stringToSign := strings.Join([]string{
+			sigV4Algorithm,
+			auth.amzDate,
+			auth.scope(),
+			hashHex([]byte(canonicalRequest(c.Request, auth))),
+		}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(auth.signature)) != 1 {
+			AbortS3(c, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided")
+			return
+		}
+
+		if strings.HasPrefix(auth.payloadHash, streamingPrefix) {
+			decoded, err := strconv.ParseInt(c.GetHeader("X-Amz-Decoded-Content-Length"), 10, 64)
+			if err != nil || decoded < 0 {
+				AbortS3(c, http.StatusLengthRequired, "MissingContentLength", "X-Amz-Decoded-Content-Length is required for streaming uploads")
+				return
+			}
+			c.Request.Body = &chunkedReader{
+				body:       c.Request.Body,
+				r:          bufio.NewReader(c.Request.Body),
+				signed:     auth.payloadHash == streamingSigned || auth.payloadHash == streamingTrailer,
+				signingKey: signingKey,
+				amzDate:    auth.amzDate,
+				scope:      auth.scope(),
+				prevSig:    auth.signature,
+				remaining:  decoded,
+			}
+			c.Request.ContentLength = decoded
+		}
+
+		db.Model(&key).Update("last_used_at", &now)
+
+		c.Set("userID", key.UserID)
+		c.Set("s3PayloadHash", auth.payloadHash)
+		c.Next()
+	}
+}
+
+func parseSigV4(r *http.Request) (*sigV4Auth, error) {
+	auth := &sigV4Auth{}
+	var credential, signedHeaders string
+
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return nil, errors.New("unsupported signing algorithm")
+		}
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds < 1 || seconds > 7*24*3600 {
+			return nil, errors.New("invalid X-Amz-Expires")
+		}
+		auth.presigned = true
+		auth.expires = time.Duration(seconds) * time.Second
+		auth.amzDate = query.Get("X-Amz-Date")
+		auth.signature = query.Get("X-Amz-Signature")
+		auth.payloadHash = UnsignedPayload
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+	} else {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, sigV4Algorithm+" ") {
+			return nil, errors.New("missing or unsupported Authorization header")
+		}
+		for _, part := range strings.Split(strings.TrimPrefix(header, sigV4Algorithm+" "), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch k {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				signedHeaders = v
+			case "Signature":
+				auth.signature = v
+			}
+		}
+		auth.amzDate = r.Header.Get("X-Amz-Date")
+		auth.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if auth.payloadHash == "" {
+			return nil, errors.New("missing X-Amz-Content-Sha256")
+		}
+	}
+
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[4] != "aws4_request" {
+		return nil, errors.New("malformed credential")
+	}
+	auth.accessKeyID, auth.date, auth.region, auth.service = scope[0], scope[1], scope[2], scope[3]
+
+	if signedHeaders == "" || auth.signature == "" {
+		return nil, errors.New("missing signature")
+	}
+	auth.signedHeaders = strings.Split(signedHeaders, ";")
+	// Without the host a signature would be good for any server sharing the key
+	if !slices.Contains(auth.signedHeaders, "host") {
+		return nil, errors.New("host must be a signed header")
+	}
+	return auth, nil
+}
+
+func canonicalRequest(r *http.Request, auth *sigV4Auth) string {
+	var headers strings.Builder
+	for _, name := range auth.signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = r.Header.Get("Content-Length")
+			if value == "" {
+				value = strconv.FormatInt(r.ContentLength, 10)
+			}
+		default:
+			values := r.Header.Values(name)
+			for i, v := range values {
+				values[i] = strings.Join(strings.Fields(v), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		canonicalURI(r.URL.Path),
+		canonicalQuery(r.URL.Query(), auth.presigned),
+		headers.String(),
+		strings.Join(auth.signedHeaders, ";"),
+		auth.payloadHash,
+	}, "\n")
+}
+
+func canonicalURI(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return uriEncode(p, false)
+}
+
+func canonicalQuery(query url.Values, presigned bool) string {
+	var pairs []string
+	for k, values := range query {
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode applies the SigV4 encoding rules: everything but unreserved characters is percent-encoded.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' && !encodeSlash {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+func deriveSigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	errChunkSignature = errors.New("chunk signature does not match")
+	errDecodedLength  = errors.New("body does not match X-Amz-Decoded-Content-Length")
+)
+
+// chunkedReader decodes an aws-chunked request body, verifying the signature chain when signed.
+type chunkedReader struct {
+	body       io.Closer
+	r          *bufio.Reader
+	signed     bool
+	signingKey []byte
+	amzDate    string
+	scope      string
+	prevSig    string
+	// remaining is what X-Amz-Decoded-Content-Length says is still to come
+	remaining int64
+
+	chunk []byte
+	done  bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for len(cr.chunk) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.nextChunk(); err != nil {
+			// The body only ends after the final, empty chunk
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+func (cr *chunkedReader) Close() error {
+	return cr.body.Close()
+}
+
+func (cr *chunkedReader) nextChunk() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errors.New("malformed chunk header")
+	}
+	if size > cr.remaining || size == 0 && cr.remaining != 0 {
+		return errDecodedLength
+	}
+	cr.remaining -= size
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, data); err != nil {
+		return err
+	}
+
+	if cr.signed {
+		sig := strings.TrimPrefix(ext, "chunk-signature=")
+		stringToSign := strings.Join([]string{
+			sigV4Algorithm + "-PAYLOAD",
+			cr.amzDate,
+			cr.scope,
+			cr.prevSig,
+			emptyPayloadHash,
+			hashHex(data),
+		}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(cr.signingKey, stringToSign))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(sig)) != 1 {
+			return errChunkSignature
+		}
+		cr.prevSig = sig
+	}
+
+	if size == 0 {
+		// Trailing headers (such as checksums) follow the final chunk up to a blank line
+		for {
+			line, err := cr.r.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if strings.TrimRight(line, "\r\n") == "" {
+				break
+			}
+		}
+		cr.done = true
+		return nil
+	}
+
+	crlf := make([]byte, 2)
+	if _, err := io.ReadFull(cr.r, crlf); err != nil || !bytes.Equal(crlf, []byte("\r\n")) {
+		return errors.New("malformed chunk terminator")
+	}
+	cr.chunk = data
+	return nil
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AccessKey is an S3-style key pair. SigV4 needs the raw secret to recompute
+// signatures, so unlike app passwords it cannot be stored hashed.
+type AccessKey struct {
+	gorm.Model
+	UserID      uint       `json:"user_id" gorm:"not null;index"`
+	AccessKeyID string     `json:"access_key_id" gorm:"not null;uniqueIndex"`
+	SecretKey   string     `json:"-" gorm:"not null"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+}
+
+// MultipartUpload tracks an S3 multipart upload until it is completed or aborted.
+type MultipartUpload struct {
+	gorm.Model
+	UploadID string `json:"upload_id" gorm:"not null;uniqueIndex"`
+	UserID   uint   `json:"user_id" gorm:"not null;index"`
+	Bucket   string `json:"bucket" gorm:"not null"`
+	Key      string `json:"key" gorm:"not null"`
+}
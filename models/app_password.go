@@ -0,0 +1,23 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AppPassword is a revocable credential for clients that can only do basic auth, such as WebDAV mounts.
+type AppPassword struct {
+	gorm.Model
+	UserID     uint       `json:"user_id" gorm:"not null;index"`
+	Name       string     `json:"name" gorm:"not null"`
+	TokenHash  string     `json:"-" gorm:"not null;uniqueIndex"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,15 @@
+package models
+
+import "gorm.io/gorm"
+
+// Chunk is a content-defined chunk of a user's files, stored once however many
+// file manifests list it. RefCount counts the listings; chunks left at zero are
+// removed by the chunk garbage collector.
+type Chunk struct {
+	gorm.Model
+	UserID   uint   `json:"user_id" gorm:"not null;uniqueIndex:idx_chunk"`
+	Hash     string `json:"hash" gorm:"not null;uniqueIndex:idx_chunk"`
+	Size     int64  `json:"size" gorm:"not null"`
+	Path     string `json:"path" gorm:"not null;index"`
+	RefCount int64  `json:"ref_count" gorm:"not null;default:0;index"`
+}
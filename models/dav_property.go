@@ -0,0 +1,11 @@
+package models
+
+// DavProperty is a WebDAV dead property set on a file through PROPPATCH.
+type DavProperty struct {
+	ID       uint   `gorm:"primarykey"`
+	FileID   uint   `gorm:"not null;uniqueIndex:idx_dav_property"`
+	Space    string `gorm:"uniqueIndex:idx_dav_property"`
+	Local    string `gorm:"not null;uniqueIndex:idx_dav_property"`
+	Lang     string
+	InnerXML string
+}
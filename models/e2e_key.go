@@ -0,0 +1,22 @@
+package models
+
+import "gorm.io/gorm"
+
+// UserKey is the end-to-end encryption identity of a user. Only the public key
+// is readable by the server; SealedKeys is encrypted by the client with a key
+// derived from the user's passphrase.
+type UserKey struct {
+	gorm.Model
+	UserID     uint   `json:"user_id" gorm:"not null;uniqueIndex"`
+	PublicKey  string `json:"public_key" gorm:"not null"`
+	SealedKeys string `json:"sealed_keys" gorm:"not null"`
+}
+
+// FileKey is the key of an end-to-end encrypted file, wrapped by its owner for
+// the public key of another user.
+type FileKey struct {
+	gorm.Model
+	FileID     uint   `json:"file_id" gorm:"not null;uniqueIndex:idx_file_key"`
+	UserID     uint   `json:"user_id" gorm:"not null;uniqueIndex:idx_file_key;index"`
+	WrappedKey string `json:"wrapped_key" gorm:"not null"`
+}
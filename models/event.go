@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// Event is the persisted form of a bus event, kept so clients can resume streams.
+type Event struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	Type      string    `json:"type" gorm:"not null"`
+	UserID    uint      `json:"user_id" gorm:"not null;index"`
+	FileID    *uint     `json:"file_id"`
+	Data      string    `json:"data"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
@@ -13,8 +13,46 @@ type File struct {
 	Path         string    `json:"path" gorm:"not null"`
 	Size         int64     `json:"size" gorm:"not null"`
 	Hash         string    `json:"hash" gorm:"not null;index"`
+	MimeType     string    `json:"mime_type" gorm:"default:''"`
+	Metadata     Metadata  `json:"metadata" gorm:"type:text"`
 	IsDir        bool      `json:"is_dir" gorm:"default:false"`
 	ParentID     *uint     `json:"parent_id"`
 	Version      int       `json:"version" gorm:"default:1"`
 	LastModified time.Time `json:"last_modified"`
+	Starred      bool      `json:"starred" gorm:"default:false"`
+	Color        string    `json:"color"`
+	Tags         []Tag     `json:"tags,omitempty" gorm:"many2many:file_tags"`
+	// Set by the integrity scrubber when the blob is missing or fails its hash
+	Corrupt bool `json:"corrupt,omitempty" gorm:"default:false"`
+	// Compression of the blob at rest, "" or gzip; StoredSize is then its
+	// compressed size while Size stays that of the original
+	Compression string `json:"compression,omitempty" gorm:"default:''"`
+	StoredSize  int64  `json:"stored_size,omitempty" gorm:"default:0"`
+	// Malware scan of the content: "" when not scanned, or one of the Scan
+	// statuses; ScanResult names the signature found or the scan error
+	ScanStatus string     `json:"scan_status,omitempty" gorm:"default:'';index"`
+	ScanResult string     `json:"scan_result,omitempty"`
+	ScannedAt  *time.Time `json:"scanned_at,omitempty"`
+	// LegalHold blocks deleting or replacing the file, or for a folder
+	// everything below it, regardless of retention rules
+	LegalHold bool `json:"legal_hold,omitempty" gorm:"default:false"`
+	// The file is deleted once ExpiresAt passes or, when MaxDownloads is set,
+	// after that many downloads
+	ExpiresAt     *time.Time `json:"expires_at,omitempty" gorm:"index"`
+	MaxDownloads  int        `json:"max_downloads,omitempty" gorm:"default:0"`
+	DownloadCount int        `json:"download_count,omitempty" gorm:"default:0"`
 }
+
+// Expired reports whether the file has run out of time or downloads.
+func (f *File) Expired(now time.Time) bool {
+	return (f.ExpiresAt != nil && !now.Before(*f.ExpiresAt)) ||
+		(f.MaxDownloads > 0 && f.DownloadCount >= f.MaxDownloads)
+}
+
+// Malware scan statuses. Pending and infected files cannot be downloaded.
+const (
+	ScanPending  = "pending"
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanFailed   = "error"
+)
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// FileRequest is a link through which people without an account upload files
+// into one of its owner's folders. Only the hash of its token is stored.
+type FileRequest struct {
+	gorm.Model
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	FolderID  uint       `json:"folder_id" gorm:"not null"`
+	Title     string     `json:"title"`
+	TokenHash string     `json:"-" gorm:"not null;uniqueIndex"`
+	Password  string     `json:"-"` // bcrypt hash, empty when none is needed
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// 0 allows any size the owner's quota does
+	MaxFileSize int64 `json:"max_file_size,omitempty" gorm:"default:0"`
+	// Comma separated lower case extensions without the dot, empty allows any
+	Extensions   string `json:"extensions,omitempty"`
+	RequireName  bool   `json:"require_name" gorm:"default:false"`
+	RequireEmail bool   `json:"require_email" gorm:"default:false"`
+	Uploads      int    `json:"uploads" gorm:"default:0"`
+}
+
+func (r *FileRequest) SetPassword(password string) error {
+	if password == "" {
+		r.Password = ""
+		return nil
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	r.Password = string(hashed)
+	return nil
+}
+
+func (r *FileRequest) CheckPassword(password string) bool {
+	return r.Password == "" || bcrypt.CompareHashAndPassword([]byte(r.Password), []byte(password)) == nil
+}
+
+// FileRequestUpload records who uploaded a file through a request.
+type FileRequestUpload struct {
+	gorm.Model
+	RequestID uint   `json:"request_id" gorm:"not null;index"`
+	FileID    uint   `json:"file_id" gorm:"not null"`
+	FileName  string `json:"file_name"`
+	Size      int64  `json:"size"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	IP        string `json:"ip"`
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Job statuses
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is a unit of background work, picked up by the first idle worker once
+// RunAt has passed. Higher priorities run first.
+type Job struct {
+	gorm.Model
+	UserID      uint            `json:"user_id" gorm:"index"` // 0 for system jobs
+	Type        string          `json:"type" gorm:"not null;index"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Status      string          `json:"status" gorm:"not null;index:idx_job_due;default:queued"`
+	Priority    int             `json:"priority" gorm:"index:idx_job_due"`
+	RunAt       time.Time       `json:"run_at" gorm:"index:idx_job_due"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts" gorm:"default:1"`
+	Total       int             `json:"total"`
+	Done        int             `json:"done"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	LastError   string          `json:"error,omitempty"`
+	Schedule    string          `json:"schedule,omitempty" gorm:"index"`
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+}
+
+// Finished reports whether the job will not run again.
+func (j *Job) Finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCancelled
+}
+
+// JobSchedule queues a job of Type every time its cron Spec comes due.
+type JobSchedule struct {
+	gorm.Model
+	Name      string          `json:"name" gorm:"not null;uniqueIndex"`
+	Spec      string          `json:"spec" gorm:"not null"`
+	Type      string          `json:"type" gorm:"not null"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	NextRunAt time.Time       `json:"next_run_at" gorm:"index"`
+	LastRunAt *time.Time      `json:"last_run_at,omitempty"`
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+)
+
+// Metadata holds properties extracted from a file's content, stored as JSON.
+type Metadata map[string]interface{}
+
+func (m Metadata) Value() (driver.Value, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(m)
+	return string(data), err
+}
+
+func (m *Metadata) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return errors.New("unsupported metadata value")
+	}
+	return json.Unmarshal(data, m)
+}
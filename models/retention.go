@@ -0,0 +1,23 @@
+package models
+
+import "gorm.io/gorm"
+
+// Retention rule actions.
+const (
+	RetainKeep   = "keep"
+	RetainDelete = "delete"
+)
+
+// RetentionRule keeps the files it matches for at least Days after they were
+// last modified, or deletes them once they are that old. A rule matches the
+// files of every user below Folder, tagged Tag and of type MimeType (a prefix
+// such as "image/"), whichever are set.
+type RetentionRule struct {
+	gorm.Model
+	Name     string `json:"name" gorm:"not null"`
+	Action   string `json:"action" gorm:"not null"`
+	Days     int    `json:"days" gorm:"not null"`
+	Folder   string `json:"folder"`
+	Tag      string `json:"tag"`
+	MimeType string `json:"mime_type"`
+}
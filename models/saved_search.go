@@ -0,0 +1,11 @@
+package models
+
+import "gorm.io/gorm"
+
+// SavedSearch is a named search query a user can run again later.
+type SavedSearch struct {
+	gorm.Model
+	UserID uint   `json:"user_id" gorm:"not null;uniqueIndex:idx_saved_search_name"`
+	Name   string `json:"name" gorm:"not null;uniqueIndex:idx_saved_search_name"`
+	Query  string `json:"query" gorm:"not null"`
+}
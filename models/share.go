@@ -0,0 +1,13 @@
+package models
+
+import "gorm.io/gorm"
+
+// Share gives another user access to a file or folder.
+type Share struct {
+	gorm.Model
+	FileID       uint   `json:"file_id" gorm:"not null;uniqueIndex:idx_share_target"`
+	OwnerID      uint   `json:"owner_id" gorm:"not null;index"`
+	SharedWithID uint   `json:"shared_with_id" gorm:"not null;uniqueIndex:idx_share_target;index"`
+	Permission   string `json:"permission" gorm:"not null;default:read"` // read or write
+	File         File   `json:"file"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "gorm.io/gorm"
+
+// SSHKey is a public key that may authenticate the user to the SFTP server.
+type SSHKey struct {
+	gorm.Model
+	UserID      uint   `json:"user_id" gorm:"not null;index"`
+	Name        string `json:"name" gorm:"not null"`
+	PublicKey   string `json:"public_key" gorm:"not null"`
+	Fingerprint string `json:"fingerprint" gorm:"not null;uniqueIndex"`
+}
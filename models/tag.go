@@ -0,0 +1,25 @@
+package models
+
+import "gorm.io/gorm"
+
+// Tag is a user's label for organising files outside the folder tree.
+type Tag struct {
+	gorm.Model
+	UserID uint   `json:"user_id" gorm:"not null;uniqueIndex:idx_tag_name"`
+	Name   string `json:"name" gorm:"not null;uniqueIndex:idx_tag_name"`
+}
+
+// Colors lists the color labels a file may carry; "" means none.
+var Colors = []string{"red", "orange", "yellow", "green", "blue", "purple", "gray"}
+
+func ValidColor(color string) bool {
+	if color == "" {
+		return true
+	}
+	for _, c := range Colors {
+		if c == color {
+			return true
+		}
+	}
+	return false
+}
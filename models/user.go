@@ -8,8 +8,10 @@ import (
 
 type User struct {
 	gorm.Model
-	Username string `gorm:"uniqueIndex;not null"`
-	Password string `gorm:"not null"`
+	Username   string `gorm:"uniqueIndex;not null"`
+	Password   string `gorm:"not null"`
+	IsAdmin    bool   `gorm:"default:false"`
+	QuotaBytes int64  `gorm:"default:0"` // 0 means unlimited
 }
 
 func (u *User) HashPassword(password string) error {
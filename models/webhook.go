@@ -0,0 +1,48 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+type Webhook struct {
+	gorm.Model
+	UserID uint   `json:"user_id" gorm:"not null;index"`
+	URL    string `json:"url" gorm:"not null"`
+	Secret string `json:"-" gorm:"not null"`
+	Events string `json:"events" gorm:"not null"` // comma-separated event types, "*" for all
+	Global bool   `json:"global" gorm:"default:false"`
+	Active bool   `json:"active" gorm:"default:true"`
+}
+
+// Matches reports whether the webhook subscribes to the given event type.
+func (w *Webhook) Matches(eventType string) bool {
+	for _, e := range strings.Split(w.Events, ",") {
+		e = strings.TrimSpace(e)
+		if e == "*" || e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDelivery struct {
+	gorm.Model
+	WebhookID     uint      `json:"webhook_id" gorm:"not null;index"`
+	EventType     string    `json:"event_type" gorm:"not null"`
+	Payload       string    `json:"payload" gorm:"not null"`
+	Status        string    `json:"status" gorm:"not null;index;default:pending"`
+	Attempts      int       `json:"attempts" gorm:"default:0"`
+	NextAttemptAt time.Time `json:"next_attempt_at" gorm:"index"`
+	ResponseCode  int       `json:"response_code"`
+	LastError     string    `json:"last_error"`
+}
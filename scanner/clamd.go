@@ -0,0 +1,106 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Clamd scans with a ClamAV daemon over its INSTREAM command.
+type Clamd struct {
+	Network string // tcp or unix
+	Address string
+	Timeout time.Duration
+	// ChunkSize bounds the pieces content is streamed in
+	ChunkSize int
+}
+
+// NewClamd returns a driver for the clamd at addr: "unix:/path/to/clamd.sock",
+// "tcp:host:port" or plain "host:port".
+func NewClamd(addr string) *Clamd {
+	c := &Clamd{Network: "tcp", Address: addr, Timeout: 5 * time.Minute, ChunkSize: 64 << 10}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		c.Network, c.Address = "unix", path
+	} else if hostPort, ok := strings.CutPrefix(addr, "tcp:"); ok {
+		c.Address = hostPort
+	}
+	return c
+}
+
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// Null-terminated command, then length-prefixed chunks ending with an empty one
+	w := bufio.NewWriterSize(conn, c.ChunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return Result{}, err
+	}
+	buf := make([]byte, c.ChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if werr := binary.Write(w, binary.BigEndian, uint32(n)); werr != nil {
+				return Result{}, werr
+			}
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return Result{}, c.reply(conn, werr)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
+		return Result{}, c.reply(conn, err)
+	}
+	if err := w.Flush(); err != nil {
+		return Result{}, c.reply(conn, err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return Result{}, err
+	}
+	return parseReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// reply prefers the daemon's explanation, such as the size limit, to the write
+// error it caused by closing the connection.
+func (c *Clamd) reply(conn net.Conn, err error) error {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if reply, _ := bufio.NewReader(conn).ReadString(0); reply != "" {
+		return fmt.Errorf("clamd: %s", strings.TrimRight(reply, "\x00\n"))
+	}
+	return err
+}
+
+// parseReply reads "stream: OK", "stream: <signature> FOUND" or "<message> ERROR".
+func parseReply(reply string) (Result, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
@@ -0,0 +1,129 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeClamd answers INSTREAM commands like clamd does: content holding "EICAR"
+// is infected, and streams over limit bytes are refused mid-upload.
+func fakeClamd(t *testing.T, network, address string, limit int) string {
+	t.Helper()
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn, limit)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveClamd(conn net.Conn, limit int) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var content bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if content.Len()+int(size) > limit {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+		if _, err := io.CopyN(&content, r, int64(size)); err != nil {
+			return
+		}
+	}
+	if bytes.Contains(content.Bytes(), []byte("EICAR")) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestClamdScan(t *testing.T) {
+	clamd := NewClamd(fakeClamd(t, "tcp", "127.0.0.1:0", 1<<20))
+	// Small chunks make the content span several of them
+	clamd.ChunkSize = 16
+
+	tests := []struct {
+		name    string
+		content string
+		want    Result
+	}{
+		{"clean", strings.Repeat("harmless ", 10), Result{}},
+		{"empty", "", Result{}},
+		{"infected", strings.Repeat("x", 20) + "EICAR" + strings.Repeat("x", 20), Result{Infected: true, Signature: "Eicar-Test-Signature"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := clamd.Scan(context.Background(), strings.NewReader(tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Scan = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClamdSizeLimit(t *testing.T) {
+	clamd := NewClamd("tcp:" + fakeClamd(t, "tcp", "127.0.0.1:0", 1<<10))
+	clamd.ChunkSize = 256
+
+	_, err := clamd.Scan(context.Background(), bytes.NewReader(make([]byte, 1<<20)))
+	if err == nil || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Errorf("Scan over the size limit = %v, want the daemon's error", err)
+	}
+}
+
+func TestClamdUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	fakeClamd(t, "unix", socket, 1<<20)
+
+	got, err := NewClamd("unix:"+socket).Scan(context.Background(), strings.NewReader("EICAR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Infected {
+		t.Errorf("Scan = %+v, want infected", got)
+	}
+}
+
+func TestClamdUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	if _, err := NewClamd(addr).Scan(context.Background(), strings.NewReader("data")); err == nil {
+		t.Error("Scan without a daemon succeeded")
+	}
+}
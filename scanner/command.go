@@ -0,0 +1,62 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Command scans by running an external program with the content on its
+// standard input, following the clamscan convention: exit status 0 means clean
+// and 1 infected, with the first line of output naming what was found. Any other
+// status is an error.
+type Command struct {
+	Path string
+	Args []string
+}
+
+// NewCommand returns a driver running the command line cmd, split on spaces,
+// e.g. "clamscan --no-summary -".
+func NewCommand(cmd string) *Command {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return &Command{}
+	}
+	return &Command{Path: fields[0], Args: fields[1:]}
+}
+
+func (c *Command) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	if c.Path == "" {
+		return Result{}, errors.New("scanner: no command configured")
+	}
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	cmd.Stdin = r
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return Result{}, nil
+	case errors.As(err, &exit) && exit.ExitCode() == 1:
+		signature, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\n")
+		// clamscan prints "stdin: <signature> FOUND"
+		signature = strings.TrimSuffix(strings.TrimPrefix(signature, "stdin: "), " FOUND")
+		if signature == "" {
+			signature = "infected"
+		}
+		return Result{Infected: true, Signature: signature}, nil
+	default:
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return Result{}, fmt.Errorf("scanner: %s: %s", c.Path, msg)
+	}
+}
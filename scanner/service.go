@@ -0,0 +1,168 @@
+// Package scanner checks uploaded content for malware in the background. Files
+// are held back from downloads while their scan is pending; infected blobs are
+// moved to a quarantine directory and their owners notified.
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud-storage/blobcrypt"
+	"cloud-storage/chunkstore"
+	"cloud-storage/events"
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+
+	"gorm.io/gorm"
+)
+
+const jobType = "scan"
+
+// Result is the verdict on some content.
+type Result struct {
+	Infected  bool
+	Signature string // what was found, when infected
+}
+
+// Scanner inspects content read from r.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// Service scans every uploaded file with Scanner and records the outcome on
+// all the file records sharing its blob.
+type Service struct {
+	DB      *gorm.DB
+	Scanner Scanner
+	Open    func(file *models.File) (io.ReadCloser, error)
+	// Keys decrypts blobs encrypted at rest
+	Keys *blobcrypt.Keyring
+	// Infected blobs are moved into this directory
+	QuarantineDir string
+
+	bus *events.Bus
+}
+
+func NewService(db *gorm.DB, scanner Scanner, quarantineDir string) *Service {
+	s := &Service{DB: db, Scanner: scanner, QuarantineDir: quarantineDir}
+	s.Open = func(file *models.File) (io.ReadCloser, error) { return chunkstore.OpenFile(file.Path, s.Keys) }
+	return s
+}
+
+// Start marks every uploaded file pending and queues its scan. Copies that
+// arrive already scanned keep their outcome.
+func (s *Service) Start(bus *events.Bus, queue *jobs.Queue) {
+	s.bus = bus
+	queue.Register(jobType, s.runJob)
+	bus.Subscribe(func(e events.Event) {
+		if e.Type != events.FileUploaded || e.FileID == nil {
+			return
+		}
+		res := s.DB.Model(&models.File{}).Where("id = ? AND scan_status IN ?", *e.FileID, []string{"", models.ScanPending}).
+			Updates(map[string]interface{}{"scan_status": models.ScanPending, "scan_result": "", "scanned_at": nil})
+		err := res.Error
+		if err == nil && res.RowsAffected > 0 {
+			_, err = queue.Enqueue(e.UserID, jobType, scanJob{FileID: *e.FileID}, jobs.Options{MaxAttempts: 3})
+		}
+		if err != nil {
+			log.Printf("scanner: file %d: failed to queue: %v", *e.FileID, err)
+		}
+	})
+}
+
+type scanJob struct {
+	FileID uint `json:"file_id"`
+}
+
+type scanResult struct {
+	Status    string `json:"status"`
+	Signature string `json:"signature,omitempty"`
+	Files     int64  `json:"files"`
+}
+
+func (s *Service) runJob(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	var payload scanJob
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	var file models.File
+	if err := s.DB.First(&file, payload.FileID).Error; err != nil || file.ScanStatus != models.ScanPending {
+		// Deleted, or settled with another file sharing the blob
+		return nil, nil
+	}
+
+	// Copies and repeated uploads share a blob that may be scanned already
+	var scanned models.File
+	if err := s.DB.Where("path = ? AND scan_status = ?", file.Path, models.ScanClean).First(&scanned).Error; err == nil {
+		return s.settle(&file, models.ScanClean, "")
+	}
+
+	content, err := s.Open(&file)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.Scanner.Scan(ctx, content)
+	content.Close()
+	if err != nil {
+		if job.Attempts >= job.MaxAttempts {
+			s.settle(&file, models.ScanFailed, err.Error())
+		}
+		return nil, err
+	}
+	if result.Infected {
+		return s.quarantine(&file, result.Signature)
+	}
+	return s.settle(&file, models.ScanClean, "")
+}
+
+// settle records the outcome on the pending files sharing file's blob.
+func (s *Service) settle(file *models.File, status, detail string) (*scanResult, error) {
+	res := s.DB.Model(&models.File{}).Where("path = ? AND scan_status = ?", file.Path, models.ScanPending).
+		Updates(map[string]interface{}{"scan_status": status, "scan_result": detail, "scanned_at": time.Now()})
+	return &scanResult{Status: status, Files: res.RowsAffected}, res.Error
+}
+
+// quarantine marks every file sharing file's blob infected, moves the blob
+// aside and notifies the owners. Chunk manifests stay in place, as their chunks
+// may be shared with clean files, and are only blocked.
+func (s *Service) quarantine(file *models.File, signature string) (*scanResult, error) {
+	var infected []models.File
+	if err := s.DB.Where("path = ?", file.Path).Find(&infected).Error; err != nil {
+		return nil, err
+	}
+
+	updates := map[string]interface{}{"scan_status": models.ScanInfected, "scan_result": signature, "scanned_at": time.Now()}
+	if !strings.HasSuffix(file.Path, chunkstore.Ext) {
+		// Blobs keep their name below a directory per user directory
+		dst := filepath.Join(s.QuarantineDir, filepath.Base(filepath.Dir(file.Path)), filepath.Base(file.Path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(file.Path, dst); err != nil {
+			return nil, err
+		}
+		updates["path"] = dst
+	}
+	if err := s.DB.Model(&models.File{}).Where("path = ?", file.Path).Updates(updates).Error; err != nil {
+		if dst, ok := updates["path"].(string); ok {
+			os.Rename(dst, file.Path)
+		}
+		return nil, err
+	}
+
+	for _, f := range infected {
+		s.bus.Publish(events.Event{
+			Type:   events.FileInfected,
+			UserID: f.UserID,
+			FileID: &f.ID,
+			Data:   map[string]interface{}{"name": f.Name, "signature": signature},
+		})
+	}
+	return &scanResult{Status: models.ScanInfected, Signature: signature, Files: int64(len(infected))}, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"cloud-storage/models"
+	"cloud-storage/scrub"
+)
+
+// runScrub implements the scrub subcommand, checking storage while the server
+// may keep running. It exits with status 1 when problems were found.
+func runScrub(dbName string, args []string) {
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	var opts scrub.Options
+	flags.BoolVar(&opts.Quarantine, "quarantine", false, "move corrupt blobs and orphans to storage/quarantine")
+	flags.BoolVar(&opts.DeleteOrphans, "delete-orphans", false, "delete orphan files instead of quarantining them")
+	flags.BoolVar(&opts.MarkCorrupt, "mark-corrupt", false, "flag files whose blob is missing or corrupt")
+	asJSON := flags.Bool("json", false, "print the full report as JSON")
+	flags.Parse(args)
+
+	db, err := openDB(dbName)
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+	db.AutoMigrate(&models.File{})
+
+	scrubber := scrub.NewScrubber(db, "storage")
+	if scrubber.Keys, err = loadKeys(); err != nil {
+		log.Fatal("Failed to load master keys:", err)
+	}
+	total, err := scrubber.Count()
+	if err != nil {
+		log.Fatal("Failed to count blobs:", err)
+	}
+
+	// Ctrl-C stops the scrub and still prints what was found
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := scrubber.Run(ctx, opts, func(done int) {
+		if !*asJSON && (done%100 == 0 || done == total) {
+			fmt.Fprintf(os.Stderr, "\rChecked %d of %d blobs", done, total)
+		}
+	})
+	if err != nil {
+		log.Fatal("Scrub failed:", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		fmt.Fprintln(os.Stderr)
+		for _, issue := range report.Issues {
+			line := fmt.Sprintf("%-10s %s", issue.Problem, issue.Path)
+			if len(issue.FileIDs) > 0 {
+				line += fmt.Sprintf(" files=%v", issue.FileIDs)
+			}
+			if issue.Action != "" {
+				line += " (" + issue.Action + ")"
+			}
+			if issue.Error != "" {
+				line += ": " + issue.Error
+			}
+			fmt.Println(line)
+		}
+		fmt.Printf("%d blobs, %d healthy (%d bytes), %d missing, %d mismatched, %d unreadable, %d orphans\n",
+			report.Blobs, report.Healthy, report.Bytes, report.Counts[scrub.Missing], report.Counts[scrub.Mismatch],
+			report.Counts[scrub.Unreadable], report.Counts[scrub.Orphan])
+		if report.Interrupted {
+			fmt.Println("Interrupted before every blob was checked")
+		}
+	}
+
+	if len(report.Issues) > 0 || report.Truncated {
+		os.Exit(1)
+	}
+}
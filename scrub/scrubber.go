@@ -0,0 +1,321 @@
+package scrub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud-storage/blobcompress"
+	"cloud-storage/blobcrypt"
+	"cloud-storage/chunkstore"
+	"cloud-storage/models"
+
+	"gorm.io/gorm"
+)
+
+// Problems found by a scrub.
+const (
+	Missing    = "missing"    // the blob of a file record is gone
+	Mismatch   = "mismatch"   // the blob's content no longer matches its hash or size
+	Unreadable = "unreadable" // the blob could not be read
+	Orphan     = "orphan"     // a file on disk no record refers to
+)
+
+const (
+	// Files this young may belong to an upload still in progress
+	orphanGrace = time.Hour
+	// The report lists at most this many issues, the counts cover all of them
+	maxIssues = 10000
+)
+
+// Options choose the repairs to make. Without any the scrub only reports.
+type Options struct {
+	// Quarantine moves corrupt blobs and orphans under the quarantine directory
+	Quarantine bool `json:"quarantine"`
+	// DeleteOrphans removes orphans instead of quarantining them
+	DeleteOrphans bool `json:"delete_orphans"`
+	// MarkCorrupt flags the records of missing and corrupt blobs, and clears the
+	// flag on records whose blob is healthy again
+	MarkCorrupt bool `json:"mark_corrupt"`
+}
+
+// Issue is one problem with a blob.
+type Issue struct {
+	Problem  string `json:"problem"`
+	Path     string `json:"path"`
+	FileIDs  []uint `json:"file_ids,omitempty"`
+	Expected string `json:"expected_hash,omitempty"`
+	Actual   string `json:"actual_hash,omitempty"`
+	Size     int64  `json:"size"`
+	Action   string `json:"action,omitempty"` // quarantined, deleted or marked corrupt
+	Error    string `json:"error,omitempty"`
+}
+
+// Report summarises a scrub.
+type Report struct {
+	Options      Options        `json:"options"`
+	StartedAt    time.Time      `json:"started_at"`
+	FinishedAt   time.Time      `json:"finished_at"`
+	Blobs        int            `json:"blobs"`
+	Bytes        int64          `json:"bytes"`
+	Healthy      int            `json:"healthy"`
+	Counts       map[string]int `json:"counts"`
+	Issues       []Issue        `json:"issues"`
+	Truncated    bool           `json:"truncated,omitempty"`
+	Quarantine   string         `json:"quarantine,omitempty"`
+	Interrupted  bool           `json:"interrupted,omitempty"`
+	MarkedFiles  int64          `json:"marked_files,omitempty"`
+	ClearedFiles int64          `json:"cleared_files,omitempty"`
+}
+
+func (r *Report) add(issue Issue) {
+	r.Counts[issue.Problem]++
+	if len(r.Issues) < maxIssues {
+		r.Issues = append(r.Issues, issue)
+	} else {
+		r.Truncated = true
+	}
+}
+
+// Scrubber re-hashes every blob referenced by a file record and looks for files
+// under Root that nothing refers to.
+type Scrubber struct {
+	DB   *gorm.DB
+	Root string
+	// Quarantined files go to a timestamped directory below this one
+	QuarantineDir string
+	// Keys decrypts blobs encrypted at rest
+	Keys *blobcrypt.Keyring
+}
+
+func NewScrubber(db *gorm.DB, root string) *Scrubber {
+	return &Scrubber{DB: db, Root: root, QuarantineDir: filepath.Join(root, "quarantine")}
+}
+
+// blobRef is a blob path with the records that use it; copies share blobs.
+type blobRef struct {
+	Hash    string
+	Size    int64
+	FileIDs []uint
+}
+
+// Count returns the number of blobs a scrub will check.
+func (s *Scrubber) Count() (int, error) {
+	var n int64
+	err := s.DB.Model(&models.File{}).Where("is_dir = ? AND path <> ''", false).Distinct("path").Count(&n).Error
+	return int(n), err
+}
+
+// Run checks all blobs, then looks for orphans, calling progress after each blob.
+// A cancelled ctx stops the scrub early with what was found so far.
+func (s *Scrubber) Run(ctx context.Context, opts Options, progress func(done int)) (*Report, error) {
+	report := &Report{Options: opts, StartedAt: time.Now(), Counts: map[string]int{}, Issues: []Issue{}}
+	if opts.Quarantine {
+		report.Quarantine = filepath.Join(s.QuarantineDir, report.StartedAt.UTC().Format("20060102-150405"))
+	}
+
+	var files []models.File
+	if err := s.DB.Select("id, path, hash, size").Where("is_dir = ? AND path <> ''", false).Order("path").Find(&files).Error; err != nil {
+		return nil, err
+	}
+	blobs := make(map[string]*blobRef)
+	var paths []string
+	for _, f := range files {
+		ref, ok := blobs[f.Path]
+		if !ok {
+			ref = &blobRef{Hash: f.Hash, Size: f.Size}
+			blobs[f.Path] = ref
+			paths = append(paths, f.Path)
+		}
+		ref.FileIDs = append(ref.FileIDs, f.ID)
+	}
+
+	var corrupt, healthy []uint
+	for i, path := range paths {
+		if ctx.Err() != nil {
+			report.Interrupted = true
+			break
+		}
+		ref := blobs[path]
+		issue := s.check(path, ref)
+		report.Blobs++
+		if issue == nil {
+			report.Healthy++
+			report.Bytes += ref.Size
+			healthy = append(healthy, ref.FileIDs...)
+		} else {
+			if issue.Problem != Missing && opts.Quarantine {
+				s.quarantine(report, issue)
+			}
+			if opts.MarkCorrupt && issue.Action == "" {
+				issue.Action = "marked corrupt"
+			}
+			corrupt = append(corrupt, ref.FileIDs...)
+			report.add(*issue)
+		}
+		progress(i + 1)
+	}
+
+	if !report.Interrupted {
+		if err := s.findOrphans(ctx, report, blobs); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MarkCorrupt {
+		var err error
+		if report.MarkedFiles, err = s.setCorrupt(corrupt, true); err != nil {
+			return nil, err
+		}
+		if report.ClearedFiles, err = s.setCorrupt(healthy, false); err != nil {
+			return nil, err
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// check re-hashes one blob, returning nil when it is healthy.
+func (s *Scrubber) check(path string, ref *blobRef) *Issue {
+	issue := &Issue{Path: path, FileIDs: ref.FileIDs, Expected: ref.Hash, Size: ref.Size}
+
+	f, err := chunkstore.OpenFile(path, s.Keys)
+	if os.IsNotExist(err) {
+		issue.Problem = Missing
+		return issue
+	}
+	if err == blobcrypt.ErrCorrupt || err == blobcompress.ErrCorrupt || err == chunkstore.ErrCorrupt {
+		issue.Problem = Mismatch
+		issue.Error = err.Error()
+		return issue
+	}
+	if err != nil {
+		issue.Problem = Unreadable
+		issue.Error = err.Error()
+		return issue
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err == blobcrypt.ErrCorrupt || err == blobcompress.ErrCorrupt {
+		issue.Problem = Mismatch
+		issue.Error = err.Error()
+		return issue
+	}
+	if err != nil {
+		issue.Problem = Unreadable
+		issue.Error = err.Error()
+		return issue
+	}
+	issue.Actual = hex.EncodeToString(hash.Sum(nil))
+	if issue.Actual != ref.Hash || size != ref.Size {
+		issue.Problem = Mismatch
+		issue.Size = size
+		return issue
+	}
+	return nil
+}
+
+// findOrphans walks the user directories for files neither a record nor a
+// chunk refers to, including temporary files left behind by interrupted uploads.
+func (s *Scrubber) findOrphans(ctx context.Context, report *Report, blobs map[string]*blobRef) error {
+	entries, err := os.ReadDir(s.Root)
+	if err != nil {
+		return err
+	}
+	var chunkPaths []string
+	if err := s.DB.Model(&models.Chunk{}).Pluck("path", &chunkPaths).Error; err != nil {
+		return err
+	}
+	chunks := make(map[string]bool, len(chunkPaths))
+	for _, path := range chunkPaths {
+		chunks[path] = true
+	}
+
+	for _, entry := range entries {
+		// Only the numbered per-user directories hold blobs
+		if _, err := strconv.ParseUint(entry.Name(), 10, 64); err != nil || !entry.IsDir() {
+			continue
+		}
+		err := filepath.WalkDir(filepath.Join(s.Root, entry.Name()), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				report.Interrupted = true
+				return filepath.SkipAll
+			}
+			// Uploads in progress are collected by the multipart GC
+			if d.IsDir() && d.Name() == ".staging" {
+				return filepath.SkipDir
+			}
+			if d.IsDir() || blobs[path] != nil || chunks[path] {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || time.Since(info.ModTime()) < orphanGrace {
+				return nil
+			}
+
+			issue := Issue{Problem: Orphan, Path: path, Size: info.Size()}
+			switch {
+			case report.Options.DeleteOrphans:
+				if err := os.Remove(path); err != nil {
+					issue.Error = err.Error()
+				} else {
+					issue.Action = "deleted"
+				}
+			case report.Options.Quarantine:
+				s.quarantine(report, &issue)
+			}
+			report.add(issue)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quarantine moves the blob of issue aside, keeping its path below the root.
+func (s *Scrubber) quarantine(report *Report, issue *Issue) {
+	rel, err := filepath.Rel(s.Root, issue.Path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(issue.Path)
+	}
+	dst := filepath.Join(report.Quarantine, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		issue.Error = err.Error()
+		return
+	}
+	if err := os.Rename(issue.Path, dst); err != nil {
+		issue.Error = err.Error()
+		return
+	}
+	issue.Action = "quarantined"
+}
+
+func (s *Scrubber) setCorrupt(ids []uint, corrupt bool) (int64, error) {
+	var changed int64
+	// Stay below SQLite's limit on bound parameters
+	for len(ids) > 0 {
+		n := min(len(ids), 500)
+		res := s.DB.Model(&models.File{}).Where("id IN ? AND corrupt = ?", ids[:n], !corrupt).Update("corrupt", corrupt)
+		if res.Error != nil {
+			return changed, res.Error
+		}
+		changed += res.RowsAffected
+		ids = ids[n:]
+	}
+	return changed, nil
+}
@@ -0,0 +1,321 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud-storage/models"
+
+	"gorm.io/gorm"
+)
+
+// compiler turns filters into SQL conditions on the files table for one user.
+type compiler struct {
+	db     *gorm.DB
+	userID uint
+}
+
+// filterFunc returns a SQL condition and its arguments, or an error message that
+// is reported at the filter's position.
+type filterFunc func(c *compiler, f Filter) (string, []interface{}, error)
+
+// Filters maps each field name to its compiler. Fields are matched case-insensitively.
+var Filters = map[string]filterFunc{
+	"type":     typeFilter,
+	"size":     sizeFilter,
+	"modified": modifiedFilter,
+	"in":       inFilter,
+	"name":     nameFilter,
+	"ext":      extFilter,
+	"tag":      tagFilter,
+	"color":    colorFilter,
+	"is":       isFilter,
+}
+
+func knownField(field string) bool {
+	if strings.HasPrefix(field, "meta.") {
+		return true
+	}
+	_, ok := Filters[field]
+	return ok
+}
+
+func (c *compiler) compile(f Filter) (string, []interface{}, error) {
+	fn := Filters[f.Field]
+	if strings.HasPrefix(f.Field, "meta.") {
+		fn = metaFilter
+	}
+
+	sql, args, err := fn(c, f)
+	if err != nil {
+		return "", nil, &ParseError{Pos: f.Pos, Msg: err.Error()}
+	}
+	if f.Negate {
+		// Missing values count as not matching, so excluding keeps those files
+		sql = "NOT COALESCE((" + sql + "), 0)"
+	}
+	return sql, args, nil
+}
+
+func onlyEquals(f Filter) error {
+	if f.Op != "=" {
+		return fmt.Errorf("%s does not support %s", f.Field, f.Op)
+	}
+	return nil
+}
+
+// typeCategories maps type: names to MIME type patterns.
+var typeCategories = map[string][]string{
+	"image":    {"image/%"},
+	"video":    {"video/%"},
+	"audio":    {"audio/%"},
+	"text":     {"text/%"},
+	"pdf":      {"application/pdf%"},
+	"document": {"application/pdf%", "text/%", "application/msword%", "application/vnd.openxmlformats-officedocument.%", "application/vnd.oasis.opendocument.%", "application/rtf%"},
+	"archive":  {"application/zip%", "application/x-tar%", "application/gzip%", "application/x-7z-compressed%", "application/x-rar-compressed%", "application/x-bzip2%", "application/x-xz%"},
+}
+
+func typeFilter(c *compiler, f Filter) (string, []interface{}, error) {
+	if err := onlyEquals(f); err != nil {
+		return "", nil, err
+	}
+
+	value := strings.ToLower(f.Value)
+	switch value {
+	case "folder":
+		return "files.is_dir = ?", []interface{}{true}, nil
+	case "file":
+		return "files.is_dir = ?", []interface{}{false}, nil
+	}
+
+	patterns, ok := typeCategories[value]
+	if !ok {
+		if !strings.Contains(value, "/") {
+			return "", nil, fmt.Errorf("unknown type %q", f.Value)
+		}
+		// A MIME type, optionally with a * wildcard such as image/*
+		patterns = []string{likePattern(value, false) + "%"}
+	}
+
+	conds := make([]string, len(patterns))
+	args := make([]interface{}, len(patterns))
+	for i, p := range patterns {
+		conds[i] = `files.mime_type LIKE ? ESCAPE '\'`
+		args[i] = p
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args, nil
+}
+
+var sizeUnits = map[string]float64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+	"t":  1 << 40,
+	"tb": 1 << 40,
+}
+
+var sizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-zA-Z]*)$`)
+
+func sizeFilter(c *compiler, f Filter) (string, []interface{}, error) {
+	m := sizePattern.FindStringSubmatch(f.Value)
+	if m == nil {
+		return "", nil, fmt.Errorf("invalid size %q", f.Value)
+	}
+	unit, ok := sizeUnits[strings.ToLower(m[2])]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown size unit %q", m[2])
+	}
+	n, _ := strconv.ParseFloat(m[1], 64)
+	return "files.size " + f.Op + " ?", []interface{}{int64(n * unit)}, nil
+}
+
+var relativeUnits = map[byte]time.Duration{
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parsePeriod reads an absolute date (2006-01-02, 2006-01 or 2006) as the period
+// it covers, or a relative age such as 7d as the instant that long ago.
+func parsePeriod(value string) (time.Time, time.Time, error) {
+	if n := len(value); n > 1 {
+		if unit, ok := relativeUnits[value[n-1]]; ok {
+			if count, err := strconv.Atoi(value[:n-1]); err == nil {
+				t := time.Now().Add(-time.Duration(count) * unit)
+				return t, t, nil
+			}
+		}
+	}
+
+	for _, layout := range []struct {
+		format string
+		next   func(time.Time) time.Time
+	}{
+		{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+		{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+		{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+	} {
+		if t, err := time.ParseInLocation(layout.format, value, time.Local); err == nil {
+			return t, layout.next(t), nil
+		}
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD or an age such as 7d", value)
+}
+
+func modifiedFilter(c *compiler, f Filter) (string, []interface{}, error) {
+	start, end, err := parsePeriod(f.Value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch f.Op {
+	case "<":
+		return "files.last_modified < ?", []interface{}{start}, nil
+	case "<=":
+		return "files.last_modified < ?", []interface{}{end}, nil
+	case ">":
+		return "files.last_modified >= ?", []interface{}{end}, nil
+	case ">=":
+		return "files.last_modified >= ?", []interface{}{start}, nil
+	}
+	if start.Equal(end) {
+		return "", nil, errors.New("modified: with an age needs < or >")
+	}
+	return "files.last_modified >= ? AND files.last_modified < ?", []interface{}{start, end}, nil
+}
+
+// inFilter matches everything below a folder, at any depth.
+func inFilter(c *compiler, f Filter) (string, []interface{}, error) {
+	if err := onlyEquals(f); err != nil {
+		return "", nil, err
+	}
+
+	var parentID *uint
+	for _, name := range strings.Split(strings.Trim(f.Value, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		var folder models.File
+		q := c.db.Where("user_id = ? AND name = ? AND is_dir = ?", c.userID, name, true)
+		if parentID == nil {
+			q = q.Where("parent_id IS NULL")
+		} else {
+			q = q.Where("parent_id = ?", *parentID)
+		}
+		if err := q.First(&folder).Error; err != nil {
+			return "", nil, fmt.Errorf("folder %q not found", f.Value)
+		}
+		parentID = &folder.ID
+	}
+
+	if parentID == nil {
+		return "1 = 1", nil, nil
+	}
+	return `files.id IN (WITH RECURSIVE tree(id) AS (
+			SELECT id FROM files WHERE parent_id = ? AND deleted_at IS NULL
+			UNION ALL
+			SELECT files.id FROM files JOIN tree ON files.parent_id = tree.id WHERE files.deleted_at IS NULL
+		) SELECT id FROM tree)`, []interface{}{*parentID}, nil
+}
+
+func nameFilter(c *compiler, f Filter) (string, []interface{}, error) {
+	if err := onlyEquals(f); err != nil {
+		return "", nil, err
+	}
+	// Without wildcards the name only has to contain the value
+	pattern := likePattern(f.Value, true)
+	if !strings.ContainsAny(f.Value, "*?") {
+		pattern = "%" + pattern + "%"
+	}
+	return `files.name LIKE ? ESCAPE '\'`, []interface{}{pattern}, nil
+}
+
+func extFilter(c *compiler, f Filter) (string, []interface{}, error) {
+	if err := onlyEquals(f); err != nil {
+		return "", nil, err
+	}
+	return `files.name LIKE ? ESCAPE '\'`, []interface{}{"%." + likePattern(strings.TrimPrefix(f.Value, "."), false)}, nil
+}
+
+func tagFilter(c *compiler, f Filter) (string, []interface{}, error) {
+	if err := onlyEquals(f); err != nil {
+		return "", nil, err
+	}
+	return `files.id IN (SELECT file_tags.file_id FROM file_tags
+			JOIN tags ON tags.id = file_tags.tag_id
+			WHERE tags.user_id = ? AND tags.name LIKE ? ESCAPE '\')`, []interface{}{c.userID, likePattern(f.Value, true)}, nil
+}
+
+func colorFilter(c *compiler, f Filter) (string, []interface{}, error) {
+	if err := onlyEquals(f); err != nil {
+		return "", nil, err
+	}
+	value := strings.ToLower(f.Value)
+	if value == "none" {
+		value = ""
+	}
+	if !models.ValidColor(value) {
+		return "", nil, fmt.Errorf("unknown color %q", f.Value)
+	}
+	return "files.color = ?", []interface{}{value}, nil
+}
+
+// isFilter matches flags: is:starred.
+func isFilter(c *compiler, f Filter) (string, []interface{}, error) {
+	if err := onlyEquals(f); err != nil {
+		return "", nil, err
+	}
+	if strings.ToLower(f.Value) != "starred" {
+		return "", nil, fmt.Errorf("unknown flag %q, use is:starred", f.Value)
+	}
+	return "files.starred = ?", []interface{}{true}, nil
+}
+
+var metaKey = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// metaFilter compares an extracted metadata property, e.g. meta.camera_make:canon
+// or meta.width:>=1920. Numbers compare numerically and text case-insensitively.
+func metaFilter(c *compiler, f Filter) (string, []interface{}, error) {
+	key := strings.TrimPrefix(f.Field, "meta.")
+	if !metaKey.MatchString(key) {
+		return "", nil, fmt.Errorf("invalid metadata key %q", key)
+	}
+	column := "json_extract(files.metadata, '$." + key + "')"
+
+	if n, err := strconv.ParseFloat(f.Value, 64); err == nil {
+		return column + " " + f.Op + " ?", []interface{}{n}, nil
+	}
+	if err := onlyEquals(f); err != nil {
+		return "", nil, err
+	}
+	return column + ` LIKE ? ESCAPE '\'`, []interface{}{likePattern(f.Value, true)}, nil
+}
+
+// likePattern escapes LIKE metacharacters and turns * into a wildcard, and ? too
+// when glob is set.
+func likePattern(value string, glob bool) string {
+	var sb strings.Builder
+	for _, r := range value {
+		switch {
+		case r == '%' || r == '_' || r == '\\':
+			sb.WriteRune('\\')
+			sb.WriteRune(r)
+		case r == '*':
+			sb.WriteRune('%')
+		case r == '?' && glob:
+			sb.WriteRune('_')
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,304 @@
+package search
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"cloud-storage/events"
+	"cloud-storage/metadata"
+	"cloud-storage/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	queueSize = 1024
+
+	// Markers placed around matched terms in highlights and snippets
+	MarkStart = "<mark>"
+	MarkEnd   = "</mark>"
+)
+
+var ErrEmptyQuery = errors.New("empty search query")
+
+// Index keeps an SQLite FTS5 table of file names, paths, tags and extracted text
+// in step with the drive. The FTS5 rowid is the file ID.
+type Index struct {
+	DB   *gorm.DB
+	Open func(file *models.File) (io.ReadCloser, error)
+
+	// fts is false when SQLite lacks FTS5; words then only match file names
+	fts   bool
+	queue chan events.Event
+}
+
+// NewIndex creates the index table. go-sqlite3 only includes FTS5 with the
+// sqlite_fts5 build tag; without it searches fall back to matching names.
+func NewIndex(db *gorm.DB) *Index {
+	ix := &Index{
+		DB:    db,
+		Open:  func(file *models.File) (io.ReadCloser, error) { return os.Open(file.Path) },
+		queue: make(chan events.Event, queueSize),
+	}
+
+	err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS file_search USING fts5(
+		name, path, tags, content, user_id UNINDEXED,
+		tokenize = 'unicode61 remove_diacritics 2',
+		prefix = '2 3'
+	)`).Error
+	if err == nil {
+		// The table may exist from a build with FTS5 while this one lacks it
+		err = db.Exec("SELECT rowid FROM file_search LIMIT 0").Error
+	}
+	if err != nil {
+		log.Println("search: full-text index unavailable, matching names only (build with -tags sqlite_fts5):", err)
+		return ix
+	}
+	ix.fts = true
+	return ix
+}
+
+// Start follows file events and indexes anything added while the server was down.
+func (ix *Index) Start(bus *events.Bus) {
+	if !ix.fts {
+		return
+	}
+
+	bus.Subscribe(func(e events.Event) {
+		switch e.Type {
+		case events.FileUploaded, events.FileUpdated, events.FileDeleted, events.FileMoved, events.FolderCreated:
+		default:
+			return
+		}
+		if e.FileID == nil {
+			return
+		}
+		select {
+		case ix.queue <- e:
+		default:
+			log.Printf("search: queue full, file %d will be indexed on restart", *e.FileID)
+		}
+	})
+
+	go func() {
+		ix.backfill()
+		for e := range ix.queue {
+			var err error
+			switch e.Type {
+			case events.FileDeleted:
+				err = ix.Remove(*e.FileID)
+			case events.FileMoved:
+				err = ix.UpdateTree(*e.FileID)
+			default:
+				err = ix.Update(*e.FileID)
+			}
+			if err != nil {
+				log.Printf("search: file %d: %v", *e.FileID, err)
+			}
+		}
+	}()
+}
+
+// backfill indexes files missing from the index and drops entries for deleted files.
+func (ix *Index) backfill() {
+	var missing []uint
+	err := ix.DB.Model(&models.File{}).
+		Where("id NOT IN (SELECT rowid FROM file_search)").
+		Pluck("id", &missing).Error
+	if err != nil {
+		log.Println("search: backfill failed:", err)
+		return
+	}
+	for _, id := range missing {
+		if err := ix.Update(id); err != nil {
+			log.Printf("search: file %d: %v", id, err)
+		}
+	}
+
+	err = ix.DB.Exec("DELETE FROM file_search WHERE rowid NOT IN (SELECT id FROM files WHERE deleted_at IS NULL)").Error
+	if err != nil {
+		log.Println("search: backfill failed:", err)
+	}
+}
+
+// Update (re)indexes a single file or folder.
+func (ix *Index) Update(fileID uint) error {
+	var file models.File
+	if err := ix.DB.First(&file, fileID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ix.Remove(fileID)
+		}
+		return err
+	}
+
+	filePath, err := ix.drivePath(&file)
+	if err != nil {
+		return err
+	}
+
+	var tags []string
+	if err := ix.DB.Model(&models.Tag{}).
+		Joins("JOIN file_tags ON file_tags.tag_id = tags.id").
+		Where("file_tags.file_id = ?", file.ID).
+		Pluck("name", &tags).Error; err != nil {
+		return err
+	}
+
+	content := ""
+	if !file.IsDir && metadata.HasText(file.MimeType) {
+		if r, err := ix.Open(&file); err == nil {
+			content = metadata.ExtractText(r, file.MimeType)
+			r.Close()
+		}
+	}
+
+	return ix.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM file_search WHERE rowid = ?", file.ID).Error; err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO file_search (rowid, name, path, tags, content, user_id) VALUES (?, ?, ?, ?, ?, ?)",
+			file.ID, file.Name, filePath, strings.Join(tags, " "), content, file.UserID).Error
+	})
+}
+
+// UpdateTree reindexes a folder and everything below it, whose paths change with it.
+func (ix *Index) UpdateTree(fileID uint) error {
+	if err := ix.Update(fileID); err != nil {
+		return err
+	}
+
+	var children []uint
+	if err := ix.DB.Model(&models.File{}).Where("parent_id = ?", fileID).Pluck("id", &children).Error; err != nil {
+		return err
+	}
+	for _, id := range children {
+		if err := ix.UpdateTree(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ix *Index) Remove(fileID uint) error {
+	return ix.DB.Exec("DELETE FROM file_search WHERE rowid = ?", fileID).Error
+}
+
+// drivePath builds the slash-separated path of a file from its parent folders.
+func (ix *Index) drivePath(file *models.File) (string, error) {
+	names := []string{file.Name}
+	for id := file.ParentID; id != nil; {
+		var parent models.File
+		if err := ix.DB.Select("id", "name", "parent_id").First(&parent, *id).Error; err != nil {
+			return "", err
+		}
+		names = append([]string{parent.Name}, names...)
+		id = parent.ParentID
+	}
+	return path.Join(append([]string{"/"}, names...)...), nil
+}
+
+// Result is one search hit. Highlight is the file name and Snippet a fragment of
+// the best matching column, both with matches wrapped in MarkStart and MarkEnd.
+type Result struct {
+	File      models.File `json:"file"`
+	Highlight string      `json:"highlight"`
+	Snippet   string      `json:"snippet"`
+	Score     float64     `json:"score"`
+}
+
+type hit struct {
+	FileID    uint
+	Highlight string
+	Snippet   string
+	Rank      float64
+}
+
+// Search returns a user's files matching query, best first. See Parse for the
+// syntax; malformed queries return a *ParseError.
+func (ix *Index) Search(userID uint, query string, limit, offset int) ([]Result, error) {
+	q, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &compiler{db: ix.DB, userID: userID}
+	var conds []string
+	var args []interface{}
+	for _, f := range q.Filters {
+		sql, filterArgs, err := c.compile(f)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, sql)
+		args = append(args, filterArgs...)
+	}
+
+	match, err := q.ftsExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	var hits []hit
+	if match != "" && ix.fts {
+		// Matches in the name weigh most, then tags, then the path and the content
+		db := ix.DB.Table("file_search").
+			Select(`file_search.rowid AS file_id,
+				highlight(file_search, 0, ?, ?) AS highlight,
+				snippet(file_search, -1, ?, ?, '…', 16) AS snippet,
+				bm25(file_search, 10.0, 4.0, 6.0, 1.0) AS rank`, MarkStart, MarkEnd, MarkStart, MarkEnd).
+			Joins("JOIN files ON files.id = file_search.rowid").
+			Where("file_search MATCH ? AND files.user_id = ? AND files.deleted_at IS NULL", match, userID).
+			Order("rank")
+		err = applyConditions(db, conds, args).Limit(limit).Offset(offset).Scan(&hits).Error
+	} else {
+		db := ix.DB.Table("files").
+			Select("files.id AS file_id, files.name AS highlight").
+			Where("files.user_id = ? AND files.deleted_at IS NULL", userID).
+			Order("files.last_modified DESC")
+		for _, t := range q.Terms {
+			cond := `files.name LIKE ? ESCAPE '\'`
+			if t.Negate {
+				cond = "NOT (" + cond + ")"
+			}
+			db = db.Where(cond, "%"+likePattern(t.Text, false)+"%")
+		}
+		err = applyConditions(db, conds, args).Limit(limit).Offset(offset).Scan(&hits).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, len(hits))
+	for i, h := range hits {
+		ids[i] = h.FileID
+	}
+	var files []models.File
+	if err := ix.DB.Preload("Tags").Where("id IN ? AND user_id = ?", ids, userID).Find(&files).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]models.File, len(files))
+	for _, f := range files {
+		byID[f.ID] = f
+	}
+
+	results := make([]Result, 0, len(hits))
+	for _, h := range hits {
+		file, ok := byID[h.FileID]
+		if !ok {
+			continue
+		}
+		results = append(results, Result{File: file, Highlight: h.Highlight, Snippet: h.Snippet, Score: -h.Rank})
+	}
+	return results, nil
+}
+
+func applyConditions(db *gorm.DB, conds []string, args []interface{}) *gorm.DB {
+	if len(conds) == 0 {
+		return db
+	}
+	return db.Where(strings.Join(conds, " AND "), args...)
+}
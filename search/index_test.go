@@ -0,0 +1,117 @@
+package search
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-storage/models"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestIndex returns an index on a fresh database whose files read as the
+// contents map holds them, by name.
+func newTestIndex(t *testing.T, contents map[string]string) *Index {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.User{}, &models.File{}, &models.Tag{}); err != nil {
+		t.Fatal(err)
+	}
+	ix := NewIndex(db)
+	ix.Open = func(file *models.File) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(contents[file.Name])), nil
+	}
+	return ix
+}
+
+// addFile creates a file and indexes it.
+func addFile(t *testing.T, ix *Index, file models.File) *models.File {
+	t.Helper()
+	if file.UserID == 0 {
+		file.UserID = 1
+	}
+	if file.LastModified.IsZero() {
+		file.LastModified = time.Now()
+	}
+	if err := ix.DB.Create(&file).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Update(file.ID); err != nil {
+		t.Fatal(err)
+	}
+	return &file
+}
+
+func names(results []Result) string {
+	var s []string
+	for _, r := range results {
+		s = append(s, r.File.Name)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestIndexSearch(t *testing.T) {
+	ix := newTestIndex(t, map[string]string{
+		"notes.txt":   "The annual budget was approved after a long meeting.",
+		"minutes.txt": "Nothing about money here.",
+		"theirs.txt":  "Another budget, but not ours.",
+	})
+	if !ix.fts {
+		t.Skip("SQLite built without FTS5 (-tags sqlite_fts5)")
+	}
+
+	projects := addFile(t, ix, models.File{Name: "Projects", IsDir: true})
+	addFile(t, ix, models.File{Name: "notes.txt", MimeType: "text/plain", ParentID: &projects.ID})
+	addFile(t, ix, models.File{Name: "budget.xlsx", MimeType: "application/octet-stream"})
+	addFile(t, ix, models.File{Name: "minutes.txt", MimeType: "text/plain"})
+	addFile(t, ix, models.File{Name: "theirs.txt", MimeType: "text/plain", UserID: 2})
+
+	search := func(query string) []Result {
+		t.Helper()
+		results, err := ix.Search(1, query, 10, 0)
+		if err != nil {
+			t.Fatalf("Search(%q): %v", query, err)
+		}
+		return results
+	}
+
+	// Names weigh more than contents, and other users' files are not searched
+	results := search("budget")
+	if got := names(results); got != "budget.xlsx,notes.txt" {
+		t.Fatalf("budget found %s, want the spreadsheet before the notes", got)
+	}
+	if !strings.Contains(results[1].Snippet, MarkStart+"budget"+MarkEnd) {
+		t.Errorf("snippet = %q, want the match marked", results[1].Snippet)
+	}
+	if got := names(search(`budg* -"annual budget"`)); got != "budget.xlsx" {
+		t.Errorf("prefix without the phrase found %s", got)
+	}
+	// Words in the folder path match too
+	if got := names(search("projects")); got != "Projects,notes.txt" {
+		t.Errorf("projects found %s", got)
+	}
+
+	// A renamed folder changes the paths below it
+	ix.DB.Model(projects).Update("name", "Archive")
+	if err := ix.UpdateTree(projects.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(search("projects")); got != "" {
+		t.Errorf("projects found %s after the rename", got)
+	}
+
+	if err := ix.Remove(results[0].File.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(search("budget")); got != "notes.txt" {
+		t.Errorf("budget found %s after removing the spreadsheet", got)
+	}
+}
@@ -0,0 +1,196 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ParseError reports a malformed query. Pos is the 1-based character position of
+// the offending term.
+type ParseError struct {
+	Pos int    `json:"position"`
+	Msg string `json:"error"`
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// Term is a free-text word or phrase, matched against the full-text index.
+type Term struct {
+	Text   string
+	Phrase bool
+	Prefix bool
+	Negate bool
+	Pos    int
+}
+
+// Filter is a field:value condition such as size:>10MB. Op is one of =, <, <=, > or >=.
+type Filter struct {
+	Field  string
+	Op     string
+	Value  string
+	Negate bool
+	Pos    int
+}
+
+// Query is a parsed search: every term and filter must match.
+type Query struct {
+	Terms   []Term
+	Filters []Filter
+}
+
+// Parse reads a query such as
+//
+//	report "annual budget" type:pdf size:>10MB modified:<2025-01-01 in:/Projects -ext:tmp tag:q3 is:starred
+//
+// Words and quoted phrases are searched for in names, paths and contents, with a
+// trailing * for prefix matches. field:value pairs filter on file properties and
+// values may be quoted. A leading - excludes matches.
+func Parse(input string) (*Query, error) {
+	q := &Query{}
+	s := []rune(input)
+
+	for i := 0; i < len(s); {
+		if unicode.IsSpace(s[i]) {
+			i++
+			continue
+		}
+		start := i
+
+		negate := false
+		if s[i] == '-' && i+1 < len(s) && !unicode.IsSpace(s[i+1]) {
+			negate = true
+			i++
+		}
+
+		if s[i] == '"' {
+			text, next, err := readQuoted(s, i)
+			if err != nil {
+				return nil, err
+			}
+			i = next
+			if strings.TrimSpace(text) == "" {
+				return nil, &ParseError{Pos: start + 1, Msg: "empty phrase"}
+			}
+			q.Terms = append(q.Terms, Term{Text: text, Phrase: true, Negate: negate, Pos: start + 1})
+			continue
+		}
+
+		// A field name is letters, digits, dots and underscores followed by a colon
+		j := i
+		for j < len(s) && (unicode.IsLetter(s[j]) || unicode.IsDigit(s[j]) || s[j] == '.' || s[j] == '_') {
+			j++
+		}
+		if j > i && j < len(s) && s[j] == ':' {
+			filter, next, err := readFilter(s, i, j)
+			if err != nil {
+				return nil, err
+			}
+			filter.Negate = negate
+			filter.Pos = start + 1
+			q.Filters = append(q.Filters, filter)
+			i = next
+			continue
+		}
+
+		for i < len(s) && !unicode.IsSpace(s[i]) {
+			i++
+		}
+		word := string(s[start:i])
+		if negate {
+			word = word[1:]
+		}
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.Trim(word, `*"`)
+		if word == "" {
+			continue
+		}
+		q.Terms = append(q.Terms, Term{Text: word, Prefix: prefix, Negate: negate, Pos: start + 1})
+	}
+
+	if len(q.Terms) == 0 && len(q.Filters) == 0 {
+		return nil, ErrEmptyQuery
+	}
+	return q, nil
+}
+
+func readQuoted(s []rune, i int) (string, int, error) {
+	for j := i + 1; j < len(s); j++ {
+		if s[j] == '"' {
+			return string(s[i+1 : j]), j + 1, nil
+		}
+	}
+	return "", 0, &ParseError{Pos: i + 1, Msg: "unterminated quote"}
+}
+
+// readFilter parses field:value where the field spans s[i:colon].
+func readFilter(s []rune, i, colon int) (Filter, int, error) {
+	f := Filter{Field: strings.ToLower(string(s[i:colon])), Op: "="}
+	if !knownField(f.Field) {
+		return f, 0, &ParseError{Pos: i + 1, Msg: fmt.Sprintf("unknown filter %q", f.Field)}
+	}
+
+	j := colon + 1
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(string(s[j:min(j+2, len(s))]), op) {
+			f.Op = op
+			j += len(op)
+			break
+		}
+	}
+
+	if j < len(s) && s[j] == '"' {
+		value, next, err := readQuoted(s, j)
+		if err != nil {
+			return f, 0, err
+		}
+		f.Value = value
+		return f, next, nil
+	}
+
+	k := j
+	for k < len(s) && !unicode.IsSpace(s[k]) {
+		k++
+	}
+	f.Value = string(s[j:k])
+	if f.Value == "" {
+		return f, 0, &ParseError{Pos: j + 1, Msg: fmt.Sprintf("missing value for %q", f.Field)}
+	}
+	return f, k, nil
+}
+
+// ftsExpression builds the FTS5 MATCH expression for the free-text terms. It
+// returns "" when there are none.
+func (q *Query) ftsExpression() (string, error) {
+	var include, exclude []string
+	for _, t := range q.Terms {
+		term := quoteTerm(t.Text)
+		if t.Prefix {
+			term += "*"
+		}
+		if t.Negate {
+			exclude = append(exclude, term)
+		} else {
+			include = append(include, term)
+		}
+	}
+
+	if len(include) == 0 {
+		if len(exclude) > 0 {
+			return "", &ParseError{Pos: q.Terms[0].Pos, Msg: "excluded words need at least one word to search for"}
+		}
+		return "", nil
+	}
+
+	expr := strings.Join(include, " ")
+	for _, term := range exclude {
+		expr += " NOT " + term
+	}
+	return expr, nil
+}
+
+func quoteTerm(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+}
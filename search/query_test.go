@@ -0,0 +1,133 @@
+package search
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud-storage/models"
+)
+
+func TestParse(t *testing.T) {
+	q, err := Parse(`report "annual budget" budg* -draft size:>=10MB -ext:tmp name:"q3 plan" meta.Width:<2000`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTerms := []Term{
+		{Text: "report", Pos: 1},
+		{Text: "annual budget", Phrase: true, Pos: 8},
+		{Text: "budg", Prefix: true, Pos: 24},
+		{Text: "draft", Negate: true, Pos: 30},
+	}
+	wantFilters := []Filter{
+		{Field: "size", Op: ">=", Value: "10MB", Pos: 37},
+		{Field: "ext", Op: "=", Value: "tmp", Negate: true, Pos: 49},
+		{Field: "name", Op: "=", Value: "q3 plan", Pos: 58},
+		{Field: "meta.width", Op: "<", Value: "2000", Pos: 73},
+	}
+	if !reflect.DeepEqual(q.Terms, wantTerms) {
+		t.Errorf("terms = %+v, want %+v", q.Terms, wantTerms)
+	}
+	if !reflect.DeepEqual(q.Filters, wantFilters) {
+		t.Errorf("filters = %+v, want %+v", q.Filters, wantFilters)
+	}
+
+	for _, tt := range []struct {
+		query string
+		pos   int
+	}{
+		{`report "annual`, 8},
+		{`colour:red`, 1},
+		{`size:> x`, 7},
+		{`"  "`, 1},
+	} {
+		var parseErr *ParseError
+		if _, err := Parse(tt.query); !errors.As(err, &parseErr) || parseErr.Pos != tt.pos {
+			t.Errorf("Parse(%q) = %v, want an error at %d", tt.query, err, tt.pos)
+		}
+	}
+	if _, err := Parse("   "); err != ErrEmptyQuery {
+		t.Errorf("Parse of blanks = %v, want ErrEmptyQuery", err)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	ix := newTestIndex(t, nil)
+	day := func(s string) time.Time {
+		d, _ := time.ParseInLocation("2006-01-02", s, time.Local)
+		return d.Add(12 * time.Hour)
+	}
+	create := func(file models.File) *models.File {
+		t.Helper()
+		if file.UserID == 0 {
+			file.UserID = 1
+		}
+		if file.LastModified.IsZero() {
+			file.LastModified = day("2025-06-01")
+		}
+		if err := ix.DB.Create(&file).Error; err != nil {
+			t.Fatal(err)
+		}
+		return &file
+	}
+
+	projects := create(models.File{Name: "Projects", IsDir: true})
+	q3 := create(models.File{Name: "Q3", IsDir: true, ParentID: &projects.ID})
+	report := create(models.File{Name: "report.pdf", ParentID: &q3.ID, MimeType: "application/pdf", Size: 20 << 20,
+		LastModified: day("2024-06-15"), Starred: true})
+	create(models.File{Name: "photo.jpg", MimeType: "image/jpeg", Size: 3 << 20, LastModified: day("2025-02-01"),
+		Metadata: models.Metadata{"width": 4000, "camera_make": "Canon"}})
+	create(models.File{Name: "scratch.tmp", MimeType: "text/plain", Size: 10})
+	create(models.File{Name: "theirs.pdf", MimeType: "application/pdf", Size: 20 << 20, UserID: 2})
+
+	tag := models.Tag{UserID: 1, Name: "q3"}
+	if err := ix.DB.Create(&tag).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.DB.Model(report).Association("Tags").Append(&tag); err != nil {
+		t.Fatal(err)
+	}
+
+	for query, want := range map[string]string{
+		"type:pdf":                          "report.pdf",
+		"type:folder":                       "Projects,Q3",
+		"type:image/*":                      "photo.jpg",
+		"size:>10MB":                        "report.pdf",
+		"size:<=3mb type:file":              "photo.jpg,scratch.tmp",
+		"in:/Projects":                      "Q3,report.pdf",
+		"-ext:tmp type:file":                "photo.jpg,report.pdf",
+		"tag:Q*":                            "report.pdf",
+		"is:starred":                        "report.pdf",
+		"meta.width:>=1920":                 "photo.jpg",
+		"meta.camera_make:canon":            "photo.jpg",
+		"-meta.camera_make:canon type:file": "report.pdf,scratch.tmp",
+		"modified:2024":                     "report.pdf",
+		"modified:<2025-03 type:file":       "photo.jpg,report.pdf",
+		`name:"scratch"`:                    "scratch.tmp",
+		"name:*.jpg":                        "photo.jpg",
+	} {
+		results, err := ix.Search(1, query, 10, 0)
+		if err != nil {
+			t.Errorf("Search(%q): %v", query, err)
+			continue
+		}
+		var got []string
+		for _, r := range results {
+			got = append(got, r.File.Name)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != want {
+			t.Errorf("Search(%q) = %v, want %s", query, got, want)
+		}
+	}
+
+	for query, pos := range map[string]int{"size:abc": 1, "type:pdf in:/Nowhere": 10, "modified:3d": 1, "is:shared": 1} {
+		var parseErr *ParseError
+		if _, err := ix.Search(1, query, 10, 0); !errors.As(err, &parseErr) || parseErr.Pos != pos {
+			t.Errorf("Search(%q) = %v, want an error at %d", query, err, pos)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package thumbnails
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"cloud-storage/blobcrypt"
+	"cloud-storage/chunkstore"
+	"cloud-storage/events"
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+
+	"github.com/nfnt/resize"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"gorm.io/gorm"
+)
+
+// Sizes maps the names accepted by the API to the bounding box in pixels.
+var Sizes = map[string]uint{
+	"small":  64,
+	"medium": 256,
+	"large":  1024,
+}
+
+const (
+	DefaultSize = "medium"
+	// Images above this many pixels are not decoded, to keep memory bounded
+	maxPixels = 50_000_000
+	jobType   = "thumbnail"
+)
+
+var (
+	ErrUnsupported = errors.New("file is not a supported image")
+	ErrUnknownSize = errors.New("unknown thumbnail size")
+)
+
+// Service renders thumbnails into a cache keyed by content hash, so files with the
+// same content share them.
+type Service struct {
+	DB   *gorm.DB
+	Dir  string
+	Open func(file *models.File) (io.ReadCloser, error)
+	// Keys encrypts cached thumbnails; nil stores them in plaintext
+	Keys *blobcrypt.Keyring
+
+	mu    sync.Mutex
+	locks map[string]*hashLock
+}
+
+// hashLock serialises rendering of one content hash; refs counts the holders
+// and waiters so it is dropped when the last one is done.
+type hashLock struct {
+	sync.Mutex
+	refs int
+}
+
+func NewService(db *gorm.DB, dir string) *Service {
+	s := &Service{DB: db, Dir: dir}
+	s.Open = func(file *models.File) (io.ReadCloser, error) { return chunkstore.OpenFile(file.Path, s.Keys) }
+	return s
+}
+
+// Start queues a thumbnail job for every uploaded file.
+func (s *Service) Start(bus *events.Bus, queue *jobs.Queue) {
+	queue.Register(jobType, s.runJob)
+	bus.Subscribe(func(e events.Event) {
+		if e.Type != events.FileUploaded || e.FileID == nil {
+			return
+		}
+		payload := thumbnailJob{FileID: *e.FileID}
+		if _, err := queue.Enqueue(e.UserID, jobType, payload, jobs.Options{Priority: jobs.PriorityLow, MaxAttempts: 3}); err != nil {
+			// Missing thumbnails are rendered on first request instead
+			log.Printf("thumbnails: file %d: failed to queue: %v", *e.FileID, err)
+		}
+	})
+}
+
+type thumbnailJob struct {
+	FileID uint `json:"file_id"`
+}
+
+func (s *Service) runJob(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	var payload thumbnailJob
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	var file models.File
+	if err := s.DB.First(&file, payload.FileID).Error; err != nil {
+		// Deleted before its turn came
+		return nil, nil
+	}
+	if err := s.Generate(&file); err != nil && err != ErrUnsupported {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *Service) path(hash, size string) string {
+	return filepath.Join(s.Dir, hash+"-"+size+".jpg")
+}
+
+// Path returns the cached thumbnail of file at the named size, rendering it if needed.
+func (s *Service) Path(file *models.File, size string) (string, error) {
+	if _, ok := Sizes[size]; !ok {
+		return "", ErrUnknownSize
+	}
+	p := s.path(file.Hash, size)
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+	if err := s.Generate(file); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// Generate renders every size for file unless they are already cached.
+func (s *Service) Generate(file *models.File) error {
+	if file.IsDir || file.Hash == "" {
+		return ErrUnsupported
+	}
+	if file.MimeType != "" && !strings.HasPrefix(file.MimeType, "image/") {
+		return ErrUnsupported
+	}
+
+	// Concurrent requests for the same content don't decode the image twice
+	unlock := s.lock(file.Hash)
+	defer unlock()
+
+	missing := false
+	for size := range Sizes {
+		if _, err := os.Stat(s.path(file.Hash, size)); err != nil {
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	img, err := s.decode(file)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	for size, px := range Sizes {
+		if err := s.writeJPEG(s.path(file.Hash, size), resize.Thumbnail(px, px, img, resize.Lanczos3)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) lock(hash string) func() {
+	s.mu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]*hashLock)
+	}
+	l, ok := s.locks[hash]
+	if !ok {
+		l = &hashLock{}
+		s.locks[hash] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, hash)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Service) decode(file *models.File) (image.Image, error) {
+	// Check the dimensions before decoding the pixels
+	var config image.Config
+	err := s.read(file, func(r io.Reader) (err error) {
+		config, _, err = image.DecodeConfig(r)
+		return err
+	})
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, fmt.Errorf("image too large: %dx%d", config.Width, config.Height)
+	}
+
+	var img image.Image
+	err = s.read(file, func(r io.Reader) (err error) {
+		img, _, err = image.Decode(r)
+		return err
+	})
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	return img, nil
+}
+
+func (s *Service) read(file *models.File, fn func(io.Reader) error) error {
+	r, err := s.Open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return fn(r)
+}
+
+func (s *Service) writeJPEG(path string, img image.Image) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var w io.Writer = tmp
+	var enc *blobcrypt.Writer
+	if s.Keys != nil {
+		if enc, err = blobcrypt.NewWriter(tmp, s.Keys); err != nil {
+			tmp.Close()
+			return err
+		}
+		w = enc
+	}
+	err = jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Remove deletes the cached thumbnails for a content hash.
+func (s *Service) Remove(hash string) {
+	for size := range Sizes {
+		os.Remove(s.path(hash, size))
+	}
+}
@@ -0,0 +1,175 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud-storage/events"
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	MaxAttempts = 8
+	// JobType is the queue job that makes one delivery, retried with the queue's backoff
+	JobType = "webhook.deliver"
+)
+
+// Dispatcher turns bus events into webhook deliveries, sent as jobs on the queue.
+type Dispatcher struct {
+	DB     *gorm.DB
+	Client *http.Client
+	Queue  *jobs.Queue
+}
+
+func NewDispatcher(db *gorm.DB, queue *jobs.Queue) *Dispatcher {
+	return &Dispatcher{
+		DB:    db,
+		Queue: queue,
+		Client: &http.Client{
+			Timeout: 15 * time.Second,
+			// No proxy from the environment, which would dial on the hook's behalf
+			Transport: &http.Transport{DialContext: dialer().DialContext, TLSHandshakeTimeout: 10 * time.Second},
+		},
+	}
+}
+
+// Start registers the delivery job and subscribes to the bus.
+func (d *Dispatcher) Start(bus *events.Bus) {
+	d.Queue.Register(JobType, d.runJob)
+	bus.Subscribe(d.enqueue)
+}
+
+type deliveryJob struct {
+	DeliveryID uint `json:"delivery_id"`
+}
+
+// QueueDelivery queues a job that sends a pending delivery.
+func QueueDelivery(queue *jobs.Queue, userID uint, delivery *models.WebhookDelivery) error {
+	_, err := queue.Enqueue(userID, JobType, deliveryJob{DeliveryID: delivery.ID}, jobs.Options{MaxAttempts: MaxAttempts})
+	return err
+}
+
+// enqueue records a pending delivery for every active webhook interested in the event.
+func (d *Dispatcher) enqueue(e events.Event) {
+	var hooks []models.Webhook
+	if err := d.DB.Where("active = ? AND (user_id = ? OR global = ?)", true, e.UserID, true).Find(&hooks).Error; err != nil {
+		log.Println("webhooks: failed to load webhooks:", err)
+		return
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Println("webhooks: failed to encode event:", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if !hook.Matches(e.Type) {
+			continue
+		}
+		delivery := models.WebhookDelivery{
+			WebhookID:     hook.ID,
+			EventType:     e.Type,
+			Payload:       string(payload),
+			Status:        models.DeliveryPending,
+			NextAttemptAt: time.Now(),
+		}
+		if err := d.DB.Create(&delivery).Error; err != nil {
+			log.Println("webhooks: failed to record delivery:", err)
+			continue
+		}
+		if err := QueueDelivery(d.Queue, hook.UserID, &delivery); err != nil {
+			log.Println("webhooks: failed to queue delivery:", err)
+		}
+	}
+}
+
+// runJob makes one attempt at a delivery. Failures are returned for the queue
+// to retry; the delivery records the outcome for its owner to see.
+func (d *Dispatcher) runJob(ctx context.Context, job *models.Job, progress func(int)) (interface{}, error) {
+	var payload deliveryJob
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	var delivery models.WebhookDelivery
+	if err := d.DB.First(&delivery, payload.DeliveryID).Error; err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	if delivery.Status != models.DeliveryPending {
+		return nil, nil
+	}
+
+	var hook models.Webhook
+	if err := d.DB.First(&hook, delivery.WebhookID).Error; err != nil {
+		// Webhook was removed, nothing left to deliver to
+		delivery.Status = models.DeliveryDead
+		delivery.LastError = "webhook not found"
+		d.DB.Save(&delivery)
+		return nil, jobs.Permanent(errors.New(delivery.LastError))
+	}
+
+	delivery.Attempts++
+	code, err := d.send(ctx, &hook, &delivery)
+	delivery.ResponseCode = code
+
+	switch {
+	case err == nil:
+		delivery.Status = models.DeliveryDelivered
+		delivery.LastError = ""
+	case job.Attempts >= job.MaxAttempts:
+		delivery.Status = models.DeliveryDead
+		delivery.LastError = err.Error()
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = time.Now().Add(jobs.Backoff(job.Attempts))
+	}
+
+	if saveErr := d.DB.Save(&delivery).Error; saveErr != nil {
+		log.Println("webhooks: failed to update delivery:", saveErr)
+	}
+	return map[string]int{"response_code": code}, err
+}
+
+func (d *Dispatcher) send(ctx context.Context, hook *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Delivery", fmt.Sprintf("%d", delivery.ID))
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(hook.Secret, []byte(delivery.Payload)))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of the payload keyed by the webhook secret.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,193 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud-storage/events"
+	"cloud-storage/jobs"
+	"cloud-storage/models"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDispatcher returns a dispatcher on a fresh database, subscribed to the
+// returned bus, and a function running the deliveries it has queued.
+func newTestDispatcher(t *testing.T) (*Dispatcher, *events.Bus, func(wantJobs int) []error) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.Webhook{}, &models.WebhookDelivery{}, &models.Job{}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher(db, jobs.NewQueue(db))
+	bus := events.NewBus(nil)
+	d.Start(bus)
+
+	deliver := func(wantJobs int) []error {
+		t.Helper()
+		// Deliveries are queued by the bus subscriber in the background
+		var queued []models.Job
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			db.Where("type = ? AND status = ?", JobType, models.JobQueued).Find(&queued)
+			if len(queued) >= wantJobs || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(queued) != wantJobs {
+			t.Fatalf("%d deliveries queued, want %d", len(queued), wantJobs)
+		}
+		var errs []error
+		for i := range queued {
+			queued[i].Attempts++
+			_, err := d.runJob(context.Background(), &queued[i], func(int) {})
+			errs = append(errs, err)
+			queued[i].Status = models.JobSucceeded
+			db.Save(&queued[i])
+		}
+		return errs
+	}
+	return d, bus, deliver
+}
+
+func allowPrivate(t *testing.T) {
+	AllowPrivate = true
+	t.Cleanup(func() { AllowPrivate = false })
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	allowPrivate(t)
+	d, bus, deliver := newTestDispatcher(t)
+
+	var mu sync.Mutex
+	received := map[string]*http.Request{}
+	bodies := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received[r.URL.Path], bodies[r.URL.Path] = r, string(body)
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, hook := range []models.Webhook{
+		{UserID: 1, URL: srv.URL + "/uploads", Secret: "s1", Events: "file.uploaded"},
+		{UserID: 1, URL: srv.URL + "/deletes", Secret: "s2", Events: "file.deleted"},
+		{UserID: 2, URL: srv.URL + "/other-user", Secret: "s3", Events: "*"},
+		{UserID: 2, URL: srv.URL + "/global", Secret: "s4", Events: "*", Global: true},
+	} {
+		hook.Active = true
+		if err := d.DB.Create(&hook).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bus.Publish(events.Event{Type: events.FileUploaded, UserID: 1, Data: map[string]interface{}{"name": "a.txt"}})
+	for _, err := range deliver(2) {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for path, secret := range map[string]string{"/uploads": "s1", "/global": "s4"} {
+		r := received[path]
+		if r == nil {
+			t.Errorf("nothing delivered to %s", path)
+			continue
+		}
+		if got := r.Header.Get("X-Webhook-Event"); got != events.FileUploaded {
+			t.Errorf("%s event header = %q", path, got)
+		}
+		if got, want := r.Header.Get("X-Webhook-Signature"), "sha256="+Sign(secret, []byte(bodies[path])); got != want {
+			t.Errorf("%s signature = %q, want %q", path, got, want)
+		}
+		if !strings.Contains(bodies[path], `"a.txt"`) {
+			t.Errorf("%s payload = %s", path, bodies[path])
+		}
+	}
+	if len(received) != 2 {
+		t.Errorf("delivered to %d webhooks, want 2", len(received))
+	}
+
+	var delivered int64
+	d.DB.Model(&models.WebhookDelivery{}).Where("status = ?", models.DeliveryDelivered).Count(&delivered)
+	if delivered != 2 {
+		t.Errorf("%d deliveries marked delivered, want 2", delivered)
+	}
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	allowPrivate(t)
+	d, bus, deliver := newTestDispatcher(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+
+	hook := models.Webhook{UserID: 1, URL: srv.URL, Secret: "s", Events: "*", Active: true}
+	if err := d.DB.Create(&hook).Error; err != nil {
+		t.Fatal(err)
+	}
+	bus.Publish(events.Event{Type: events.FileDeleted, UserID: 1})
+	if errs := deliver(1); errs[0] == nil {
+		t.Fatal("delivery to a failing receiver succeeded")
+	}
+
+	var delivery models.WebhookDelivery
+	d.DB.First(&delivery)
+	if delivery.Status != models.DeliveryPending || delivery.ResponseCode != 500 || delivery.LastError == "" {
+		t.Errorf("after a failed attempt delivery = %+v, want pending with the error", delivery)
+	}
+
+	// The last attempt moves it to the dead-letter list
+	job := models.Job{Type: JobType, Attempts: MaxAttempts, MaxAttempts: MaxAttempts}
+	job.Payload = []byte(fmt.Sprintf(`{"delivery_id": %d}`, delivery.ID))
+	d.runJob(context.Background(), &job, func(int) {})
+	d.DB.First(&delivery, delivery.ID)
+	if delivery.Status != models.DeliveryDead {
+		t.Errorf("after the last attempt status = %q, want dead", delivery.Status)
+	}
+}
+
+func TestPrivateAddresses(t *testing.T) {
+	for _, raw := range []string{
+		"ftp://example.com/hook",
+		"http:///hook",
+		"http://127.0.0.1/hook",
+		"http://10.1.2.3/hook",
+		"http://100.64.0.1/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+	} {
+		if err := CheckURL(context.Background(), raw); err == nil {
+			t.Errorf("CheckURL(%q) accepted", raw)
+		}
+	}
+	if err := CheckURL(context.Background(), "https://93.184.215.14/hook"); err != nil {
+		t.Errorf("CheckURL of a public address: %v", err)
+	}
+
+	// A host that passed the check cannot be pointed inside later
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("private receiver reached")
+	}))
+	t.Cleanup(srv.Close)
+	d := NewDispatcher(nil, nil)
+	if _, err := d.send(context.Background(), &models.Webhook{URL: srv.URL}, &models.WebhookDelivery{}); err == nil {
+		t.Error("delivery to a loopback address succeeded")
+	}
+}